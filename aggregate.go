@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"hash/maphash"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// aggregates, SELECT count and friends: instead of the rows, one row with what they
+// add up to, its key the function and its value the result. COUNT counts every row,
+// MIN, MAX, SUM and AVG read the values as numbers (parse_score's, so 1e3 and -inf
+// work) and skip the ones that aren't, the way SQL skips NULLs. with no numbers to
+// go on their value is empty
+//
+// GroupBy does the same per group, GROUP BY prefix: a hash of group → aggregate, filled
+// in one pass, then one row per group, its key the group and its value the result
+//
+// past MaxGroups it spills, grace hash style like Distinct: the groups it has keep being
+// added up in memory, and the rows of any other group go to one of groupby_partitions
+// files (see spill.go) by the hash of their group. once the input is drained each
+// partition is added up on its own, its results written out sorted, and Next merges
+// those with the groups that stayed in memory, so the rows still come in group order
+
+// aggregate_funcs are the functions SELECT takes besides key and *
+var aggregate_funcs = map[string]bool{"COUNT": true, "MIN": true, "MAX": true, "SUM": true, "AVG": true}
+
+// like SELECT COUNT(*) ...: Open consumes the whole input, Next returns the one summary row
+type Aggregate struct {
+	Input Operator
+	Func  string // COUNT, MIN, MAX, SUM or AVG
+
+	row *Row
+}
+
+// like GROUP BY: Open consumes the whole input into a map of groups, Next returns a row
+// per group, in group order
+type GroupBy struct {
+	Input     Operator
+	Group     func(r Row) string // KeyPrefix, RowValue or anything else that names a row's group
+	Func      string             // COUNT, MIN, MAX, SUM or AVG
+	MaxGroups int                // groups added up in memory before the rows of others spill, 0 for no limit
+	Dir       string             // where spill files go, os.TempDir() if empty
+	Format    SpillFormat        // how the spill files are written
+
+	rows    []*Row
+	pos     int
+	seed    maphash.Seed
+	parts   []*spill_file // the partitions, nil until it spills
+	runs    []*spill_file // their results, sorted
+	merge   *run_merge    // nil unless it spilled
+	spilled int64         // bytes written to the partitions and runs
+}
+
+// how many files a spilling GroupBy splits the rows of the groups it has no room for over
+const groupby_partitions = 16
+
+// the groups the query engine's GROUP BY adds up in memory before spilling
+const groupby_max_groups = 1 << 17
+
+// the groupings GroupBy comes with
+// KeyPrefix groups keys by their namespace, the part before the first ':', keys without one go in ""
+func KeyPrefix(r Row) string {
+	return key_namespace(r.Key.name)
+}
+
+// RowValue groups rows with the same value
+func RowValue(r Row) string {
+	return r.Value.data
+}
+
+// aggregate is one function's running state over the rows it has been given
+type aggregate struct {
+	fn       string
+	rows     int // every row, for COUNT
+	numbers  int // the rows whose value is a number, for the rest
+	sum      float64
+	min, max float64
+}
+
+func new_aggregate(fn string) (*aggregate, error) {
+	fn = strings.ToUpper(fn)
+	if !aggregate_funcs[fn] {
+		return nil, errors.New("unknown aggregate " + fn + ", want COUNT, MIN, MAX, SUM or AVG")
+	}
+	return &aggregate{fn: fn, min: math.Inf(1), max: math.Inf(-1)}, nil
+}
+
+func (a *aggregate) add(r *Row) {
+	a.rows++
+	if a.fn == "COUNT" {
+		return
+	}
+	n, err := parse_score(r.Value.data)
+	if err != nil {
+		return
+	}
+	a.numbers++
+	a.sum += n
+	a.min, a.max = min(a.min, n), max(a.max, n)
+}
+
+func (a *aggregate) result() string {
+	if a.fn == "COUNT" {
+		return strconv.Itoa(a.rows)
+	}
+	if a.numbers == 0 {
+		return ""
+	}
+	var v float64
+	switch a.fn {
+	case "MIN":
+		v = a.min
+	case "MAX":
+		v = a.max
+	case "SUM":
+		v = a.sum
+	case "AVG":
+		v = a.sum / float64(a.numbers)
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// Open runs the input to the end, adding up every row
+func (ag *Aggregate) Open() error {
+	a, err := new_aggregate(ag.Func)
+	if err != nil {
+		return err
+	}
+	err = drain(ag.Input, func(row *Row) error {
+		a.add(row)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ag.row = &Row{Key: key{name: strings.ToLower(a.fn)}, Value: value{data: a.result()}}
+	return nil
+}
+
+// Next returns the summary row once, then nil
+func (ag *Aggregate) Next() (*Row, error) {
+	row := ag.row
+	ag.row = nil
+	return row, nil
+}
+
+func (ag *Aggregate) Close() error {
+	ag.row = nil
+	return ag.Input.Close()
+}
+
+// Open runs the input to the end, adding every row up in its group
+func (g *GroupBy) Open() error {
+	if _, err := new_aggregate(g.Func); err != nil {
+		return err
+	}
+	g.rows, g.pos, g.seed, g.parts, g.runs, g.merge, g.spilled = nil, 0, maphash.MakeSeed(), nil, nil, nil, 0
+	groups := make(map[string]*aggregate)
+	err := drain(g.Input, func(row *Row) error {
+		name := g.Group(*row)
+		a, ok := groups[name]
+		if !ok {
+			if g.MaxGroups > 0 && len(groups) >= g.MaxGroups {
+				return g.spill(name, row)
+			}
+			a, _ = new_aggregate(g.Func)
+			groups[name] = a
+		}
+		a.add(row)
+		return nil
+	})
+	g.rows = group_rows(groups)
+	if err == nil && g.parts != nil {
+		err = g.add_up_spilled()
+	}
+	if err != nil {
+		g.remove_spill()
+		return err
+	}
+	return nil
+}
+
+// group_rows is a row per group, in group order
+func group_rows(groups map[string]*aggregate) []*Row {
+	rows := make([]*Row, 0, len(groups))
+	for name, a := range groups {
+		rows = append(rows, &Row{Key: key{name: name}, Value: value{data: a.result()}})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Key.name < rows[j].Key.name })
+	return rows
+}
+
+// spill writes row to the partition of its group
+func (g *GroupBy) spill(name string, row *Row) error {
+	if g.parts == nil {
+		query_groupby_spills_total.Inc()
+		g.parts = make([]*spill_file, groupby_partitions)
+		for i := range g.parts {
+			part, err := new_spill_file(g.Dir, "groupby-*", g.Format)
+			if err != nil {
+				g.parts = g.parts[:i]
+				return err
+			}
+			g.parts[i] = part
+		}
+	}
+	return g.parts[maphash.String(g.seed, name)%groupby_partitions].write(row)
+}
+
+// add_up_spilled adds up each partition with a map of only its own groups, and starts
+// merging their results with the groups that were in memory. a group is in one place
+// only, there are no ties
+func (g *GroupBy) add_up_spilled() error {
+	runs := []sorted_run{&memory_run{rows: g.rows}}
+	g.rows = nil
+	for _, part := range g.parts {
+		if err := part.rewind(); err != nil {
+			return err
+		}
+		g.spilled += part.bytes
+		groups := make(map[string]*aggregate)
+		for {
+			row, err := part.next()
+			if err != nil {
+				return err
+			}
+			if row == nil {
+				break
+			}
+			name := g.Group(*row)
+			a, ok := groups[name]
+			if !ok {
+				a, _ = new_aggregate(g.Func)
+				groups[name] = a
+			}
+			a.add(row)
+		}
+		part.remove()
+		run, err := new_spill_file(g.Dir, "groupby-*", g.Format)
+		if err != nil {
+			return err
+		}
+		g.runs = append(g.runs, run)
+		for _, row := range group_rows(groups) {
+			if err := run.write(row); err != nil {
+				return err
+			}
+		}
+		if err := run.rewind(); err != nil {
+			return err
+		}
+		g.spilled += run.bytes
+		runs = append(runs, run)
+	}
+	query_spill_bytes_total.Add(uint64(g.spilled))
+	var err error
+	g.merge, err = new_run_merge(runs, ByKey)
+	return err
+}
+
+// remove_spill closes and removes the partitions and runs
+func (g *GroupBy) remove_spill() {
+	for _, f := range append(g.parts, g.runs...) {
+		f.remove()
+	}
+	g.parts, g.runs, g.merge = nil, nil, nil
+}
+
+func (g *GroupBy) Next() (*Row, error) {
+	if g.merge != nil {
+		return g.merge.next()
+	}
+	if g.pos >= len(g.rows) {
+		return nil, nil
+	}
+	g.pos++
+	return g.rows[g.pos-1], nil
+}
+
+// Close removes the spill files
+func (g *GroupBy) Close() error {
+	g.remove_spill()
+	g.rows = nil
+	return g.Input.Close()
+}
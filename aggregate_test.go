@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// aggregates and groups, see aggregate.go
+
+// each function over values some of which aren't numbers, which only COUNT counts
+func TestAggregate(t *testing.T) {
+	rows := []*Row{kv("a", "4"), kv("b", "x"), kv("c", "-2"), kv("d", "1e1"), kv("e", "")}
+	for fn, want := range map[string]string{"COUNT": "5", "MIN": "-2", "MAX": "10", "SUM": "12", "AVG": "4", "avg": "4"} {
+		got := run_op(t, &Aggregate{Input: &row_source{rows: rows}, Func: fn})
+		if row_pairs(got) != strings.ToLower(fn)+"="+want {
+			t.Errorf("%s: %s, want %s", fn, row_pairs(got), want)
+		}
+	}
+	//nothing to go on: a count of 0, no value for the rest
+	for fn, want := range map[string]string{"COUNT": "count=0", "SUM": "sum=", "MAX": "max="} {
+		if got := row_pairs(run_op(t, &Aggregate{Input: &row_source{}, Func: fn})); got != want {
+			t.Errorf("%s of nothing: %s, want %s", fn, got, want)
+		}
+	}
+	if err := (&Aggregate{Input: &row_source{}, Func: "MEDIAN"}).Open(); err == nil {
+		t.Error("MEDIAN opened")
+	}
+	input := &failing_input{row_source: row_source{rows: rows}}
+	if err := (&Aggregate{Input: input, Func: "SUM"}).Open(); !errors.Is(err, errInput) || !input.closed {
+		t.Errorf("Open = %v with the input failing, input closed %v", err, input.closed)
+	}
+}
+
+// SELECT count answers how many keys match without handing them all over
+func TestSelectAggregate(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "30")
+	set(t, s, "user:2", "50")
+	set(t, s, "order:1", "7")
+	if got := row_pairs(query(t, s, "SCAN SELECT count WHERE key LIKE user:*")); got != "count=2" {
+		t.Errorf("SELECT count: %s", got)
+	}
+	if got := row_pairs(query(t, s, "SCAN SELECT avg WHERE key LIKE user:*")); got != "avg=40" {
+		t.Errorf("SELECT avg: %s", got)
+	}
+}
+
+// GroupBy adds up each group on its own and returns them in group order
+func TestGroupBy(t *testing.T) {
+	rows := []*Row{kv("user:1", "3"), kv("order:1", "x"), kv("user:2", "4"), kv("plain", "1"), kv("order:2", "5")}
+	for fn, want := range map[string]string{
+		"COUNT": "=1 order=2 user=2",
+		"SUM":   "=1 order=5 user=7",
+		"MAX":   "=1 order=5 user=4",
+	} {
+		if got := row_pairs(run_op(t, &GroupBy{Input: &row_source{rows: rows}, Group: KeyPrefix, Func: fn})); got != want {
+			t.Errorf("%s by prefix: %s, want %s", fn, got, want)
+		}
+	}
+	if got := row_pairs(run_op(t, &GroupBy{Input: &row_source{rows: rows}, Group: RowValue, Func: "COUNT"})); got != "1=1 3=1 4=1 5=1 x=1" {
+		t.Errorf("COUNT by value: %s", got)
+	}
+	input := &failing_input{row_source: row_source{rows: rows}}
+	if err := (&GroupBy{Input: input, Group: KeyPrefix, Func: "COUNT"}).Open(); !errors.Is(err, errInput) || !input.closed {
+		t.Errorf("Open = %v with the input failing, input closed %v", err, input.closed)
+	}
+}
+
+// GROUP BY in a query, COUNT unless SELECT names another function
+func TestSelectGroupBy(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "30")
+	set(t, s, "user:2", "50")
+	set(t, s, "order:1", "7")
+	if got := row_pairs(query(t, s, "SCAN GROUP BY prefix")); got != "order=1 user=2" {
+		t.Errorf("GROUP BY prefix: %s", got)
+	}
+	if got := row_pairs(query(t, s, "SCAN SELECT sum GROUP BY prefix ORDER BY value DESC LIMIT 1")); got != "user=80" {
+		t.Errorf("the biggest group: %s", got)
+	}
+}
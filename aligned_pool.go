@@ -0,0 +1,160 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+	"unsafe"
+)
+
+// aligned buffers for the O_DIRECT writer: memory handed to an O_DIRECT write has
+// to start at an aligned address, so buffers come from a pool that hands out
+// aligned ones (4K, or 2MB with Options.DirectIOAlign) in power of two size classes
+// and takes them back when the writer is done or outgrows them
+//
+// with 2MB alignment and Options.HugePages, Linux buffers are mmapped with
+// MAP_HUGETLB so each is backed by huge pages and costs one TLB entry per 2MB.
+// that needs huge pages reserved (vm.nr_hugepages), without them it falls back to
+// ordinary aligned memory, BufferStats says how many of the allocations got huge pages
+//
+// a class keeps at most buffer_pool_keep free buffers, the rest go back to the GC
+// (or are unmapped), so a burst of large writes doesn't pin the memory forever
+
+// huge page size on x86-64 and arm64 Linux, also the largest alignment we hand out
+const huge_page_size = 2 << 20
+
+// free buffers kept per size class
+const buffer_pool_keep = 4
+
+// BufferStats is what the O_DIRECT buffer pool has handed out and kept, see aligned_pool.go
+type BufferStats struct {
+	Align       int    // address alignment of every buffer
+	Gets        uint64 // buffers handed out
+	Hits        uint64 // of them, reused from the pool
+	Allocs      uint64 // fresh allocations
+	HugeAllocs  uint64 // of those, backed by huge pages
+	Dropped     uint64 // returned buffers the pool had no room for
+	InUse       int    // handed out and not returned yet
+	InUseBytes  int64
+	PooledBytes int64 // free buffers held for reuse
+}
+
+type buffer_pool struct {
+	lock      sync.Mutex
+	align     int
+	huge      bool
+	free      map[int][][]byte // size class → free buffers, full length
+	stats     BufferStats
+	huge_bufs map[*byte]bool // buffers that were mmapped, they are unmapped instead of dropped
+}
+
+// new_buffer_pool hands out buffers aligned to `align`, rounded up to a power of two
+// between direct_io_align and huge_page_size (0 is direct_io_align)
+func new_buffer_pool(align int, huge bool) *buffer_pool {
+	align = max(align, direct_io_align)
+	align = min(1<<bits.Len(uint(align-1)), huge_page_size)
+	return &buffer_pool{
+		align:     align,
+		huge:      huge && align == huge_page_size,
+		free:      make(map[int][][]byte),
+		huge_bufs: make(map[*byte]bool),
+		stats:     BufferStats{Align: align},
+	}
+}
+
+// buffer_class is the size of the class n falls in: a power of two, at least align
+func (p *buffer_pool) buffer_class(n int) int {
+	return max(1<<bits.Len(uint(max(n, 1)-1)), p.align)
+}
+
+// get returns a zeroed, aligned buffer of length n
+func (p *buffer_pool) get(n int) []byte {
+	class := p.buffer_class(n)
+
+	p.lock.Lock()
+	p.stats.Gets++
+	p.stats.InUse++
+	p.stats.InUseBytes += int64(class)
+	if free := p.free[class]; len(free) > 0 {
+		buf := free[len(free)-1]
+		p.free[class] = free[:len(free)-1]
+		p.stats.Hits++
+		p.stats.PooledBytes -= int64(class)
+		p.lock.Unlock()
+		clear(buf)
+		return buf[:n]
+	}
+	p.stats.Allocs++
+	p.lock.Unlock()
+
+	if p.huge {
+		if buf, ok := alloc_huge(class); ok {
+			p.lock.Lock()
+			p.stats.HugeAllocs++
+			p.huge_bufs[&buf[0]] = true
+			p.lock.Unlock()
+			return buf[:n]
+		}
+	}
+	return aligned_buffer(class, p.align)[:n]
+}
+
+// put gives a buffer from get back, it must not be used afterwards
+func (p *buffer_pool) put(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	buf = buf[:cap(buf)]
+	class := len(buf)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stats.InUse--
+	p.stats.InUseBytes -= int64(class)
+	if len(p.free[class]) < buffer_pool_keep {
+		p.free[class] = append(p.free[class], buf)
+		p.stats.PooledBytes += int64(class)
+		return
+	}
+	p.stats.Dropped++
+	if p.huge_bufs[&buf[0]] {
+		delete(p.huge_bufs, &buf[0])
+		free_huge(buf)
+	}
+}
+
+// release drops every free buffer, for when the WAL closes
+func (p *buffer_pool) release() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for class, free := range p.free {
+		for _, buf := range free {
+			if p.huge_bufs[&buf[0]] {
+				delete(p.huge_bufs, &buf[0])
+				free_huge(buf)
+			}
+		}
+		delete(p.free, class)
+	}
+	p.stats.PooledBytes = 0
+}
+
+func (p *buffer_pool) buffer_stats() BufferStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.stats
+}
+
+// aligned_buffer returns a zeroed buffer of n bytes starting at an address aligned to `align`
+func aligned_buffer(n int, align int) []byte {
+	buf := make([]byte, n+align)
+	skip := 0
+	if rem := int(uintptr(unsafe.Pointer(&buf[0])) % uintptr(align)); rem != 0 {
+		skip = align - rem
+	}
+	return buf[skip : skip+n : skip+n]
+}
+
+// BufferStats shows the O_DIRECT buffer pool, nothing is handed out unless Options.DirectIO is on
+func (s *Store) BufferStats() BufferStats {
+	return s.wal.buffers.buffer_stats()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// the aligned buffer pool, see aligned_pool.go
+
+func aligned(buf []byte, align int) bool {
+	return uintptr(unsafe.Pointer(&buf[0]))%uintptr(align) == 0
+}
+
+// buffers start at an aligned address, come in power of two classes, and what is
+// put back is handed out again, zeroed, up to buffer_pool_keep per class
+func TestBufferPool(t *testing.T) {
+	for _, tc := range []struct{ asked, align int }{{0, direct_io_align}, {1000, direct_io_align}, {8192, 8192}, {3 << 20, huge_page_size}} {
+		if got := new_buffer_pool(tc.asked, false).align; got != tc.align {
+			t.Errorf("alignment for %d: %d, want %d", tc.asked, got, tc.align)
+		}
+	}
+
+	p := new_buffer_pool(0, false)
+	for n, class := range map[int]int{1: 4096, 4096: 4096, 4097: 8192, 100000: 131072} {
+		buf := p.get(n)
+		if len(buf) != n || cap(buf) != class || !aligned(buf, p.align) {
+			t.Errorf("get(%d): len %d, cap %d, aligned %v", n, len(buf), cap(buf), aligned(buf, p.align))
+		}
+		p.put(buf)
+	}
+
+	buf := p.get(100)
+	buf[0] = 1
+	p.put(buf)
+	again := p.get(200)
+	if &again[0] != &buf[0] || again[0] != 0 {
+		t.Error("a buffer put back wasn't reused zeroed")
+	}
+	bufs := [][]byte{again}
+	for range buffer_pool_keep {
+		bufs = append(bufs, p.get(4096))
+	}
+	for _, buf := range bufs {
+		p.put(buf)
+	}
+	stats := p.buffer_stats()
+	if stats.Dropped != 1 || stats.InUse != 0 || stats.InUseBytes != 0 || stats.PooledBytes != int64(4*4096+8192+131072) {
+		t.Errorf("stats %+v", stats)
+	}
+	if stats.Gets != stats.Hits+stats.Allocs || stats.HugeAllocs != 0 {
+		t.Errorf("stats %+v", stats)
+	}
+	p.release()
+	if stats := p.buffer_stats(); stats.PooledBytes != 0 || len(p.free) != 0 {
+		t.Errorf("after release: %+v", stats)
+	}
+}
+
+// with huge pages asked for, a 2MB pool either maps them or falls back to ordinary
+// aligned memory, and either way the buffer is usable
+func TestHugePagePool(t *testing.T) {
+	p := new_buffer_pool(huge_page_size, true)
+	buf := p.get(100)
+	if !aligned(buf, huge_page_size) || cap(buf) != huge_page_size {
+		t.Fatalf("cap %d, aligned %v", cap(buf), aligned(buf, huge_page_size))
+	}
+	buf[len(buf)-1] = 1
+	p.put(buf)
+	p.release()
+	t.Logf("stats %+v", p.buffer_stats())
+	if small := new_buffer_pool(0, true); small.huge {
+		t.Error("huge pages for a 4K pool")
+	}
+}
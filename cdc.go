@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ChangeEvent is one WAL record turned into a structured change
+// Before and After are nil when the key did not exist before / does not exist after
+// they are string values, a change to a hash, list, set or sorted set carries its Type and what the
+// record holds in Args instead: field, value pairs for HSET, fields for HDEL, the
+// pushed elements for LPUSH and RPUSH, how many were popped for LPOP and RPOP, the
+// members added or removed for SADD and SREM, score, member pairs for ZADD, the
+// members removed for ZREM, and the whole object for RESTORE
+// RENAME and COPY are events on the source key with the destination's name and db in Args
+type ChangeEvent struct {
+	LSN    uint64   `json:"lsn"`
+	Op     string   `json:"op"`
+	Key    string   `json:"key"`
+	DB     int      `json:"db,omitempty"` // the key's database, left out for 0
+	Before *string  `json:"before"`
+	After  *string  `json:"after"`
+	Type   string   `json:"type,omitempty"`
+	Args   []string `json:"args,omitempty"`
+	TTL    string   `json:"ttl,omitempty"`
+	// ExpiresAt is the absolute expiry carried by SET, EXPIRE and GETEX records (RFC 3339)
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Encoding is "base64" when the key or a value isn't valid UTF-8, which json would
+	// mangle, and Key, Before, After and Args are base64 (standard, padded) instead of text
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// binary_safe base64s the event's key and values if any of them isn't valid UTF-8
+func (ev *ChangeEvent) binary_safe() {
+	valid := utf8.ValidString(ev.Key) && (ev.Before == nil || utf8.ValidString(*ev.Before)) && (ev.After == nil || utf8.ValidString(*ev.After))
+	for _, arg := range ev.Args {
+		valid = valid && utf8.ValidString(arg)
+	}
+	if valid {
+		return
+	}
+	encode := func(v *string) *string {
+		if v == nil {
+			return nil
+		}
+		e := base64.StdEncoding.EncodeToString([]byte(*v))
+		return &e
+	}
+	ev.Key = *encode(&ev.Key)
+	ev.Before, ev.After = encode(ev.Before), encode(ev.After)
+	for i := range ev.Args {
+		ev.Args[i] = *encode(&ev.Args[i])
+	}
+	ev.Encoding = "base64"
+}
+
+// ChangeSink receives batches of change events
+// a Kafka producer is the obvious implementation, WriterSink is the simple one
+type ChangeSink interface {
+	Publish(events []ChangeEvent) error
+}
+
+// WriterSink writes change events as json lines to any writer
+type WriterSink struct {
+	W io.Writer
+}
+
+func (ws *WriterSink) Publish(events []ChangeEvent) error {
+	encoder := json.NewEncoder(ws.W)
+	for _, ev := range events {
+		if err := encoder.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportCDC converts the WAL into a stream of json change events, one per line
+// events at or below `after` are not written, so a consumer can resume
+// returns the LSN of the last record seen
+func (s *Store) ExportCDC(w io.Writer, after uint64) (uint64, error) {
+	encoder := json.NewEncoder(w)
+	return s.walk_changes(after, func(ev ChangeEvent) error {
+		return encoder.Encode(ev)
+	})
+}
+
+// PublishCDC delivers every change after the persisted offset to the sink
+// and then persists the new offset
+// delivery is at-least-once: if we crash after Publish but before the
+// offset hits the disk, the same events are published again on the next run
+// returns the number of events published
+func (s *Store) PublishCDC(sink ChangeSink, offset_file string) (int, error) {
+	offset, err := read_cdc_offset(offset_file)
+	if err != nil {
+		return 0, err
+	}
+
+	var events []ChangeEvent
+	lsn, err := s.walk_changes(offset, func(ev ChangeEvent) error {
+		events = append(events, ev)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	if err := sink.Publish(events); err != nil {
+		return 0, err
+	}
+	return len(events), write_cdc_offset(offset_file, lsn)
+}
+
+func read_cdc_offset(offset_file string) (uint64, error) {
+	data, err := os.ReadFile(offset_file)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	offset, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid CDC offset file: " + offset_file)
+	}
+	return offset, nil
+}
+
+// the offset is replaced with temp file + fsync + rename
+// so a crash leaves either the old or the new offset, never half of one
+func write_cdc_offset(offset_file string, lsn uint64) error {
+	return replace_file(offset_file, []byte(strconv.FormatUint(lsn, 10)+"\n"))
+}
+
+// walk_changes calls fn for every change event after `after`
+// events carry the records' LSNs
+// the WAL only has the new value, so we replay it into a scratch map
+// to know the before image of every change
+func (s *Store) walk_changes(after uint64, fn func(ev ChangeEvent) error) (uint64, error) {
+	s.wal.wal_lock.Lock()
+	defer s.wal.wal_lock.Unlock()
+
+	state := make(map[key]string)
+	deleted := make(map[key]string) // soft-deleted values, for UNDELETE's after image
+	var lsns lsn_counter
+
+	//a transaction's changes only show up once its COMMIT does
+	var txs tx_buffer
+	err := s.wal.for_each_record(func(rec wal_record) error {
+		lsns.stamp(&rec)
+		return txs.feed(rec.op, rec.value, func() error { return change_event(rec, after, state, deleted, fn) })
+	})
+	return max(lsns.last, after), err
+}
+
+// change_event turns rec into an event for fn, keeping the scratch map up to date
+func change_event(rec wal_record, after uint64, state, deleted map[key]string, fn func(ev ChangeEvent) error) error {
+	lsn := rec.lsn
+
+	ev := ChangeEvent{LSN: lsn, Op: rec.op.String(), Key: rec.key, DB: rec.db}
+	k := key{name: rec.key, db: rec.db}
+	if before, ok := state[k]; ok {
+		ev.Before = &before
+	}
+
+	switch rec.op {
+	case SET, CAS:
+		after := rec.value
+		state[k] = after
+		delete(deleted, k)
+		ev.After = &after
+		if !rec.expires_at.IsZero() {
+			ev.ExpiresAt = rec.expires_at.UTC().Format(time.RFC3339Nano)
+		} else if rec.ttl > 0 {
+			ev.TTL = rec.ttl.String()
+		}
+	case DELETE, GETDEL:
+		if ev.Before != nil && !rec.expires_at.IsZero() {
+			deleted[k] = *ev.Before
+		}
+		delete(state, k)
+	case APPEND:
+		after := rec.value
+		if ev.Before != nil {
+			after = *ev.Before + rec.value
+		}
+		state[k] = after
+		ev.After = &after
+		if !rec.expires_at.IsZero() {
+			ev.ExpiresAt = rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+	case HSET, HDEL, RESTORE, LPUSH, RPUSH, LPOP, RPOP, SADD, SREM, ZADD, ZREM:
+		if rec.op == RESTORE {
+			obj, err := load_object(rec.value)
+			if err != nil {
+				return err
+			}
+			ev.Type, ev.Args = obj.kind(), obj.members()
+		} else {
+			args, err := decode_args(rec.value)
+			if err != nil {
+				return err
+			}
+			ev.Type, ev.Args = object_ops[rec.op], args
+		}
+		delete(state, k)
+		if !rec.expires_at.IsZero() {
+			ev.ExpiresAt = rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+	case RENAME, COPY:
+		dst, err := move_target(rec)
+		if err != nil {
+			return err
+		}
+		ev.Args = []string{dst.name, strconv.Itoa(dst.db)}
+		if ev.Before != nil {
+			state[dst] = *ev.Before
+		} else {
+			delete(state, dst)
+		}
+		delete(deleted, dst)
+		if rec.op == RENAME {
+			delete(state, k)
+		} else {
+			ev.After = ev.Before
+		}
+	case UNDELETE:
+		if restored, ok := deleted[k]; ok {
+			state[k] = restored
+			ev.After = &restored
+			delete(deleted, k)
+		}
+	case EXPIRE:
+		if !rec.expires_at.IsZero() {
+			ev.ExpiresAt = rec.expires_at.UTC().Format(time.RFC3339Nano)
+		} else {
+			ev.TTL = rec.ttl.String()
+		}
+		ev.After = ev.Before
+	case GETEX:
+		if !rec.expires_at.IsZero() {
+			ev.ExpiresAt = rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+		ev.After = ev.Before
+	}
+
+	if lsn <= after {
+		return nil
+	}
+	ev.binary_safe()
+	return fn(ev)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// change events from the WAL, see cdc.go
+
+// changes is what ExportCDC writes after lsn, decoded
+func changes(t *testing.T, s *Store, after uint64) []ChangeEvent {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := s.ExportCDC(&buf, after); err != nil {
+		t.Fatal(err)
+	}
+	var events []ChangeEvent
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var ev ChangeEvent
+		if err := dec.Decode(&ev); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+// image is a before or after image for a message, "-" for none
+func image(v *string) string {
+	if v == nil {
+		return "-"
+	}
+	return *v
+}
+
+// each write is an event with the value before and after it, and a consumer picks up
+// after the last LSN it saw
+func TestExportCDC(t *testing.T) {
+	s := open_store(t, filepath.Join(t.TempDir(), "wal.log"), PersistWAL)
+	defer s.Close()
+	set(t, s, "a", "1")
+	set(t, s, "a", "2")
+	s.Append(key{name: "a"}, "x")
+	s.Rename(key{name: "a"}, key{name: "b"})
+	s.Delete(key{name: "b"})
+	s.Set(key{name: "c", db: 2}, time.Hour, "\xff\x00")
+
+	want := []string{"SET - 1", "SET 1 2", "APPEND 2 2x", "RENAME 2x -", "DELETE 2x -", "SET - /wA="}
+	events := changes(t, s, 0)
+	if len(events) != len(want) {
+		t.Fatalf("%d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, ev := range events {
+		if got := ev.Op + " " + image(ev.Before) + " " + image(ev.After); got != want[i] || ev.LSN != uint64(i+1) {
+			t.Errorf("event %d: LSN %d %s, want %s", i, ev.LSN, got, want[i])
+		}
+	}
+	if args := events[3].Args; len(args) != 2 || args[0] != "b" || args[1] != "0" {
+		t.Errorf("RENAME's args: %v", args)
+	}
+	last := events[5]
+	if last.Encoding != "base64" || last.DB != 2 || last.ExpiresAt == "" {
+		t.Errorf("a binary value in db 2 with a ttl: %+v", last)
+	}
+
+	if events := changes(t, s, 4); len(events) != 2 || events[0].LSN != 5 {
+		t.Errorf("after LSN 4: %+v", events)
+	}
+	if events := changes(t, s, 6); len(events) != 0 {
+		t.Errorf("after the last LSN: %+v", events)
+	}
+}
+
+// a transaction's writes are events once it committed, without the markers
+func TestExportCDCTx(t *testing.T) {
+	s := open_store(t, filepath.Join(t.TempDir(), "wal.log"), PersistWAL)
+	defer s.Close()
+	tx := s.Begin()
+	tx.Set(key{name: "a"}, 0, "1")
+	tx.Set(key{name: "b"}, 0, "2")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, ev := range changes(t, s, 0) {
+		ops = append(ops, ev.Op+" "+ev.Key)
+	}
+	if len(ops) != 2 || ops[0] != "SET a" || ops[1] != "SET b" {
+		t.Errorf("a committed transaction: %v", ops)
+	}
+}
+
+// sink collects what it's given, or fails with err
+type sink struct {
+	events []ChangeEvent
+	err    error
+}
+
+func (k *sink) Publish(events []ChangeEvent) error {
+	if k.err != nil {
+		return k.err
+	}
+	k.events = append(k.events, events...)
+	return nil
+}
+
+// PublishCDC hands over what the offset file hasn't seen and moves it on, a failed
+// publish leaves it where it was so the events go again
+func TestPublishCDC(t *testing.T) {
+	dir := t.TempDir()
+	offset := filepath.Join(dir, "cdc.offset")
+	s := open_store(t, filepath.Join(dir, "wal.log"), PersistWAL)
+	defer s.Close()
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+
+	k := &sink{}
+	if n, err := s.PublishCDC(k, offset); n != 2 || err != nil {
+		t.Fatalf("first publish: %d %v", n, err)
+	}
+	if n, err := s.PublishCDC(k, offset); n != 0 || err != nil {
+		t.Errorf("nothing new: %d %v", n, err)
+	}
+
+	set(t, s, "c", "3")
+	k.err = errInput
+	if _, err := s.PublishCDC(k, offset); err != errInput {
+		t.Errorf("publish with the sink failing: %v", err)
+	}
+	k.err = nil
+	if n, err := s.PublishCDC(k, offset); n != 1 || err != nil {
+		t.Errorf("after the failure: %d %v", n, err)
+	}
+	if len(k.events) != 3 || k.events[2].Key != "c" || k.events[2].LSN != 3 {
+		t.Errorf("published: %+v", k.events)
+	}
+
+	os.WriteFile(offset, []byte("three\n"), 0o644)
+	if _, err := s.PublishCDC(k, offset); err == nil {
+		t.Error("published past an offset file that isn't a number")
+	}
+}
+
+// WriterSink writes json lines
+func TestWriterSink(t *testing.T) {
+	var buf bytes.Buffer
+	v := "1"
+	(&WriterSink{W: &buf}).Publish([]ChangeEvent{{LSN: 7, Op: "SET", Key: "a", After: &v}})
+	if got := buf.String(); got != `{"lsn":7,"op":"SET","key":"a","before":null,"after":"1"}`+"\n" {
+		t.Errorf("WriterSink: %s", got)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a checkpoint only holds writers up for its mark, sealing the WAL and copying the map
+// into a View, not while the snapshot is written and fsynced. the write latencies while
+// one runs, for a bigger map:
+//
+//	go test -run XXX -bench CheckpointWrites
+
+// checkpoint_store is a store with n keys, put straight in the map rather than logged
+func checkpoint_store(tb testing.TB, n int) *Store {
+	s := New_Store(filepath.Join(tb.TempDir(), "wal.log"), Options{Persistence: PersistWAL, Durability: DurabilityNone})
+	tb.Cleanup(func() { s.Close() })
+	data := strings.Repeat("v", 100)
+	s.lock.Lock()
+	for i := 0; i < n; i++ {
+		s.put(key{name: "key:" + strconv.Itoa(i)}, value{data: data, lsn: s.next_lsn()})
+	}
+	s.lock.Unlock()
+	return s
+}
+
+// write_interval is how often the writer in writes_during_checkpoint writes
+const write_interval = 200 * time.Microsecond
+
+// writes_during_checkpoint runs a checkpoint with a writer going and returns how long
+// it took and the latencies of the writes due in the meantime. the writer writes on a
+// schedule, and a write's latency counts from when it was due, so a stall shows up in
+// every write it held back and not just the one it caught
+func writes_during_checkpoint(tb testing.TB, s *Store) (time.Duration, []time.Duration) {
+	type write struct {
+		due  time.Time
+		took time.Duration
+	}
+	var writes []write
+	//when the checkpoint ended, the writer catches up on the writes due until then
+	stop := make(chan time.Time, 1)
+	var writer sync.WaitGroup
+	writer.Add(1)
+	go func() {
+		defer writer.Done()
+		var end time.Time
+		due := time.Now()
+		for i := 0; ; i++ {
+			select {
+			case end = <-stop:
+			default:
+			}
+			due = due.Add(write_interval)
+			if !end.IsZero() && due.After(end) {
+				return
+			}
+			time.Sleep(time.Until(due))
+			if err := s.Set(key{name: "w:" + strconv.Itoa(i%1000)}, 0, "v"); err != nil {
+				tb.Error(err)
+				return
+			}
+			writes = append(writes, write{due, time.Since(due)})
+		}
+	}()
+	//the writer is going before the checkpoint starts
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	if _, err := s.Checkpoint(); err != nil {
+		tb.Fatal(err)
+	}
+	end := time.Now()
+	stop <- end
+	writer.Wait()
+
+	var latencies []time.Duration
+	for _, w := range writes {
+		if !w.due.Before(start) && w.due.Before(end) {
+			latencies = append(latencies, w.took)
+		}
+	}
+	return end.Sub(start), latencies
+}
+
+func percentile(latencies []time.Duration, p float64) time.Duration {
+	if len(latencies) == 0 {
+		return 0
+	}
+	sorted := slices.Clone(latencies)
+	slices.Sort(sorted)
+	return sorted[min(len(sorted)-1, int(float64(len(sorted))*p))]
+}
+
+// writers carry on while the snapshot is written: the p99 write stays well under the
+// checkpoint's time, where it used to be all of it. on a single CPU the writer only
+// runs when the scheduler preempts the snapshot writer, every 10ms or so, and the
+// p99 says more about that than about the store, so only the writes are checked
+func TestCheckpointDoesntBlockWriters(t *testing.T) {
+	s := checkpoint_store(t, 100_000)
+	took, latencies := writes_during_checkpoint(t, s)
+	p99 := percentile(latencies, 0.99)
+	t.Logf("checkpoint took %s, %d writes meanwhile, p99 %s", took, len(latencies), p99)
+	if len(latencies) < 10 {
+		t.Fatalf("only %d writes while the checkpoint ran for %s", len(latencies), took)
+	}
+	if p99 > took/2 && runtime.GOMAXPROCS(0) > 1 {
+		t.Errorf("p99 write latency %s during a checkpoint of %s", p99, took)
+	}
+
+	//the keys that were never logged are in the snapshot, the writes made during the
+	//checkpoint in it or in the log after it
+	path := s.wal.filename
+	s.Close()
+	s = open_store(t, path, PersistWAL)
+	defer s.Close()
+	for _, name := range []string{"key:0", "key:99999", "w:0", "w:" + strconv.Itoa(min(len(latencies), 999))} {
+		if _, ok := s.Get(key{name: name}); !ok {
+			t.Errorf("%s is gone after the checkpoint and a restart", name)
+		}
+	}
+}
+
+func BenchmarkCheckpointWrites(b *testing.B) {
+	s := checkpoint_store(b, 1_000_000)
+	var all []time.Duration
+	var took time.Duration
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, latencies := writes_during_checkpoint(b, s)
+		took += d
+		all = append(all, latencies...)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(percentile(all, 0.99).Microseconds()), "p99-µs")
+	b.ReportMetric(float64(percentile(all, 1).Microseconds()), "max-µs")
+	b.ReportMetric(float64(len(all))/float64(b.N), "writes/checkpoint")
+}
+
+// a checkpoint drops the segments it covers, and a restart loads the snapshot and only
+// replays the writes after it: deletes after it included, expired keys left out of it
+func TestCheckpoint(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{WALSegmentSize: 4096}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		set(t, s, "k:"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	s.Delete(key{name: "k:0"})
+	if err := s.Set(key{name: "short"}, time.Millisecond, "v"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if before := wal_segments(t, s); len(before) < 4 {
+		t.Fatalf("only %d segments to checkpoint", len(before))
+	}
+	n, err := s.Checkpoint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 299 {
+		t.Errorf("%d keys snapshotted, want 299", n)
+	}
+	if after := wal_segments(t, s); len(after) != 1 {
+		t.Errorf("%d segments left after the checkpoint, want the new one", len(after))
+	}
+	s.Delete(key{name: "k:1"})
+	set(t, s, "after", "v")
+	s.Close()
+
+	s, report, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.SnapshotKeys != 299 || report.Records != 2 {
+		t.Errorf("%d keys from the snapshot and %d records replayed, want 299 and 2", report.SnapshotKeys, report.Records)
+	}
+	for name, want := range map[string]bool{"k:0": false, "k:1": false, "k:2": true, "k:299": true, "after": true, "short": false} {
+		if _, ok := s.Get(key{name: name}); ok != want {
+			t.Errorf("%s there %v after the restart, want %v", name, ok, want)
+		}
+	}
+
+	//a snapshot cut short fails the restart instead of starting without the keys in its tail
+	s.Close()
+	info, err := os.Stat(path + ".snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Truncate(path+".snapshot", info.Size()-10)
+	if _, _, err := Recover("", path, opts); err == nil {
+		t.Error("recovered from a truncated snapshot")
+	}
+}
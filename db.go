@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// databases: the keyspace is split into numbered databases, like Redis's SELECT,
+// so unrelated data (tests and the real thing, two apps...) can share one store
+// without their keys running into each other. a key is its name and its db, so the
+// same name in two databases is two keys, and every WAL record carries the db of
+// its key, everything shares the one log, snapshot and memory cap
+//
+// the shell works in whatever database SELECT picked last, 0 to start with. freezes
+// and validators go by namespace and apply to that namespace in every database
+
+// how many databases SELECT can pick from when Options.Databases isn't set
+const default_databases = 16
+
+// Select makes db the database the shell's commands work in
+func (s *Store) Select(db int) error {
+	if db < 0 || db >= s.databases {
+		return errors.New("database " + strconv.Itoa(db) + " is out of range, 0 to " + strconv.Itoa(s.databases-1))
+	}
+	s.db = db
+	return nil
+}
+
+// shell_key is the key a shell command means by name: name in the SELECTed database
+func (s *Store) shell_key(name string) key {
+	return key{name: name, db: s.db}
+}
+
+// in_selected_db points a query that doesn't name a database (DB n) at the SELECTed one
+func (s *Store) in_selected_db(plan *QueryPlan) {
+	if plan.DB < 0 {
+		plan.DB = s.db
+	}
+}
+
+// SELECT db
+func (s *Store) process_select(input_parts []string) error {
+	if len(input_parts) != 2 {
+		return errors.New("SELECT command requires a database number")
+	}
+	db, err := strconv.Atoi(input_parts[1])
+	if err != nil {
+		return errors.New("invalid database number: " + input_parts[1])
+	}
+	if err := s.Select(db); err != nil {
+		return err
+	}
+	log.Printf("Database %d selected\n", db)
+	return nil
+}
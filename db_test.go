@@ -0,0 +1,59 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// numbered databases, see db.go
+
+// the same name in two databases is two keys, each record carries its db, and both
+// come back after a restart in either WAL format
+func TestDatabases(t *testing.T) {
+	quiet_log(t)
+	for name, format := range map[string]WALFormat{"binary": WALBinary, "text": WALText} {
+		path := filepath.Join(t.TempDir(), "wal.log")
+		opts := Options{WALFormat: format, Databases: 4}
+		s, _, err := Recover("", path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, cmd := range []string{"SET user:1 zero", "SELECT 3", "SET user:1 three", "SET only:3 x"} {
+			if err := s.Process(strings.Fields(cmd)); err != nil {
+				t.Fatalf("%s: %v", cmd, err)
+			}
+		}
+		for _, db := range []int{-1, 4} {
+			if err := s.Select(db); err == nil {
+				t.Errorf("%s: SELECT %d of 4 databases", name, db)
+			}
+		}
+		var dbs []int
+		s.ReplayFrom(0, func(e Entry) error {
+			dbs = append(dbs, e.DB)
+			return nil
+		})
+		if len(dbs) != 3 || dbs[0] != 0 || dbs[1] != 3 || dbs[2] != 3 {
+			t.Errorf("%s: records in databases %v", name, dbs)
+		}
+		s.Close()
+
+		s, _, err = Recover("", path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zero, _ := s.Get(key{name: "user:1"})
+		three, _ := s.Get(key{name: "user:1", db: 3})
+		if zero != "zero" || three != "three" || s.Exists(key{name: "only:3"}) {
+			t.Errorf("%s: after a restart user:1 is %q in db 0 and %q in db 3", name, zero, three)
+		}
+		if got := strings.Join(s.Keys(3, "*"), " "); got != "only:3 user:1" {
+			t.Errorf("%s: KEYS * in db 3: %s", name, got)
+		}
+		if got := row_pairs(query(t, s, "SCAN DB 3 WHERE key LIKE user:*")); got != "user:1=three" {
+			t.Errorf("%s: SCAN DB 3: %s", name, got)
+		}
+		s.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// the demo subcommand, see demo.go
+
+// the whole tour on a small dataset: every step runs, the crash leaves a torn tail
+// that recovery cuts off, and with -dir the store is kept
+func TestDemo(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	var err error
+	out := stdout(t, func() { err = run_demo([]string{"-users", "50", "-bench", "100", "-dir", dir}) })
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	for _, want := range []string{
+		"50 users, 17 sessions",
+		"7. what durability costs",
+		"user:1    = name=alice city=lisbon plan=pro",
+		"torn tail: true",
+		"the last user written before the crash is still there",
+		"the store is in " + dir,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q isn't in the output:\n%s", want, out)
+		}
+	}
+	//what waldump would read, the 50 users after the checkpoint
+	r, err := OpenWALReader(filepath.Join(dir, "kvs_wal.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if got := len(read_all(t, r)); got != 50 {
+		t.Errorf("%d records left in the WAL, want 50", got)
+	}
+	if err := run_demo([]string{"-users", "0"}); err == nil {
+		t.Error("demo with no users")
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/maphash"
+	"io"
+	"os"
+)
+
+// DISTINCT: only the first row of each projection (its key, its value, or whatever On
+// makes of it) gets through. while the set of projections seen is under MaxRows it
+// streams, a row is passed on as soon as it turns out to be new, in input order
+//
+// past MaxRows it spills, grace hash join style: the projections seen so far and
+// every row still to come go to one of distinct_partitions files by the hash of their
+// projection, and once the input is drained the partitions are deduplicated one at a
+// time, each with a set of only its own projections. in each file the projections seen
+// come first, so a row that was already passed on isn't passed on again. rows after the
+// spill come out grouped by partition rather than in input order
+
+// how many files a spilling Distinct splits its rows over, each is read back on its own
+const distinct_partitions = 16
+
+// the projections the query engine's DISTINCT keeps in memory before spilling
+const distinct_max_rows = 1 << 17
+
+// record kinds in a spill file
+const (
+	spilled_seen = 's' // a projection passed on before the spill
+	spilled_row  = 'r' // a row that came after
+)
+
+type Distinct struct {
+	Input   Operator
+	On      func(r Row) string // RowKey, RowValue or any other projection
+	MaxRows int                // projections kept in memory before spilling, 0 for no limit
+	Dir     string             // where spill files go, os.TempDir() if empty
+
+	seen    map[string]bool
+	seed    maphash.Seed
+	files   []*os.File // the partitions, nil until it spills
+	writers []*bufio.Writer
+	part    int // the partition being read back, -1 while the input is still spilling
+	reader  *bufio.Reader
+	err     error // what made it give up on spilling, see fail
+}
+
+// RowKey projects a row to its key, for Distinct over FileScan rows
+func RowKey(r Row) string {
+	return r.Key.name
+}
+
+func (d *Distinct) Open() error {
+	d.seen, d.seed, d.files, d.writers, d.part, d.reader, d.err = make(map[string]bool), maphash.MakeSeed(), nil, nil, -1, nil, nil
+	return d.Input.Open()
+}
+
+// Next passes on the next row with a projection not seen yet
+func (d *Distinct) Next() (*Row, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	for d.files == nil {
+		row, err := d.Input.Next()
+		if err != nil || row == nil {
+			return row, err
+		}
+		p := d.On(*row)
+		if d.seen[p] {
+			continue
+		}
+		if d.MaxRows > 0 && len(d.seen) >= d.MaxRows {
+			if err := d.spill(row, p); err != nil {
+				return nil, d.fail(err)
+			}
+			break
+		}
+		d.seen[p] = true
+		return row, nil
+	}
+	row, err := d.next_spilled()
+	if err != nil {
+		return nil, d.fail(err)
+	}
+	return row, nil
+}
+
+// fail removes the spill files as soon as something goes wrong with them instead of
+// leaving them to Close, and keeps err for any Next after
+func (d *Distinct) fail(err error) error {
+	d.remove_spill()
+	d.err = err
+	return err
+}
+
+// spill moves the projections seen so far, row and the rest of the input out to the partitions
+func (d *Distinct) spill(row *Row, p string) error {
+	d.files = make([]*os.File, distinct_partitions)
+	d.writers = make([]*bufio.Writer, distinct_partitions)
+	for i := range d.files {
+		fd, err := os.CreateTemp(d.Dir, "distinct-*")
+		if err != nil {
+			return err
+		}
+		d.files[i], d.writers[i] = fd, bufio.NewWriter(fd)
+	}
+	query_distinct_spills_total.Inc()
+
+	for seen := range d.seen {
+		d.write(spilled_seen, seen, nil)
+	}
+	d.seen = nil
+	for row != nil {
+		d.write(spilled_row, p, row)
+		var err error
+		if row, err = d.Input.Next(); err != nil {
+			return err
+		}
+		if row != nil {
+			p = d.On(*row)
+		}
+	}
+	for i, w := range d.writers {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		if _, err := d.files[i].Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write appends a record to p's partition: its kind, then p and the row (see row_args)
+// packed with encode_args behind their length. write errors surface in spill's Flush
+func (d *Distinct) write(kind byte, p string, row *Row) {
+	args := []string{p}
+	if row != nil {
+		args = append(args, row_args(row)...)
+	}
+	packed := encode_args(args)
+	w := d.writers[maphash.String(d.seed, p)%distinct_partitions]
+	w.WriteByte(kind)
+	w.Write(binary.AppendUvarint(nil, uint64(len(packed))))
+	w.WriteString(packed)
+}
+
+// next_spilled reads the partitions back one after the other, deduplicating each on its own
+func (d *Distinct) next_spilled() (*Row, error) {
+	for {
+		if d.reader == nil {
+			d.part++
+			if d.part >= len(d.files) {
+				return nil, nil
+			}
+			d.reader = bufio.NewReader(d.files[d.part])
+			d.seen = make(map[string]bool)
+		}
+		kind, err := d.reader.ReadByte()
+		if err == io.EOF {
+			d.reader = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		args, err := read_spilled(d.reader)
+		if err != nil {
+			return nil, err
+		}
+		if d.seen[args[0]] {
+			continue
+		}
+		d.seen[args[0]] = true
+		if kind == spilled_seen {
+			continue
+		}
+		return spilled_to_row(args)
+	}
+}
+
+func read_spilled(r *bufio.Reader) ([]string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	args, err := decode_args(string(buf))
+	if err == nil && len(args) == 0 {
+		err = errors.New("empty record in a distinct spill file")
+	}
+	return args, err
+}
+
+func spilled_to_row(args []string) (*Row, error) {
+	if len(args) != 6 {
+		return nil, errors.New("malformed row in a distinct spill file")
+	}
+	return args_to_row(args[1:])
+}
+
+// remove_spill closes and removes the spill files
+func (d *Distinct) remove_spill() {
+	for _, fd := range d.files {
+		if fd == nil {
+			continue //spill failed to create it
+		}
+		fd.Close()
+		os.Remove(fd.Name())
+	}
+	d.files, d.writers, d.reader = nil, nil, nil
+}
+
+// Close removes the spill files
+func (d *Distinct) Close() error {
+	d.remove_spill()
+	d.seen = nil
+	return d.Input.Close()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Distinct in memory and spilled, see distinct.go
+
+// under MaxRows it streams the first row of each value, in input order
+func TestDistinct(t *testing.T) {
+	rows := []*Row{kv("a", "1"), kv("b", "2"), kv("c", "1"), kv("d", "3"), kv("e", "2")}
+	if got := row_pairs(run_op(t, &Distinct{Input: &row_source{rows: rows}, On: RowValue})); got != "a=1 b=2 d=3" {
+		t.Errorf("distinct values: %s", got)
+	}
+	if got := row_pairs(run_op(t, &Distinct{Input: &row_source{rows: rows}, On: RowKey})); got != "a=1 b=2 c=1 d=3 e=2" {
+		t.Errorf("distinct keys: %s", got)
+	}
+}
+
+// past MaxRows every value still comes out once, the ones passed on before the spill
+// included, and the spill files are gone after Close
+func TestDistinctSpill(t *testing.T) {
+	var rows []*Row
+	for i := 0; i < 5000; i++ {
+		rows = append(rows, kv("k"+strconv.Itoa(i), strconv.Itoa(i*7%2000)))
+	}
+	dir := t.TempDir()
+	d := &Distinct{Input: &row_source{rows: rows}, On: RowValue, MaxRows: 100, Dir: dir}
+	got := run_op(t, d)
+	if len(got) != 2000 {
+		t.Errorf("%d rows, want 2000", len(got))
+	}
+	seen := map[string]string{}
+	for _, row := range got {
+		if first, ok := seen[row.Value.data]; ok {
+			t.Fatalf("%s came out twice, from %s and %s", row.Value.data, first, row.Key.name)
+		}
+		seen[row.Value.data] = row.Key.name
+	}
+	//the first row of each value, whichever side of the spill it was on
+	for i := 0; i < 2000; i++ {
+		if want := "k" + strconv.Itoa(i); seen[strconv.Itoa(i*7%2000)] != want {
+			t.Fatalf("value %d came from %s, want %s", i*7%2000, seen[strconv.Itoa(i*7%2000)], want)
+		}
+	}
+	no_spill_left(t, dir)
+
+	//nowhere to spill to: an error from then on, not a partial result
+	d = &Distinct{Input: &row_source{rows: rows}, On: RowValue, MaxRows: 100, Dir: filepath.Join(dir, "missing")}
+	if err := d.Open(); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	for i := 0; err == nil && i <= len(rows); i++ {
+		_, err = d.Next()
+	}
+	if err == nil {
+		t.Fatal("spilled into a directory that isn't there")
+	}
+	if _, again := d.Next(); again != err {
+		t.Errorf("Next after the failure: %v, want %v", again, err)
+	}
+	d.Close()
+}
+
+// DISTINCT comes before the aggregate, SELECT count DISTINCT value counts values
+func TestSelectDistinct(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "active")
+	set(t, s, "user:2", "idle")
+	set(t, s, "user:3", "active")
+	if got := row_pairs(query(t, s, "SCAN SELECT count DISTINCT value")); got != "count=2" {
+		t.Errorf("SELECT count DISTINCT value: %s", got)
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"log"
+	"strings"
+	"time"
+)
+
+// DUMP and RESTORE move one key between stores: Dump serializes its value and what
+// is left of its ttl, Restore recreates it somewhere else, logged as the SET (or for
+// an object the RESTORE record) a snapshot would write for it
+//
+// payload:
+//
+//	version (1 byte) | ttl left in ms (uvarint, 0 = no expiry) | tag (1 byte) | value | CRC32 of everything before (u32)
+//
+// the tag is 'r' for a string, whose value is the bytes, or an object's tag (see object_tags)
+// followed by its members packed like a RESTORE record's. the ttl is relative so the key
+// lives as long on a host whose clock disagrees
+
+const dump_version byte = 1
+
+// the tag of a plain string in a dump, objects have theirs in object_tags
+const dump_string_tag = 'r'
+
+// Dump serializes k's value and ttl for Restore, a missing or expired key is an error
+func (s *Store) Dump(k key) ([]byte, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		return nil, ErrKeyNotFound
+	}
+	var ttl uint64
+	if !val.expires_at.IsZero() {
+		//rounded up, a key with under a millisecond left must not come back without an expiry
+		ttl = uint64((time.Until(val.expires_at) + time.Millisecond - 1) / time.Millisecond)
+	}
+
+	payload := []byte{dump_version}
+	payload = binary.AppendUvarint(payload, ttl)
+	if val.obj != nil {
+		payload = append(payload, dump_object(val.obj)...)
+	} else {
+		payload = append(payload, dump_string_tag)
+		payload = append(payload, val.data...)
+	}
+	return binary.LittleEndian.AppendUint32(payload, crc32.ChecksumIEEE(payload)), nil
+}
+
+// load_dump checks a Dump payload and returns the value and ttl in it
+func load_dump(payload []byte) (value, time.Duration, error) {
+	if len(payload) < 1+1+1+4 {
+		return value{}, 0, errors.New("dump payload is too short")
+	}
+	body, sum := payload[:len(payload)-4], payload[len(payload)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return value{}, 0, errors.New("dump payload checksum mismatch")
+	}
+	if body[0] < 1 || body[0] > dump_version {
+		return value{}, 0, errors.New("unsupported dump version")
+	}
+	ttl, n := binary.Uvarint(body[1:])
+	if n <= 0 || 1+n >= len(body) {
+		return value{}, 0, errors.New("malformed dump payload")
+	}
+	rest := body[1+n:]
+	if rest[0] == dump_string_tag {
+		return value{data: string(rest[1:])}, time.Duration(ttl) * time.Millisecond, nil
+	}
+	obj, err := load_object(string(rest))
+	if err != nil {
+		return value{}, 0, err
+	}
+	return value{obj: obj}, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// Restore recreates a key from a Dump payload under k
+// if k already holds a live value it is only replaced with replace set, otherwise it's an error
+func (s *Store) Restore(k key, payload []byte, replace bool) error {
+	val, ttl, err := load_dump(payload)
+	if err != nil {
+		return err
+	}
+	if ttl > 0 {
+		val.expires_at = time.Now().Add(ttl)
+	}
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	if old, exists := s.data.get(k); exists && !replace && (old.expires_at.IsZero() || time.Now().Before(old.expires_at)) {
+		s.lock.Unlock()
+		return errors.New("key " + describe_key(k) + " already exists, RESTORE it with REPLACE")
+	}
+	if val.obj == nil {
+		if err := s.validate(k, val.data); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	if err := s.make_room_for(k, entry_size(k, val)); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	val.lsn = s.next_lsn()
+	rec := value_record(k, val)
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	if err := s.replayEntry(rec); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return s.wait(ack)
+}
+
+// DUMP key prints the payload in hex, RESTORE key payload [REPLACE] takes it back
+func (s *Store) process_dump(cmd string, input_parts []string) error {
+	if cmd == "DUMP" {
+		if len(input_parts) != 2 {
+			return errors.New("DUMP command requires a key")
+		}
+		payload, err := s.Dump(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		println(hex.EncodeToString(payload))
+		return nil
+	}
+
+	if len(input_parts) < 3 || len(input_parts) > 4 {
+		return errors.New("RESTORE command requires a key and a payload")
+	}
+	replace := len(input_parts) == 4
+	if replace && strings.ToUpper(input_parts[3]) != "REPLACE" {
+		return errors.New("RESTORE takes REPLACE, got: " + input_parts[3])
+	}
+	payload, err := hex.DecodeString(input_parts[2])
+	if err != nil {
+		return errors.New("RESTORE payload must be hex, as DUMP prints it")
+	}
+	if err := s.Restore(s.shell_key(input_parts[1]), payload, replace); err != nil {
+		return err
+	}
+	log.Printf("Key %s restored\n", input_parts[1])
+	return nil
+}
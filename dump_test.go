@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/hex"
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// DUMP and RESTORE, see dump.go
+
+// a key dumped from one store comes back in another with its value, object and ttl,
+// logged there, and a payload that was changed or cut short is refused
+func TestDumpRestore(t *testing.T) {
+	quiet_log(t)
+	src := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer src.Close()
+	path := filepath.Join(t.TempDir(), "wal.log")
+	dst := open_store(t, path, PersistWAL)
+	src.Set(key{name: "ttl"}, time.Hour, "x")
+	set(t, src, "bin", "\x00\xff\r\n")
+	src.HSet(key{name: "h"}, map[string]string{"f": "v", "g": "w"})
+	src.ZAdd(key{name: "z"}, map[string]float64{"a": 1.5, "b": -2})
+	for _, name := range []string{"ttl", "bin", "h", "z"} {
+		payload, err := src.Dump(key{name: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dst.Restore(key{name: name}, payload, false); err != nil {
+			t.Errorf("RESTORE %s: %v", name, err)
+		}
+	}
+	if _, err := src.Dump(key{name: "missing"}); err != ErrKeyNotFound {
+		t.Errorf("DUMP of a missing key: %v", err)
+	}
+
+	payload, _ := src.Dump(key{name: "bin"})
+	if err := dst.Restore(key{name: "bin"}, payload, false); err == nil {
+		t.Error("RESTORE over a live key without REPLACE")
+	}
+	set(t, src, "bin", "new")
+	payload, _ = src.Dump(key{name: "bin"})
+	if err := dst.Restore(key{name: "bin"}, payload, true); err != nil || get(t, dst, "bin") != "new" {
+		t.Errorf("RESTORE REPLACE: %v, bin=%q", err, get(t, dst, "bin"))
+	}
+	for name, bad := range map[string][]byte{
+		"a changed byte": append([]byte{payload[0], payload[1], 'R'}, payload[3:]...),
+		"cut short":      payload[:len(payload)-1],
+		"empty":          nil,
+	} {
+		if err := dst.Restore(key{name: "bad"}, bad, true); err == nil {
+			t.Errorf("restored a payload with %s", name)
+		}
+	}
+
+	dst = reopen(t, dst, path)
+	defer dst.Close()
+	if _, ttl, _, _ := dst.Ttl(key{name: "ttl"}); get(t, dst, "ttl") != "x" || ttl <= 59*time.Minute || get(t, dst, "bin") != "new" {
+		t.Errorf("after a restart ttl=%s with %v left, bin=%q", get(t, dst, "ttl"), ttl, get(t, dst, "bin"))
+	}
+	if all, _ := dst.HGetAll(key{name: "h"}); !maps.Equal(all, map[string]string{"f": "v", "g": "w"}) {
+		t.Errorf("h: %v", all)
+	}
+	if score, ok, _ := dst.ZScore(key{name: "z"}, "b"); !ok || score != -2 {
+		t.Errorf("z's b: %v %v", score, ok)
+	}
+}
+
+// the shell's RESTORE takes the payload in hex, as DUMP prints it
+func TestProcessRestore(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "a", "1")
+	payload, _ := s.Dump(key{name: "a"})
+	if err := s.Process([]string{"RESTORE", "b", hex.EncodeToString(payload)}); err != nil || get(t, s, "b") != "1" {
+		t.Errorf("RESTORE b: %v, b=%s", err, get(t, s, "b"))
+	}
+	if err := s.Process([]string{"RESTORE", "b", hex.EncodeToString(payload), "replace"}); err != nil {
+		t.Errorf("RESTORE b REPLACE: %v", err)
+	}
+	for _, args := range [][]string{
+		{"RESTORE", "c", "not hex"},
+		{"RESTORE", "c", hex.EncodeToString(payload), "OVER"},
+		{"RESTORE", "c"},
+		{"DUMP", "missing"},
+	} {
+		if err := s.Process(args); err == nil {
+			t.Errorf("%q", args)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// the errors of the Store API a caller may want to act on, to tell apart with errors.Is
+// rather than by their text. some come back wrapped with more detail, a ttl that doesn't
+// parse for one, so compare with errors.Is and not ==
+//
+// an expired key the sweeper hasn't got to is missing like any other, only Ttl says
+// ErrKeyExpired instead of ErrKeyNotFound
+
+var (
+	ErrKeyNotFound = errors.New("the key does not exist")
+	ErrKeyExpired  = errors.New("the key has expired")
+	ErrInvalidTTL  = errors.New("invalid TTL")
+	ErrWrongType   = errors.New("WRONGTYPE operation against a key holding the wrong kind of value")
+)
+
+// parse_ttl reads a ttl in time.ParseDuration's format, "90s", "5m", "1h30m"
+func parse_ttl(arg string) (time.Duration, error) {
+	ttl, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, fmt.Errorf("%w %q, use a duration like 30s or 5m", ErrInvalidTTL, arg)
+	}
+	return ttl, nil
+}
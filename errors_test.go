@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the sentinel errors, see errors.go
+
+// each comes back from the calls and commands that can't do what they were asked,
+// wrapped or not, and errors.Is finds it
+func TestSentinelErrors(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	set(t, s, "str", "v")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	s.Set(key{name: "gone"}, time.Millisecond, "v")
+	time.Sleep(5 * time.Millisecond)
+
+	_, _, _, ttl_missing := s.Ttl(key{name: "missing"})
+	_, _, _, ttl_gone := s.Ttl(key{name: "gone"})
+	_, _, hget_str := s.HGet(key{name: "str"}, "f")
+	_, lpush_h := s.LPush(key{name: "h"}, "x")
+	_, sadd_str := s.SAdd(key{name: "str"}, "x")
+	_, set_keepttl := s.SetOpts(key{name: "str"}, time.Minute, "v", SetOptions{KeepTTL: true})
+	_, parse := parse_ttl("soon")
+	for _, tc := range []struct {
+		name string
+		err  error
+		want error
+	}{
+		{"TTL of a missing key", ttl_missing, ErrKeyNotFound},
+		{"TTL of an expired key", ttl_gone, ErrKeyExpired},
+		{"EXPIRE of an expired key", s.Expire(key{name: "gone"}, time.Minute), ErrKeyNotFound},
+		{"RENAME of a missing key", s.Rename(key{name: "missing"}, key{name: "x"}), ErrKeyNotFound},
+		{"HGET of a string", hget_str, ErrWrongType},
+		{"LPUSH to a hash", lpush_h, ErrWrongType},
+		{"SADD to a string", sadd_str, ErrWrongType},
+		{"KEEPTTL with a ttl", set_keepttl, ErrInvalidTTL},
+		{"a ttl that doesn't parse", parse, ErrInvalidTTL},
+		{"shell GET of a missing key", s.Process(strings.Fields("GET missing")), ErrKeyNotFound},
+		{"shell GET of a hash", s.Process(strings.Fields("GET h")), ErrWrongType},
+		{"shell SET with a bad ttl", s.Process(strings.Fields("SET a 1 soon")), ErrInvalidTTL},
+		{"shell GETEX with a negative ttl", s.Process(strings.Fields("GETEX str -1s")), ErrInvalidTTL},
+	} {
+		if !errors.Is(tc.err, tc.want) {
+			t.Errorf("%s: %v, want %v", tc.name, tc.err, tc.want)
+		}
+	}
+	if _, err := parse_ttl("soon"); !strings.Contains(err.Error(), `"soon"`) {
+		t.Errorf("the ttl that didn't parse isn't in %q", err)
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// memory cap: the store keeps an estimate of what s.data takes (keys, values and a
+// fixed overhead per entry), and with Options.MaxMemory set a SET that would take it
+// over the cap first evicts other keys. like Redis it doesn't keep the keys ordered:
+// it samples a few, lets the EvictionPolicy pick one, and repeats until the write fits
+//
+// every eviction is logged as a DELETE, so replay ends up with the same keys. when the
+// policy finds nothing to evict (volatile-ttl without keys that have a ttl) the SET
+// fails with a *ResourceLimitError and nothing is written
+//
+// LRU and LFU need to know when and how often a key was read. Get updates that with
+// atomics under the read lock, so it is only kept when there is a cap, or a warm-up to
+// list the hot keys for (see warmup.go)
+
+// per entry, on top of the key and value bytes: the map slot, the string headers and value,
+// and the key's entry in the scan index
+const entry_overhead = 128
+
+// keys looked at per eviction, Redis's maxmemory-samples
+const eviction_samples = 5
+
+// samples tried before a write fails because the policy found nothing to evict
+const eviction_attempts = 3
+
+// EvictionCandidate is what a policy gets to see of a sampled key
+type EvictionCandidate struct {
+	Key        string
+	Size       int64     // estimated bytes
+	LastAccess time.Time // last read or write
+	Accesses   uint64    // reads and writes since the key was created
+	ExpiresAt  time.Time // zero without a ttl
+}
+
+// EvictionPolicy picks the key to evict from a sample, -1 to evict none of them
+type EvictionPolicy interface {
+	Victim(sample []EvictionCandidate) int
+}
+
+// EvictLRU evicts the key that was used longest ago, the default
+var EvictLRU EvictionPolicy = lru_policy{}
+
+// EvictLFU evicts the key used least often, its count halved for every minute it sat idle
+// so a key that was hot an hour ago doesn't stay forever
+var EvictLFU EvictionPolicy = lfu_policy{}
+
+// EvictVolatileTTL only evicts keys with a ttl, the one closest to expiring first
+var EvictVolatileTTL EvictionPolicy = volatile_ttl_policy{}
+
+type lru_policy struct{}
+
+func (lru_policy) Victim(sample []EvictionCandidate) int {
+	victim := -1
+	for i, c := range sample {
+		if victim < 0 || c.LastAccess.Before(sample[victim].LastAccess) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+type lfu_policy struct{}
+
+func lfu_score(c EvictionCandidate) uint64 {
+	idle := uint(min(time.Since(c.LastAccess)/time.Minute, 63))
+	return c.Accesses >> idle
+}
+
+func (lfu_policy) Victim(sample []EvictionCandidate) int {
+	victim := -1
+	for i, c := range sample {
+		if victim < 0 || lfu_score(c) < lfu_score(sample[victim]) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+type volatile_ttl_policy struct{}
+
+func (volatile_ttl_policy) Victim(sample []EvictionCandidate) int {
+	victim := -1
+	for i, c := range sample {
+		if c.ExpiresAt.IsZero() {
+			continue
+		}
+		if victim < 0 || c.ExpiresAt.Before(sample[victim].ExpiresAt) {
+			victim = i
+		}
+	}
+	return victim
+}
+
+// ParseEvictionPolicy turns "lru", "lfu" or "volatile-ttl" into its policy
+func ParseEvictionPolicy(name string) (EvictionPolicy, bool) {
+	switch name {
+	case "lru":
+		return EvictLRU, true
+	case "lfu":
+		return EvictLFU, true
+	case "volatile-ttl":
+		return EvictVolatileTTL, true
+	}
+	return nil, false
+}
+
+// access_stats is shared by every copy of a value, reads update it under the read lock
+type access_stats struct {
+	last atomic.Int64 // unix nanoseconds
+	hits atomic.Uint64
+}
+
+func new_access_stats() *access_stats {
+	a := &access_stats{}
+	a.touch()
+	return a
+}
+
+func (a *access_stats) touch() {
+	a.last.Store(time.Now().UnixNano())
+	a.hits.Add(1)
+}
+
+func entry_size(k key, val value) int64 {
+	size := int64(len(k.name)+len(val.data)) + entry_overhead
+	if val.obj != nil {
+		size += val.obj.size()
+	}
+	return size
+}
+
+// put stores val under k, keeping the memory estimate, the access stats and the scan index up to date
+// Caller must hold s.lock
+func (s *Store) put(k key, val value) {
+	if old, exists := s.data.get(k); exists {
+		s.memory -= entry_size(k, old)
+		if val.access == nil {
+			val.access = old.access
+		}
+	} else {
+		s.scan.add(k)
+	}
+	if val.access == nil && (s.max_memory > 0 || s.warm_up > 0) {
+		val.access = new_access_stats()
+	}
+	s.data.set(k, val)
+	s.memory += entry_size(k, val)
+}
+
+// drop deletes k, keeping the memory estimate and the scan index up to date
+// Caller must hold s.lock
+func (s *Store) drop(k key) {
+	if old, exists := s.data.get(k); exists {
+		s.memory -= entry_size(k, old)
+		s.data.remove(k)
+		s.scan.remove(k)
+	}
+}
+
+// make_room evicts keys until v fits under the cap as k's new value
+// the evictions' DELETEs are queued before the write that needed them,
+// so that write's ack covers them too
+// Caller must hold s.lock
+func (s *Store) make_room(k key, v string) error {
+	return s.make_room_for(k, entry_size(k, value{data: v}))
+}
+
+// make_room_for is make_room for a new value of k that takes size bytes
+// keys in keep aren't evicted either, the write needs them
+// Caller must hold s.lock
+func (s *Store) make_room_for(k key, size int64, keep ...key) error {
+	if s.max_memory <= 0 {
+		return nil
+	}
+	if size > s.max_memory {
+		return &ResourceLimitError{Resource: "bytes of memory", Kind: "key " + k.name, Limit: int(s.max_memory)}
+	}
+	if old, exists := s.data.get(k); exists {
+		size -= entry_size(k, old)
+	}
+	return s.evict_for(size, "key "+k.name, append(keep, k))
+}
+
+// evict_for evicts keys other than the ones in keep until the map can grow by growth
+// bytes and stay under the cap, kind is what the room is for, for the error
+// Caller must hold s.lock
+func (s *Store) evict_for(growth int64, kind string, keep []key) error {
+	needed := s.memory + growth - s.max_memory
+	for needed > 0 {
+		victim, ok := s.eviction_victim(keep)
+		if !ok {
+			return &ResourceLimitError{Resource: "bytes of memory", Kind: kind, Limit: int(s.max_memory)}
+		}
+		rec := wal_record{lsn: s.next_lsn(), op: DELETE, key: victim.name, db: victim.db}
+		if _, err := s.log_write(rec); err != nil {
+			return err
+		}
+		old, _ := s.data.get(victim)
+		needed -= entry_size(victim, old)
+		s.drop(victim)
+		s.announce(rec)
+		evicted_keys_total.Inc()
+		log.Printf("Evicted %s to stay under %d bytes\n", victim.name, s.max_memory)
+	}
+	return nil
+}
+
+// eviction_victim samples keys other than the ones in keep and returns the one to evict
+// an expired key in the sample goes first, whatever the policy. a policy that
+// passes on a sample (volatile-ttl, none of them has a ttl) gets a couple more
+// Caller must hold s.lock
+func (s *Store) eviction_victim(keep []key) (key, bool) {
+	for attempt := 0; attempt < eviction_attempts; attempt++ {
+		keys, sample, expired := s.eviction_sample(keep)
+		if expired != nil {
+			return *expired, true
+		}
+		if len(sample) == 0 {
+			return key{}, false
+		}
+		if victim := s.eviction.Victim(sample); victim >= 0 && victim < len(sample) {
+			return keys[victim], true
+		}
+	}
+	return key{}, false
+}
+
+// eviction_sample picks up to eviction_samples keys, starting somewhere random
+// Caller must hold s.lock
+func (s *Store) eviction_sample(keep []key) ([]key, []EvictionCandidate, *key) {
+	now := time.Now()
+	keys := make([]key, 0, eviction_samples)
+	sample := make([]EvictionCandidate, 0, eviction_samples)
+	var expired *key
+	s.data.each(s.data.random_shard(), func(k key, val value) bool {
+		if len(sample) == eviction_samples {
+			return false
+		}
+		if slices.Contains(keep, k) || s.check_frozen(k) != nil {
+			return true
+		}
+		if !val.expires_at.IsZero() && !val.expires_at.After(now) {
+			expired = &k
+			return false
+		}
+		c := EvictionCandidate{Key: k.name, Size: entry_size(k, val), ExpiresAt: val.expires_at}
+		if val.access != nil {
+			c.LastAccess = time.Unix(0, val.access.last.Load())
+			c.Accesses = val.access.hits.Load()
+		}
+		keys = append(keys, k)
+		sample = append(sample, c)
+		return true
+	})
+	if expired != nil {
+		return nil, nil, expired
+	}
+	return keys, sample, nil
+}
+
+// Memory is the estimated size of the keys and values in memory, and the cap (0 = none)
+func (s *Store) Memory() (int64, int64) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.memory, s.max_memory
+}
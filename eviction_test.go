@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the memory cap and the eviction policies, see eviction.go
+
+// each policy's pick from the same sample, and volatile-ttl passing on one without a ttl
+func TestEvictionPolicies(t *testing.T) {
+	now := time.Now()
+	sample := []EvictionCandidate{
+		{Key: "recent", LastAccess: now, Accesses: 2},
+		{Key: "old", LastAccess: now.Add(-30 * time.Second), Accesses: 50},
+		{Key: "idle", LastAccess: now.Add(-5 * time.Minute), Accesses: 40, ExpiresAt: now.Add(time.Hour)},
+		{Key: "expiring", LastAccess: now, Accesses: 9, ExpiresAt: now.Add(time.Minute)},
+	}
+	for name, want := range map[string]string{"lru": "idle", "lfu": "idle", "volatile-ttl": "expiring"} {
+		policy, ok := ParseEvictionPolicy(name)
+		if !ok {
+			t.Fatalf("%s didn't parse", name)
+		}
+		if got := policy.Victim(sample); got < 0 || sample[got].Key != want {
+			t.Errorf("%s evicts %d, want %s", name, got, want)
+		}
+	}
+	//40 uses 5 minutes ago count for 1 now, less than recent's 2
+	if score := lfu_score(sample[2]); score != 1 {
+		t.Errorf("lfu score of 40 uses idle for 5 minutes: %d", score)
+	}
+	if got := EvictVolatileTTL.Victim(sample[:2]); got != -1 {
+		t.Errorf("volatile-ttl evicts %d from keys without a ttl", got)
+	}
+	if _, ok := ParseEvictionPolicy("random"); ok {
+		t.Error("random parsed")
+	}
+}
+
+// past the cap a SET evicts by the policy, logging each eviction, and a restart comes
+// back with the same keys. a key read before every SET survives LRU
+func TestMaxMemory(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	data := strings.Repeat("v", 100)
+	limit := 10 * entry_size(key{name: "k:00"}, value{data: data})
+	s := New_Store(path, Options{MaxMemory: limit})
+	set(t, s, "hot", data)
+	for i := range 50 {
+		get(t, s, "hot")
+		set(t, s, "k:"+strconv.Itoa(10+i), data)
+		if used, _ := s.Memory(); used > limit {
+			t.Fatalf("%d bytes used after %d writes, the cap is %d", used, i+1, limit)
+		}
+	}
+	if get(t, s, "hot") != data || get(t, s, "k:59") != data {
+		t.Error("the hot key or the last one written was evicted")
+	}
+	keys := strings.Join(s.Keys(0, "*"), " ")
+	if deletes := strings.Count(entries(t, s, 0), "DELETE"); deletes != 51-len(s.Keys(0, "*")) {
+		t.Errorf("%d DELETEs logged, %d keys left of 51", deletes, len(s.Keys(0, "*")))
+	}
+	s.Close()
+
+	s, _, err := Recover("", path, Options{MaxMemory: limit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := strings.Join(s.Keys(0, "*"), " "); got != keys {
+		t.Errorf("keys after a restart: %s, before: %s", got, keys)
+	}
+}
+
+// a value bigger than the cap, or a cap volatile-ttl can't evict anything under, fails
+// the SET with a *ResourceLimitError and writes nothing
+func TestMaxMemoryFull(t *testing.T) {
+	quiet_log(t)
+	data := strings.Repeat("v", 100)
+	limit := 3 * entry_size(key{name: "k:0"}, value{data: data})
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{MaxMemory: limit, Eviction: EvictVolatileTTL})
+	defer s.Close()
+	var full *ResourceLimitError
+	if err := s.Set(key{name: "big"}, 0, strings.Repeat("v", int(limit))); !errors.As(err, &full) {
+		t.Errorf("a value bigger than the cap: %v", err)
+	}
+	for i := range 3 {
+		set(t, s, "k:"+strconv.Itoa(i), data)
+	}
+	if err := s.Set(key{name: "k:3"}, 0, data); !errors.As(err, &full) || full.Resource != "bytes of memory" {
+		t.Fatalf("a fourth key with nothing volatile to evict: %v", err)
+	}
+	if _, ok := s.Get(key{name: "k:3"}); ok || len(s.Keys(0, "*")) != 3 {
+		t.Errorf("k:3 there %v, %d keys", ok, len(s.Keys(0, "*")))
+	}
+	//one with a ttl can go
+	s.Expire(key{name: "k:1"}, time.Hour)
+	set(t, s, "k:3", data)
+	if _, ok := s.Get(key{name: "k:1"}); ok {
+		t.Error("k:1, the only key with a ttl, is still there")
+	}
+}
@@ -2,18 +2,36 @@ package main
 
 import (
 	"errors"
+	"math"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // QueryPlan represents a parsed query before building the operator tree
 // we want to apply limits after filters to match SQL semantics
-// Order: KVScan → Filters → Limit → Project
+// Order: KVScan → Filters → Distinct → Aggregate or GroupBy → Sort → Limit → Project
+// with both ORDER BY and LIMIT, Sort and Limit are one TopK
 type QueryPlan struct {
-	Filters []FilterClause
-	Limit   int  // 0 means no limit
-	KeyOnly bool // SELECT key (default false = return both)
+	Source   string // file to scan instead of the store (FROM path), empty means the store
+	KeyCol   string // column mapped to the key when scanning a file
+	ValueCol string // column mapped to the value when scanning a file
+	ZSet     string // sorted set to scan in score order instead of the store (ZSET key)
+	ScoreMin float64
+	ScoreMax float64 // the score range of the ZSET scan (SCORE min max), everything by default
+	DB       int     // database the store is scanned in (DB n), ParseQuery leaves -1 for the SELECTed one
+	AsOf     bool    // scan the store as of a past write (AS OF lsn|time), see history.go
+	AsOfLSN  uint64
+	AsOfTime time.Time // the point AS OF gave, a time if this isn't zero
+	Filters  []FilterClause
+	Distinct string // "KEY" or "VALUE" (DISTINCT ...), only the first row of each
+	AggFunc  string // COUNT, MIN, MAX, SUM or AVG over the rows (SELECT count), empty for the rows themselves
+	GroupBy  string // "PREFIX" or "VALUE" (GROUP BY ...), AggFunc (COUNT by default) per group instead
+	OrderBy  string // "KEY", "VALUE" or "TTL" (ORDER BY field [ASC|DESC]), empty for scan order
+	Desc     bool
+	Limit    int  // 0 means no limit
+	KeyOnly  bool // SELECT key (default false = return both)
 }
 
 type FilterClause struct {
@@ -25,15 +43,79 @@ type FilterClause struct {
 // simple query planner that parses a limited SQL-like syntax
 func ParseQuery(parts []string) (*QueryPlan, error) {
 	plan := &QueryPlan{
-		Filters: []FilterClause{},
-		Limit:   0,
-		KeyOnly: false,
+		KeyCol:   "key",
+		ValueCol: "value",
+		ScoreMin: math.Inf(-1),
+		ScoreMax: math.Inf(1),
+		DB:       -1,
+		Filters:  []FilterClause{},
+		Limit:    0,
+		KeyOnly:  false,
 	}
 
 	for i := 1; i < len(parts); i++ {
 		part := strings.ToUpper(parts[i])
 
 		switch part {
+		case "FROM":
+			if i+1 >= len(parts) {
+				return nil, errors.New("FROM requires a file path")
+			}
+			plan.Source = parts[i+1]
+			i++
+
+		case "ZSET":
+			if i+1 >= len(parts) {
+				return nil, errors.New("ZSET requires a key")
+			}
+			plan.ZSet = parts[i+1]
+			i++
+
+		case "DB":
+			if i+1 >= len(parts) {
+				return nil, errors.New("DB requires a database number")
+			}
+			n, err := strconv.Atoi(parts[i+1])
+			if err != nil || n < 0 {
+				return nil, errors.New("invalid DB value: " + parts[i+1])
+			}
+			plan.DB = n
+			i++
+
+		case "AS":
+			// AS OF <lsn|time>, the store as it was then
+			if i+2 >= len(parts) || strings.ToUpper(parts[i+1]) != "OF" {
+				return nil, errors.New("AS requires: OF lsn or time")
+			}
+			lsn, at, err := parse_point(parts[i+2])
+			if err != nil {
+				return nil, err
+			}
+			plan.AsOf, plan.AsOfLSN, plan.AsOfTime = true, lsn, at
+			i += 2
+
+		case "SCORE":
+			// SCORE <min> <max>, the score range of a ZSET scan
+			if i+2 >= len(parts) {
+				return nil, errors.New("SCORE requires: min max")
+			}
+			lo, err1 := parse_score(parts[i+1])
+			hi, err2 := parse_score(parts[i+2])
+			if err1 != nil || err2 != nil {
+				return nil, errors.New("SCORE min and max must be numbers (or -inf, +inf)")
+			}
+			plan.ScoreMin, plan.ScoreMax = lo, hi
+			i += 2
+
+		case "MAP":
+			// MAP <key column> <value column>, schema mapping for FROM
+			if i+2 >= len(parts) {
+				return nil, errors.New("MAP requires: key_column value_column")
+			}
+			plan.KeyCol = parts[i+1]
+			plan.ValueCol = parts[i+2]
+			i += 2
+
 		case "SELECT":
 			if i+1 >= len(parts) {
 				return nil, errors.New("SELECT requires column (key or *)")
@@ -46,10 +128,58 @@ func ParseQuery(parts []string) (*QueryPlan, error) {
 			case "*", "KEY,VALUE", "VALUE,KEY":
 				plan.KeyOnly = false // both (default)
 			default:
-				return nil, errors.New("SELECT must be: key or * (for both)")
+				if !aggregate_funcs[col] {
+					return nil, errors.New("SELECT must be: key, * (for both), or count, min, max, sum or avg")
+				}
+				plan.AggFunc = col
 			}
 			i++
 
+		case "ORDER":
+			// ORDER BY <key|value|ttl> [ASC|DESC]
+			if i+2 >= len(parts) || strings.ToUpper(parts[i+1]) != "BY" {
+				return nil, errors.New("ORDER requires: BY key, value or ttl")
+			}
+			field := strings.ToUpper(parts[i+2])
+			if field != "KEY" && field != "VALUE" && field != "TTL" {
+				return nil, errors.New("ORDER BY must be key, value or ttl, got: " + parts[i+2])
+			}
+			plan.OrderBy = field
+			i += 2
+			if i+1 < len(parts) {
+				switch strings.ToUpper(parts[i+1]) {
+				case "ASC":
+					i++
+				case "DESC":
+					plan.Desc = true
+					i++
+				}
+			}
+
+		case "DISTINCT":
+			// DISTINCT <key|value>
+			if i+1 >= len(parts) {
+				return nil, errors.New("DISTINCT requires: key or value")
+			}
+			field := strings.ToUpper(parts[i+1])
+			if field != "KEY" && field != "VALUE" {
+				return nil, errors.New("DISTINCT must be key or value, got: " + parts[i+1])
+			}
+			plan.Distinct = field
+			i++
+
+		case "GROUP":
+			// GROUP BY <prefix|value>
+			if i+2 >= len(parts) || strings.ToUpper(parts[i+1]) != "BY" {
+				return nil, errors.New("GROUP requires: BY prefix or value")
+			}
+			field := strings.ToUpper(parts[i+2])
+			if field != "PREFIX" && field != "VALUE" {
+				return nil, errors.New("GROUP BY must be prefix or value, got: " + parts[i+2])
+			}
+			plan.GroupBy = field
+			i += 2
+
 		case "LIMIT":
 			if i+1 >= len(parts) {
 				return nil, errors.New("LIMIT requires a number")
@@ -89,14 +219,40 @@ func ParseQuery(parts []string) (*QueryPlan, error) {
 		}
 	}
 
+	if plan.ZSet != "" && plan.Source != "" {
+		return nil, errors.New("a query scans either FROM a file or a ZSET, not both")
+	}
+	if plan.AsOf && (plan.ZSet != "" || plan.Source != "") {
+		return nil, errors.New("AS OF only goes with a scan of the store")
+	}
+	if plan.GroupBy != "" && plan.KeyOnly {
+		return nil, errors.New("GROUP BY returns a group and its aggregate, SELECT key doesn't go with it")
+	}
+	if plan.GroupBy != "" && plan.AggFunc == "" {
+		plan.AggFunc = "COUNT"
+	}
 	return plan, nil
 }
 
 // BuildOperatorTree constructs the operator tree from a QueryPlan
-// Order: KVScan then Filters then Limit then Project (SQL semantics)
+// Order: KVScan then Filters then Distinct then Aggregate or GroupBy then Sort then Limit then Project (SQL semantics)
 func BuildOperatorTree(store *Store, plan *QueryPlan) Operator {
-	var op Operator = NewKVScan(store)
+	store.in_selected_db(plan)
+	var op Operator = NewKVScan(store, plan.DB)
+	if plan.AsOf {
+		op = NewHistoryScan(store, plan.DB, plan.AsOfLSN, plan.AsOfTime)
+	}
+	if plan.Source != "" {
+		op = NewFileScan(plan.Source, plan.KeyCol, plan.ValueCol)
+	}
+	if plan.ZSet != "" {
+		op = NewZScan(store, plan.DB, plan.ZSet, plan.ScoreMin, plan.ScoreMax)
+	}
+	return build_on(op, plan)
+}
 
+// build_on puts the rest of the plan's operators on top of the scan op
+func build_on(op Operator, plan *QueryPlan) Operator {
 	// Apply filters first
 	for _, f := range plan.Filters {
 		filter := f // capture for closure
@@ -119,8 +275,37 @@ func BuildOperatorTree(store *Store, plan *QueryPlan) Operator {
 		}
 	}
 
+	// Drop repeats before they are counted, SELECT count DISTINCT value counts values
+	if plan.Distinct != "" {
+		on := map[string]func(r Row) string{"KEY": RowKey, "VALUE": RowValue}[plan.Distinct]
+		op = &Distinct{Input: op, On: on, MaxRows: distinct_max_rows}
+	}
+
+	// Add up what the filters let through, LIMIT and the rest work on the summary
+	// or, grouped, on the groups
+	if plan.GroupBy != "" {
+		group := map[string]func(r Row) string{"PREFIX": KeyPrefix, "VALUE": RowValue}[plan.GroupBy]
+		op = &GroupBy{Input: op, Group: group, Func: plan.AggFunc, MaxGroups: groupby_max_groups, Format: query_spill_format}
+	} else if plan.AggFunc != "" {
+		op = &Aggregate{Input: op, Func: plan.AggFunc}
+	}
+
+	// Sort what the filters let through, before the limit picks the first rows
+	// both together are a TopK, which only ever holds the rows it returns
+	if plan.OrderBy != "" {
+		less := map[string]func(a, b Row) bool{"KEY": ByKey, "VALUE": ByValue, "TTL": ByExpiry}[plan.OrderBy]
+		if plan.Desc {
+			less = Desc(less)
+		}
+		if plan.Limit > 0 {
+			op = &TopK{Input: op, K: plan.Limit, Less: less}
+		} else {
+			op = &Sort{Input: op, Less: less, MaxRows: sort_max_rows, Format: query_spill_format}
+		}
+	}
+
 	// Apply limit
-	if plan.Limit > 0 {
+	if plan.Limit > 0 && plan.OrderBy == "" {
 		op = &Limit{Input: op, Max: plan.Limit}
 	}
 
@@ -149,12 +334,42 @@ func PrintQueryPlan(plan *QueryPlan) string {
 		indent++
 	}
 
-	if plan.Limit > 0 {
+	if plan.Limit > 0 && plan.OrderBy == "" {
 		sb.WriteString(strings.Repeat("  ", indent))
 		sb.WriteString("→ Limit (max=" + strconv.Itoa(plan.Limit) + ")\n")
 		indent++
 	}
 
+	if plan.OrderBy != "" {
+		direction := "asc"
+		if plan.Desc {
+			direction = "desc"
+		}
+		sb.WriteString(strings.Repeat("  ", indent))
+		if plan.Limit > 0 {
+			sb.WriteString("→ TopK (" + plan.OrderBy + " " + direction + ", k=" + strconv.Itoa(plan.Limit) + ")\n")
+		} else {
+			sb.WriteString("→ Sort (" + plan.OrderBy + " " + direction + ")\n")
+		}
+		indent++
+	}
+
+	if plan.GroupBy != "" {
+		sb.WriteString(strings.Repeat("  ", indent))
+		sb.WriteString("→ GroupBy (" + plan.GroupBy + ", " + plan.AggFunc + ")\n")
+		indent++
+	} else if plan.AggFunc != "" {
+		sb.WriteString(strings.Repeat("  ", indent))
+		sb.WriteString("→ Aggregate (" + plan.AggFunc + ")\n")
+		indent++
+	}
+
+	if plan.Distinct != "" {
+		sb.WriteString(strings.Repeat("  ", indent))
+		sb.WriteString("→ Distinct (" + plan.Distinct + ")\n")
+		indent++
+	}
+
 	for i := len(plan.Filters) - 1; i >= 0; i-- {
 		f := plan.Filters[i]
 		sb.WriteString(strings.Repeat("  ", indent))
@@ -162,14 +377,129 @@ func PrintQueryPlan(plan *QueryPlan) string {
 		indent++
 	}
 
+	in_db := ""
+	if plan.DB > 0 {
+		in_db = " in db " + strconv.Itoa(plan.DB)
+	}
 	sb.WriteString(strings.Repeat("  ", indent))
-	sb.WriteString("→ KVScan\n")
+	if plan.Source != "" {
+		sb.WriteString("→ FileScan (" + plan.Source + ", key=" + plan.KeyCol + ", value=" + plan.ValueCol + ")\n")
+	} else if plan.ZSet != "" {
+		sb.WriteString("→ ZScan (" + plan.ZSet + in_db + ", score " + format_score(plan.ScoreMin) + " to " + format_score(plan.ScoreMax) + ")\n")
+	} else if plan.AsOf && !plan.AsOfTime.IsZero() {
+		sb.WriteString("→ HistoryScan" + in_db + " (as of " + plan.AsOfTime.Format(time.RFC3339Nano) + ")\n")
+	} else if plan.AsOf {
+		sb.WriteString("→ HistoryScan" + in_db + " (as of LSN " + strconv.FormatUint(plan.AsOfLSN, 10) + ")\n")
+	} else {
+		sb.WriteString("→ KVScan" + in_db + "\n")
+	}
+
+	return sb.String()
+}
+
+// InsertPlan is an INSERT ... SCAN, the rows of the query are written back into the store
+// KeyCol and ValueCol say which column of each row becomes the new key and value
+type InsertPlan struct {
+	KeyCol   string // "KEY" or "VALUE"
+	ValueCol string // "KEY" or "VALUE"
+	TTL      time.Duration
+	Query    *QueryPlan
+}
+
+// ParseInsert parses INSERT <key column> <value column> [ttl] SCAN ...
+func ParseInsert(parts []string) (*InsertPlan, error) {
+	if len(parts) < 4 {
+		return nil, errors.New("INSERT requires: key_column value_column [ttl] SCAN ...")
+	}
+
+	plan := &InsertPlan{
+		KeyCol:   strings.ToUpper(parts[1]),
+		ValueCol: strings.ToUpper(parts[2]),
+	}
+	for _, col := range []string{plan.KeyCol, plan.ValueCol} {
+		if col != "KEY" && col != "VALUE" {
+			return nil, errors.New("INSERT columns must be KEY or VALUE, got: " + col)
+		}
+	}
 
+	rest := parts[3:]
+	if strings.ToUpper(rest[0]) != "SCAN" {
+		ttl, err := parse_ttl(rest[0])
+		if err != nil {
+			return nil, err
+		}
+		plan.TTL = ttl
+		rest = rest[1:]
+	}
+	if len(rest) == 0 || strings.ToUpper(rest[0]) != "SCAN" {
+		return nil, errors.New("INSERT requires a SCAN query")
+	}
+
+	query, err := ParseQuery(rest)
+	if err != nil {
+		return nil, err
+	}
+	plan.Query = query
+	return plan, nil
+}
+
+// PrintInsertPlan prints the query plan with the insert sink on top
+func PrintInsertPlan(plan *InsertPlan) string {
+	sink := "→ Insert (key=" + plan.KeyCol + ", value=" + plan.ValueCol
+	if plan.TTL > 0 {
+		sink += ", ttl=" + plan.TTL.String()
+	}
+	sink += ")\n"
+
+	query := PrintQueryPlan(plan.Query)
+	header_end := strings.Index(query, "→")
+	var sb strings.Builder
+	sb.WriteString(query[:header_end])
+	sb.WriteString(sink)
+	for _, line := range strings.SplitAfter(query[header_end:], "\n") {
+		if line != "" {
+			sb.WriteString("  " + line)
+		}
+	}
 	return sb.String()
 }
 
+// ExecuteInsert drains the operator tree and writes every row into the store, in the SELECTed database
+// the pipeline is drained and closed before the first write. KVScan only holds the
+// read lock while Open copies its View, so no lock of the query's is held by the time
+// the writes take the write lock, and the rows inserted never turn up in the scan
+func ExecuteInsert(store *Store, op Operator, plan *InsertPlan) (int, error) {
+	rows, err := ExecuteQuery(op)
+	if err != nil {
+		return 0, err
+	}
+
+	column := func(r *Row, col string) string {
+		if col == "KEY" {
+			return r.Key.name
+		}
+		return r.Value.data
+	}
+
+	inserted := 0
+	for _, r := range rows {
+		k := column(r, plan.KeyCol)
+		if k == "" {
+			continue // nothing to key the row by
+		}
+		if err := store.Set(store.shell_key(k), plan.TTL, column(r, plan.ValueCol)); err != nil {
+			return inserted, err
+		}
+		inserted++
+	}
+	return inserted, nil
+}
+
 // ExecuteQuery runs the operator tree and collects results
 func ExecuteQuery(op Operator) ([]*Row, error) {
+	query_total.Inc()
+	defer func(start time.Time) { query_seconds.Observe(time.Since(start).Seconds()) }(time.Now())
+
 	if err := op.Open(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// INSERT ... SCAN, see executor.go
+
+// insert runs q, a shell INSERT, against s
+func insert(t *testing.T, s *Store, q string) int {
+	t.Helper()
+	plan, err := ParseInsert(strings.Fields(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := ExecuteInsert(s, BuildOperatorTree(s, plan.Query), plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// the query's rows go back into the store keyed and valued by the columns named, with
+// the ttl if there is one, and none of them turn up in the scan that made them
+func TestInsert(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "alice")
+	set(t, s, "user:2", "bob")
+	if n := insert(t, s, "INSERT VALUE KEY SCAN WHERE key LIKE user:*"); n != 2 {
+		t.Errorf("inserted %d rows, want 2", n)
+	}
+	if got := get(t, s, "alice"); got != "user:1" {
+		t.Errorf("alice = %q", got)
+	}
+	if n := insert(t, s, "INSERT KEY VALUE 1h SCAN"); n != 4 {
+		t.Errorf("inserted %d rows over the whole store, want 4", n)
+	}
+	if _, ttl, _, err := s.Ttl(key{name: "bob"}); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("bob's ttl after INSERT with 1h: %v %v", ttl, err)
+	}
+
+	//a file's rows, the ones with no key skipped
+	path := filepath.Join(t.TempDir(), "users.csv")
+	os.WriteFile(path, []byte("id,name\nu1,carol\n,nobody\n"), 0o644)
+	if n := insert(t, s, "INSERT KEY VALUE SCAN FROM "+path+" MAP id name"); n != 1 {
+		t.Errorf("inserted %d rows from the file, want 1", n)
+	}
+	if got := get(t, s, "u1"); got != "carol" {
+		t.Errorf("u1 = %q", got)
+	}
+
+	for _, q := range []string{"INSERT KEY SCAN", "INSERT KEY ROW SCAN", "INSERT KEY VALUE 1h", "INSERT KEY VALUE soon SCAN"} {
+		if _, err := ParseInsert(strings.Fields(q)); err == nil {
+			t.Errorf("%q parsed", q)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// active expiry: Get only hides an expired key, so a key nobody reads again would
+// sit in s.data forever. the sweeper does what Redis does: every ExpireInterval it
+// looks at ExpireSample keys, deletes the expired ones (logging a DELETE for each, so
+// replay doesn't bring them back just to drop them), and goes again straight away
+// while more than a quarter of the sample had expired, up to a quarter of the interval
+//
+// map iteration starts at a random place, which is all the randomness the sample needs
+//
+// with Options.ExpireOnRead reads don't only hide the expired keys they come across,
+// they hand them to the sweeper to delete (and log) straight away, instead of waiting
+// for a sample to hit them. the read itself can't: Get holds no store lock and the
+// rest only the read lock, and waiting for the write lock would hold a read up behind
+// every writer. so the key goes on a queue the sweeper drains between samples. a full
+// queue drops it, the sampling gets to it in the end
+
+// defaults for Options.ExpireInterval and Options.ExpireSample
+const (
+	default_expire_interval = 100 * time.Millisecond
+	default_expire_sample   = 20
+)
+
+// how many expired keys reads can queue for the sweeper, and how many it deletes under one lock
+const (
+	expired_reads_queue = 1024
+	expired_reads_batch = 64
+)
+
+// expire deletes k, whose value is val, if it has expired by now, logging a DELETE,
+// and returns the DELETE's ack and whether it did
+// frozen keys are left alone, a freeze means no writes, not even this one
+// Caller must hold s.lock
+func (s *Store) expire(k key, val value, now time.Time) (<-chan error, bool) {
+	if val.expires_at.IsZero() || val.expires_at.After(now) || s.check_frozen(k) != nil {
+		return nil, false
+	}
+	rec := wal_record{lsn: s.next_lsn(), op: DELETE, key: k.name, db: k.db}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		log.Printf("WARNING: expiring %s: %v\n", k.name, err)
+		return nil, false
+	}
+	s.drop(k)
+	s.announce(rec)
+	return ack, true
+}
+
+// wait_expired waits for the DELETEs of expired keys, outside the lock: with group commit they are only queued
+func wait_expired(acks []<-chan error) {
+	for _, ack := range acks {
+		if err := <-ack; err != nil {
+			log.Printf("WARNING: logging an expired key's DELETE: %v\n", err)
+		}
+	}
+	expired_keys_total.Add(uint64(len(acks)))
+}
+
+// expire_sample deletes the expired keys among `sample` keys of the map and
+// returns how many it looked at and how many it deleted
+func (s *Store) expire_sample(sample int) (int, int) {
+	s.lock.Lock()
+	//Close closes s.stop before it takes the lock, so this can't race with the WAL closing
+	select {
+	case <-s.stop:
+		s.lock.Unlock()
+		return 0, 0
+	default:
+	}
+	now := time.Now()
+	seen := 0
+	var acks []<-chan error
+	s.data.each(s.data.random_shard(), func(k key, val value) bool {
+		if seen == sample {
+			return false
+		}
+		seen++
+		if ack, ok := s.expire(k, val, now); ok {
+			acks = append(acks, ack)
+		}
+		return true
+	})
+	s.lock.Unlock()
+
+	wait_expired(acks)
+	return seen, len(acks)
+}
+
+// found_expired queues k, which a read found expired, for the sweeper to delete, with
+// Options.ExpireOnRead. it never blocks, see above
+func (s *Store) found_expired(k key) {
+	if s.expired_reads == nil {
+		return
+	}
+	select {
+	case s.expired_reads <- k:
+	default:
+	}
+}
+
+// expire_reads deletes the keys reads found expired, first and whatever else is queued
+// up to a batch. a key written since it was queued has a new expiry, or none, and stays
+func (s *Store) expire_reads(first key) {
+	keys := []key{first}
+drain:
+	for len(keys) < expired_reads_batch {
+		select {
+		case k := <-s.expired_reads:
+			keys = append(keys, k)
+		default:
+			break drain
+		}
+	}
+
+	s.lock.Lock()
+	select {
+	case <-s.stop:
+		s.lock.Unlock()
+		return
+	default:
+	}
+	now := time.Now()
+	var acks []<-chan error
+	for _, k := range keys {
+		if val, exists := s.data.get(k); exists {
+			if ack, ok := s.expire(k, val, now); ok {
+				acks = append(acks, ack)
+			}
+		}
+	}
+	s.lock.Unlock()
+
+	wait_expired(acks)
+}
+
+// sweep_expired is one sweeper cycle
+func (s *Store) sweep_expired(sample int, budget time.Duration) {
+	start := time.Now()
+	for {
+		seen, expired := s.expire_sample(sample)
+		if seen == 0 || expired*4 <= seen || time.Since(start) > budget {
+			return
+		}
+	}
+}
+
+// sweep_expired_every runs the sweeper until Close, a negative interval only drains what reads queue
+func (s *Store) sweep_expired_every(interval time.Duration, sample int) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			s.sweep_expired(sample, interval/4)
+		case k := <-s.expired_reads:
+			s.expire_reads(k)
+		case <-s.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the expiry sweeper, see expire.go, and EXPIRE with its conditions
+
+// expired_left waits up to a second for the keys in s.data to come down to n
+func expired_left(t *testing.T, s *Store, n int) int {
+	t.Helper()
+	left := func() int {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		return s.data.len()
+	}
+	deadline := time.Now().Add(time.Second)
+	for left() > n && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	return left()
+}
+
+// the sweeper deletes expired keys nobody reads, logging a DELETE for each, and
+// leaves the rest and the frozen ones alone
+func TestSweeper(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := New_Store(path, Options{ExpireInterval: 5 * time.Millisecond, ExpireSample: 10})
+	for i := range 100 {
+		s.Set(key{name: "tmp:" + strconv.Itoa(i)}, 20*time.Millisecond, "x")
+	}
+	for i := range 10 {
+		set(t, s, "keep:"+strconv.Itoa(i), "x")
+	}
+	s.Set(key{name: "frozen:1"}, 20*time.Millisecond, "x")
+	s.Freeze("frozen", time.Hour)
+	if got := expired_left(t, s, 11); got != 11 {
+		t.Fatalf("%d keys left a second on, want the 10 without a ttl and the frozen one", got)
+	}
+	deletes := strings.Count(entries(t, s, 0), "DELETE tmp:")
+	s.Close()
+	if deletes != 100 {
+		t.Errorf("%d DELETEs logged for 100 expired keys", deletes)
+	}
+
+	//only the frozen key is left to drop on replay, freezes don't outlive the store
+	s, report, err := Recover("", path, Options{ExpireInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.KeysRestored != 10 || report.Expired != 1 {
+		t.Errorf("report %+v", report)
+	}
+}
+
+// a negative ExpireInterval turns the sweeper off, expired keys stay in the map but
+// reads don't see them
+func TestSweeperOff(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	s.Set(key{name: "a"}, time.Millisecond, "x")
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := s.Get(key{name: "a"}); s.data.len() != 1 || ok {
+		t.Errorf("%d keys in the map, a read %v", s.data.len(), ok)
+	}
+}
+
+// with ExpireOnRead the reads that find expired keys have them deleted and logged,
+// sampling or not, and a key written again after it was found stays
+func TestExpireOnRead(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1, ExpireOnRead: true})
+	defer s.Close()
+	for i := range 10 {
+		s.Set(key{name: "tmp:" + strconv.Itoa(i)}, time.Millisecond, "x")
+	}
+	set(t, s, "keep", "x")
+	time.Sleep(5 * time.Millisecond)
+	for i := range 5 {
+		s.Get(key{name: "tmp:" + strconv.Itoa(i)})
+	}
+	s.Ttl(key{name: "tmp:5"})
+	s.GetWithVersion(key{name: "tmp:6"})
+	if got := expired_left(t, s, 4); got != 4 {
+		t.Errorf("%d keys left, want keep and the 3 nobody read", got)
+	}
+	if deletes := strings.Count(entries(t, s, 0), "DELETE tmp:"); deletes != 7 {
+		t.Errorf("%d DELETEs logged for 7 expired keys read", deletes)
+	}
+
+	s.Set(key{name: "back"}, time.Millisecond, "x")
+	time.Sleep(5 * time.Millisecond)
+	set(t, s, "back", "again")
+	s.expire_reads(key{name: "back"})
+	if get(t, s, "back") != "again" {
+		t.Error("a key written after it was found expired was deleted")
+	}
+}
+
+// EXPIRE's NX, XX, GT and LT, a key without an expiry counting as expiring later than
+// any ttl; a condition that doesn't hold leaves the key and the WAL alone
+func TestExpireOpts(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for _, tc := range []struct {
+		name string // p doesn't expire, t expires in an hour
+		ttl  time.Duration
+		opts ExpireOptions
+		set  bool
+	}{
+		{"p", time.Minute, ExpireOptions{}, true},
+		{"p", time.Minute, ExpireOptions{NX: true}, true},
+		{"t", time.Minute, ExpireOptions{NX: true}, false},
+		{"p", time.Minute, ExpireOptions{XX: true}, false},
+		{"t", time.Minute, ExpireOptions{XX: true}, true},
+		{"p", time.Minute, ExpireOptions{GT: true}, false},
+		{"t", time.Minute, ExpireOptions{GT: true}, false},
+		{"t", 2 * time.Hour, ExpireOptions{GT: true}, true},
+		{"p", time.Minute, ExpireOptions{LT: true}, true},
+		{"t", time.Minute, ExpireOptions{LT: true}, true},
+		{"t", 2 * time.Hour, ExpireOptions{LT: true}, false},
+		{"t", 2 * time.Hour, ExpireOptions{XX: true, GT: true}, true},
+	} {
+		set(t, s, "p", "v")
+		s.Set(key{name: "t"}, time.Hour, "v")
+		_, before, _, _ := s.Ttl(key{name: tc.name})
+		last := s.LastLSN()
+		ok, err := s.ExpireOpts(key{name: tc.name}, tc.ttl, tc.opts)
+		_, after, _, _ := s.Ttl(key{name: tc.name})
+		if ok != tc.set || err != nil {
+			t.Errorf("EXPIRE %s %v %+v: %v %v, want %v", tc.name, tc.ttl, tc.opts, ok, err, tc.set)
+		}
+		if tc.set && (after > tc.ttl || after < tc.ttl-time.Second || s.LastLSN() != last+1) {
+			t.Errorf("EXPIRE %s %v %+v left %v, %d records logged", tc.name, tc.ttl, tc.opts, after, s.LastLSN()-last)
+		}
+		if !tc.set && (after > before || after < before-time.Second || s.LastLSN() != last) {
+			t.Errorf("EXPIRE %s %v %+v changed the ttl from %v to %v, %d records logged", tc.name, tc.ttl, tc.opts, before, after, s.LastLSN()-last)
+		}
+	}
+
+	for _, opts := range []ExpireOptions{{NX: true, XX: true}, {NX: true, GT: true}, {GT: true, LT: true}} {
+		if _, err := s.ExpireOpts(key{name: "t"}, time.Minute, opts); err == nil {
+			t.Errorf("%+v together", opts)
+		}
+	}
+	if _, err := s.ExpireOpts(key{name: "missing"}, time.Minute, ExpireOptions{}); err != ErrKeyNotFound {
+		t.Errorf("EXPIRE of a missing key: %v", err)
+	}
+	if err := s.Process(strings.Fields("EXPIRE t 1m SOON")); err == nil {
+		t.Error("EXPIRE with a flag it doesn't take")
+	}
+	if err := s.Process(strings.Fields("EXPIRE t 3h gt")); err != nil {
+		t.Error(err)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "t"}); ttl <= 2*time.Hour {
+		t.Errorf("EXPIRE t 3h gt left %v", ttl)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// read-only freezes, see freeze.go
+
+// a frozen namespace turns its writes away and no other's, reads carry on, and the
+// freeze lifts when Unfreeze or its time says so
+func TestFreeze(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "a")
+
+	s.Freeze("user", time.Hour)
+	var frozen *FrozenError
+	if err := s.Set(key{name: "user:1"}, 0, "b"); !errors.As(err, &frozen) || frozen.Namespace != "user" {
+		t.Errorf("a write to a frozen namespace: %v", err)
+	}
+	if _, err := s.Append(key{name: "user:2"}, "b"); !errors.As(err, &frozen) {
+		t.Errorf("an APPEND to a frozen namespace: %v", err)
+	}
+	if err := s.Delete(key{name: "user:1"}); !errors.As(err, &frozen) {
+		t.Errorf("a delete in a frozen namespace: %v", err)
+	}
+	if get(t, s, "user:1") != "a" {
+		t.Error("a read in a frozen namespace")
+	}
+	set(t, s, "order:1", "x")
+	set(t, s, "plain", "x")
+	s.Unfreeze("user")
+	set(t, s, "user:1", "b")
+
+	s.Freeze("", 20*time.Millisecond)
+	if err := s.Set(key{name: "plain"}, 0, "y"); !errors.As(err, &frozen) || frozen.Namespace != "" {
+		t.Errorf("a write with the store frozen: %v", err)
+	}
+	tx := s.Begin()
+	tx.Set(key{name: "order:2"}, 0, "y")
+	if err := tx.Commit(); !errors.As(err, &frozen) {
+		t.Errorf("a transaction with the store frozen: %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	set(t, s, "plain", "y")
+}
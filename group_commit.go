@@ -0,0 +1,324 @@
+package main
+
+import (
+	"log"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// group commit: instead of every writer paying for its own fsync,
+// writers queue their records and a single flusher goroutine writes
+// whatever has piled up and fsyncs once for the whole batch.
+// while one fsync is in flight the next batch keeps growing, so the
+// number of fsyncs drops as concurrency goes up
+//
+//	writer ─┐
+//	writer ─┼─► queue ─► flusher: write batch, Sync() once ─► wake every writer in the batch
+//	writer ─┘
+//
+// on top of that the flusher can hold a batch open for a short window
+// to let more writers in (it closes early once the batch is as big as the
+// last one, i.e. everyone who was waiting is back). the window is adaptive:
+// every few batches the controller compares throughput with the previous
+// epoch and keeps moving the window the same way if it helped, the other
+// way if it didn't. the p99 commit latency (enqueue → durable) is a hard
+// cap: if it goes over the target the window halves straight away
+
+// upper bound on records per batch, keeps a single fsync from covering too much
+const max_group_commit_batch = 1024
+
+// default p99 commit latency the window controller aims for
+const default_group_commit_target = 5 * time.Millisecond
+
+// how many recent latencies the controller looks at
+const group_commit_samples = 128
+
+// batches per controller epoch
+const group_commit_epoch = 16
+
+// smallest non-zero window
+const min_group_commit_window = 50 * time.Microsecond
+
+type commit_request struct {
+	rec     wal_record
+	batch   []wal_record // records that go in together instead of rec, see enqueue_batch
+	barrier bool         // no record, just wait for everything queued before it
+	queued  time.Time
+	done    chan error
+}
+
+// GroupCommitStats shows what the window controller is doing
+type GroupCommitStats struct {
+	Target        time.Duration // p99 commit latency the controller aims for
+	Window        time.Duration // how long a batch is currently held open
+	FlushP99      time.Duration // p99 of recent batch write+fsync times
+	CommitP99     time.Duration // p99 of recent enqueue → durable latencies
+	Throughput    float64       // records per second over the last epoch
+	Batches       uint64
+	Records       uint64
+	WindowGrows   uint64
+	WindowShrinks uint64
+}
+
+type group_committer struct {
+	w       *wal
+	queue   chan commit_request
+	target  time.Duration
+	stopped chan struct{} // closed when run returns
+
+	stats_lock sync.Mutex
+	stats      GroupCommitStats
+	flushes    []time.Duration // ring of recent flush times
+	commits    []time.Duration // ring of recent commit latencies
+	last_batch int
+
+	epoch_start   time.Time
+	epoch_batches int
+	epoch_records int
+	growing       bool // direction the window is currently being moved
+
+	//done hears how each batch went, for the store to undo the writes of one that
+	//failed, see undo.go. set before the first record is queued
+	done func(records []wal_record, err error)
+
+	//once a batch fails whatever was queued behind it fails too, unwritten, and no more
+	//records are taken until repair: the writes after a failed one may depend on it
+	broken_lock sync.Mutex
+	broken      error
+}
+
+func new_group_committer(w *wal, target time.Duration) *group_committer {
+	if target <= 0 {
+		target = default_group_commit_target
+	}
+	gc := &group_committer{
+		w:      w,
+		queue:  make(chan commit_request, max_group_commit_batch),
+		target: target,
+
+		stopped: make(chan struct{}),
+	}
+	gc.stats.Target = target
+	gc.epoch_start = time.Now()
+	gc.growing = true
+	w.res.start("group commit", gc.run)
+	return gc
+}
+
+// enqueue hands rec to the flusher and returns a channel that gets its batch's result
+// records are written in the order they are enqueued
+// the queue is bounded, so enqueue blocks when the flusher falls that far behind
+func (gc *group_committer) enqueue(rec wal_record) <-chan error {
+	done := make(chan error, 1)
+	gc.queue <- commit_request{rec: rec, queued: time.Now(), done: done}
+	return done
+}
+
+// enqueue_batch is enqueue for records that must not be split across batches,
+// a transaction's BEGIN, writes and COMMIT
+func (gc *group_committer) enqueue_batch(records []wal_record) <-chan error {
+	done := make(chan error, 1)
+	gc.queue <- commit_request{batch: records, queued: time.Now(), done: done}
+	return done
+}
+
+// barrier waits until every record enqueued before it is durable
+func (gc *group_committer) barrier() error {
+	done := make(chan error, 1)
+	gc.queue <- commit_request{barrier: true, queued: time.Now(), done: done}
+	return <-done
+}
+
+// failed is the error of the batch that broke the committer, nil if it takes records
+func (gc *group_committer) failed() error {
+	gc.broken_lock.Lock()
+	defer gc.broken_lock.Unlock()
+	return gc.broken
+}
+
+// repair takes records again after a failed batch, once the store has undone it
+func (gc *group_committer) repair() {
+	gc.broken_lock.Lock()
+	gc.broken = nil
+	gc.broken_lock.Unlock()
+}
+
+// close stops accepting records and waits for the queue to drain
+func (gc *group_committer) close() {
+	close(gc.queue)
+	<-gc.stopped
+}
+
+func (gc *group_committer) run() {
+	defer close(gc.stopped)
+
+	for req := range gc.queue {
+		batch := gc.collect(req)
+
+		records := make([]wal_record, 0, len(batch))
+		for _, r := range batch {
+			switch {
+			case r.batch != nil:
+				records = append(records, r.batch...)
+			case !r.barrier:
+				records = append(records, r.rec)
+			}
+		}
+
+		err := gc.failed()
+		var flush time.Duration
+		if len(records) > 0 && err == nil {
+			start := time.Now()
+			gc.w.wal_lock.Lock()
+			err = gc.w.write_records(records)
+			gc.w.wal_lock.Unlock()
+			flush = time.Since(start)
+			//in async mode nobody may be waiting to hear about it
+			if err != nil {
+				log.Printf("ERROR: WAL write of %d records failed: %v\n", len(records), err)
+				gc.broken_lock.Lock()
+				gc.broken = err
+				gc.broken_lock.Unlock()
+			}
+		}
+		if gc.done != nil && len(records) > 0 {
+			gc.done(records, err)
+		}
+
+		done := time.Now()
+		for _, r := range batch {
+			r.done <- err
+		}
+		gc.observe(batch, len(records), flush, done)
+	}
+}
+
+// collect builds a batch starting with `first`, holding it open for the current window
+func (gc *group_committer) collect(first commit_request) []commit_request {
+	batch := []commit_request{first}
+
+	//writers that were just woken by the previous batch are about to
+	//enqueue again, give them a chance to make it into this one
+	runtime.Gosched()
+
+	window, last_batch := gc.window()
+	if window <= 0 {
+		for len(batch) < max_group_commit_batch {
+			select {
+			case next, ok := <-gc.queue:
+				if !ok {
+					return batch
+				}
+				batch = append(batch, next)
+			default:
+				return batch
+			}
+		}
+		return batch
+	}
+
+	timer := time.NewTimer(window)
+	defer timer.Stop()
+	for len(batch) < max_group_commit_batch && len(batch) < max(last_batch, 2) {
+		select {
+		case next, ok := <-gc.queue:
+			if !ok {
+				return batch
+			}
+			batch = append(batch, next)
+		case <-timer.C:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (gc *group_committer) window() (time.Duration, int) {
+	gc.stats_lock.Lock()
+	defer gc.stats_lock.Unlock()
+	return gc.stats.Window, gc.last_batch
+}
+
+// observe records the batch's latencies and adjusts the window
+func (gc *group_committer) observe(batch []commit_request, records int, flush time.Duration, done time.Time) {
+	gc.stats_lock.Lock()
+	defer gc.stats_lock.Unlock()
+
+	gc.stats.Batches++
+	gc.stats.Records += uint64(records)
+	if records > 0 {
+		gc.flushes = push_sample(gc.flushes, flush)
+	}
+	for _, r := range batch {
+		gc.commits = push_sample(gc.commits, done.Sub(r.queued))
+	}
+
+	gc.stats.FlushP99 = p99(gc.flushes)
+	gc.stats.CommitP99 = p99(gc.commits)
+
+	gc.last_batch = len(batch)
+
+	//latency cap first: over target, back off hard right away
+	if gc.stats.CommitP99 > gc.target {
+		gc.shrink()
+		gc.growing = false
+		return
+	}
+
+	gc.epoch_batches++
+	gc.epoch_records += records
+	if gc.epoch_batches < group_commit_epoch {
+		return
+	}
+
+	//end of epoch: hill climb on throughput
+	throughput := float64(gc.epoch_records) / time.Since(gc.epoch_start).Seconds()
+	if throughput < gc.stats.Throughput*0.95 {
+		gc.growing = !gc.growing
+	}
+	gc.stats.Throughput = throughput
+	gc.epoch_start, gc.epoch_batches, gc.epoch_records = time.Now(), 0, 0
+
+	if gc.growing && gc.stats.Window+gc.stats.FlushP99 < gc.target {
+		gc.stats.Window = min(max(gc.stats.Window*2, min_group_commit_window), gc.target-gc.stats.FlushP99)
+		gc.stats.WindowGrows++
+	} else if !gc.growing {
+		gc.shrink()
+	}
+}
+
+// caller must hold gc.stats_lock
+func (gc *group_committer) shrink() {
+	if gc.stats.Window == 0 {
+		return
+	}
+	gc.stats.Window /= 2
+	if gc.stats.Window < min_group_commit_window {
+		gc.stats.Window = 0
+	}
+	gc.stats.WindowShrinks++
+}
+
+func (gc *group_committer) snapshot() GroupCommitStats {
+	gc.stats_lock.Lock()
+	defer gc.stats_lock.Unlock()
+	return gc.stats
+}
+
+func push_sample(samples []time.Duration, d time.Duration) []time.Duration {
+	if len(samples) == group_commit_samples {
+		samples = samples[1:]
+	}
+	return append(samples, d)
+}
+
+func p99(samples []time.Duration) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)-1)*99/100]
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the group commit window controller, see group_commit.go. observe is fed made up
+// batches, with the epoch's start moved back a second so its throughput is its records
+
+// epoch runs a whole epoch of batches of n records, each committed in commit and
+// flushed in flush
+func epoch(gc *group_committer, n int, commit, flush time.Duration) {
+	gc.epoch_start = time.Now().Add(-time.Second)
+	for range group_commit_epoch {
+		done := time.Now()
+		batch := make([]commit_request, n)
+		for i := range batch {
+			batch[i].queued = done.Add(-commit)
+		}
+		gc.observe(batch, n, flush, done)
+	}
+}
+
+func new_controller(target time.Duration) *group_committer {
+	gc := &group_committer{target: target, growing: true}
+	gc.stats.Target = target
+	return gc
+}
+
+// the window opens while throughput goes up or holds, turns back when it drops, and
+// never goes past the target less the time a flush takes
+func TestGroupCommitWindow(t *testing.T) {
+	gc := new_controller(5 * time.Millisecond)
+	var windows []time.Duration
+	for _, n := range []int{10, 10, 10, 5, 5} {
+		epoch(gc, n, time.Millisecond, time.Millisecond)
+		windows = append(windows, gc.snapshot().Window)
+	}
+	want := []time.Duration{min_group_commit_window, 2 * min_group_commit_window, 4 * min_group_commit_window, 2 * min_group_commit_window, min_group_commit_window}
+	for i := range want {
+		if windows[i] != want[i] {
+			t.Fatalf("windows %v, want %v", windows, want)
+		}
+	}
+	if stats := gc.snapshot(); stats.WindowGrows != 3 || stats.WindowShrinks != 2 || stats.Batches != 5*group_commit_epoch {
+		t.Errorf("stats %+v", stats)
+	}
+
+	gc = new_controller(5 * time.Millisecond)
+	for range 20 {
+		epoch(gc, 10, time.Millisecond, 4900*time.Microsecond)
+	}
+	if window := gc.snapshot().Window; window != 100*time.Microsecond {
+		t.Errorf("window %v with flushes of 4.9ms under a 5ms target", window)
+	}
+}
+
+// a p99 commit latency over the target halves the window straight away, down to none
+func TestGroupCommitLatencyCap(t *testing.T) {
+	gc := new_controller(5 * time.Millisecond)
+	gc.stats.Window = 4 * min_group_commit_window
+	var windows []time.Duration
+	for range 4 {
+		done := time.Now()
+		gc.observe([]commit_request{{queued: done.Add(-10 * time.Millisecond)}}, 1, time.Millisecond, done)
+		windows = append(windows, gc.snapshot().Window)
+	}
+	want := []time.Duration{2 * min_group_commit_window, min_group_commit_window, 0, 0}
+	for i := range want {
+		if windows[i] != want[i] {
+			t.Fatalf("windows %v, want %v", windows, want)
+		}
+	}
+	if stats := gc.snapshot(); stats.CommitP99 != 10*time.Millisecond || stats.WindowShrinks != 3 {
+		t.Errorf("stats %+v", stats)
+	}
+}
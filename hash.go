@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+// hashes: a key that maps fields to values, so changing one field of a record
+// doesn't mean rewriting (and logging) the whole thing. HSET logs only the fields
+// it sets and HDEL only the fields it removes, see types.go for the rest
+
+type hash_object struct {
+	fields map[string]string
+	bytes  int64
+}
+
+func (h *hash_object) kind() string { return "hash" }
+func (h *hash_object) len() int     { return len(h.fields) }
+func (h *hash_object) size() int64  { return h.bytes }
+
+// members is field, value, field, value ... sorted by field so a dump is always the same
+func (h *hash_object) members() []string {
+	names := h.names()
+	args := make([]string, 0, 2*len(names))
+	for _, f := range names {
+		args = append(args, f, h.fields[f])
+	}
+	return args
+}
+
+func (h *hash_object) names() []string {
+	names := make([]string, 0, len(h.fields))
+	for f := range h.fields {
+		names = append(names, f)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (h *hash_object) apply(op operation_type, args []string) error {
+	switch op {
+	case HSET, RESTORE:
+		if len(args)%2 != 0 {
+			return errors.New(op.String() + " record has a field without a value")
+		}
+		for i := 0; i < len(args); i += 2 {
+			h.del(args[i])
+			h.fields[args[i]] = args[i+1]
+			h.bytes += int64(len(args[i])+len(args[i+1])) + element_overhead
+		}
+	case HDEL:
+		for _, f := range args {
+			h.del(f)
+		}
+	default:
+		return errors.New(op.String() + " is not a hash operation")
+	}
+	return nil
+}
+
+func (h *hash_object) del(f string) {
+	if v, ok := h.fields[f]; ok {
+		h.bytes -= int64(len(f)+len(v)) + element_overhead
+		delete(h.fields, f)
+	}
+}
+
+// HSet sets fields of the hash at k, creating it if needed, and returns how many of them are new
+func (s *Store) HSet(k key, fields map[string]string) (int, error) {
+	if len(fields) == 0 {
+		return 0, errors.New("HSET needs at least one field")
+	}
+	added := 0
+	err := s.write_object(k, "hash", HSET, func(obj object) ([]string, error) {
+		set := &hash_object{fields: fields}
+		args := set.members()
+		for _, f := range set.names() {
+			if obj == nil {
+				added++
+			} else if _, ok := obj.(*hash_object).fields[f]; !ok {
+				added++
+			}
+		}
+		return args, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// HGet returns one field of the hash at k
+func (s *Store) HGet(k key, field string) (string, bool, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "hash")
+	if obj == nil {
+		return "", false, err
+	}
+	v, ok := obj.(*hash_object).fields[field]
+	return v, ok, nil
+}
+
+// HDel removes fields from the hash at k and returns how many were there
+// the hash goes when its last field does
+func (s *Store) HDel(k key, fields ...string) (int, error) {
+	removed := 0
+	err := s.write_object(k, "hash", HDEL, func(obj object) ([]string, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		var args []string
+		seen := make(map[string]bool)
+		for _, f := range fields {
+			if _, ok := obj.(*hash_object).fields[f]; ok && !seen[f] {
+				args = append(args, f)
+				seen[f] = true
+				removed++
+			}
+		}
+		return args, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// HGetAll returns a copy of the hash at k, empty if k is missing
+func (s *Store) HGetAll(k key) (map[string]string, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "hash")
+	all := make(map[string]string)
+	if obj == nil {
+		return all, err
+	}
+	for f, v := range obj.(*hash_object).fields {
+		all[f] = v
+	}
+	return all, nil
+}
+
+// HSET key field value [field value ...], HGET key field, HDEL key field [field ...], HGETALL key
+func (s *Store) process_hash(cmd string, input_parts []string) error {
+	switch cmd {
+	case "HSET":
+		if len(input_parts) < 4 || len(input_parts)%2 != 0 {
+			return errors.New("HSET command requires a key and field value pairs")
+		}
+		fields := make(map[string]string)
+		for i := 2; i < len(input_parts); i += 2 {
+			fields[input_parts[i]] = input_parts[i+1]
+		}
+		added, err := s.HSet(s.shell_key(input_parts[1]), fields)
+		if err != nil {
+			return err
+		}
+		log.Printf("Hash %s: %d fields added, %d updated\n", input_parts[1], added, len(fields)-added)
+
+	case "HGET":
+		if len(input_parts) != 3 {
+			return errors.New("HGET command requires a key and a field")
+		}
+		v, ok, err := s.HGet(s.shell_key(input_parts[1]), input_parts[2])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("field does not exist")
+		}
+		log.Printf("Value for %s %s: %s\n", input_parts[1], input_parts[2], v)
+
+	case "HDEL":
+		if len(input_parts) < 3 {
+			return errors.New("HDEL command requires a key and at least one field")
+		}
+		removed, err := s.HDel(s.shell_key(input_parts[1]), input_parts[2:]...)
+		if err != nil {
+			return err
+		}
+		log.Printf("Hash %s: %d fields removed\n", input_parts[1], removed)
+
+	case "HGETALL":
+		if len(input_parts) != 2 {
+			return errors.New("HGETALL command requires a key")
+		}
+		all, err := s.HGetAll(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		h := &hash_object{fields: all}
+		for _, f := range h.names() {
+			log.Printf("  %s: %s\n", f, all[f])
+		}
+		log.Printf("%d fields\n", len(all))
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hashes, see hash.go
+
+// HSET counts the fields it added, HDEL the ones it removed, the hash goes with its
+// last field, and only the fields that changed are logged
+func TestHash(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	h := key{name: "user:1"}
+	if n, err := s.HSet(h, map[string]string{"name": "ann", "city": "oslo"}); n != 2 || err != nil {
+		t.Errorf("HSET of 2 new fields: %d %v", n, err)
+	}
+	if n, _ := s.HSet(h, map[string]string{"city": "rome", "age": "30"}); n != 1 {
+		t.Errorf("HSET of a new field and an old one: %d", n)
+	}
+	if v, ok, err := s.HGet(h, "city"); v != "rome" || !ok || err != nil {
+		t.Errorf("HGET city: %q %v %v", v, ok, err)
+	}
+	if _, ok, _ := s.HGet(h, "email"); ok {
+		t.Error("HGET of a field that isn't there")
+	}
+	if n, _ := s.HDel(h, "age", "age", "email"); n != 1 {
+		t.Errorf("HDEL age age email: %d", n)
+	}
+	all, _ := s.HGetAll(h)
+	all["name"] = "changed"
+	if all, _ := s.HGetAll(h); !maps.Equal(all, map[string]string{"name": "ann", "city": "rome"}) {
+		t.Errorf("HGETALL: %v", all)
+	}
+	if _, err := s.HSet(h, nil); err == nil {
+		t.Error("HSET without fields")
+	}
+
+	set(t, s, "str", "x")
+	if _, err := s.HSet(key{name: "str"}, map[string]string{"f": "v"}); err != ErrWrongType {
+		t.Errorf("HSET on a string: %v", err)
+	}
+	s.HSet(key{name: "gone"}, map[string]string{"a": "1"})
+	s.HDel(key{name: "gone"}, "a")
+	if got := s.Type(key{name: "gone"}); got != "none" {
+		t.Errorf("a hash without fields is a %s", got)
+	}
+
+	var logged []string
+	s.ReplayFrom(0, func(e Entry) error {
+		if e.Key == h.name {
+			args, _ := decode_args(e.Value)
+			logged = append(logged, e.Op+" "+strings.Join(args, " "))
+		}
+		return nil
+	})
+	if got := strings.Join(logged, ", "); got != "HSET city oslo name ann, HSET age 30 city rome, HDEL age" {
+		t.Errorf("logged %s", got)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if all, _ := s.HGetAll(h); !maps.Equal(all, map[string]string{"name": "ann", "city": "rome"}) || s.Type(h) != "hash" {
+		t.Errorf("after a restart HGETALL: %v", all)
+	}
+}
+
+// a hash keeps its ttl through HSET and HDEL, and one that expired starts again empty
+func TestHashExpiry(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	s.HSet(key{name: "h"}, map[string]string{"a": "1", "b": "2"})
+	s.Expire(key{name: "h"}, time.Hour)
+	s.HSet(key{name: "h"}, map[string]string{"c": "3"})
+	s.HDel(key{name: "h"}, "a")
+	if _, ttl, _, _ := s.Ttl(key{name: "h"}); ttl <= 59*time.Minute {
+		t.Errorf("ttl after HSET and HDEL: %v", ttl)
+	}
+
+	s.HSet(key{name: "old"}, map[string]string{"a": "1"})
+	s.Expire(key{name: "old"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if n, _ := s.HSet(key{name: "old"}, map[string]string{"b": "2"}); n != 1 {
+		t.Errorf("HSET on an expired hash added %d", n)
+	}
+	if all, _ := s.HGetAll(key{name: "old"}); !maps.Equal(all, map[string]string{"b": "2"}) {
+		t.Errorf("the expired hash's fields came back: %v", all)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "old"}); ttl != 0 {
+		t.Errorf("the new hash has the old one's ttl: %v", ttl)
+	}
+	if ops := entries(t, s, 0); !strings.Contains(ops, "DELETE old, HSET old") {
+		t.Errorf("logged %s", ops)
+	}
+}
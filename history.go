@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// time travel: every logged write has an LSN and the time it was logged, so the store as
+// it was after any write the log still holds can be rebuilt by replaying the snapshot and
+// the log into a store of its own, as recovery would, and stopping there. GetAsOf reads
+// one key of it, a query with AS OF scans it (HistoryScan)
+//
+// it is only as far back as the log goes: a checkpoint or COMPACT drops the history before
+// it (see log_start), and segments only kept for the archiver aren't read, there is no
+// state to replay them onto. it is expensive too, every call replays the whole log up to
+// the point it asks for, with writers blocked as in ReplayFrom. soft deletes and expiries
+// are judged as recovery judges them, the rebuilt store only hides what had expired by then
+//
+// records written before they had a time, and the ones snapshots and COMPACT write, have
+// none. they all come before the records that do, so a time is only a point in the log
+// once there is a record after the last checkpoint or COMPACT that says when it was logged
+
+var errEndOfHistory = errors.New("end of history")
+
+// as_of rebuilds the store as of the last write with an LSN up to lsn, logged at or
+// before until if it isn't zero. it returns the rebuilt store and the moment it is as
+// of, for expiries: until, or when that write was logged, or now if the log doesn't say
+func (s *Store) as_of(lsn uint64, until time.Time) (*Store, time.Time, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.persistence.logs() {
+		return nil, time.Time{}, errors.New("time travel needs the WAL, persistence is " + s.persistence.String())
+	}
+	start, err := s.log_start()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if lsn < start {
+		return nil, time.Time{}, errors.New("LSN " + strconv.FormatUint(lsn, 10) + " is older than the log, it starts after " + strconv.FormatUint(start, 10))
+	}
+
+	//everything queued so far has to be readable from the segments
+	if err := s.wal.wait_pending(); err != nil {
+		return nil, time.Time{}, err
+	}
+	s.wal.wal_lock.Lock()
+	defer s.wal.wal_lock.Unlock()
+
+	//a store of its own on the same files, nothing it does writes to them
+	past := &Store{
+		data:        new_shard_map(1),
+		scan:        &scan_index{seed: maphash.MakeSeed()},
+		wal:         s.wal,
+		persistence: s.persistence,
+		key_codec:   s.key_codec,
+	}
+	from, err := past.load_snapshot(s.snapshot_path())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	//the snapshot is the state at the start of the log, or later
+	floor := max(start, past.last_lsn)
+	if lsn < floor {
+		return nil, time.Time{}, errors.New("LSN " + strconv.FormatUint(lsn, 10) + " is older than the snapshot, it covers up to " + strconv.FormatUint(floor, 10))
+	}
+
+	applied := past.last_lsn
+	lsns := lsn_counter{last: past.last_lsn}
+	var at time.Time
+	var txs tx_buffer
+	err = s.wal.for_each_record_after(from, applied, func(rec wal_record) error {
+		lsns.stamp(&rec)
+		if rec.lsn <= applied {
+			return nil
+		}
+		//LSN order is the order writes were logged in, the first one past the point ends it
+		if rec.lsn > lsn || (!until.IsZero() && rec.at.After(until)) {
+			return errEndOfHistory
+		}
+		applied = rec.lsn
+		if !rec.at.IsZero() {
+			at = rec.at
+		}
+		//a transaction is only applied if its COMMIT is before the point
+		return txs.feed(rec.op, rec.value, func() error { return past.replayEntry(rec) })
+	})
+	if err != nil && !errors.Is(err, errEndOfHistory) {
+		return nil, time.Time{}, err
+	}
+	if !until.IsZero() {
+		//what the log starts with may be from after until, without a time there's no telling
+		if at.IsZero() && applied > 0 && applied <= floor {
+			return nil, time.Time{}, errors.New("the log doesn't go back to " + format_time_into_readable_string(until))
+		}
+		return past, until, nil
+	}
+	if at.IsZero() {
+		at = time.Now()
+	}
+	return past, at, nil
+}
+
+// GetAsOf is Get as it would have answered right after the write with LSN lsn, or
+// the last one before it, rebuilt from the log (see above)
+// it fails if the log no longer goes back that far or the store isn't keeping one
+func (s *Store) GetAsOf(k key, lsn uint64) (string, bool, error) {
+	past, when, err := s.as_of(lsn, time.Time{})
+	if err != nil {
+		return "", false, err
+	}
+	return past.get_at(s.encode_key(k), when)
+}
+
+// GetAsOfTime is GetAsOf as of the last write logged at or before t
+func (s *Store) GetAsOfTime(k key, t time.Time) (string, bool, error) {
+	past, when, err := s.as_of(no_lsn_limit, t)
+	if err != nil {
+		return "", false, err
+	}
+	return past.get_at(s.encode_key(k), when)
+}
+
+// parse_point reads AS OF's and GETASOF's point: an LSN, or an RFC 3339 time
+func parse_point(arg string) (uint64, time.Time, error) {
+	if lsn, err := strconv.ParseUint(arg, 10, 64); err == nil {
+		return lsn, time.Time{}, nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, arg)
+	if err != nil {
+		return 0, time.Time{}, errors.New("invalid point in time " + strconv.Quote(arg) + ", use an LSN or an RFC 3339 time")
+	}
+	return 0, at, nil
+}
+
+// the LSN of a point in time, the time is what stops the replay
+const no_lsn_limit = ^uint64(0)
+
+// get_at reads k in a rebuilt store as of when
+func (s *Store) get_at(k key, when time.Time) (string, bool, error) {
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && !val.expires_at.After(when)) {
+		return "", false, nil
+	}
+	if val.obj != nil {
+		return "", false, ErrWrongType
+	}
+	return val.data, true, nil
+}
+
+// History is every logged write to k the log still has, oldest first, with its LSN and
+// when it was logged: a transaction's writes once it committed, and a RENAME or COPY to k
+// as well as from it. the Entries don't say where in the log they are
+// with Options.IndexKeys the segments whose key filter says they don't write k aren't
+// read (see wal_index.go), without it, or for the active segment, the whole log is
+// writers are blocked while it runs
+func (s *Store) History(k key) ([]Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.persistence.logs() {
+		return nil, errors.New("HISTORY needs the WAL, persistence is " + s.persistence.String())
+	}
+	k = s.encode_key(k)
+	//everything queued so far has to be readable from the segments
+	if err := s.wal.wait_pending(); err != nil {
+		return nil, err
+	}
+	s.wal.wal_lock.Lock()
+	defer s.wal.wal_lock.Unlock()
+
+	segments, err := s.wal.segments_from(0)
+	if err != nil {
+		return nil, err
+	}
+	var history []Entry
+	var lsns lsn_counter
+	var txs tx_buffer
+	read := func(rec wal_record) error {
+		lsns.stamp(&rec)
+		return txs.feed(rec.op, rec.value, func() error {
+			if slices.Contains(record_keys(rec), k) {
+				history = append(history, record_entry(rec))
+			}
+			return nil
+		})
+	}
+	for i, seq := range segments {
+		//a transaction is counted whole, so its segments can't be skipped
+		if idx := s.wal.segment_index(seq); idx != nil && !idx.may_have(k) && !idx.open_tx && !txs.open {
+			lsns.last = idx.last
+			continue
+		}
+		if s.wal.striped(seq) {
+			err = s.wal.read_striped(seq, i == len(segments)-1, read)
+		} else if err = s.wal.read_segment(seq, read); err != nil {
+			err = fmt.Errorf("%s: %w", s.wal.segment_path(seq), err)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return history, nil
+}
+
+// HistoryScan is KVScan over the store as of a past LSN or time, see above
+// the point is resolved and the store rebuilt when it is opened
+type HistoryScan struct {
+	KVScan
+	LSN uint64    // the last write to include
+	At  time.Time // or the time of it, if not zero
+}
+
+func NewHistoryScan(store *Store, db int, lsn uint64, at time.Time) *HistoryScan {
+	return &HistoryScan{KVScan: KVScan{store: store, DB: db}, LSN: lsn, At: at}
+}
+
+func (hs *HistoryScan) Open() error {
+	lsn := hs.LSN
+	if !hs.At.IsZero() {
+		lsn = no_lsn_limit
+	}
+	past, when, err := hs.store.as_of(lsn, hs.At)
+	if err != nil {
+		return err
+	}
+	hs.scan(past.view_db(hs.DB), when)
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func get_as_of(t *testing.T, s *Store, name string, lsn uint64) string {
+	t.Helper()
+	v, _, err := s.GetAsOf(key{name: name}, lsn)
+	if err != nil {
+		t.Fatalf("GetAsOf %s %d: %v", name, lsn, err)
+	}
+	return v
+}
+
+// every point in the log reads what was there right after that write, transactions
+// included only once they committed, in both formats
+func TestGetAsOf(t *testing.T) {
+	for name, format := range map[string]WALFormat{"binary": WALBinary, "text": WALText} {
+		t.Run(name, func(t *testing.T) {
+			s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{WALFormat: format})
+			defer s.Close()
+
+			set(t, s, "a", "1")
+			one := s.LastLSN()
+			set(t, s, "a", "2")
+			two := s.LastLSN()
+			if err := s.Delete(key{name: "a"}); err != nil {
+				t.Fatal(err)
+			}
+			gone := s.LastLSN()
+			tx := s.Begin()
+			tx.Set(key{name: "a"}, 0, "3")
+			tx.Set(key{name: "b"}, 0, "3")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			for lsn, want := range map[uint64]string{0: "", one: "1", two: "2", gone: "", gone + 1: "", s.LastLSN(): "3"} {
+				if v := get_as_of(t, s, "a", lsn); v != want {
+					t.Errorf("a as of %d = %q, want %q", lsn, v, want)
+				}
+			}
+			//BEGIN and the first SET are before the COMMIT, the transaction isn't there yet
+			if v := get_as_of(t, s, "b", s.LastLSN()-1); v != "" {
+				t.Errorf("b = %q half way through its transaction", v)
+			}
+		})
+	}
+}
+
+func TestGetAsOfTime(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "a", "1")
+	time.Sleep(time.Millisecond)
+	between := time.Now()
+	time.Sleep(time.Millisecond)
+	set(t, s, "a", "2")
+
+	if v, _, err := s.GetAsOfTime(key{name: "a"}, between); err != nil || v != "1" {
+		t.Errorf("a as of between = %q, %v, want 1", v, err)
+	}
+	if v, _, err := s.GetAsOfTime(key{name: "a"}, time.Now()); err != nil || v != "2" {
+		t.Errorf("a as of now = %q, %v, want 2", v, err)
+	}
+}
+
+// a checkpoint drops the history before it, what is after it is replayed onto the snapshot
+func TestGetAsOfCheckpoint(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistBoth})
+	defer s.Close()
+	set(t, s, "a", "1")
+	before := s.LastLSN()
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	at := s.LastLSN()
+	set(t, s, "a", "2")
+
+	if _, _, err := s.GetAsOf(key{name: "a"}, before-1); err == nil {
+		t.Error("GetAsOf before the checkpoint didn't fail")
+	}
+	if v := get_as_of(t, s, "a", at); v != "1" {
+		t.Errorf("a as of the checkpoint = %q, want 1", v)
+	}
+	if v := get_as_of(t, s, "a", s.LastLSN()); v != "2" {
+		t.Errorf("a as of the last write = %q, want 2", v)
+	}
+}
+
+func TestHistoryScan(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for i := 0; i < 5; i++ {
+		set(t, s, "k"+strconv.Itoa(i), "old")
+	}
+	lsn := s.LastLSN()
+	set(t, s, "k0", "new")
+	set(t, s, "k9", "new")
+
+	plan, err := ParseQuery([]string{"SCAN", "AS", "OF", strconv.FormatUint(lsn, 10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ExecuteQuery(BuildOperatorTree(s, plan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, row := range rows {
+		got = append(got, row.Key.name+"="+row.Value.data)
+	}
+	sort.Strings(got)
+	want := []string{"k0=old", "k1=old", "k2=old", "k3=old", "k4=old"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+// a key's history is its writes in LSN order, from a transaction and a RENAME too, and
+// with key filters the segments that don't write it aren't read
+func TestHistory(t *testing.T) {
+	for _, indexed := range []bool{false, true} {
+		t.Run("indexed="+strconv.FormatBool(indexed), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			opts := Options{IndexKeys: indexed, WALSegmentSize: 4096}
+			s := New_Store(path, opts)
+			filler := func() {
+				for i := 0; i < 300; i++ {
+					set(t, s, "f:"+strconv.Itoa(i), "filler")
+				}
+			}
+			set(t, s, "h", "1")
+			filler()
+			tx := s.Begin()
+			tx.Set(key{name: "other"}, 0, "x")
+			tx.Set(key{name: "h"}, 0, "2")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			filler()
+			set(t, s, "src", "3")
+			if err := s.Rename(key{name: "src"}, key{name: "h"}); err != nil {
+				t.Fatal(err)
+			}
+			filler()
+			if err := s.Delete(key{name: "h"}); err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			s, _, err := Recover("", path, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if indexed {
+				//break every segment the filter rules out, History mustn't notice
+				segments := wal_segments(t, s)
+				damaged := 0
+				for _, seq := range segments[:len(segments)-1] {
+					if idx := s.wal.segment_index(seq); idx != nil && !idx.may_have(key{name: "h"}) && !idx.open_tx {
+						fd, err := os.OpenFile(s.wal.segment_path(seq), os.O_WRONLY, 0)
+						if err != nil {
+							t.Fatal(err)
+						}
+						fd.WriteAt([]byte("damage"), 64)
+						fd.Close()
+						damaged++
+					}
+				}
+				if damaged == 0 {
+					t.Fatalf("none of %d segments was ruled out", len(segments))
+				}
+			}
+
+			history, err := s.History(key{name: "h"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for i, e := range history {
+				got = append(got, e.Op+" "+e.Value)
+				if e.At.IsZero() || (i > 0 && e.LSN <= history[i-1].LSN) {
+					t.Errorf("write %d: LSN %d at %v", i, e.LSN, e.At)
+				}
+			}
+			want := []string{"SET 1", "SET 2", "RENAME " + encode_args([]string{"h", "0"}), "DELETE "}
+			if len(got) != len(want) {
+				t.Fatalf("history %q, want %q", got, want)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("history %q, want %q", got, want)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// read-through and write-through, for a store that sits in front of another system
+// as a durable cache: with Options.Load a Get that misses asks that system for the key
+// and keeps what comes back, logged like any SET, and with Options.OnWrite every Set
+// and Delete is passed on once the store has it
+//
+// the hooks are called with no lock held, they can be slow and can use the store.
+// a key written while its load was out keeps that write, the loaded value only goes
+// in if the key is still missing. Set, SetOpts, Delete and a transaction's writes call
+// OnWrite, the async variants and the other commands don't. an OnWrite error is returned
+// by the write, which the store has made regardless
+
+// LoadFunc fetches a key the store doesn't have: its value, how long to keep it
+// (0 for no expiry) and whether the system behind the store has it at all
+type LoadFunc func(name string, db int) (value string, ttl time.Duration, found bool, err error)
+
+// WriteEvent is a Set or Delete the store has made
+type WriteEvent struct {
+	Op    string // SET or DELETE
+	Key   string
+	DB    int
+	Value string        // SET's value
+	TTL   time.Duration // SET's ttl, 0 if the key doesn't expire
+}
+
+// WriteFunc writes a change through to the system behind the store
+type WriteFunc func(w WriteEvent) error
+
+// load_through is Get's miss with a loader: the loaded value is set, unless the
+// key has been written since, in which case that is what Get returns
+func (s *Store) load_through(k key) (string, bool) {
+	v, ttl, found, err := s.load(k.name, k.db)
+	if err != nil {
+		store_load_errors_total.Inc()
+		log.Printf("WARNING: loading %s: %v\n", k.name, err)
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	store_loads_total.Inc()
+
+	var expires_at time.Time
+	if ttl != 0 {
+		expires_at = time.Now().Add(ttl)
+	}
+	s.lock.Lock()
+	if val, exists := s.data.get(k); exists && (val.expires_at.IsZero() || time.Now().Before(val.expires_at)) {
+		s.lock.Unlock()
+		v, found, _ := s.get_string(k)
+		return v, found
+	}
+	ack, err := s.set(k, v, expires_at)
+	s.lock.Unlock()
+	if err == nil {
+		err = s.wait(ack)
+	}
+	if err != nil {
+		//the caller still gets the value, only keeping it failed
+		log.Printf("WARNING: keeping %s after loading it: %v\n", k.name, err)
+	}
+	return v, true
+}
+
+// write_through hands a write to OnWrite, if there is one, k is already encoded
+func (s *Store) write_through(op string, k key, v string, ttl time.Duration) error {
+	if s.on_write == nil {
+		return nil
+	}
+	return s.on_write(WriteEvent{Op: op, Key: k.name, DB: k.db, Value: v, TTL: ttl})
+}
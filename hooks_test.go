@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// read-through and write-through, see hooks.go
+
+// a Get that misses loads the key once and keeps it, logged, with the loader's ttl; a
+// key the loader doesn't have or fails on stays missing, and a write made while the
+// load was out wins over what it loaded
+func TestLoad(t *testing.T) {
+	quiet_log(t)
+	var s *Store
+	var loads []string
+	backend := map[string]string{"a": "1", "ttl": "x", "raced": "loaded"}
+	load := func(name string, db int) (string, time.Duration, bool, error) {
+		loads = append(loads, name)
+		switch name {
+		case "broken":
+			return "", 0, false, errors.New("backend down")
+		case "ttl":
+			return backend[name], time.Hour, true, nil
+		case "raced":
+			set(t, s, "raced", "written")
+		}
+		v, ok := backend[name]
+		return v, 0, ok, nil
+	}
+	s = New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Load: load})
+	defer s.Close()
+	for range 2 {
+		if get(t, s, "a") != "1" || get(t, s, "ttl") != "x" || get(t, s, "missing") != "" || get(t, s, "broken") != "" {
+			t.Errorf("a=%s ttl=%s missing=%s broken=%s", get(t, s, "a"), get(t, s, "ttl"), get(t, s, "missing"), get(t, s, "broken"))
+		}
+	}
+	if got := strings.Join(loads, " "); got != "a ttl missing broken missing broken" {
+		t.Errorf("loaded %s", got)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "ttl"}); ttl <= 59*time.Minute {
+		t.Errorf("a loaded key with %v left", ttl)
+	}
+	if got := entries(t, s, 0); got != "SET a, SET ttl" {
+		t.Errorf("logged %s", got)
+	}
+	if got := get(t, s, "raced"); got != "written" {
+		t.Errorf("a load raced by a write: %s", got)
+	}
+}
+
+// Set, SetOpts and Delete are written through once the store has them, an error
+// from OnWrite is returned with the write made anyway, and SetAsync isn't written through
+func TestOnWrite(t *testing.T) {
+	quiet_log(t)
+	var written []string
+	var fail bool
+	var s *Store
+	s = New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{OnWrite: func(e WriteEvent) error {
+		if _, ok := s.Get(key{name: e.Key}); !ok && e.Op == "SET" {
+			return errors.New("written through before the store had it")
+		}
+		written = append(written, fmt.Sprintf("%s %s %s %v", e.Op, e.Key, e.Value, e.TTL.Round(time.Hour)))
+		if fail {
+			return errors.New("backend down")
+		}
+		return nil
+	}})
+	defer s.Close()
+	s.Set(key{name: "a"}, time.Hour, "1")
+	s.SetOpts(key{name: "a"}, 0, "2", SetOptions{KeepTTL: true})
+	s.SetOpts(key{name: "a"}, 0, "3", SetOptions{NX: true})
+	s.Delete(key{name: "a"})
+	ack, _ := s.SetAsync(key{name: "b"}, 0, "async")
+	<-ack
+	fail = true
+	if err := s.Set(key{name: "c"}, 0, "1"); err == nil || get(t, s, "c") != "1" {
+		t.Errorf("Set with OnWrite failing: %v, c=%s", err, get(t, s, "c"))
+	}
+	if got := strings.Join(written, ", "); got != "SET a 1 1h0m0s, SET a 2 1h0m0s, DELETE a  0s, SET c 1 0s" {
+		t.Errorf("written through: %s", got)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+)
+
+// INCR and friends: the read, the addition and the write happen under one write
+// lock, so concurrent increments can't lose each other the way a Get followed by a
+// Set from the caller can. the result is logged as a plain SET of the new number,
+// which replays to the same value however many times it is applied
+//
+// like Redis, a missing (or expired) key counts as 0 and the key keeps its expiry
+
+var errNotInteger = errors.New("value is not an integer or out of range")
+
+var errIncrOverflow = errors.New("increment or decrement would overflow")
+
+// IncrBy adds n to the integer at k and returns the new value
+func (s *Store) IncrBy(k key, n int64) (int64, error) {
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	var current int64
+	val, exists := s.data.get(k)
+	if exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		val, exists = value{}, false
+	}
+	if exists {
+		if val.obj != nil {
+			s.lock.Unlock()
+			return 0, ErrWrongType
+		}
+		if value_encoding(val) != encoding_int {
+			s.lock.Unlock()
+			return 0, errNotInteger
+		}
+		current, _ = strconv.ParseInt(val.data, 10, 64)
+	}
+	if (n > 0 && current > math.MaxInt64-n) || (n < 0 && current < math.MinInt64-n) {
+		s.lock.Unlock()
+		return 0, errIncrOverflow
+	}
+	result := current + n
+	v := strconv.FormatInt(result, 10)
+	if err := s.validate(k, v); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	if err := s.make_room(k, v); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+
+	rec := wal_record{lsn: s.next_lsn(), op: SET, key: k.name, db: k.db, value: v, expires_at: val.expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	s.put(k, value{data: v, expires_at: val.expires_at, lsn: rec.lsn})
+	if val.access != nil {
+		val.access.touch()
+	}
+	delete(s.tombstones, k)
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return result, s.wait(ack)
+}
+
+// Incr adds one to the integer at k
+func (s *Store) Incr(k key) (int64, error) {
+	return s.IncrBy(k, 1)
+}
+
+// DecrBy subtracts n from the integer at k
+func (s *Store) DecrBy(k key, n int64) (int64, error) {
+	if n == math.MinInt64 {
+		return 0, errIncrOverflow
+	}
+	return s.IncrBy(k, -n)
+}
+
+// Decr subtracts one from the integer at k
+func (s *Store) Decr(k key) (int64, error) {
+	return s.IncrBy(k, -1)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// INCR and friends, see incr.go
+
+// a missing key counts as 0, the key keeps its ttl, and what isn't an integer, or
+// would overflow, is left as it is
+func TestIncr(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	steps := []struct {
+		name string
+		fn   func(key) (int64, error)
+		want int64
+	}{
+		{"INCR", s.Incr, 1},
+		{"INCRBY 10", func(k key) (int64, error) { return s.IncrBy(k, 10) }, 11},
+		{"DECRBY 20", func(k key) (int64, error) { return s.DecrBy(k, 20) }, -9},
+		{"DECR", s.Decr, -10},
+	}
+	for _, step := range steps {
+		if got, err := step.fn(key{name: "n"}); got != step.want || err != nil {
+			t.Errorf("%s: %d %v, want %d", step.name, got, err, step.want)
+		}
+	}
+
+	s.Set(key{name: "ttl"}, time.Hour, "5")
+	s.Incr(key{name: "ttl"})
+	if _, ttl, _, _ := s.Ttl(key{name: "ttl"}); get(t, s, "ttl") != "6" || ttl <= 59*time.Minute {
+		t.Errorf("ttl=%s with %v left", get(t, s, "ttl"), ttl)
+	}
+	s.Set(key{name: "gone"}, time.Millisecond, "41")
+	time.Sleep(5 * time.Millisecond)
+	if got, _ := s.Incr(key{name: "gone"}); got != 1 {
+		t.Errorf("INCR of an expired key: %d", got)
+	}
+
+	set(t, s, "word", "abc")
+	set(t, s, "max", strconv.FormatInt(math.MaxInt64, 10))
+	s.HSet(key{name: "h"}, map[string]string{"f": "1"})
+	for name, err := range map[string]error{"word": errNotInteger, "max": errIncrOverflow, "h": ErrWrongType} {
+		if _, got := s.Incr(key{name: name}); got != err {
+			t.Errorf("INCR %s: %v, want %v", name, got, err)
+		}
+	}
+	if _, err := s.DecrBy(key{name: "n"}, math.MinInt64); err != errIncrOverflow {
+		t.Errorf("DECRBY MinInt64: %v", err)
+	}
+	if get(t, s, "word") != "abc" || get(t, s, "n") != "-10" {
+		t.Error("a failed INCR changed the value")
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if get(t, s, "n") != "-10" || get(t, s, "ttl") != "6" || get(t, s, "gone") != "1" {
+		t.Errorf("after a restart n=%s ttl=%s gone=%s", get(t, s, "n"), get(t, s, "ttl"), get(t, s, "gone"))
+	}
+	if ops := entries(t, s, 0); strings.Contains(ops, "INCR") {
+		t.Errorf("logged %s, want SETs of the results", ops)
+	}
+}
+
+// concurrent increments don't lose each other
+func TestIncrConcurrent(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Durability: DurabilityNone})
+	defer s.Close()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				if _, err := s.Incr(key{name: "n"}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := get(t, s, "n"); got != "800" {
+		t.Errorf("n is %s after 800 increments", got)
+	}
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// Exporter writes a registry's metrics out in some format
+// Prometheus and JSON are built in, expvar publishes instead of writing (see PublishExpvar)
+type Exporter interface {
+	Export(w io.Writer, samples []Sample) error
+}
+
+// Export gathers the registry and hands it to the exporter
+func (r *Registry) Export(w io.Writer, exporter Exporter) error {
+	return exporter.Export(w, r.Gather())
+}
+
+// Prometheus writes the text exposition format, what a /metrics handler serves
+type Prometheus struct{}
+
+func (Prometheus) Export(w io.Writer, samples []Sample) error {
+	for _, s := range samples {
+		if s.Help != "" {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n", s.Name, s.Help); err != nil {
+				return err
+			}
+		}
+		var err error
+		switch s.Kind {
+		case KindCounter:
+			_, err = fmt.Fprintf(w, "# TYPE %s counter\n%s %s\n", s.Name, s.Name, format_float(s.Value))
+		case KindGauge:
+			_, err = fmt.Fprintf(w, "# TYPE %s gauge\n%s %s\n", s.Name, s.Name, format_float(s.Value))
+		case KindHistogram:
+			err = write_prometheus_histogram(w, s.Name, s.Histogram)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func write_prometheus_histogram(w io.Writer, name string, h *HistogramSnapshot) error {
+	if _, err := fmt.Fprintf(w, "# TYPE %s histogram\n", name); err != nil {
+		return err
+	}
+	for i, bound := range h.Bounds {
+		if _, err := fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, format_float(bound), h.Counts[i]); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n%s_sum %s\n%s_count %d\n", name, h.Count, name, format_float(h.Sum), name, h.Count)
+	return err
+}
+
+func format_float(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// JSON writes every sample as one json document, for dumps and debugging
+type JSON struct {
+	Indent bool
+}
+
+func (j JSON) Export(w io.Writer, samples []Sample) error {
+	encoder := json.NewEncoder(w)
+	if j.Indent {
+		encoder.SetIndent("", "  ")
+	}
+	return encoder.Encode(samples)
+}
+
+// PublishExpvar exposes the registry under /debug/vars as `name`,
+// read fresh on every request. like expvar.Publish it panics if the name is taken
+func PublishExpvar(name string, r *Registry) {
+	expvar.Publish(name, expvar.Func(func() any {
+		vars := make(map[string]any)
+		for _, s := range r.Gather() {
+			if s.Histogram != nil {
+				vars[s.Name] = s.Histogram
+			} else {
+				vars[s.Name] = s.Value
+			}
+		}
+		return vars
+	}))
+}
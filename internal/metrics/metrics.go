@@ -0,0 +1,207 @@
+// Package metrics is the one place the store, the WAL and the query operators
+// keep their numbers: counters, gauges and histograms that are safe to update
+// from any goroutine without a lock, in a registry the exporters read from
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter only goes up
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc()          { c.v.Add(1) }
+func (c *Counter) Add(n uint64)  { c.v.Add(n) }
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+// Gauge is a value that goes up and down, stored as float64 bits
+type Gauge struct {
+	bits atomic.Uint64
+}
+
+func (g *Gauge) Set(v float64) { g.bits.Store(math.Float64bits(v)) }
+
+func (g *Gauge) Add(d float64) {
+	for {
+		old := g.bits.Load()
+		if g.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+d)) {
+			return
+		}
+	}
+}
+
+func (g *Gauge) Value() float64 { return math.Float64frombits(g.bits.Load()) }
+
+// Histogram counts observations into fixed buckets, Prometheus style:
+// bucket i counts the values <= Bounds[i], and everything above the last bound
+// only shows up in Count
+type Histogram struct {
+	bounds   []float64
+	buckets  []atomic.Uint64
+	count    atomic.Uint64
+	sum_bits atomic.Uint64
+}
+
+// LatencyBuckets are for durations in seconds, 50µs to 5s
+var LatencyBuckets = []float64{0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+func new_histogram(bounds []float64) *Histogram {
+	bounds = append([]float64{}, bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, buckets: make([]atomic.Uint64, len(bounds))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.buckets[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum_bits.Load()
+		if h.sum_bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// HistogramSnapshot is a histogram's state at one point, with cumulative bucket counts
+// the fields are read one by one, so a snapshot taken during Observe can be off by one
+type HistogramSnapshot struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []uint64  `json:"counts"` // Counts[i] is the number of values <= Bounds[i]
+	Count  uint64    `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	snap := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds))}
+	var total uint64
+	for i := range h.buckets {
+		total += h.buckets[i].Load()
+		snap.Counts[i] = total
+	}
+	snap.Count = h.count.Load()
+	snap.Sum = math.Float64frombits(h.sum_bits.Load())
+	return snap
+}
+
+// Quantile estimates the q-th quantile (0..1) as the upper bound of the bucket it falls in
+// +Inf if it's above the last bound, 0 without observations
+func (s HistogramSnapshot) Quantile(q float64) float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(s.Count)))
+	for i, c := range s.Counts {
+		if c >= rank {
+			return s.Bounds[i]
+		}
+	}
+	return math.Inf(1)
+}
+
+// Kind tells the exporters what a metric is
+type Kind int
+
+const (
+	KindCounter Kind = iota
+	KindGauge
+	KindHistogram
+)
+
+type entry struct {
+	name      string
+	help      string
+	kind      Kind
+	counter   *Counter
+	gauge     *Gauge
+	histogram *Histogram
+}
+
+// Registry holds named metrics, asking for a name twice gives the same metric
+// so each subsystem can declare what it needs without coordinating
+type Registry struct {
+	lock    sync.RWMutex
+	entries map[string]*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{entries: make(map[string]*entry)}
+}
+
+// Default is the registry the whole process shares
+var Default = NewRegistry()
+
+func (r *Registry) get(name string, help string, kind Kind, create func(e *entry)) *entry {
+	r.lock.RLock()
+	e, ok := r.entries[name]
+	r.lock.RUnlock()
+	if !ok {
+		r.lock.Lock()
+		if e, ok = r.entries[name]; !ok {
+			e = &entry{name: name, help: help, kind: kind}
+			create(e)
+			r.entries[name] = e
+		}
+		r.lock.Unlock()
+	}
+	if e.kind != kind {
+		panic("metrics: " + name + " registered twice with different kinds")
+	}
+	return e
+}
+
+func (r *Registry) Counter(name string, help string) *Counter {
+	return r.get(name, help, KindCounter, func(e *entry) { e.counter = &Counter{} }).counter
+}
+
+func (r *Registry) Gauge(name string, help string) *Gauge {
+	return r.get(name, help, KindGauge, func(e *entry) { e.gauge = &Gauge{} }).gauge
+}
+
+// Histogram uses the bounds it was first registered with
+func (r *Registry) Histogram(name string, help string, bounds []float64) *Histogram {
+	return r.get(name, help, KindHistogram, func(e *entry) { e.histogram = new_histogram(bounds) }).histogram
+}
+
+// Sample is one metric's current value, what exporters work from
+// Value is set for counters and gauges, Histogram for histograms
+type Sample struct {
+	Name      string             `json:"name"`
+	Help      string             `json:"help,omitempty"`
+	Kind      Kind               `json:"-"`
+	Value     float64            `json:"value"`
+	Histogram *HistogramSnapshot `json:"histogram,omitempty"`
+}
+
+// Gather reads every metric, sorted by name
+func (r *Registry) Gather() []Sample {
+	r.lock.RLock()
+	entries := make([]*entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, e)
+	}
+	r.lock.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+
+	samples := make([]Sample, 0, len(entries))
+	for _, e := range entries {
+		sample := Sample{Name: e.name, Help: e.help, Kind: e.kind}
+		switch e.kind {
+		case KindCounter:
+			sample.Value = float64(e.counter.Value())
+		case KindGauge:
+			sample.Value = e.gauge.Value()
+		case KindHistogram:
+			snap := e.histogram.Snapshot()
+			sample.Histogram = &snap
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
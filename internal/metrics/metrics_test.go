@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// a name asked for twice is the same metric, from any number of goroutines at once
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 1000 {
+				r.Counter("ops_total", "ops").Inc()
+				r.Gauge("level", "").Add(0.5)
+				r.Histogram("seconds", "", LatencyBuckets).Observe(0.001)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := r.Counter("ops_total", "").Value(); got != 8000 {
+		t.Errorf("ops_total = %d, want 8000", got)
+	}
+	if got := r.Gauge("level", "").Value(); got != 4000 {
+		t.Errorf("level = %v, want 4000", got)
+	}
+	if snap := r.Histogram("seconds", "", nil).Snapshot(); snap.Count != 8000 || math.Abs(snap.Sum-8) > 1e-9 {
+		t.Errorf("seconds: %d observations summing to %v", snap.Count, snap.Sum)
+	}
+
+	samples := r.Gather()
+	if len(samples) != 3 || samples[0].Name != "level" || samples[1].Name != "ops_total" || samples[2].Name != "seconds" {
+		t.Errorf("Gather isn't by name: %+v", samples)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("a counter's name asked for as a gauge")
+		}
+	}()
+	r.Gauge("ops_total", "")
+}
+
+// buckets count the values up to their bound, a quantile is the bound of its bucket
+func TestHistogram(t *testing.T) {
+	h := new_histogram([]float64{10, 1, 5})
+	for _, v := range []float64{0.5, 1, 3, 7, 7, 20} {
+		h.Observe(v)
+	}
+	snap := h.Snapshot()
+	if want := []uint64{2, 3, 5}; !slices.Equal(snap.Counts, want) || snap.Count != 6 || snap.Sum != 38.5 {
+		t.Errorf("snapshot %+v, counts want %v", snap, want)
+	}
+	for q, want := range map[float64]float64{0.1: 1, 0.5: 5, 0.8: 10, 0.99: math.Inf(1)} {
+		if got := snap.Quantile(q); got != want {
+			t.Errorf("quantile %v = %v, want %v", q, got, want)
+		}
+	}
+	if got := (HistogramSnapshot{}).Quantile(0.5); got != 0 {
+		t.Errorf("quantile of nothing = %v", got)
+	}
+}
+
+// the text exposition format, every kind
+func TestPrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("writes_total", "writes so far").Add(3)
+	r.Gauge("memory_bytes", "").Set(1.5)
+	r.Histogram("fsync_seconds", "", []float64{0.01, 0.1}).Observe(0.05)
+	var buf bytes.Buffer
+	if err := r.Export(&buf, Prometheus{}); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE fsync_seconds histogram
+fsync_seconds_bucket{le="0.01"} 0
+fsync_seconds_bucket{le="0.1"} 1
+fsync_seconds_bucket{le="+Inf"} 1
+fsync_seconds_sum 0.05
+fsync_seconds_count 1
+# TYPE memory_bytes gauge
+memory_bytes 1.5
+# HELP writes_total writes so far
+# TYPE writes_total counter
+writes_total 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("Prometheus:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"iter"
+	"strings"
+	"time"
+)
+
+// All and AllWithPrefix are the supported way to walk the store from outside: range
+// over them like a map, for name, v := range store.All() { ... }. they walk a View,
+// so what they yield is the store as it was when the loop started, and the loop body
+// can take as long as it likes and write to the store without holding anybody up
+//
+// keys come in no particular order, from every database (Value.DB says which), named
+// as stored, after the KeyCodec. expired keys the sweeper hasn't got to are skipped
+
+// Value is a key's value as All yields it
+type Value struct {
+	Type      string // "string", "hash", "list", "set" or "zset", what TYPE says
+	Data      string // a string's bytes, empty for the other types
+	Len       int    // a string's length in bytes, the fields, elements or members of the others
+	DB        int
+	ExpiresAt time.Time // zero if the key doesn't expire
+	LSN       uint64    // the write that last changed the key
+}
+
+func export_value(k key, val value) Value {
+	v := Value{Type: "string", Data: val.data, Len: len(val.data), DB: k.db, ExpiresAt: val.expires_at, LSN: val.lsn}
+	if val.obj != nil {
+		v.Type, v.Len = val.obj.kind(), val.obj.len()
+	}
+	return v
+}
+
+// All yields every live key and its value, see above
+func (s *Store) All() iter.Seq2[string, Value] {
+	return s.AllWithPrefix("")
+}
+
+// AllWithPrefix is All for the keys that start with prefix
+func (s *Store) AllWithPrefix(prefix string) iter.Seq2[string, Value] {
+	return func(yield func(string, Value) bool) {
+		s.View().all(prefix, yield)
+	}
+}
+
+// All is Store.All over the View
+func (v *View) All() iter.Seq2[string, Value] {
+	return func(yield func(string, Value) bool) {
+		v.all("", yield)
+	}
+}
+
+func (v *View) all(prefix string, yield func(string, Value) bool) {
+	now := time.Now()
+	v.each(func(k key, val value) bool {
+		if !strings.HasPrefix(k.name, prefix) || (!val.expires_at.IsZero() && now.After(val.expires_at)) {
+			return true
+		}
+		return yield(k.name, export_value(k, val))
+	})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// All and AllWithPrefix, see iter.go
+
+// every live key once, with what it holds, as the store was when the loop started
+func TestAll(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	set(t, s, "user:1", "ann")
+	s.Set(key{name: "user:2", db: 3}, time.Hour, "bob")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v", "g": "w"})
+	s.ZAdd(key{name: "z"}, map[string]float64{"a": 1})
+	s.Set(key{name: "user:gone"}, time.Millisecond, "x")
+	time.Sleep(5 * time.Millisecond)
+
+	got := map[string]string{}
+	for name, v := range s.All() {
+		got[name] = fmt.Sprintf("%s %s %d %d", v.Type, v.Data, v.Len, v.DB)
+		if name == "user:2" && (v.ExpiresAt.IsZero() || v.LSN != 2) {
+			t.Errorf("user:2 expires at %v, LSN %d", v.ExpiresAt, v.LSN)
+		}
+		//the loop can write, and doesn't see it
+		set(t, s, "added:"+name, "v")
+	}
+	want := map[string]string{"user:1": "string ann 3 0", "user:2": "string bob 3 3", "h": "hash  2 0", "z": "zset  1 0"}
+	if !maps.Equal(got, want) {
+		t.Errorf("All: %v, want %v", got, want)
+	}
+
+	var prefixed []string
+	for name := range s.AllWithPrefix("user:") {
+		prefixed = append(prefixed, name)
+	}
+	if len(prefixed) != 2 {
+		t.Errorf("AllWithPrefix(user:): %v", prefixed)
+	}
+	n := 0
+	for range s.All() {
+		n++
+		break
+	}
+	if n != 1 {
+		t.Errorf("%d keys after a break", n)
+	}
+
+	v := s.View()
+	s.Delete(key{name: "user:1"})
+	n = 0
+	for range v.All() {
+		n++
+	}
+	if n != 8 {
+		t.Errorf("%d keys in the View, want 8", n)
+	}
+}
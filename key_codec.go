@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// KeyCodec turns the key an application passes in into the key that is stored
+// it runs on every Store call, so "User:1" and "user:1" can be the same key
+// the WAL and snapshots hold encoded keys, so replay doesn't run it again
+type KeyCodec interface {
+	Name() string
+	Encode(k string) string
+}
+
+// IdentityKeys stores keys as they are (the default)
+type IdentityKeys struct{}
+
+func (IdentityKeys) Name() string           { return "identity" }
+func (IdentityKeys) Encode(k string) string { return k }
+
+// LowercaseKeys makes keys case-insensitive
+type LowercaseKeys struct{}
+
+func (LowercaseKeys) Name() string           { return "lower" }
+func (LowercaseKeys) Encode(k string) string { return strings.ToLower(k) }
+
+// keys longer than this are hashed by HashLongKeys
+const max_plain_key_len = 64
+
+// HashLongKeys replaces keys over 64 bytes with "sha256:" + the hex digest,
+// so huge keys cost a fixed amount of memory and WAL space
+// the original key can't be recovered, SCAN shows the hash
+type HashLongKeys struct{}
+
+func (HashLongKeys) Name() string { return "hash" }
+func (HashLongKeys) Encode(k string) string {
+	if len(k) <= max_plain_key_len {
+		return k
+	}
+	sum := sha256.Sum256([]byte(k))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// key_codec_chain runs codecs left to right, e.g. "lower,hash"
+type key_codec_chain []KeyCodec
+
+func (c key_codec_chain) Name() string {
+	names := make([]string, len(c))
+	for i, codec := range c {
+		names[i] = codec.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+func (c key_codec_chain) Encode(k string) string {
+	for _, codec := range c {
+		k = codec.Encode(k)
+	}
+	return k
+}
+
+var key_codecs = map[string]KeyCodec{
+	"identity": IdentityKeys{},
+	"lower":    LowercaseKeys{},
+	"hash":     HashLongKeys{},
+}
+
+// ParseKeyCodec looks a codec up by name, comma separated names are chained
+func ParseKeyCodec(name string) (KeyCodec, error) {
+	parts := strings.Split(name, ",")
+	if len(parts) == 1 {
+		codec, ok := key_codecs[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown key codec: " + name)
+		}
+		return codec, nil
+	}
+
+	chain := make(key_codec_chain, 0, len(parts))
+	for _, part := range parts {
+		codec, err := ParseKeyCodec(part)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, codec)
+	}
+	return chain, nil
+}
+
+func (s *Store) encode_key(k key) key {
+	return key{name: s.key_codec.Encode(k.name), db: k.db}
+}
+
+// the manifest (<wal>.manifest) records settings replay depends on,
+// one "name value" pair per line
+func (s *Store) manifest_path() string {
+	return s.wal.manifest_path()
+}
+
+func (w *wal) manifest_path() string {
+	return w.filename + ".manifest"
+}
+
+// the store and the WAL archiver both update the manifest
+var manifest_lock sync.Mutex
+
+func read_manifest(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	manifest := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		name, val, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if !ok {
+			continue
+		}
+		manifest[name] = strings.TrimSpace(val)
+	}
+	return manifest, scanner.Err()
+}
+
+func write_manifest(path string, manifest map[string]string) error {
+	names := make([]string, 0, len(manifest))
+	for name := range manifest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	for _, name := range names {
+		sb.WriteString(name + " " + manifest[name] + "\n")
+	}
+	return replace_file(path, []byte(sb.String()))
+}
+
+// update_manifest sets one entry and keeps the others
+func update_manifest(path string, name string, val string) error {
+	manifest_lock.Lock()
+	defer manifest_lock.Unlock()
+
+	manifest, err := read_manifest(path)
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		manifest = make(map[string]string)
+	}
+	manifest[name] = val
+	return write_manifest(path, manifest)
+}
+
+// remove_from_manifest drops one entry and keeps the others
+func remove_from_manifest(path string, name string) error {
+	manifest_lock.Lock()
+	defer manifest_lock.Unlock()
+
+	manifest, err := read_manifest(path)
+	if err != nil || manifest[name] == "" {
+		return err
+	}
+	delete(manifest, name)
+	return write_manifest(path, manifest)
+}
+
+// fresh_log says whether nothing has been written under filename yet: no segment,
+// snapshot or manifest
+func fresh_log(filename string) bool {
+	files, err := filepath.Glob(filename + "*")
+	return err == nil && len(files) == 0
+}
+
+// record_key_codec records the codec of a store that starts a new log, so the keys it
+// writes are read back with it whether or not it is reopened through Recover
+func (s *Store) record_key_codec() {
+	if err := update_manifest(s.manifest_path(), "key_codec", s.key_codec.Name()); err != nil {
+		log.Printf("WARNING: recording the key codec in %s: %v\n", s.manifest_path(), err)
+	}
+}
+
+// check_key_codec makes sure the store encodes keys the same way the log was written
+// a new log has its codec recorded by New_Store, one from before the manifest by the
+// first run that replays it. later runs with no codec
+// in their Options pick it up from there, and a different one is an error
+// caller must hold s.lock, after the log has been replayed
+func (s *Store) check_key_codec(configured bool) error {
+	path := s.manifest_path()
+	manifest, err := read_manifest(path)
+	if err != nil {
+		return err
+	}
+
+	recorded, ok := manifest["key_codec"]
+	if !ok {
+		//a log from before the manifest existed was written with raw keys
+		if s.data.len() > 0 && s.key_codec.Name() != (IdentityKeys{}).Name() {
+			return errors.New("key codec mismatch: the log has raw keys, options say " + s.key_codec.Name())
+		}
+		return update_manifest(path, "key_codec", s.key_codec.Name())
+	}
+
+	if !configured {
+		codec, err := ParseKeyCodec(recorded)
+		if err != nil {
+			return err
+		}
+		s.key_codec = codec
+		return nil
+	}
+	if recorded != s.key_codec.Name() {
+		return errors.New("key codec mismatch: the log was written with " + recorded + ", options say " + s.key_codec.Name())
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// a store started with New_Store on a new log records its codec, so its keys are read
+// back with it, with the codec in Options or without
+func TestKeyCodecRecordedByNewStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{KeyCodec: LowercaseKeys{}}
+	s := New_Store(path, opts)
+	set(t, s, "User:1", "alice")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatalf("reopening with the same codec: %v", err)
+	}
+	s.Close()
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatalf("reopening without a codec: %v", err)
+	}
+	defer s.Close()
+	if v, _ := s.Get(key{name: "USER:1"}); v != "alice" {
+		t.Errorf("USER:1 = %q, want alice", v)
+	}
+	if _, _, err := Recover("", path, Options{KeyCodec: IdentityKeys{}}); err == nil {
+		t.Error("reopening with another codec didn't fail")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// KEYS pattern: Redis style globs over the keys of one database
+//
+//	*      any run of bytes, '/' and ':' included
+//	?      any one byte
+//	[abc]  one of a, b or c; [a-z] a range; [^abc] anything but those
+//	\x     x itself, to match a literal *, ?, [ or \
+//
+// patterns match keys as they are stored, i.e. after the KeyCodec. it takes the read
+// lock for the whole walk, so on a big store it holds writers up, like KEYS does in Redis
+
+// Keys returns the live keys of database db matching pattern, sorted
+func (s *Store) Keys(db int, pattern string) []string {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	var keys []string
+	s.data.each(0, func(k key, val value) bool {
+		if k.db == db && (val.expires_at.IsZero() || !now.After(val.expires_at)) && glob_match(pattern, k.name) {
+			keys = append(keys, k.name)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
+
+// RandomKey returns a live key of database db picked at random, false if there are none
+func (s *Store) RandomKey(db int) (string, bool) {
+	keys := s.SampleKeys(db, 1)
+	if len(keys) == 0 {
+		return "", false
+	}
+	return keys[0], true
+}
+
+// SampleKeys returns up to n distinct live keys of database db picked at random, for
+// monitoring or trying out an eviction policy. it doesn't take the store lock, only each
+// shard's in turn, and stops once it has n keys, so writers don't wait on it. random
+// the way Redis' RANDOMKEY is: good enough for a sample, not uniform
+func (s *Store) SampleKeys(db int, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	sample := s.data.sample(n, func(k key, val value) bool {
+		return k.db == db && (val.expires_at.IsZero() || val.expires_at.After(now))
+	})
+	keys := make([]string, len(sample))
+	for i, k := range sample {
+		keys[i] = k.name
+	}
+	return keys
+}
+
+// glob_match reports whether name matches pattern, byte by byte
+// a '*' that fails to match is retried one byte further on, only the last one
+// has to be, so it is linear in most patterns and never exponential
+func glob_match(pattern string, name string) bool {
+	p, n := 0, 0
+	star_p, star_n := -1, -1
+	for n < len(name) {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				star_p, star_n = p, n
+				p++
+				continue
+			case '?':
+				p++
+				n++
+				continue
+			case '[':
+				if matched, next := glob_class(pattern, p, name[n]); matched {
+					p = next
+					n++
+					continue
+				}
+			case '\\':
+				if p+1 < len(pattern) && pattern[p+1] == name[n] {
+					p += 2
+					n++
+					continue
+				}
+			default:
+				if pattern[p] == name[n] {
+					p++
+					n++
+					continue
+				}
+			}
+		}
+		if star_p < 0 {
+			return false
+		}
+		star_n++
+		p, n = star_p+1, star_n
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// glob_class matches c against the [...] at pattern[p] and returns where the
+// pattern carries on after it. an unclosed '[' matches a literal '['
+func glob_class(pattern string, p int, c byte) (bool, int) {
+	i := p + 1
+	negate := i < len(pattern) && (pattern[i] == '^' || pattern[i] == '!')
+	if negate {
+		i++
+	}
+	matched := false
+	first := true
+	for ; i < len(pattern) && (pattern[i] != ']' || first); i++ {
+		first = false
+		lo := pattern[i]
+		if lo == '\\' && i+1 < len(pattern) {
+			i++
+			lo = pattern[i]
+		}
+		hi := lo
+		if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			hi = pattern[i+2]
+			if hi == '\\' && i+3 < len(pattern) {
+				hi = pattern[i+3]
+				i++
+			}
+			i += 2
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+		}
+		if lo <= c && c <= hi {
+			matched = true
+		}
+	}
+	if i >= len(pattern) {
+		return c == '[', p + 1
+	}
+	return matched != negate, i + 1
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// KEYS and its globs, see keys.go
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "", true},
+		{"*", "user:1/a", true},
+		{"user:*", "user:1", true},
+		{"user:*", "order:1", false},
+		{"*:1", "user:1", true},
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[!e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[c-a]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"[]]", "]", true},
+		{"a[", "a[", true},
+		{`a\*`, "a*", true},
+		{`a\*`, "ab", false},
+		{"*a*b*c*", "xaybzc", true},
+		{"*a*b*c*", "xaybz", false},
+		{strings.Repeat("*a", 20) + "b", strings.Repeat("a", 50), false},
+	} {
+		if got := glob_match(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("glob_match(%q, %q) = %v", tc.pattern, tc.name, got)
+		}
+	}
+}
+
+// Keys is the live keys of one database that match, sorted
+func TestKeys(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	for _, name := range []string{"user:2", "user:10", "order:1", "user:1"} {
+		set(t, s, name, "x")
+	}
+	s.Set(key{name: "user:3"}, time.Millisecond, "x")
+	s.Set(key{name: "user:4", db: 1}, 0, "x")
+	time.Sleep(5 * time.Millisecond)
+	if got := strings.Join(s.Keys(0, "user:*"), " "); got != "user:1 user:10 user:2" {
+		t.Errorf("KEYS user:*: %s", got)
+	}
+	if got := strings.Join(s.Keys(1, "*"), " "); got != "user:4" {
+		t.Errorf("KEYS * in db 1: %s", got)
+	}
+	if got := strings.Join(s.Keys(0, "user:1?"), " "); got != "user:10" {
+		t.Errorf("KEYS user:1?: %s", got)
+	}
+	if got := s.Keys(0, "session:*"); len(got) != 0 {
+		t.Errorf("KEYS session:*: %v", got)
+	}
+}
+
+// RandomKey and SampleKeys pick live keys of the one database, a sample's all different
+func TestSampleKeys(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	if _, ok := s.RandomKey(0); ok {
+		t.Error("a random key from an empty store")
+	}
+	if err := s.Process([]string{"RANDOMKEY"}); err == nil {
+		t.Error("RANDOMKEY on an empty store")
+	}
+	for i := range 20 {
+		set(t, s, "k"+strconv.Itoa(i), "v")
+	}
+	s.Set(key{name: "other", db: 1}, 0, "v")
+	s.Set(key{name: "gone"}, time.Millisecond, "v")
+	time.Sleep(5 * time.Millisecond)
+
+	picked := map[string]bool{}
+	for range 200 {
+		k, ok := s.RandomKey(0)
+		if !ok || !strings.HasPrefix(k, "k") {
+			t.Fatalf("RandomKey: %q %v", k, ok)
+		}
+		picked[k] = true
+	}
+	if len(picked) < 2 {
+		t.Errorf("200 picks, all %v", picked)
+	}
+	sample := s.SampleKeys(0, 5)
+	if len(sample) != 5 {
+		t.Errorf("a sample of %d, want 5", len(sample))
+	}
+	all := s.SampleKeys(0, 100)
+	slices.Sort(all)
+	if len(all) != 20 || len(slices.Compact(all)) != 20 || slices.Contains(all, "gone") {
+		t.Errorf("a sample bigger than the database: %v", all)
+	}
+	if got := s.SampleKeys(1, 10); len(got) != 1 || got[0] != "other" {
+		t.Errorf("a sample of database 1: %v", got)
+	}
+	if got := s.SampleKeys(0, 0); got != nil {
+		t.Errorf("a sample of 0: %v", got)
+	}
+}
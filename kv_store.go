@@ -1,205 +1,764 @@
 package main
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"hash/maphash"
 	"log"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/pixperk/go-io-drill/internal/metrics"
 )
 
 type key struct {
 	name string
+	db   int // which logical database the key lives in, see db.go
 }
 
 type value struct {
-	data       string
+	data       string // any bytes, a Go string is just an immutable []byte, see SetBytes
+	obj        object // a hash, list, set or sorted set instead of a string, see types.go
 	expires_at time.Time
+	lsn        uint64        // LSN of the write that last changed the key
+	access     *access_stats // when and how often it was used, only with a memory cap, see eviction.go
+	gen        uint64        // s.view_gen when obj was made, an older one may be shared with a View, see view.go
 }
 
-type wal struct {
-	filename string
-	//why not using RWMutex here?
-	//because we want to allow only one writer at a time
-	//but multiple readers can read concurrently
-	//so a simple Mutex is sufficient
-	wal_lock sync.Mutex
-}
-
-type key_val_pair_map map[key]value
-
 type Store struct {
-	data key_val_pair_map
+	data *shard_map // see shard.go
 	lock sync.RWMutex
 	wal  *wal
+
+	persistence Persistence
+	last_lsn    uint64        // LSN of the last write, see lsn.go
+	stop        chan struct{} // closed by Close to stop the snapshot ticker
+	close_once  sync.Once     // Close only shuts down once
+
+	checkpoint_lock sync.Mutex // one checkpoint or COMPACT at a time, taken before s.lock, see snapshot.go
+
+	freezes    map[string]time.Time      // namespace ("" = everything) → when the freeze ends
+	validators map[string]ValueValidator // namespace → validator every Set in it has to pass
+
+	max_key_size   int // 0 = no limit
+	max_value_size int
+
+	soft_delete time.Duration     // how long deleted values stay restorable, 0 = hard deletes
+	tombstones  map[key]tombstone // soft-deleted keys, see softdelete.go
+
+	memory     int64 // estimated bytes of s.data, see eviction.go
+	max_memory int64 // 0 = no cap
+	eviction   EvictionPolicy
+
+	multi *Tx         // the shell's open MULTI, see tx.go
+	subs  subscribers // Subscribe's channels, see notify.go
+	watch *Tx         // the shell's WATCHes before MULTI, see watch.go
+	db    int         // the shell's SELECTed database, see db.go
+	scan  *scan_index // keys by slot for Scan, kept up to date by put and drop
+
+	watched map[key]*watched_key // keys open transactions watch, see watch.go
+
+	views_lock sync.Mutex
+	views      map[string]*MaterializedView // CreateView's, by name, see matview.go
+
+	load     LoadFunc  // read-through on a Get miss, see hooks.go
+	on_write WriteFunc // write-through after Set and Delete
+
+	expired_reads chan key // expired keys reads found, for the sweeper to delete, nil without Options.ExpireOnRead
+
+	undo_lock sync.Mutex
+	undo      map[uint64][]undo_entry // what writes group commit hasn't made durable yet replaced, by LSN, see undo.go
+	undoing   sync.WaitGroup          // batch_done's goroutines
+
+	counters op_counters   // what Stats reports, see stats.go
+	view_gen atomic.Uint64 // bumped by every View, see view.go
+	opened   time.Time
+
+	async              bool // writes don't wait for their WAL record to be durable
+	key_codec          KeyCodec
+	key_codec_set      bool // given in Options, otherwise taken from the manifest
+	truncate_torn_tail bool
+	replay_workers     int // goroutines replay applies records on, see replay.go
+	snapshot_parts     int // files the snapshot is split in, see snapshot_parts.go
+	warm_up            int // hot keys a checkpoint lists for the next start, see warmup.go
+	warming            warm_up_state
+	databases          int // how many databases SELECT can pick from
 }
 
-func new_wal(filename string) *wal {
-	return &wal{
-		filename: filename,
-		wal_lock: sync.Mutex{},
-	}
+// Options tunes a Store, the zero value gives the defaults
+type Options struct {
+	// WALSegmentSize is the size in bytes at which the WAL rolls over to a new segment
+	WALSegmentSize int64
+	// PreallocateWAL allocates each new segment up to WALSegmentSize when it is created, so
+	// appends only need a data flush instead of a metadata update on every fsync
+	PreallocateWAL bool
+	// DirectIO writes the active WAL segment with O_DIRECT (Linux only), through
+	// aligned, zero padded blocks, to compare bypassing the page cache with buffered writes
+	DirectIO bool
+	// DirectIOAlign is the address alignment of the O_DIRECT buffers, 4096 (default) up to 2MB
+	// HugePages backs 2MB aligned ones with huge pages on Linux when some are reserved
+	DirectIOAlign int
+	HugePages     bool
+	// CompressSegments gzips WAL segments in the background once they are sealed
+	CompressSegments bool
+	// IndexSegments writes an index next to every sealed WAL segment, so reads from an LSN
+	// seek into the log instead of decoding it from the start, see wal_index.go
+	// IndexKeys adds a filter of the keys each segment writes to its index (and implies IndexSegments)
+	IndexSegments bool
+	IndexKeys     bool
+	// WALStripes are more directories, ideally on other disks, to stripe the WAL across
+	// with its own: each batch is split between them and written to all at once, see
+	// wal_stripe.go. they are recorded in the manifest the first time and kept from then on
+	WALStripes []string
+	// WALFormat is the encoding of new WAL records, binary unless set to WALText
+	WALFormat WALFormat
+	// EncryptionKey (16, 24 or 32 bytes) encrypts WAL records and snapshots with AES-GCM
+	// and authenticates them on replay, WALFormat is ignored when it is set
+	EncryptionKey []byte
+	// GroupCommit batches concurrent writers' records behind a single fsync
+	// a write is visible to readers once it is queued, and the writer returns once it is durable
+	GroupCommit bool
+	// GroupCommitTarget is the p99 commit latency the adaptive batching window aims for (default 5ms)
+	GroupCommitTarget time.Duration
+	// AsyncWAL makes Set/Delete/Expire return as soon as their WAL record is queued for
+	// the writer goroutine, a crash can lose the writes still in the queue
+	// SetAsync/DeleteAsync give an ack channel to wait on for the ones that need to be durable
+	AsyncWAL bool
+	// TruncateTornTail makes Replay_wal recover from a crash mid-write: an invalid
+	// last record in the newest segment is cut off with a warning instead of failing startup,
+	// and a damaged record with intact ones after it is skipped with a warning
+	TruncateTornTail bool
+	// Durability is when WAL writes get fsynced: always (default), everysec or none
+	Durability Durability
+	// Persistence is what gets written to disk: the WAL (default), periodic snapshots, both, or nothing
+	// it can be changed at runtime with SetPersistence / CONFIG SET persistence
+	Persistence Persistence
+	// SnapshotInterval is how often the snapshot and both modes take a snapshot (default 5m)
+	SnapshotInterval time.Duration
+	// SnapshotParts splits the store's snapshot in this many files written and loaded at
+	// once, behind a manifest (default 1, a single file), see snapshot_parts.go
+	SnapshotParts int
+	// WarmUp is how many of the most used keys a checkpoint lists, for the store to give
+	// back their access counts (and Load the missing ones) first thing after a restart
+	// (0, the default, is none), see warmup.go
+	WarmUp int
+	// Validators maps a namespace (the key prefix before ':') to the validator its values
+	// must pass before Set logs them, see JSONValues and JSONSchema
+	Validators map[string]ValueValidator
+	// KeyCodec normalizes keys on every call (see LowercaseKeys, HashLongKeys)
+	// it is recorded in the manifest on first use; nil means "whatever the manifest says", identity for a new store
+	KeyCodec KeyCodec
+	// Archive is called with the path of every sealed WAL segment, see ArchiveFunc
+	// segments aren't deleted by CHECKPOINT or COMPACT until it has succeeded for them
+	Archive ArchiveFunc
+	// SoftDelete keeps deleted values around for this long so UNDELETE can bring them back
+	// zero (the default) deletes for good straight away
+	SoftDelete time.Duration
+	// ExpireInterval is how often the sweeper deletes expired keys (default 100ms, negative turns it off)
+	// without it an expired key stays in memory until it is read, written or compacted away
+	ExpireInterval time.Duration
+	// ExpireSample is how many keys each sweeper round looks at (default 20), see expire.go
+	ExpireSample int
+	// ExpireOnRead has reads delete the expired keys they find, through the sweeper and
+	// logged as DELETEs, instead of only hiding them until a sweep gets to them
+	ExpireOnRead bool
+	// MaxOpenFiles and MaxGoroutines cap the files and goroutines the store holds at once,
+	// going over returns a *ResourceLimitError (0, the default, is no limit), see resources.go
+	MaxOpenFiles  int
+	MaxGoroutines int
+	// MaxMemory caps the estimated bytes of keys and values, a SET that would go over
+	// evicts keys by the Eviction policy first (EvictLRU by default), see eviction.go
+	MaxMemory int64
+	Eviction  EvictionPolicy
+	// Databases is how many numbered databases SELECT can pick from (default 16), see db.go
+	Databases int
+	// Shards is how many locks the map is split under (default 32), see shard.go
+	Shards int
+	// ReplayWorkers is how many goroutines recovery applies WAL records on, each to its own
+	// shards (default 1, all of them on the one reading the log), see replay.go
+	ReplayWorkers int
+	// MaxKeySize and MaxValueSize cap the bytes of a key and of a value (0, the default,
+	// is no limit), a write over them fails with a *SizeLimitError, see validate.go
+	MaxKeySize   int
+	MaxValueSize int
+	// Load fetches a key Get misses from the system behind the store, and OnWrite
+	// gets every Set and Delete to write through to it, see hooks.go
+	Load    LoadFunc
+	OnWrite WriteFunc
 }
 
-func New_Store(wal_filename string) *Store {
-	return &Store{
-		data: make(key_val_pair_map),
+func New_Store(wal_filename string, opts Options) *Store {
+	key_codec := opts.KeyCodec
+	if key_codec == nil {
+		key_codec = IdentityKeys{}
+	}
+	snapshot_interval := opts.SnapshotInterval
+	if snapshot_interval <= 0 {
+		snapshot_interval = default_snapshot_interval
+	}
+	fresh := fresh_log(wal_filename)
+	s := &Store{
+		data: new_shard_map(opts.Shards),
+		scan: &scan_index{seed: maphash.MakeSeed()},
 		lock: sync.RWMutex{},
-		wal:  new_wal(wal_filename),
+		wal:  new_wal(wal_filename, opts),
+
+		persistence: opts.Persistence,
+		stop:        make(chan struct{}),
+		opened:      time.Now(),
+
+		soft_delete: opts.SoftDelete,
+
+		max_memory: opts.MaxMemory,
+		eviction:   opts.Eviction,
+
+		async:              opts.AsyncWAL,
+		key_codec:          key_codec,
+		key_codec_set:      opts.KeyCodec != nil,
+		truncate_torn_tail: opts.TruncateTornTail,
+		replay_workers:     opts.ReplayWorkers,
+		snapshot_parts:     opts.SnapshotParts,
+		warm_up:            opts.WarmUp,
+		databases:          opts.Databases,
+		max_key_size:       opts.MaxKeySize,
+		max_value_size:     opts.MaxValueSize,
+		load:               opts.Load,
+		on_write:           opts.OnWrite,
+	}
+	if s.eviction == nil {
+		s.eviction = EvictLRU
+	}
+	if fresh {
+		s.record_key_codec()
+	}
+	if s.databases <= 0 {
+		s.databases = default_databases
+	}
+	for namespace, v := range opts.Validators {
+		s.SetValidator(namespace, v)
+	}
+	if s.wal.committer != nil {
+		s.wal.committer.done = s.batch_done
+	}
+	s.wal.res.start("snapshot ticker", func() { s.snapshot_every(snapshot_interval) })
+	if opts.SoftDelete > 0 {
+		s.wal.res.start("tombstone purge", func() { s.purge_tombstones_every(min(opts.SoftDelete, time.Minute)) })
 	}
+	if opts.ExpireOnRead {
+		s.expired_reads = make(chan key, expired_reads_queue)
+	}
+	if opts.ExpireInterval >= 0 || opts.ExpireOnRead {
+		expire_interval, expire_sample := opts.ExpireInterval, opts.ExpireSample
+		if expire_interval == 0 {
+			expire_interval = default_expire_interval
+		}
+		if expire_sample <= 0 {
+			expire_sample = default_expire_sample
+		}
+		s.wal.res.start("expiry sweeper", func() { s.sweep_expired_every(expire_interval, expire_sample) })
+	}
+	return s
 }
 
-type operation_type int
+func (s *Store) Get(k key) (string, bool) {
+	store_reads_total.Inc()
+	k = s.encode_key(k)
+	v, found, live := s.get_string(k)
+	if live || s.load == nil {
+		return s.counters.hit(v, found)
+	}
+	return s.counters.hit(s.load_through(k))
+}
 
-const (
-	SET operation_type = iota
-	DELETE
-	EXPIRE
-)
+// get_string is Get without the loader, live says whether k holds anything at all
+// k is already encoded
+func (s *Store) get_string(k key) (v string, found bool, live bool) {
+	//only k's shard is locked, not the store, see shard.go
+	val, exists := s.data.load(k)
+	if !exists {
+		return "", false, false
+	}
 
-func (w *wal) log_op(key key, op operation_type, value string, ttl time.Duration) error {
-	w.wal_lock.Lock()
-	defer w.wal_lock.Unlock()
+	//check if key has expired
+	if !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		s.found_expired(k)
+		return "", false, false
+	}
+	//not a string, HGET and friends read those
+	if val.obj != nil {
+		return "", false, true
+	}
+	if val.access != nil {
+		val.access.touch()
+	}
+	return val.data, true, true
+}
 
-	//open file in append mode
-	//create if not exists
-	fd, err := os.OpenFile(w.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func (s *Store) Set(k key, ttl time.Duration, v string) error {
+	ack, err := s.SetAsync(k, ttl, v)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
+	//with group commit this waits for the batch fsync, outside the lock
+	//so concurrent writers can land in the same batch
+	if err := s.wait(ack); err != nil {
+		return err
+	}
+	return s.write_through("SET", s.encode_key(k), v, ttl)
+}
 
-	var log_entry string
-	switch op {
-	case SET:
-		log_entry = "SET " + key.name + " " + value
-	case DELETE:
-		log_entry = "DELETE " + key.name
-	case EXPIRE:
-		log_entry = "EXPIRE " + key.name + " " + ttl.String()
-	default:
-		return errors.New("unknown operation type")
+// SetBytes is Set for binary values (serialized protobufs, images...), v is copied
+// values are bytes all the way through: the WAL codecs, snapshots and replay keep
+// them exactly, CDC base64s what isn't UTF-8. only the shell can't type them
+func (s *Store) SetBytes(k key, ttl time.Duration, v []byte) error {
+	return s.Set(k, ttl, string(v))
+}
+
+// GetBytes is Get for binary values, the slice is the caller's to modify
+func (s *Store) GetBytes(k key) ([]byte, bool) {
+	v, exists := s.Get(k)
+	if !exists {
+		return nil, false
 	}
+	return []byte(v), true
+}
 
-	log_entry = log_entry + "|" + compute_crc(log_entry) + "\n"
+// SetAsync applies the write and queues its WAL record without waiting for the disk
+// the returned channel gets nil once the record is durable, or the write error
+func (s *Store) SetAsync(k key, ttl time.Duration, v string) (<-chan error, error) {
+	k = s.encode_key(k)
+	var expires_at time.Time
+	if ttl != 0 {
+		expires_at = time.Now().Add(ttl)
+	}
 
-	writer := bufio.NewWriter(fd)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.set(k, v, expires_at)
+}
 
-	n := 0
-	for n < len(log_entry) {
-		nn, err := writer.WriteString(log_entry[n:])
-		if err != nil {
-			return err
-		}
-		n += nn
+// set is the write half of every SET: checks, room, the record, the new value
+// Caller must hold s.lock, k is already encoded
+func (s *Store) set(k key, v string, expires_at time.Time) (<-chan error, error) {
+	if err := s.check_frozen(k); err != nil {
+		return nil, err
 	}
+	if err := s.validate(k, v); err != nil {
+		return nil, err
+	}
+	if err := s.make_room(k, v); err != nil {
+		return nil, err
+	}
+	rec := wal_record{lsn: s.next_lsn(), op: SET, key: k.name, db: k.db, value: v, expires_at: expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		return nil, err
+	}
+	s.counters.sets.Add(1)
 
-	err = writer.Flush()
+	old, _ := s.data.get(k)
+	s.put(k, value{data: v, expires_at: expires_at, lsn: rec.lsn})
+	if old.access != nil {
+		old.access.touch()
+	}
+	delete(s.tombstones, k)
+	s.announce(rec)
+	return ack, nil
+}
 
+// SetOptions are SetOpts' conditions, the zero value makes it a plain Set
+type SetOptions struct {
+	NX      bool // only set k if it is missing or expired
+	XX      bool // only set k if it is live
+	KeepTTL bool // keep k's expiry instead of taking ttl
+}
+
+// SetOpts is Set with Redis's SET flags, it reports whether it set k
+// a condition that doesn't hold isn't an error, nothing is written or logged
+func (s *Store) SetOpts(k key, ttl time.Duration, v string, opts SetOptions) (bool, error) {
+	if opts.NX && opts.XX {
+		return false, errors.New("NX and XX can't be used together")
+	}
+	if opts.KeepTTL && ttl != 0 {
+		return false, fmt.Errorf("%w, KEEPTTL can't be used with a ttl", ErrInvalidTTL)
+	}
+	k = s.encode_key(k)
+	var expires_at time.Time
+	if ttl != 0 {
+		expires_at = time.Now().Add(ttl)
+	}
+
+	s.lock.Lock()
+	val, exists := s.data.get(k)
+	if exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		val, exists = value{}, false
+	}
+	if (opts.NX && exists) || (opts.XX && !exists) {
+		s.lock.Unlock()
+		return false, nil
+	}
+	if opts.KeepTTL {
+		expires_at = val.expires_at
+	}
+	ack, err := s.set(k, v, expires_at)
+	s.lock.Unlock()
 	if err != nil {
-		return err
+		return false, err
 	}
+	if err := s.wait(ack); err != nil {
+		return true, err
+	}
+	if opts.KeepTTL && !expires_at.IsZero() {
+		ttl = time.Until(expires_at)
+	}
+	return true, s.write_through("SET", k, v, ttl)
+}
 
-	err = fd.Sync()
+// GetSet sets k to v, with no expiry, and returns what it held before in the same step
+// a missing or expired key returns false, a key holding a hash or another object ErrWrongType
+func (s *Store) GetSet(k key, v string) (string, bool, error) {
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	val, exists := s.data.get(k)
+	if exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		val, exists = value{}, false
+	}
+	if val.obj != nil {
+		s.lock.Unlock()
+		return "", false, ErrWrongType
+	}
+	ack, err := s.set(k, v, time.Time{})
+	s.lock.Unlock()
 	if err != nil {
+		return "", false, err
+	}
+	return val.data, exists, s.wait(ack)
+}
+
+func (s *Store) Delete(k key) error {
+	ack, err := s.DeleteAsync(k)
+	if err != nil {
+		return err
+	}
+	if err := s.wait(ack); err != nil {
 		return err
 	}
+	return s.write_through("DELETE", s.encode_key(k), "", 0)
+}
 
-	log.Printf("\nlogged operation to WAL: %s\n", log_entry)
-	return nil
+// DeleteAsync is the SetAsync of Delete
+func (s *Store) DeleteAsync(k key) (<-chan error, error) {
+	k = s.encode_key(k)
+	s.lock.Lock()
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	rec := wal_record{lsn: s.next_lsn(), op: DELETE, key: k.name, db: k.db, expires_at: s.purge_time(k)}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return nil, err
+	}
+	s.remove(k, rec.lsn, rec.expires_at)
+	s.announce(rec)
+	s.lock.Unlock()
+	s.counters.deletes.Add(1)
+	return ack, nil
 }
 
-func (s *Store) Get(k key) (string, bool) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+// wait blocks on a write's ack, unless the store is in async mode
+// a write that failed has been undone by the time it returns, see undo.go
+func (s *Store) wait(ack <-chan error) error {
+	if s.async {
+		return nil
+	}
+	err := <-ack
+	if err != nil {
+		s.lock.Lock()
+		s.undo_failed()
+		s.lock.Unlock()
+	}
+	return err
+}
 
-	val, exists := s.data[k]
-	if !exists {
-		return "", false
+func (s *Store) Expire(k key, ttl time.Duration) error {
+	_, err := s.ExpireOpts(k, ttl, ExpireOptions{})
+	return err
+}
+
+// the conditions of Redis 7's EXPIRE, a key that doesn't expire counts as expiring
+// later than any ttl for GT and LT
+type ExpireOptions struct {
+	NX bool // only if k has no expiry
+	XX bool // only if k has one
+	GT bool // only if the new expiry is later than k's
+	LT bool // only if the new expiry is sooner than k's
+}
+
+// ExpireOpts is Expire with Redis's EXPIRE flags, it reports whether it set the expiry
+// a missing key is an error, a condition that doesn't hold isn't, nothing is logged
+func (s *Store) ExpireOpts(k key, ttl time.Duration, opts ExpireOptions) (bool, error) {
+	if opts.NX && (opts.XX || opts.GT || opts.LT) {
+		return false, errors.New("NX can't be used with XX, GT or LT")
 	}
+	if opts.GT && opts.LT {
+		return false, errors.New("GT and LT can't be used together")
+	}
+	k = s.encode_key(k)
+	s.lock.Lock()
 
-	//check if key has expired
-	if !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
-		return "", false
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	//an expired key the sweeper hasn't got to yet is gone, EXPIRE mustn't bring it back
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		s.lock.Unlock()
+		return false, ErrKeyNotFound
+	}
+
+	//logged as an absolute time, replaying it later mustn't start the ttl over
+	expires_at := time.Now().Add(ttl)
+	persistent := val.expires_at.IsZero()
+	if (opts.NX && !persistent) || (opts.XX && persistent) ||
+		(opts.GT && (persistent || !expires_at.After(val.expires_at))) ||
+		(opts.LT && !persistent && !expires_at.Before(val.expires_at)) {
+		s.lock.Unlock()
+		return false, nil
 	}
-	return val.data, true
+	rec := wal_record{lsn: s.next_lsn(), op: EXPIRE, key: k.name, db: k.db, expires_at: expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+
+	val.expires_at = expires_at
+	val.lsn = rec.lsn
+	s.put(k, val)
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return true, s.wait(ack)
 }
 
-func (s *Store) Set(k key, ttl time.Duration, v string) error {
+// GetDel returns the value and deletes the key in one step
+// an expired or missing key returns false and logs nothing
+func (s *Store) GetDel(k key) (string, bool, error) {
+	k = s.encode_key(k)
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
-	if err := s.wal.log_op(k, SET, v, ttl); err != nil {
-		return err
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return "", false, err
+	}
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		s.lock.Unlock()
+		return "", false, nil
+	}
+	if val.obj != nil {
+		s.lock.Unlock()
+		return "", false, ErrWrongType
 	}
 
-	s.data[k] = value{
-		data: v,
-		expires_at: func() time.Time {
-			if ttl == 0 {
-				return time.Time{}
-			}
-			return time.Now().Add(ttl)
-		}(),
+	rec := wal_record{lsn: s.next_lsn(), op: GETDEL, key: k.name, db: k.db, expires_at: s.purge_time(k)}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return "", false, err
 	}
-	return nil
+	s.remove(k, rec.lsn, rec.expires_at)
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return val.data, true, s.wait(ack)
 }
 
-func (s *Store) Delete(k key) error {
+// GetEx returns the value and resets its expiry in one step:
+// to now+ttl if ttl > 0, or to never if persist is set
+// with neither it is a plain Get and nothing is logged
+func (s *Store) GetEx(k key, ttl time.Duration, persist bool) (string, bool, error) {
+	if ttl <= 0 && !persist {
+		v, exists := s.Get(k)
+		return v, exists, nil
+	}
+
+	k = s.encode_key(k)
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
-	if err := s.wal.log_op(k, DELETE, "", 0); err != nil {
-		return err
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return "", false, err
+	}
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		s.lock.Unlock()
+		return "", false, nil
+	}
+	if val.obj != nil {
+		s.lock.Unlock()
+		return "", false, ErrWrongType
 	}
-	delete(s.data, k)
 
-	return nil
+	var expires_at time.Time
+	if !persist {
+		expires_at = time.Now().Add(ttl)
+	}
+	rec := wal_record{lsn: s.next_lsn(), op: GETEX, key: k.name, db: k.db, expires_at: expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return "", false, err
+	}
+	val.expires_at = expires_at
+	val.lsn = rec.lsn
+	s.put(k, val)
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return val.data, true, s.wait(ack)
 }
 
-func (s *Store) Expire(k key, ttl time.Duration) error {
+// Append adds suffix to the end of k's value, creating the key if it is missing
+// or expired, and returns the new length. appending to a live key logs only the
+// suffix (an APPEND record), so log-style values don't get rewritten in full
+// on every write; creating it logs a SET
+func (s *Store) Append(k key, suffix string) (int, error) {
+	k = s.encode_key(k)
 	s.lock.Lock()
-	defer s.lock.Unlock()
 
-	val, exists := s.data[k]
-	if !exists {
-		return errors.New("the key does not exist")
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	val, exists := s.data.get(k)
+	if exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		val, exists = value{}, false
+	}
+	if val.obj != nil {
+		s.lock.Unlock()
+		return 0, ErrWrongType
+	}
+	v := val.data + suffix
+	if err := s.validate(k, v); err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	if err := s.make_room(k, v); err != nil {
+		s.lock.Unlock()
+		return 0, err
 	}
 
-	if err := s.wal.log_op(k, EXPIRE, "", ttl); err != nil {
-		return err
+	rec := wal_record{lsn: s.next_lsn(), op: SET, key: k.name, db: k.db, value: v}
+	if exists {
+		rec.op, rec.value, rec.expires_at = APPEND, suffix, val.expires_at
+	}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	s.put(k, value{data: v, expires_at: val.expires_at, lsn: rec.lsn})
+	if val.access != nil {
+		val.access.touch()
 	}
+	delete(s.tombstones, k)
+	s.announce(rec)
+	s.lock.Unlock()
 
-	val.expires_at = time.Now().Add(ttl)
-	s.data[k] = val
-	return nil
+	return len(v), s.wait(ack)
+}
+
+// CompareAndSet replaces k's value with v only if it currently is `expected`,
+// and reports whether it did. a missing or expired key never matches
+// the key keeps its expiry, and only a swap that happened is logged (as a CAS)
+func (s *Store) CompareAndSet(k key, expected string, v string) (bool, error) {
+	return s.compare_and_set(k, func(val value) bool { return val.data == expected }, v)
+}
+
+// compare_and_set is CompareAndSet with the comparison left to match, which gets k's live string value
+func (s *Store) compare_and_set(k key, match func(val value) bool, v string) (bool, error) {
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		s.lock.Unlock()
+		return false, nil
+	}
+	if val.obj != nil {
+		s.lock.Unlock()
+		return false, ErrWrongType
+	}
+	if !match(val) {
+		s.lock.Unlock()
+		return false, nil
+	}
+	if err := s.validate(k, v); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	if err := s.make_room(k, v); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+
+	rec := wal_record{lsn: s.next_lsn(), op: CAS, key: k.name, db: k.db, value: v, expires_at: val.expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	val.data = v
+	val.lsn = rec.lsn
+	s.put(k, val)
+	if val.access != nil {
+		val.access.touch()
+	}
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return true, s.wait(ack)
 }
 
 func (s *Store) Exists(k key) bool {
+	store_reads_total.Inc()
+	k = s.encode_key(k)
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 
-	_, exists := s.data[k]
+	_, exists := s.data.get(k)
 	return exists
 }
 
 func (s *Store) Ttl(k key) (string, time.Duration, string, error) { //returns current time, ttl duration, expiry time, error
+	k = s.encode_key(k)
 	s.lock.RLock()
 	defer s.lock.RUnlock()
 	empty_time := format_time_into_readable_string(time.Time{})
 
-	val, exists := s.data[k]
+	val, exists := s.data.get(k)
 	if !exists {
-		return empty_time, 0, empty_time, errors.New("the key does not exist")
+		return empty_time, 0, empty_time, ErrKeyNotFound
 	}
 
 	//check if key has expired
 	if !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
-		return empty_time, 0, empty_time, errors.New("the key has expired")
+		s.found_expired(k)
+		return empty_time, 0, empty_time, ErrKeyExpired
 	}
 	expiry_time := val.expires_at
 	var remaining_ttl time.Duration
@@ -211,97 +770,144 @@ func (s *Store) Ttl(k key) (string, time.Duration, string, error) { //returns cu
 	return format_time_into_readable_string(time.Now()), remaining_ttl, format_time_into_readable_string(expiry_time), nil
 }
 
+// Replay_wal rebuilds the in-memory map from the WAL, segment by segment in order
+// if a checkpoint left a snapshot, it is loaded first and only the WAL after it is replayed
+// an ephemeral store (PersistNone) starts empty
+// it is Recover without the report
 func (s *Store) Replay_wal() error {
+	_, err := s.Recover()
+	return err
+}
+
+// Close flushes anything still buffered or queued, stops the WAL's
+// background goroutines and closes the WAL file
+// the store must not be used after Close, closing it again does nothing
+func (s *Store) Close() (err error) {
+	s.close_once.Do(func() {
+		//the views write through the store, they are done before the WAL closes
+		s.stop_views()
+		close(s.stop)
+		s.warming.running.Wait()
+
+		s.lock.Lock()
+		s.subs.close_all()
+		err = s.wal.close()
+		s.lock.Unlock()
+		//an undo waiting for the lock finds the store stopped, see batch_done
+		s.undoing.Wait()
+	})
+	return err
+}
+
+// GroupCommitStats reports the group commit window controller, false if group commit is off
+func (s *Store) GroupCommitStats() (GroupCommitStats, bool) {
+	if s.wal.committer == nil {
+		return GroupCommitStats{}, false
+	}
+	return s.wal.committer.snapshot(), true
+}
+
+// CompactWAL rewrites the WAL so it only holds the live state, one SET (or RESTORE) per surviving key
+// with its absolute expiry, expired keys are dropped, and the old segments are deleted once the new one is in place
+// soft-deleted keys still in their window keep their SET and DELETE
+func (s *Store) CompactWAL() (int, error) {
+	//it may replace the snapshot, not while a checkpoint is writing it
+	s.checkpoint_lock.Lock()
+	defer s.checkpoint_lock.Unlock()
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	file, err := os.Open(s.wal.filename)
-	if err != nil {
-		return err
+	//records still queued for group commit must land before the log is replaced,
+	//and ones that didn't mustn't be in it
+	s.undo_failed()
+	if err := s.wal.wait_pending(); err != nil {
+		return 0, err
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		data, err := verify_crc(line)
-		if err != nil {
-			return err
-		}
-		parts := strings.Fields(data)
-		if len(parts) == 0 {
-			continue
+	now := time.Now()
+	records := make([]wal_record, 0, s.data.len())
+	s.data.each(0, func(k key, v value) bool {
+		if v.expires_at.IsZero() || v.expires_at.After(now) {
+			records = append(records, value_record(k, v))
 		}
+		return true
+	})
+	//soft-deleted keys have to stay undeletable after the rewrite
+	records = append(records, s.tombstone_records()...)
+	//each key keeps the LSN of its last write, in order so the new log's LSNs still only go up
+	sort.Slice(records, func(i, j int) bool { return records[i].lsn < records[j].lsn })
+
+	//the history before now is gone, ReplayFrom has to know before the log is replaced
+	if err := s.set_log_start(s.last_lsn); err != nil {
+		return 0, err
+	}
+	if err := s.wal.rewrite(records, s.replace_stale_snapshot); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
 
-		if err := s.replayEntry(parts); err != nil {
-			return err
+// replayEntry applies a WAL record without acquiring locks or logging to WAL
+// expiries go in as they were logged, even ones that have passed since: a later EXPIRE
+// may have pushed one out again before it hit, so what expired while we were down is
+// only known at the end (Recover drops those keys then)
+// Caller must hold s.lock
+func (s *Store) replayEntry(rec wal_record) error {
+	k := key{name: rec.key, db: rec.db}
+
+	switch rec.op {
+	case SET:
+		expires_at := rec.expires_at
+		if expires_at.IsZero() && rec.ttl != 0 {
+			expires_at = time.Now().Add(rec.ttl) // old relative ttl record
 		}
+		s.put(k, value{data: rec.value, expires_at: expires_at, lsn: rec.lsn})
+		delete(s.tombstones, k)
 
-		log.Printf("Replayed WAL entry: %s\n", data)
-	}
+	case DELETE, GETDEL:
+		//expires_at is the tombstone's purge time if it was a soft delete
+		s.remove(k, rec.lsn, rec.expires_at)
 
-	if err := scanner.Err(); err != nil {
-		return err
-	}
+	case UNDELETE:
+		s.replay_undelete(k, rec.lsn)
 
-	return nil
+	case CAS:
+		//only swaps that happened are logged, so it replays as a SET that keeps the expiry
+		s.put(k, value{data: rec.value, expires_at: rec.expires_at, lsn: rec.lsn})
+		delete(s.tombstones, k)
 
-}
+	case APPEND:
+		//only logged for a key that was live, it is here even if it has expired since
+		val, _ := s.data.get(k)
+		s.put(k, value{data: val.data + rec.value, expires_at: rec.expires_at, lsn: rec.lsn})
+		delete(s.tombstones, k)
 
-// replayEntry processes a WAL entry without acquiring locks or logging to WAL
-// Caller must hold s.lock
-func (s *Store) replayEntry(input_parts []string) error {
-	cmd := strings.ToUpper(input_parts[0])
+	case HSET, HDEL, RESTORE, LPUSH, RPUSH, LPOP, RPOP, SADD, SREM, ZADD, ZREM:
+		return s.replay_object(rec)
 
-	switch cmd {
-	case "SET":
-		if len(input_parts) < 3 {
-			return errors.New("SET command requires at least a key and a value")
-		}
-		key_name := input_parts[1]
-		val_str := input_parts[2]
-		var ttl time.Duration
-		if len(input_parts) == 4 {
-			var err error
-			ttl, err = time.ParseDuration(input_parts[3])
-			if err != nil {
-				return errors.New("invalid TTL format")
-			}
-		}
-		s.data[key{name: key_name}] = value{
-			data: val_str,
-			expires_at: func() time.Time {
-				if ttl == 0 {
-					return time.Time{}
-				}
-				return time.Now().Add(ttl)
-			}(),
-		}
+	case RENAME, COPY:
+		return s.replay_move(rec)
 
-	case "DELETE":
-		if len(input_parts) != 2 {
-			return errors.New("DELETE command requires a key")
+	case EXPIRE:
+		if val, exists := s.data.get(k); exists {
+			expires_at := rec.expires_at
+			if expires_at.IsZero() {
+				expires_at = time.Now().Add(rec.ttl) // old relative ttl record
+			}
+			val.expires_at = expires_at
+			val.lsn = rec.lsn
+			s.put(k, val)
 		}
-		key_name := input_parts[1]
-		delete(s.data, key{name: key_name})
 
-	case "EXPIRE":
-		if len(input_parts) != 3 {
-			return errors.New("EXPIRE command requires a key and a TTL")
-		}
-		key_name := input_parts[1]
-		ttl, err := time.ParseDuration(input_parts[2])
-		if err != nil {
-			return errors.New("invalid ttl format")
-		}
-		k := key{name: key_name}
-		if val, exists := s.data[k]; exists {
-			val.expires_at = time.Now().Add(ttl)
-			s.data[k] = val
+	case GETEX:
+		if val, exists := s.data.get(k); exists {
+			val.expires_at = rec.expires_at
+			val.lsn = rec.lsn
+			s.put(k, val)
 		}
 
 	default:
-		return errors.New("Unknown command: " + cmd)
+		return errors.New("Unknown command: " + rec.op.String())
 	}
 
 	return nil
@@ -309,37 +915,58 @@ func (s *Store) replayEntry(input_parts []string) error {
 
 func (s *Store) Process(input_parts []string) error {
 	cmd := strings.ToUpper(input_parts[0])
+	if queued, err := s.process_multi(cmd, input_parts); queued {
+		return err
+	}
 
 	switch cmd {
 	case "SET":
+		// SET key value [ttl] [NX|XX] [KEEPTTL]
 		if len(input_parts) < 3 {
 			return errors.New("SET command requires at least a key and a value")
 		}
 		key_name := input_parts[1]
 		value := input_parts[2]
 		var ttl time.Duration
-		if len(input_parts) == 4 {
-			var err error
-			ttl, err = time.ParseDuration(input_parts[3])
-			if err != nil {
-				return errors.New("invalid TTL format")
+		var opts SetOptions
+		for _, arg := range input_parts[3:] {
+			switch strings.ToUpper(arg) {
+			case "NX":
+				opts.NX = true
+			case "XX":
+				opts.XX = true
+			case "KEEPTTL":
+				opts.KeepTTL = true
+			default:
+				var err error
+				if ttl, err = parse_ttl(arg); err != nil {
+					return err
+				}
 			}
 		}
-		err := s.Set(key{name: key_name}, ttl, value)
+		set, err := s.SetOpts(s.shell_key(key_name), ttl, value, opts)
 		if err != nil {
 			return err
-		} else {
-			log.Printf("Key %s set successfully\n", key_name)
 		}
+		if !set {
+			if opts.NX {
+				return errors.New("key " + key_name + " already exists")
+			}
+			return ErrKeyNotFound
+		}
+		log.Printf("Key %s set successfully\n", key_name)
 
 	case "GET":
 		if len(input_parts) != 2 {
 			return errors.New("GET command requires a key")
 		}
 		key_name := input_parts[1]
-		value, exists := s.Get(key{name: key_name})
+		value, exists := s.Get(s.shell_key(key_name))
+		if !exists && s.Type(s.shell_key(key_name)) != "none" {
+			return ErrWrongType
+		}
 		if !exists {
-			return errors.New("key does not exist")
+			return ErrKeyNotFound
 
 		} else {
 			log.Printf("Value for key %s: %s\n", key_name, value)
@@ -350,35 +977,266 @@ func (s *Store) Process(input_parts []string) error {
 			return errors.New("DELETE command requires a key")
 		}
 		key_name := input_parts[1]
-		err := s.Delete(key{name: key_name})
+		err := s.Delete(s.shell_key(key_name))
 		if err != nil {
 			return err
 		} else {
 			log.Printf("Key %s deleted successfully\n", key_name)
 		}
 
-	case "EXPIRE":
+	case "GETSET":
+		if len(input_parts) != 3 {
+			return errors.New("GETSET command requires a key and a value")
+		}
+		key_name := input_parts[1]
+		old, existed, err := s.GetSet(s.shell_key(key_name), input_parts[2])
+		if err != nil {
+			return err
+		}
+		if !existed {
+			log.Printf("Key %s set, it had no value before\n", key_name)
+		} else {
+			log.Printf("Key %s set, old value: %s\n", key_name, old)
+		}
+
+	case "GETASOF":
+		// GETASOF key lsn|time
 		if len(input_parts) != 3 {
+			return errors.New("GETASOF command requires a key and an LSN or time")
+		}
+		key_name := input_parts[1]
+		lsn, at, err := parse_point(input_parts[2])
+		if err != nil {
+			return err
+		}
+		var value string
+		var exists bool
+		if at.IsZero() {
+			value, exists, err = s.GetAsOf(s.shell_key(key_name), lsn)
+		} else {
+			value, exists, err = s.GetAsOfTime(s.shell_key(key_name), at)
+		}
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrKeyNotFound
+		}
+		log.Printf("Value for key %s as of %s: %s\n", key_name, input_parts[2], value)
+
+	case "HISTORY":
+		if len(input_parts) != 2 {
+			return errors.New("HISTORY command requires a key")
+		}
+		history, err := s.History(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		for _, e := range history {
+			at := "-"
+			if !e.At.IsZero() {
+				at = format_time_into_readable_string(e.At)
+			}
+			log.Printf("  %d %s %s %s\n", e.LSN, at, e.Op, e.Value)
+		}
+		log.Printf("%d writes to %s in the log\n", len(history), input_parts[1])
+
+	case "UNDELETE":
+		if len(input_parts) != 2 {
+			return errors.New("UNDELETE command requires a key")
+		}
+		key_name := input_parts[1]
+		if err := s.Undelete(s.shell_key(key_name)); err != nil {
+			return err
+		}
+		log.Printf("Key %s restored\n", key_name)
+
+	case "EXPIRE":
+		// EXPIRE key ttl [NX|XX|GT|LT]
+		if len(input_parts) < 3 {
 			return errors.New("EXPIRE command requires a key and a TTL")
 		}
 		key_name := input_parts[1]
-		ttl, err := time.ParseDuration(input_parts[2])
+		ttl, err := parse_ttl(input_parts[2])
 		if err != nil {
-			return errors.New("invalid ttl format")
+			return err
 		}
-		err = s.Expire(key{name: key_name}, ttl)
+		var opts ExpireOptions
+		for _, arg := range input_parts[3:] {
+			switch strings.ToUpper(arg) {
+			case "NX":
+				opts.NX = true
+			case "XX":
+				opts.XX = true
+			case "GT":
+				opts.GT = true
+			case "LT":
+				opts.LT = true
+			default:
+				return errors.New("EXPIRE takes NX, XX, GT or LT, got: " + arg)
+			}
+		}
+		set, err := s.ExpireOpts(s.shell_key(key_name), ttl, opts)
 		if err != nil {
 			return err
+		}
+		if !set {
+			log.Printf("Expiry for key %s left as it was, the condition doesn't hold\n", key_name)
 		} else {
 			log.Printf("Expiry for key %s set to %s successfully\n", key_name, ttl.String())
 		}
 
+	case "GETDEL":
+		if len(input_parts) != 2 {
+			return errors.New("GETDEL command requires a key")
+		}
+		key_name := input_parts[1]
+		value, exists, err := s.GetDel(s.shell_key(key_name))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrKeyNotFound
+		}
+		log.Printf("Value for key %s: %s (deleted)\n", key_name, value)
+
+	case "GETEX":
+		// GETEX key [ttl|PERSIST]
+		if len(input_parts) != 2 && len(input_parts) != 3 {
+			return errors.New("GETEX command requires a key and optionally a TTL or PERSIST")
+		}
+		key_name := input_parts[1]
+		var ttl time.Duration
+		persist := false
+		if len(input_parts) == 3 {
+			if strings.ToUpper(input_parts[2]) == "PERSIST" {
+				persist = true
+			} else {
+				var err error
+				if ttl, err = parse_ttl(input_parts[2]); err != nil {
+					return err
+				}
+				if ttl <= 0 {
+					return fmt.Errorf("%w, GETEX takes a positive ttl or PERSIST", ErrInvalidTTL)
+				}
+			}
+		}
+		value, exists, err := s.GetEx(s.shell_key(key_name), ttl, persist)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return ErrKeyNotFound
+		}
+		log.Printf("Value for key %s: %s\n", key_name, value)
+
+	case "KEYS":
+		if len(input_parts) != 2 {
+			return errors.New("KEYS command requires a pattern")
+		}
+		keys := s.Keys(s.db, input_parts[1])
+		log.Printf("%d keys match %s\n", len(keys), input_parts[1])
+		for _, k := range keys {
+			log.Printf("  %s\n", k)
+		}
+
+	case "RANDOMKEY":
+		k, ok := s.RandomKey(s.db)
+		if !ok {
+			return errors.New("the database is empty")
+		}
+		log.Printf("Random key: %s\n", k)
+
+	case "APPEND":
+		if len(input_parts) != 3 {
+			return errors.New("APPEND command requires a key and a value")
+		}
+		key_name := input_parts[1]
+		n, err := s.Append(s.shell_key(key_name), input_parts[2])
+		if err != nil {
+			return err
+		}
+		log.Printf("Key %s is now %d bytes\n", key_name, n)
+
+	case "INCR", "DECR", "INCRBY", "DECRBY":
+		// INCR key, INCRBY key n (DECR, DECRBY the same)
+		by := cmd == "INCRBY" || cmd == "DECRBY"
+		if (by && len(input_parts) != 3) || (!by && len(input_parts) != 2) {
+			if by {
+				return errors.New(cmd + " command requires a key and an amount")
+			}
+			return errors.New(cmd + " command requires a key")
+		}
+		key_name := input_parts[1]
+		n := int64(1)
+		if by {
+			var err error
+			if n, err = strconv.ParseInt(input_parts[2], 10, 64); err != nil {
+				return errors.New("invalid amount: " + input_parts[2])
+			}
+		}
+		var result int64
+		var err error
+		if strings.HasPrefix(cmd, "DECR") {
+			result, err = s.DecrBy(s.shell_key(key_name), n)
+		} else {
+			result, err = s.IncrBy(s.shell_key(key_name), n)
+		}
+		if err != nil {
+			return err
+		}
+		log.Printf("Value for key %s: %d\n", key_name, result)
+
+	case "CAS":
+		if len(input_parts) != 4 {
+			return errors.New("CAS command requires a key, the expected value and the new one")
+		}
+		key_name := input_parts[1]
+		swapped, err := s.CompareAndSet(s.shell_key(key_name), input_parts[2], input_parts[3])
+		if err != nil {
+			return err
+		}
+		if !swapped {
+			return errors.New("value of key " + key_name + " is not " + input_parts[2])
+		}
+		log.Printf("Key %s set to %s\n", key_name, input_parts[3])
+
+	case "GETV", "CASV":
+		return s.process_version(cmd, input_parts)
+
+	case "HSET", "HGET", "HDEL", "HGETALL":
+		return s.process_hash(cmd, input_parts)
+
+	case "LPUSH", "RPUSH", "LPOP", "RPOP", "LRANGE", "LLEN":
+		return s.process_list(cmd, input_parts)
+
+	case "SADD", "SREM", "SISMEMBER", "SMEMBERS", "SCARD":
+		return s.process_set(cmd, input_parts)
+
+	case "ZADD", "ZREM", "ZSCORE", "ZCARD", "ZRANGE", "ZRANGEBYSCORE":
+		return s.process_zset(cmd, input_parts)
+
+	case "SELECT":
+		return s.process_select(input_parts)
+
+	case "RENAME", "COPY":
+		return s.process_move(cmd, input_parts)
+
+	case "DUMP", "RESTORE":
+		return s.process_dump(cmd, input_parts)
+
+	case "TYPE":
+		if len(input_parts) != 2 {
+			return errors.New("TYPE command requires a key")
+		}
+		log.Printf("Type of key %s: %s\n", input_parts[1], s.Type(s.shell_key(input_parts[1])))
+
 	case "TTL":
 		if len(input_parts) != 2 {
 			return errors.New("TTL command requires a key")
 		}
 		key_name := input_parts[1]
-		current_time, ttl_duration, expiry_time, err := s.Ttl(key{name: key_name})
+		current_time, ttl_duration, expiry_time, err := s.Ttl(s.shell_key(key_name))
 		if err != nil {
 			return err
 		} else {
@@ -390,29 +1248,56 @@ func (s *Store) Process(input_parts []string) error {
 			return errors.New("EXISTS command requires a key")
 		}
 		key_name := input_parts[1]
-		exists := s.Exists(key{name: key_name})
+		exists := s.Exists(s.shell_key(key_name))
 		if exists {
 			log.Printf("Key %s exists\n", key_name)
 		} else {
 			log.Printf("Key %s does not exist\n", key_name)
 		}
 
-		case "HYDRATE":
+	case "OBJECT":
+		if len(input_parts) != 3 || strings.ToUpper(input_parts[1]) != "ENCODING" {
+			return errors.New("OBJECT command requires ENCODING and a key")
+		}
+		key_name := input_parts[2]
+		encoding, err := s.ObjectEncoding(s.shell_key(key_name))
+		if err != nil {
+			return err
+		}
+		log.Printf("Encoding of key %s: %s\n", key_name, encoding)
+
+	case "HYDRATE":
 		s.HydrateSampleData()
 
 	case "EXPLAIN":
-		// EXPLAIN SCAN [...]
+		// EXPLAIN SCAN [...] or EXPLAIN INSERT [...]
+		if len(input_parts) >= 2 && strings.ToUpper(input_parts[1]) == "INSERT" {
+			plan, err := ParseInsert(input_parts[1:])
+			if err != nil {
+				return err
+			}
+			s.in_selected_db(plan.Query)
+			log.Print(PrintInsertPlan(plan))
+			return nil
+		}
 		if len(input_parts) < 2 || strings.ToUpper(input_parts[1]) != "SCAN" {
-			return errors.New("EXPLAIN requires SCAN command")
+			return errors.New("EXPLAIN requires SCAN or INSERT command")
 		}
 		plan, err := ParseQuery(input_parts[1:]) // skip "EXPLAIN"
 		if err != nil {
 			return err
 		}
+		s.in_selected_db(plan)
 		log.Print(PrintQueryPlan(plan))
 
 	//query execution commands
 	case "SCAN":
+		// SCAN cursor [MATCH pattern] [COUNT n] walks the keys, see scan.go
+		if len(input_parts) > 1 {
+			if cursor, err := strconv.ParseUint(input_parts[1], 10, 64); err == nil {
+				return s.process_scan(cursor, input_parts[2:])
+			}
+		}
 		// SCAN [LIMIT n] [WHERE key LIKE pattern] [WHERE value CONTAINS str]
 		plan, err := ParseQuery(input_parts)
 		if err != nil {
@@ -438,6 +1323,177 @@ func (s *Store) Process(input_parts []string) error {
 			}
 		}
 
+	case "FREEZE":
+		// FREEZE [namespace] [duration], no namespace freezes everything
+		var namespace string
+		var d time.Duration
+		for _, arg := range input_parts[1:] {
+			if parsed, err := time.ParseDuration(arg); err == nil {
+				d = parsed
+			} else {
+				namespace = arg
+			}
+		}
+		s.Freeze(namespace, d)
+		log.Printf("Writes to %s frozen\n", freeze_scope(namespace))
+
+	case "UNFREEZE":
+		var namespace string
+		if len(input_parts) > 1 {
+			namespace = input_parts[1]
+		}
+		s.Unfreeze(namespace)
+		log.Printf("Writes to %s unfrozen\n", freeze_scope(namespace))
+
+	case "VALIDATE":
+		// VALIDATE namespace JSON | SCHEMA file | OFF
+		if len(input_parts) < 3 {
+			return errors.New("VALIDATE command requires a namespace and JSON, SCHEMA file or OFF")
+		}
+		namespace := input_parts[1]
+		switch strings.ToUpper(input_parts[2]) {
+		case "JSON":
+			s.SetValidator(namespace, JSONValues{})
+		case "SCHEMA":
+			if len(input_parts) != 4 {
+				return errors.New("VALIDATE SCHEMA requires a schema file")
+			}
+			schema, err := LoadJSONSchema(input_parts[3])
+			if err != nil {
+				return err
+			}
+			s.SetValidator(namespace, schema)
+		case "OFF":
+			s.SetValidator(namespace, nil)
+		default:
+			return errors.New("VALIDATE command requires JSON, SCHEMA file or OFF")
+		}
+		log.Printf("Validation for namespace %s set to %s\n", namespace, strings.ToUpper(input_parts[2]))
+
+	case "CONFIG":
+		// CONFIG GET persistence, CONFIG SET persistence <mode>
+		if len(input_parts) < 3 || strings.ToLower(input_parts[2]) != "persistence" {
+			return errors.New("CONFIG requires GET persistence or SET persistence <wal|snapshot|both|none>")
+		}
+		switch strings.ToUpper(input_parts[1]) {
+		case "GET":
+			log.Printf("persistence: %s\n", s.Persistence())
+		case "SET":
+			if len(input_parts) != 4 {
+				return errors.New("CONFIG SET persistence requires a mode")
+			}
+			p, err := ParsePersistence(input_parts[3])
+			if err != nil {
+				return err
+			}
+			if err := s.SetPersistence(p); err != nil {
+				return err
+			}
+			log.Printf("persistence set to %s\n", p)
+		default:
+			return errors.New("CONFIG requires GET or SET")
+		}
+
+	case "VIEW":
+		// VIEW CREATE name SCAN ..., VIEW DROP name, VIEW LIST
+		if len(input_parts) < 2 {
+			return errors.New("VIEW requires CREATE name SCAN ..., DROP name or LIST")
+		}
+		switch strings.ToUpper(input_parts[1]) {
+		case "CREATE":
+			if len(input_parts) < 4 || strings.ToUpper(input_parts[3]) != "SCAN" {
+				return errors.New("VIEW CREATE requires a name and a SCAN query")
+			}
+			v, err := s.CreateView(input_parts[2], input_parts[3:])
+			if err != nil {
+				return err
+			}
+			log.Printf("View %s created, %d rows under %s\n", v.Name, v.Status().Rows, v.Prefix)
+		case "DROP":
+			if len(input_parts) != 3 {
+				return errors.New("VIEW DROP requires a name")
+			}
+			if err := s.DropView(input_parts[2]); err != nil {
+				return err
+			}
+			log.Printf("View %s dropped\n", input_parts[2])
+		case "LIST":
+			for _, v := range s.Views() {
+				log.Printf("%s: %d rows, up to LSN %d of %d, %d pending, %s stale, %d rebuilds (%s)\n",
+					v.Name, v.Rows, v.AppliedLSN, v.LastLSN, v.Pending, v.Staleness, v.Rebuilds, v.Query)
+			}
+		default:
+			return errors.New("VIEW requires CREATE, DROP or LIST")
+		}
+
+	case "METRICS":
+		// METRICS [JSON]
+		var exporter metrics.Exporter = metrics.Prometheus{}
+		if len(input_parts) > 1 && strings.ToUpper(input_parts[1]) == "JSON" {
+			exporter = metrics.JSON{Indent: true}
+		}
+		return metrics.Default.Export(os.Stdout, exporter)
+
+	case "RESOURCES":
+		for _, line := range resource_lines(s.Resources()) {
+			println(line)
+		}
+
+	case "INFO":
+		for _, line := range info_lines(s.Stats()) {
+			println(line)
+		}
+
+	case "CHECKPOINT":
+		if _, err := s.Checkpoint(); err != nil {
+			return err
+		}
+
+	case "SAVE":
+		if len(input_parts) != 2 {
+			return errors.New("SAVE command requires a file")
+		}
+		if _, err := s.SaveSnapshot(input_parts[1]); err != nil {
+			return err
+		}
+
+	case "COMPACT":
+		n, err := s.CompactWAL()
+		if err != nil {
+			return err
+		}
+		log.Printf("WAL compacted to %d records\n", n)
+
+	case "CDC":
+		// CDC <file>, exports the WAL as json change events
+		if len(input_parts) != 2 {
+			return errors.New("CDC command requires an output file")
+		}
+		fd, err := os.Create(input_parts[1])
+		if err != nil {
+			return err
+		}
+		defer fd.Close()
+		lsn, err := s.ExportCDC(fd, 0)
+		if err != nil {
+			return err
+		}
+		log.Printf("Exported %d change events to %s\n", lsn, input_parts[1])
+
+	case "INSERT":
+		// INSERT <key column> <value column> [ttl] SCAN ...
+		plan, err := ParseInsert(input_parts)
+		if err != nil {
+			return err
+		}
+
+		op := BuildOperatorTree(s, plan.Query)
+		n, err := ExecuteInsert(s, op, plan)
+		if err != nil {
+			return err
+		}
+		log.Printf("Inserted %d rows\n", n)
+
 	default:
 		return errors.New("Unknown command: " + cmd)
 
@@ -472,7 +1528,7 @@ func (s *Store) HydrateSampleData() {
 	}
 
 	for _, sample := range samples {
-		s.Set(key{name: sample.key}, sample.ttl, sample.value)
+		s.Set(s.shell_key(sample.key), sample.ttl, sample.value)
 	}
 
 	log.Printf("Hydrated store with %d sample entries\n", len(samples))
@@ -484,26 +1540,3 @@ func format_time_into_readable_string(t time.Time) string {
 	}
 	return t.Format(time.RFC1123)
 }
-
-func compute_crc(data string) string {
-	checksum := crc32.ChecksumIEEE([]byte(data))
-	return fmt.Sprintf("%08x", checksum)
-}
-
-func verify_crc(line string) (string, error) {
-	idx := strings.LastIndex(line, "|")
-	if idx == -1 {
-		return "", errors.New("no CRC found in line")
-	}
-
-	data := line[:idx]
-	crc_str := line[idx+1:]
-
-	computed_crc := compute_crc(data)
-
-	if computed_crc != crc_str {
-		return "", errors.New("CRC mismatch")
-	}
-
-	return data, nil
-}
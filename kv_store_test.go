@@ -0,0 +1,385 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Close flushes and closes the active segment, and a second Close is harmless
+func TestCloseTwice(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	s = open_store(t, path, PersistWAL)
+	defer s.Close()
+	if v, _ := s.Get(key{name: "a"}); v != "1" {
+		t.Errorf("a = %q after Close and reopen, want 1", v)
+	}
+}
+
+// CompactWAL leaves a record per live key with the LSN of its last write, in one
+// segment, and a restart on it gets the same store back
+func TestCompactWAL(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{WALSegmentSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		set(t, s, "k"+strconv.Itoa(i%10), strconv.Itoa(i))
+	}
+	s.Delete(key{name: "k0"})
+	s.Set(key{name: "gone"}, time.Millisecond, "x")
+	s.Set(key{name: "later"}, time.Hour, "y")
+	s.HSet(key{name: "h"}, map[string]string{"f": "1"})
+	time.Sleep(5 * time.Millisecond)
+	last := s.LastLSN()
+
+	n, err := s.CompactWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 11 {
+		t.Errorf("%d records after compaction, want 11", n)
+	}
+	if segments := wal_segments(t, s); len(segments) != 1 {
+		t.Errorf("segments after compaction: %v", segments)
+	}
+	//the history is gone, what comes after isn't
+	if err := s.ReplayFrom(last-1, func(Entry) error { return nil }); err == nil {
+		t.Error("ReplayFrom before the compaction")
+	}
+	set(t, s, "after", "1")
+	if got := entries(t, s, last); got != "SET after" || s.LastLSN() != last+1 {
+		t.Errorf("the write after compaction: %s at LSN %d, want %d", got, s.LastLSN(), last+1)
+	}
+	s.Close()
+
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	want := map[string]string{"after": "1", "later": "y"}
+	for i := 1; i < 10; i++ {
+		want["k"+strconv.Itoa(i)] = strconv.Itoa(90 + i)
+	}
+	for name, v := range want {
+		if got := get(t, s, name); got != v {
+			t.Errorf("%s after a restart: %q, want %q", name, got, v)
+		}
+	}
+	if v, _ := s.data.get(key{name: "k9"}); v.lsn != 100 {
+		t.Errorf("k9 came back with LSN %d, its last write's was 100", v.lsn)
+	}
+	if keys := s.Keys(0, "*"); len(keys) != len(want)+1 {
+		t.Errorf("keys after a restart: %v", keys)
+	}
+	if f, _, _ := s.HGet(key{name: "h"}, "f"); f != "1" {
+		t.Errorf("h's field after a restart: %q", f)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "later"}); ttl <= 59*time.Minute {
+		t.Errorf("later's ttl after a restart: %v", ttl)
+	}
+}
+
+// reopen closes s and recovers the store from its log at path
+func reopen(t *testing.T, s *Store, path string) *Store {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return open_store(t, path, PersistWAL)
+}
+
+// GETDEL hands back the value it deletes, GETEX the value it changes the expiry of,
+// and both replay
+func TestGetDelGetEx(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+	s.Set(key{name: "c"}, time.Hour, "3")
+	s.Set(key{name: "gone"}, time.Millisecond, "x")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	time.Sleep(5 * time.Millisecond)
+
+	if v, ok, err := s.GetDel(key{name: "a"}); v != "1" || !ok || err != nil {
+		t.Errorf("GETDEL a: %q %v %v", v, ok, err)
+	}
+	if v, ok, err := s.GetDel(key{name: "a"}); ok || err != nil {
+		t.Errorf("GETDEL a again: %q %v %v", v, ok, err)
+	}
+	if _, ok, _ := s.GetDel(key{name: "gone"}); ok {
+		t.Error("GETDEL of an expired key")
+	}
+	if _, _, err := s.GetDel(key{name: "h"}); err != ErrWrongType {
+		t.Errorf("GETDEL of a hash: %v", err)
+	}
+
+	if v, ok, err := s.GetEx(key{name: "b"}, time.Hour, false); v != "2" || !ok || err != nil {
+		t.Errorf("GETEX b 1h: %q %v %v", v, ok, err)
+	}
+	if v, ok, _ := s.GetEx(key{name: "c"}, 0, true); v != "3" || !ok {
+		t.Errorf("GETEX c PERSIST: %q %v", v, ok)
+	}
+	last := s.LastLSN()
+	if v, ok, _ := s.GetEx(key{name: "c"}, 0, false); v != "3" || !ok || s.LastLSN() != last {
+		t.Errorf("GETEX c with nothing to change: %q %v, logged %v", v, ok, s.LastLSN() != last)
+	}
+	if _, ok, _ := s.GetEx(key{name: "a"}, time.Hour, false); ok {
+		t.Error("GETEX of a deleted key")
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if s.Exists(key{name: "a"}) {
+		t.Error("a is back after a restart")
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "b"}); ttl <= 59*time.Minute {
+		t.Errorf("b's ttl after a restart: %v", ttl)
+	}
+	if _, ttl, _, err := s.Ttl(key{name: "c"}); ttl != 0 || err != nil {
+		t.Errorf("c's ttl after PERSIST and a restart: %v %v", ttl, err)
+	}
+}
+
+// CompareAndSet swaps only the value it was told to expect, keeps the key's ttl, and
+// counters built on it lose no increments
+func TestCompareAndSet(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	s.Set(key{name: "a"}, time.Hour, "1")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	if ok, err := s.CompareAndSet(key{name: "a"}, "2", "3"); ok || err != nil {
+		t.Errorf("CAS a 2 3: %v %v", ok, err)
+	}
+	if ok, err := s.CompareAndSet(key{name: "a"}, "1", "2"); !ok || err != nil {
+		t.Errorf("CAS a 1 2: %v %v", ok, err)
+	}
+	if ok, _ := s.CompareAndSet(key{name: "missing"}, "", "1"); ok || s.Exists(key{name: "missing"}) {
+		t.Error("CAS created a key")
+	}
+	if _, err := s.CompareAndSet(key{name: "h"}, "v", "1"); err != ErrWrongType {
+		t.Errorf("CAS of a hash: %v", err)
+	}
+
+	set(t, s, "n", "0")
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 50 {
+				for {
+					v := get(t, s, "n")
+					n, _ := strconv.Atoi(v)
+					if ok, err := s.CompareAndSet(key{name: "n"}, v, strconv.Itoa(n+1)); err != nil {
+						t.Error(err)
+						return
+					} else if ok {
+						break
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got := get(t, s, "n"); got != "400" {
+		t.Errorf("n is %s after 400 increments", got)
+	}
+	if ops := entries(t, s, 0); !strings.Contains(ops, "CAS a") {
+		t.Errorf("logged: %s", ops)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "a"}); get(t, s, "a") != "2" || get(t, s, "n") != "400" || ttl <= 59*time.Minute {
+		t.Errorf("after a restart a=%s ttl %v, n=%s", get(t, s, "a"), ttl, get(t, s, "n"))
+	}
+}
+
+// APPEND creates a missing key with a SET and only logs the suffix for one that is
+// there, keeping its ttl, and both replay to the whole value
+func TestAppend(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	for _, step := range []struct {
+		suffix string
+		want   int
+	}{{"ab", 2}, {"cd", 4}, {"", 4}, {"e", 5}} {
+		if n, err := s.Append(key{name: "log"}, step.suffix); n != step.want || err != nil {
+			t.Errorf("APPEND log %q: %d %v, want %d", step.suffix, n, err, step.want)
+		}
+	}
+	s.Set(key{name: "ttl"}, time.Hour, "x")
+	s.Append(key{name: "ttl"}, "y")
+	s.Set(key{name: "gone"}, time.Millisecond, "old")
+	time.Sleep(5 * time.Millisecond)
+	if n, _ := s.Append(key{name: "gone"}, "new"); n != 3 {
+		t.Errorf("APPEND to an expired key: %d", n)
+	}
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	if _, err := s.Append(key{name: "h"}, "x"); err != ErrWrongType {
+		t.Errorf("APPEND to a hash: %v", err)
+	}
+	if ops := entries(t, s, 0); !strings.HasPrefix(ops, "SET log, APPEND log, APPEND log, APPEND log") {
+		t.Errorf("logged %s", ops)
+	}
+	var logged []string
+	s.ReplayFrom(0, func(e Entry) error {
+		if e.Key == "log" {
+			logged = append(logged, e.Value)
+		}
+		return nil
+	})
+	if got := strings.Join(logged, ","); got != "ab,cd,,e" {
+		t.Errorf("values logged for log: %s", got)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "ttl"}); get(t, s, "log") != "abcde" || get(t, s, "ttl") != "xy" || ttl <= 59*time.Minute || get(t, s, "gone") != "new" {
+		t.Errorf("after a restart log=%s ttl=%s (%v left) gone=%s", get(t, s, "log"), get(t, s, "ttl"), ttl, get(t, s, "gone"))
+	}
+}
+
+// binary values come back byte for byte from the map, a replay of either WAL format
+// and a snapshot
+func TestBinaryValues(t *testing.T) {
+	quiet_log(t)
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	values := map[string][]byte{
+		"bytes":   all,
+		"lines":   []byte("a\nb\r\nSET x y|deadbeef\n"),
+		"invalid": {0xff, 0xfe, 0x00, 0xc3},
+		"empty":   {},
+	}
+	for name, format := range map[string]WALFormat{"binary": WALBinary, "text": WALText} {
+		path := filepath.Join(t.TempDir(), "wal.log")
+		opts := Options{WALFormat: format}
+		s, _, err := Recover("", path, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range values {
+			if err := s.SetBytes(key{name: k}, 0, v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, _ := s.GetBytes(key{name: "bytes"})
+		got[0] = 'x'
+		for restart := range 2 {
+			s.Close()
+			if s, _, err = Recover("", path, opts); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			for k, want := range values {
+				if got, ok := s.GetBytes(key{name: k}); !ok || string(got) != string(want) {
+					t.Errorf("%s, restart %d: %s is %q, want %q", name, restart, k, got, want)
+				}
+			}
+			//the second restart loads them from the snapshot
+			if _, err := s.Checkpoint(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s.Close()
+	}
+}
+
+// GETSET hands back what the key held, nothing for one missing or expired, and leaves
+// it without an expiry
+func TestGetSet(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	if old, existed, err := s.GetSet(key{name: "a"}, "1"); old != "" || existed || err != nil {
+		t.Errorf("GETSET of a missing key: %q %v %v", old, existed, err)
+	}
+	s.Set(key{name: "a"}, time.Hour, "2")
+	if old, existed, err := s.GetSet(key{name: "a"}, "3"); old != "2" || !existed || err != nil {
+		t.Errorf("GETSET a: %q %v %v", old, existed, err)
+	}
+	s.Set(key{name: "gone"}, time.Millisecond, "old")
+	time.Sleep(5 * time.Millisecond)
+	if old, existed, _ := s.GetSet(key{name: "gone"}, "new"); old != "" || existed {
+		t.Errorf("GETSET of an expired key: %q %v", old, existed)
+	}
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	if _, _, err := s.GetSet(key{name: "h"}, "x"); err != ErrWrongType {
+		t.Errorf("GETSET of a hash: %v", err)
+	}
+	if err := s.Process(strings.Fields("GETSET a 4")); err != nil || get(t, s, "a") != "4" {
+		t.Errorf("shell GETSET: %v, a=%s", err, get(t, s, "a"))
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "a"}); get(t, s, "a") != "4" || ttl != 0 || get(t, s, "gone") != "new" {
+		t.Errorf("after a restart a=%s with %v left, gone=%s", get(t, s, "a"), ttl, get(t, s, "gone"))
+	}
+}
+
+// SET's NX, XX and KEEPTTL: a condition that doesn't hold writes and logs nothing, and
+// KEEPTTL's expiry comes back with the key
+func TestSetOpts(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	if ok, err := s.SetOpts(key{name: "a"}, 0, "1", SetOptions{XX: true}); ok || err != nil {
+		t.Errorf("SET a XX on a missing key: %v %v", ok, err)
+	}
+	if ok, err := s.SetOpts(key{name: "a"}, time.Hour, "1", SetOptions{NX: true}); !ok || err != nil {
+		t.Errorf("SET a NX on a missing key: %v %v", ok, err)
+	}
+	last := s.LastLSN()
+	if ok, _ := s.SetOpts(key{name: "a"}, 0, "2", SetOptions{NX: true}); ok || get(t, s, "a") != "1" || s.LastLSN() != last {
+		t.Errorf("SET a NX on a live key: %v, a=%s, %d records logged", ok, get(t, s, "a"), s.LastLSN()-last)
+	}
+	if ok, _ := s.SetOpts(key{name: "a"}, 0, "3", SetOptions{XX: true, KeepTTL: true}); !ok || get(t, s, "a") != "3" {
+		t.Errorf("SET a XX KEEPTTL: %v, a=%s", ok, get(t, s, "a"))
+	}
+	s.Set(key{name: "gone"}, time.Millisecond, "old")
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := s.SetOpts(key{name: "gone"}, 0, "new", SetOptions{NX: true}); !ok {
+		t.Error("SET NX on an expired key didn't set it")
+	}
+	if _, err := s.SetOpts(key{name: "a"}, 0, "x", SetOptions{NX: true, XX: true}); err == nil {
+		t.Error("NX and XX together")
+	}
+	if _, err := s.SetOpts(key{name: "a"}, time.Minute, "x", SetOptions{KeepTTL: true}); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("KEEPTTL with a ttl: %v", err)
+	}
+	if err := s.Process(strings.Fields("SET a 4 NX")); err == nil {
+		t.Error("shell SET NX on a live key")
+	}
+	if err := s.Process(strings.Fields("SET b 5 XX")); err != ErrKeyNotFound {
+		t.Errorf("shell SET XX on a missing key: %v", err)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "a"}); get(t, s, "a") != "3" || ttl <= 59*time.Minute || get(t, s, "gone") != "new" {
+		t.Errorf("after a restart a=%s with %v left, gone=%s", get(t, s, "a"), ttl, get(t, s, "gone"))
+	}
+}
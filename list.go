@@ -0,0 +1,300 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+)
+
+// lists: a deque of strings, pushed and popped at either end, e.g. a work queue
+// with RPUSH to enqueue and LPOP to take the oldest job. a push logs the elements
+// it adds, a pop only how many it took off: replay pops the same ones again
+//
+// the deque is a ring buffer that doubles when it is full and halves when it is
+// down to a quarter, so pushes and pops at both ends are O(1) and LRANGE indexes straight in
+
+// smallest ring a list keeps
+const list_min_ring = 8
+
+type list_object struct {
+	ring  []string
+	head  int // index of the first element in ring
+	n     int
+	bytes int64
+}
+
+func new_list_object() *list_object {
+	return &list_object{ring: make([]string, list_min_ring)}
+}
+
+func (l *list_object) kind() string { return "list" }
+func (l *list_object) len() int     { return l.n }
+func (l *list_object) size() int64  { return l.bytes }
+
+// members is the elements head to tail
+func (l *list_object) members() []string {
+	return l.slice(0, l.n)
+}
+
+// at is the i'th element from the head, 0 <= i < n
+func (l *list_object) at(i int) string {
+	return l.ring[(l.head+i)%len(l.ring)]
+}
+
+// slice copies out elements [from, to)
+func (l *list_object) slice(from, to int) []string {
+	out := make([]string, 0, to-from)
+	for i := from; i < to; i++ {
+		out = append(out, l.at(i))
+	}
+	return out
+}
+
+func (l *list_object) resize(size int) {
+	ring := make([]string, size)
+	for i := 0; i < l.n; i++ {
+		ring[i] = l.at(i)
+	}
+	l.ring, l.head = ring, 0
+}
+
+func (l *list_object) push_front(v string) {
+	if l.n == len(l.ring) {
+		l.resize(2 * len(l.ring))
+	}
+	l.head = (l.head - 1 + len(l.ring)) % len(l.ring)
+	l.ring[l.head] = v
+	l.n++
+	l.bytes += int64(len(v)) + element_overhead
+}
+
+func (l *list_object) push_back(v string) {
+	if l.n == len(l.ring) {
+		l.resize(2 * len(l.ring))
+	}
+	l.ring[(l.head+l.n)%len(l.ring)] = v
+	l.n++
+	l.bytes += int64(len(v)) + element_overhead
+}
+
+// pop takes one element off the front or the back, the list mustn't be empty
+func (l *list_object) pop(front bool) string {
+	i := (l.head + l.n - 1) % len(l.ring)
+	if front {
+		i = l.head
+		l.head = (l.head + 1) % len(l.ring)
+	}
+	v := l.ring[i]
+	l.ring[i] = "" // the ring mustn't keep popped strings alive
+	l.n--
+	l.bytes -= int64(len(v)) + element_overhead
+	if len(l.ring) > list_min_ring && l.n <= len(l.ring)/4 {
+		l.resize(len(l.ring) / 2)
+	}
+	return v
+}
+
+func (l *list_object) apply(op operation_type, args []string) error {
+	switch op {
+	case LPUSH:
+		for _, v := range args {
+			l.push_front(v)
+		}
+	case RPUSH, RESTORE:
+		for _, v := range args {
+			l.push_back(v)
+		}
+	case LPOP, RPOP:
+		if len(args) != 1 {
+			return errors.New(op.String() + " record needs a count")
+		}
+		count, err := strconv.Atoi(args[0])
+		if err != nil || count < 0 {
+			return errors.New("invalid count in " + op.String() + " record: " + args[0])
+		}
+		for i := 0; i < count && l.n > 0; i++ {
+			l.pop(op == LPOP)
+		}
+	default:
+		return errors.New(op.String() + " is not a list operation")
+	}
+	return nil
+}
+
+// LPush adds values to the head of the list at k, creating it if needed, and returns
+// its new length. like Redis they go in one at a time, so LPush(k, "a", "b") leaves b first
+func (s *Store) LPush(k key, values ...string) (int, error) {
+	return s.push(k, LPUSH, values)
+}
+
+// RPush adds values to the tail of the list at k, creating it if needed, and returns its new length
+func (s *Store) RPush(k key, values ...string) (int, error) {
+	return s.push(k, RPUSH, values)
+}
+
+func (s *Store) push(k key, op operation_type, values []string) (int, error) {
+	if len(values) == 0 {
+		return 0, errors.New(op.String() + " needs at least one value")
+	}
+	length := 0
+	err := s.write_object(k, "list", op, func(obj object) ([]string, error) {
+		length = len(values)
+		if obj != nil {
+			length += obj.len()
+		}
+		return values, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length, nil
+}
+
+// LPop takes up to count values off the head of the list at k, none if k is missing
+// the list goes when its last value does
+func (s *Store) LPop(k key, count int) ([]string, error) {
+	return s.pop(k, LPOP, count)
+}
+
+// RPop is LPop from the tail, the values come back tail first
+func (s *Store) RPop(k key, count int) ([]string, error) {
+	return s.pop(k, RPOP, count)
+}
+
+func (s *Store) pop(k key, op operation_type, count int) ([]string, error) {
+	if count < 0 {
+		return nil, errors.New(op.String() + " count must not be negative")
+	}
+	var popped []string
+	err := s.write_object(k, "list", op, func(obj object) ([]string, error) {
+		if obj == nil || count == 0 {
+			return nil, nil
+		}
+		l := obj.(*list_object)
+		n := min(count, l.n)
+		if op == LPOP {
+			popped = l.slice(0, n)
+		} else {
+			for i := l.n - 1; i >= l.n-n; i-- {
+				popped = append(popped, l.at(i))
+			}
+		}
+		return []string{strconv.Itoa(n)}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return popped, nil
+}
+
+// LRange returns the elements from start to stop, both included, of the list at k
+// negative indexes count from the tail (-1 is the last element), out of range ones are clamped
+func (s *Store) LRange(k key, start, stop int) ([]string, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "list")
+	if obj == nil {
+		return nil, err
+	}
+	l := obj.(*list_object)
+	if start < 0 {
+		start = max(l.n+start, 0)
+	}
+	if stop < 0 {
+		stop = l.n + stop
+	}
+	stop = min(stop, l.n-1)
+	if start > stop {
+		return nil, nil
+	}
+	return l.slice(start, stop+1), nil
+}
+
+// LLen is the length of the list at k, 0 if k is missing
+func (s *Store) LLen(k key) (int, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "list")
+	if obj == nil {
+		return 0, err
+	}
+	return obj.len(), nil
+}
+
+// LPUSH/RPUSH key value [value ...], LPOP/RPOP key [count], LRANGE key start stop, LLEN key
+func (s *Store) process_list(cmd string, input_parts []string) error {
+	switch cmd {
+	case "LPUSH", "RPUSH":
+		if len(input_parts) < 3 {
+			return errors.New(cmd + " command requires a key and at least one value")
+		}
+		push := s.RPush
+		if cmd == "LPUSH" {
+			push = s.LPush
+		}
+		n, err := push(s.shell_key(input_parts[1]), input_parts[2:]...)
+		if err != nil {
+			return err
+		}
+		log.Printf("List %s is now %d long\n", input_parts[1], n)
+
+	case "LPOP", "RPOP":
+		if len(input_parts) != 2 && len(input_parts) != 3 {
+			return errors.New(cmd + " command requires a key")
+		}
+		count := 1
+		if len(input_parts) == 3 {
+			var err error
+			if count, err = strconv.Atoi(input_parts[2]); err != nil || count < 0 {
+				return errors.New("invalid count")
+			}
+		}
+		pop := s.RPop
+		if cmd == "LPOP" {
+			pop = s.LPop
+		}
+		popped, err := pop(s.shell_key(input_parts[1]), count)
+		if err != nil {
+			return err
+		}
+		if len(popped) == 0 {
+			return errors.New("list is empty")
+		}
+		for _, v := range popped {
+			log.Printf("  %s\n", v)
+		}
+
+	case "LRANGE":
+		if len(input_parts) != 4 {
+			return errors.New("LRANGE command requires a key, a start and a stop")
+		}
+		start, err1 := strconv.Atoi(input_parts[2])
+		stop, err2 := strconv.Atoi(input_parts[3])
+		if err1 != nil || err2 != nil {
+			return errors.New("LRANGE start and stop must be integers")
+		}
+		values, err := s.LRange(s.shell_key(input_parts[1]), start, stop)
+		if err != nil {
+			return err
+		}
+		for i, v := range values {
+			log.Printf("  %d) %s\n", i+1, v)
+		}
+		log.Printf("%d elements\n", len(values))
+
+	case "LLEN":
+		if len(input_parts) != 2 {
+			return errors.New("LLEN command requires a key")
+		}
+		n, err := s.LLen(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		log.Printf("List %s is %d long\n", input_parts[1], n)
+	}
+	return nil
+}
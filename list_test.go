@@ -0,0 +1,110 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// lists, see list.go
+
+// the ring grows and shrinks under pushes and pops at both ends and keeps the order
+// a slice would
+func TestListRing(t *testing.T) {
+	l := new_list_object()
+	var want []string
+	for i := range 1000 {
+		v := strconv.Itoa(i)
+		if i%3 == 0 {
+			l.push_front(v)
+			want = append([]string{v}, want...)
+		} else {
+			l.push_back(v)
+			want = append(want, v)
+		}
+	}
+	if !slices.Equal(l.members(), want) {
+		t.Fatal("the list after 1000 pushes isn't in push order")
+	}
+	for i := range 990 {
+		if front := i%2 == 0; front {
+			if got := l.pop(true); got != want[0] {
+				t.Fatalf("pop from the head: %s, want %s", got, want[0])
+			}
+			want = want[1:]
+		} else {
+			if got := l.pop(false); got != want[len(want)-1] {
+				t.Fatalf("pop from the tail: %s, want %s", got, want[len(want)-1])
+			}
+			want = want[:len(want)-1]
+		}
+	}
+	if !slices.Equal(l.members(), want) || len(l.ring) > 4*list_min_ring {
+		t.Errorf("%v in a ring of %d, want %v", l.members(), len(l.ring), want)
+	}
+}
+
+// a queue with RPUSH and LPOP, LRANGE's indexes, and pops replayed as counts
+func TestList(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	q := key{name: "jobs"}
+	if n, err := s.RPush(q, "a", "b", "c"); n != 3 || err != nil {
+		t.Errorf("RPUSH a b c: %d %v", n, err)
+	}
+	if n, _ := s.LPush(q, "y", "z"); n != 5 {
+		t.Errorf("LPUSH y z: %d", n)
+	}
+	for _, tc := range []struct {
+		start, stop int
+		want        string
+	}{{0, -1, "z y a b c"}, {1, 2, "y a"}, {-2, 100, "b c"}, {-100, 0, "z"}, {3, 1, ""}} {
+		if got, _ := s.LRange(q, tc.start, tc.stop); strings.Join(got, " ") != tc.want {
+			t.Errorf("LRANGE %d %d: %v, want %s", tc.start, tc.stop, got, tc.want)
+		}
+	}
+	if got, _ := s.LPop(q, 2); strings.Join(got, " ") != "z y" {
+		t.Errorf("LPOP 2: %v", got)
+	}
+	if got, _ := s.RPop(q, 1); strings.Join(got, " ") != "c" {
+		t.Errorf("RPOP 1: %v", got)
+	}
+	if _, err := s.LPop(q, -1); err == nil {
+		t.Error("LPOP -1")
+	}
+	if _, err := s.RPush(q); err == nil {
+		t.Error("RPUSH without values")
+	}
+	set(t, s, "str", "x")
+	if _, err := s.LPush(key{name: "str"}, "v"); err != ErrWrongType {
+		t.Errorf("LPUSH on a string: %v", err)
+	}
+	s.RPush(key{name: "gone"}, "1", "2")
+	if got, _ := s.LPop(key{name: "gone"}, 10); len(got) != 2 || s.Type(key{name: "gone"}) != "none" {
+		t.Errorf("LPOP 10 of 2: %v, then a %s", got, s.Type(key{name: "gone"}))
+	}
+
+	var logged []string
+	s.ReplayFrom(0, func(e Entry) error {
+		if e.Key == q.name {
+			args, _ := decode_args(e.Value)
+			logged = append(logged, e.Op+" "+strings.Join(args, " "))
+		}
+		return nil
+	})
+	if got := strings.Join(logged, ", "); got != "RPUSH a b c, LPUSH y z, LPOP 2, RPOP 1" {
+		t.Errorf("logged %s", got)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if got, _ := s.LRange(q, 0, -1); strings.Join(got, " ") != "a b" {
+		t.Errorf("after a restart: %v", got)
+	}
+	if n, _ := s.LLen(q); n != 2 {
+		t.Errorf("LLEN after a restart: %d", n)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strconv"
+)
+
+// every write gets a log sequence number from a per-store counter that only
+// goes up, and the LSN is persisted in its WAL record (and in snapshots)
+// LSNs are assigned under s.lock, so LSN order is WAL order
+// writes that aren't logged (snapshot / none persistence) still use one up,
+// so there can be gaps, but never a repeat
+
+// next_lsn hands out the LSN for a write
+// caller must hold s.lock for writing
+func (s *Store) next_lsn() uint64 {
+	s.last_lsn++
+	return s.last_lsn
+}
+
+// LastLSN is the LSN of the most recent write
+func (s *Store) LastLSN() uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.last_lsn
+}
+
+// lsn_counter numbers records from logs written before LSNs existed:
+// a record without one gets the one after the previous record's
+type lsn_counter struct {
+	last uint64
+}
+
+func (c *lsn_counter) stamp(rec *wal_record) {
+	if rec.lsn == 0 {
+		rec.lsn = c.last + 1
+	}
+	c.last = max(c.last, rec.lsn)
+}
+
+// the manifest remembers where the WAL's history starts: checkpoints and
+// COMPACT throw away the records before them, so a consumer that is behind
+// that point can't catch up from the log anymore
+const manifest_log_start = "log_start_lsn"
+
+func (s *Store) set_log_start(lsn uint64) error {
+	return update_manifest(s.manifest_path(), manifest_log_start, strconv.FormatUint(lsn, 10))
+}
+
+func (s *Store) log_start() (uint64, error) {
+	manifest, err := read_manifest(s.manifest_path())
+	if err != nil || manifest[manifest_log_start] == "" {
+		return 0, err
+	}
+	return strconv.ParseUint(manifest[manifest_log_start], 10, 64)
+}
+
+// ReplayFrom calls fn with every logged write after lsn, in LSN order,
+// a transaction's writes once it committed and not at all if it didn't,
+// for replication or incremental backups that remember the last LSN they saw
+// it fails if the log no longer goes back that far (a checkpoint or COMPACT
+// dropped it) or if the store isn't keeping a WAL
+// writers are blocked while it runs
+func (s *Store) ReplayFrom(lsn uint64, fn func(e Entry) error) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if !s.persistence.logs() {
+		return errors.New("ReplayFrom needs the WAL, persistence is " + s.persistence.String())
+	}
+	start, err := s.log_start()
+	if err != nil {
+		return err
+	}
+	if lsn < start {
+		return errors.New("LSN " + strconv.FormatUint(lsn, 10) + " is older than the log, it starts after " + strconv.FormatUint(start, 10))
+	}
+
+	//everything queued so far has to be readable from the segments
+	if err := s.wal.wait_pending(); err != nil {
+		return err
+	}
+	s.wal.wal_lock.Lock()
+	defer s.wal.wal_lock.Unlock()
+
+	reader, err := OpenWALReader(s.wal.filename)
+	if err != nil {
+		return err
+	}
+	reader.wal.aead = s.wal.aead
+	defer reader.Close()
+	if err := reader.Seek(lsn); err != nil {
+		return err
+	}
+	//transactions are handed over once their COMMIT is read, without the markers
+	var txs tx_buffer
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if e.LSN <= lsn {
+			continue
+		}
+		if err := txs.feed(operation_named(e.Op), e.Value, func() error { return fn(e) }); err != nil {
+			return err
+		}
+	}
+}
+
+// operation_named is the operation called name, -1 if there isn't one
+func operation_named(name string) operation_type {
+	for op, n := range operation_names {
+		if n == name {
+			return op
+		}
+	}
+	return -1
+}
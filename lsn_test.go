@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// LSNs and ReplayFrom, see lsn.go
+
+// entries is "op key" for each write ReplayFrom(lsn) hands over
+func entries(t *testing.T, s *Store, lsn uint64) string {
+	t.Helper()
+	var got []string
+	if err := s.ReplayFrom(lsn, func(e Entry) error {
+		got = append(got, e.Op+" "+e.Key)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReplayFrom(%d): %v", lsn, err)
+	}
+	return strings.Join(got, ", ")
+}
+
+// every write takes the next LSN, and a restart carries on from the last one logged
+func TestLSNs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+	s.Delete(key{name: "a"})
+	if got := s.LastLSN(); got != 3 {
+		t.Errorf("LastLSN after 3 writes: %d", got)
+	}
+	s.Close()
+
+	s = open_store(t, path, PersistWAL)
+	defer s.Close()
+	if got := s.LastLSN(); got != 3 {
+		t.Errorf("LastLSN after a restart: %d, want 3", got)
+	}
+	set(t, s, "c", "3")
+	if got := s.LastLSN(); got != 4 {
+		t.Errorf("the first write after the restart took LSN %d, want 4", got)
+	}
+}
+
+// ReplayFrom hands over the writes after an LSN in order, a transaction's once it
+// committed and without its markers, and refuses an LSN a checkpoint dropped
+func TestReplayFrom(t *testing.T) {
+	quiet_log(t)
+	s := open_store(t, filepath.Join(t.TempDir(), "wal.log"), PersistWAL)
+	defer s.Close()
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+	tx := s.Begin()
+	tx.Set(key{name: "c"}, 0, "3")
+	tx.Delete(key{name: "a"})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := entries(t, s, 0); got != "SET a, SET b, SET c, DELETE a" {
+		t.Errorf("ReplayFrom(0): %s", got)
+	}
+	if got := entries(t, s, 2); got != "SET c, DELETE a" {
+		t.Errorf("ReplayFrom(2): %s", got)
+	}
+	if got := entries(t, s, s.LastLSN()); got != "" {
+		t.Errorf("ReplayFrom(LastLSN): %s", got)
+	}
+
+	last := s.LastLSN()
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "d", "4")
+	if err := s.ReplayFrom(1, func(Entry) error { return nil }); err == nil {
+		t.Error("ReplayFrom an LSN the checkpoint dropped")
+	}
+	if got := entries(t, s, last); got != "SET d" {
+		t.Errorf("ReplayFrom(%d) after the checkpoint: %s", last, got)
+	}
+}
@@ -8,13 +8,37 @@ import (
 )
 
 func main() {
-	reader := bufio.NewReader(os.Stdin)
+	//subcommands, without one it's the interactive shell
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "walbench":
+			err = run_walbench(os.Args[2:])
+		case "waldump":
+			err = run_waldump(os.Args[2:])
+		case "soak":
+			err = run_soak(os.Args[2:])
+		case "syncdrill":
+			err = run_syncdrill(os.Args[2:])
+		case "demo":
+			err = run_demo(os.Args[2:])
+		default:
+			log.Fatalf("unknown subcommand %s, expected demo, walbench, waldump, soak or syncdrill", os.Args[1])
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	store := New_Store("kvs_wal.log")
+	reader := bufio.NewReader(os.Stdin)
 
-	if err := store.Replay_wal(); err != nil {
+	store, report, err := Recover("", "kvs_wal.log", Options{TruncateTornTail: true})
+	if err != nil {
 		log.Fatalf("Failed to replay WAL: %v", err)
 	}
+	log.Print(report)
+	defer store.Close()
 
 	for {
 		println("kvs > [q to quit]: ")
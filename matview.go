@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// materialized views: a view is a query whose rows are kept in the store as keys of their
+// own, under view:<name>: in the query's database, the row's key after the prefix and its
+// value as the value. CreateView runs the query once, then a goroutine keeps the rows up
+// to date from the change events (see notify.go): for every key an event names it reads
+// what the key holds now, runs that one row through the query and writes or deletes the
+// view's key to match. events come after the map has the write, so reading the key gives
+// the write or something newer, and running an event twice does no harm
+//
+// only queries that decide row by row can be kept up like that: filters and SELECT key.
+// an aggregate, a GROUP BY, DISTINCT, ORDER BY or LIMIT depends on the other rows too
+// and is refused, as are FROM, ZSET and AS OF. hashes, lists and the other objects
+// aren't rows of a view, only strings are. the view's own keys are never rows of it
+//
+// a view is behind the store by the events it hasn't applied yet, Status reports how
+// far: every write up to AppliedLSN is in it, and the ones it is missing were made at
+// most Staleness ago. an event that doesn't fit in the view's buffer is dropped like any
+// subscriber's, the view can't tell which key it was about, so on the next one it runs
+// the whole query again. its own writes don't come back to it as events. a key that expires leaves the
+// view when the sweeper deletes it
+//
+// the view's keys are logged like any other, and its query is recorded in the manifest
+// (view.<name>, the words in JSON), so Recover starts it again after a restart: it runs
+// the query once more, which fixes up whatever changed since the rows were logged, and
+// follows the writes from there. DropView deletes the keys, then the record
+
+// ViewStatus is how far a view is behind the store
+type ViewStatus struct {
+	Name       string
+	Query      string
+	Rows       int           // keys the view has
+	AppliedLSN uint64        // every write up to this LSN is in the view
+	LastLSN    uint64        // the store's last write, the writes in between may be missing
+	Pending    int           // events waiting to be applied
+	Staleness  time.Duration // how long ago the oldest write the view may be missing was made, 0 if none
+	Rebuilds   int           // times the query was run again because events were dropped
+}
+
+// MaterializedView is one view, see above
+type MaterializedView struct {
+	Name   string
+	Prefix string // the view's keys are Prefix + the row's key
+	query  string
+	plan   *QueryPlan
+	s      *Store
+	sub    *subscriber
+
+	lock     sync.Mutex
+	rows     map[string]bool // the view's keys, without Prefix
+	applied  uint64
+	oldest   time.Time // when the oldest event being applied was made, zero when caught up
+	rebuilds int
+	taken    uint64 // events applied, caught up once it is sub.sent
+	dropped  uint64 // sub.dropped as of the last rebuild
+	done     chan struct{}
+	stopped  atomic.Bool
+}
+
+var view_name = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// manifest_view is the prefix of the manifest entries the views' queries are kept in
+const manifest_view = "view."
+
+// CreateView materializes the query (the words of a SCAN, see ParseQuery) under name and
+// keeps it up to date, see above
+func (s *Store) CreateView(name string, query []string) (*MaterializedView, error) {
+	if !view_name.MatchString(name) {
+		return nil, errors.New("a view name is letters, digits, _ and -")
+	}
+	plan, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if plan.Source != "" || plan.ZSet != "" || plan.AsOf {
+		return nil, errors.New("a view scans the store as it is now, not FROM, ZSET or AS OF")
+	}
+	if plan.AggFunc != "" || plan.Distinct != "" || plan.OrderBy != "" || plan.Limit != 0 {
+		return nil, errors.New("a view is kept up to date row by row, it can only filter and SELECT key")
+	}
+	s.in_selected_db(plan)
+
+	v := &MaterializedView{
+		Name:   name,
+		Prefix: "view:" + name + ":",
+		query:  strings.Join(query, " "),
+		plan:   plan,
+		s:      s,
+		rows:   make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+	s.views_lock.Lock()
+	if _, exists := s.views[name]; exists {
+		s.views_lock.Unlock()
+		return nil, errors.New("there is already a view called " + name)
+	}
+	if s.views == nil {
+		s.views = make(map[string]*MaterializedView)
+	}
+	s.views[name] = v
+	s.views_lock.Unlock()
+
+	words, _ := json.Marshal(query)
+	if err := update_manifest(s.manifest_path(), manifest_view+name, string(words)); err != nil {
+		s.views_lock.Lock()
+		delete(s.views, name)
+		s.views_lock.Unlock()
+		return nil, err
+	}
+	//subscribed first, so no write between the scan and the first event is missed
+	v.sub = s.subscribe("*", v.Prefix)
+	if err := v.rebuild(); err != nil {
+		s.drop_view(v)
+		remove_from_manifest(s.manifest_path(), manifest_view+name)
+		return nil, err
+	}
+	s.wal.res.start("view "+name, v.run)
+	return v, nil
+}
+
+// DropView stops keeping the view up to date and deletes its keys
+func (s *Store) DropView(name string) error {
+	s.views_lock.Lock()
+	v := s.views[name]
+	s.views_lock.Unlock()
+	if v == nil {
+		return errors.New("no view called " + name)
+	}
+	s.drop_view(v)
+	<-v.done
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for row := range v.rows {
+		if err := s.Delete(v.key(row)); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+	}
+	v.rows = nil
+	//last, a crash before it leaves a view that is started again and can be dropped again
+	return remove_from_manifest(s.manifest_path(), manifest_view+name)
+}
+
+// restore_views starts the views the manifest records again, see above
+func (s *Store) restore_views() {
+	manifest, err := read_manifest(s.manifest_path())
+	if err != nil {
+		log.Printf("WARNING: reading the views from %s: %v\n", s.manifest_path(), err)
+		return
+	}
+	names := make([]string, 0, len(manifest))
+	for entry := range manifest {
+		if strings.HasPrefix(entry, manifest_view) {
+			names = append(names, entry)
+		}
+	}
+	sort.Strings(names)
+	for _, entry := range names {
+		name := strings.TrimPrefix(entry, manifest_view)
+		s.views_lock.Lock()
+		_, running := s.views[name]
+		s.views_lock.Unlock()
+		if running {
+			continue
+		}
+		var query []string
+		err := json.Unmarshal([]byte(manifest[entry]), &query)
+		if err == nil {
+			_, err = s.CreateView(name, query)
+		}
+		if err != nil {
+			log.Printf("WARNING: view %s isn't kept up to date after the restart: %v\n", name, err)
+		}
+	}
+}
+
+func (s *Store) drop_view(v *MaterializedView) {
+	s.views_lock.Lock()
+	delete(s.views, v.Name)
+	s.views_lock.Unlock()
+	if v.stopped.CompareAndSwap(false, true) {
+		s.Unsubscribe(v.sub.events)
+	}
+}
+
+// stop_views stops keeping every view up to date and waits for the ones writing to be
+// done, for Close: their keys and records stay, Recover starts them again
+func (s *Store) stop_views() {
+	s.views_lock.Lock()
+	views := make([]*MaterializedView, 0, len(s.views))
+	for _, v := range s.views {
+		views = append(views, v)
+	}
+	s.views_lock.Unlock()
+	for _, v := range views {
+		if v.stopped.CompareAndSwap(false, true) {
+			s.Unsubscribe(v.sub.events)
+		}
+		<-v.done
+	}
+}
+
+// Views is the status of every view, by name
+func (s *Store) Views() []ViewStatus {
+	s.views_lock.Lock()
+	views := make([]*MaterializedView, 0, len(s.views))
+	for _, v := range s.views {
+		views = append(views, v)
+	}
+	s.views_lock.Unlock()
+
+	statuses := make([]ViewStatus, len(views))
+	for i, v := range views {
+		statuses[i] = v.Status()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Status is how far the view is behind the store, see ViewStatus
+func (v *MaterializedView) Status() ViewStatus {
+	//every event of a write up to last has been sent or dropped by now
+	last := v.s.LastLSN()
+	sent, dropped := v.sub.sent.Load(), v.sub.dropped.Load()
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	status := ViewStatus{
+		Name:       v.Name,
+		Query:      v.query,
+		Rows:       len(v.rows),
+		AppliedLSN: v.applied,
+		LastLSN:    last,
+		Pending:    len(v.sub.events),
+		Rebuilds:   v.rebuilds,
+	}
+	if v.taken >= sent && v.dropped == dropped {
+		//caught up, the writes since the last event weren't to the view's keys
+		status.AppliedLSN = max(status.AppliedLSN, last)
+	} else if !v.oldest.IsZero() {
+		status.Staleness = time.Since(v.oldest)
+	}
+	return status
+}
+
+func (v *MaterializedView) key(row string) key {
+	return key{name: v.Prefix + row, db: v.plan.DB}
+}
+
+// run applies the events until the view is dropped or the store closed. it takes
+// whatever has piled up at once, the oldest of them is how stale the view is
+func (v *MaterializedView) run() {
+	defer close(v.done)
+	for ev := range v.sub.events {
+		batch := []Event{ev}
+		for more := true; more; {
+			select {
+			case ev, ok := <-v.sub.events:
+				if ok {
+					batch = append(batch, ev)
+				}
+				more = ok
+			default:
+				more = false
+			}
+		}
+		v.lock.Lock()
+		v.oldest = batch[0].At
+		v.lock.Unlock()
+
+		var err error
+		if v.sub.dropped.Load() != v.dropped {
+			v.lock.Lock()
+			v.rebuilds++
+			v.lock.Unlock()
+			err = v.rebuild()
+		} else {
+			err = v.apply(batch)
+		}
+		if err != nil && !v.stopped.Load() {
+			log.Printf("ERROR: view %s: %v\n", v.Name, err)
+		}
+		v.lock.Lock()
+		v.oldest = time.Time{}
+		v.taken += uint64(len(batch))
+		v.lock.Unlock()
+	}
+}
+
+// apply brings the rows of the keys the events name up to date
+func (v *MaterializedView) apply(batch []Event) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	for _, ev := range batch {
+		if ev.DB == v.plan.DB && !strings.HasPrefix(ev.Key, v.Prefix) {
+			if err := v.refresh(key{name: ev.Key, db: ev.DB}); err != nil {
+				return err
+			}
+		}
+		v.applied = max(v.applied, ev.LSN)
+	}
+	return nil
+}
+
+// refresh runs k, as it is now, through the query and makes the view's key for it match
+// Caller must hold v.lock
+func (v *MaterializedView) refresh(k key) error {
+	val, exists := v.s.data.load(k)
+	if !exists || (!val.expires_at.IsZero() && !val.expires_at.After(time.Now())) {
+		return v.remove(k.name)
+	}
+	//the query over just this row, without counting it as a query run
+	op := build_on(&row_source{rows: []*Row{{Key: k, Value: val}}}, v.plan)
+	if err := op.Open(); err != nil {
+		return err
+	}
+	row, err := op.Next()
+	op.Close()
+	if err != nil {
+		return err
+	}
+	if row == nil {
+		return v.remove(k.name)
+	}
+	return v.put(row)
+}
+
+// rebuild runs the whole query again, writes every row and deletes the keys of the rows
+// that are gone. what is applied after it is the events from before it has started
+func (v *MaterializedView) rebuild() error {
+	dropped := v.sub.dropped.Load()
+	last := v.s.LastLSN()
+	rows, err := ExecuteQuery(BuildOperatorTree(v.s, v.plan))
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	//what the view had, last run's keys included
+	stale := make(map[string]bool, len(v.rows))
+	for row := range v.rows {
+		stale[row] = true
+	}
+	for _, name := range v.s.Keys(v.plan.DB, v.Prefix+"*") {
+		stale[strings.TrimPrefix(name, v.Prefix)] = true
+	}
+	for _, row := range rows {
+		if strings.HasPrefix(row.Key.name, v.Prefix) {
+			continue
+		}
+		delete(stale, row.Key.name)
+		if err := v.put(row); err != nil {
+			return err
+		}
+	}
+	for row := range stale {
+		if err := v.remove(row); err != nil {
+			return err
+		}
+	}
+	v.applied = max(v.applied, last)
+	v.dropped = dropped
+	return nil
+}
+
+// put writes row's key in the view, unless it already holds the row's value
+// Caller must hold v.lock
+func (v *MaterializedView) put(row *Row) error {
+	if row.Value.obj != nil {
+		return v.remove(row.Key.name)
+	}
+	v.rows[row.Key.name] = true
+	if current, ok := v.s.Get(v.key(row.Key.name)); ok && current == row.Value.data {
+		return nil
+	}
+	return v.s.Set(v.key(row.Key.name), 0, row.Value.data)
+}
+
+// remove deletes row's key from the view
+// Caller must hold v.lock
+func (v *MaterializedView) remove(row string) error {
+	delete(v.rows, row)
+	if _, ok := v.s.Get(v.key(row)); !ok {
+		return nil
+	}
+	if err := v.s.Delete(v.key(row)); err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
+	}
+	return nil
+}
+
+// row_source hands out rows it was given, the scan of a query over one key
+type row_source struct {
+	rows []*Row
+	pos  int
+}
+
+func (r *row_source) Open() error { r.pos = 0; return nil }
+
+func (r *row_source) Next() (*Row, error) {
+	if r.pos >= len(r.rows) {
+		return nil, nil
+	}
+	r.pos++
+	return r.rows[r.pos-1], nil
+}
+
+func (r *row_source) Close() error { return nil }
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// caught_up waits for the view to have applied every write so far
+func caught_up(t *testing.T, v *MaterializedView) ViewStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := v.Status()
+		if status.AppliedLSN >= status.LastLSN {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("view never caught up: %+v", status)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// view_rows is the view's keys and values, as the store has them
+func view_rows(s *Store, v *MaterializedView) []string {
+	var rows []string
+	for _, name := range s.Keys(v.plan.DB, v.Prefix+"*") {
+		value, _ := s.Get(key{name: name, db: v.plan.DB})
+		rows = append(rows, name+"="+value)
+	}
+	sort.Strings(rows)
+	return rows
+}
+
+func same_rows(t *testing.T, got []string, want ...string) {
+	t.Helper()
+	sort.Strings(want)
+	if len(got) != len(want) {
+		t.Fatalf("view has %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("view has %v, want %v", got, want)
+		}
+	}
+}
+
+// the view starts with what the query returns and follows every kind of write after
+func TestViewFollowsWrites(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "user:1", "active")
+	set(t, s, "user:2", "idle")
+	set(t, s, "order:1", "active")
+
+	v, err := s.CreateView("active", []string{"SCAN", "WHERE", "key", "LIKE", "user:*", "WHERE", "value", "CONTAINS", "active"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	same_rows(t, view_rows(s, v), "view:active:user:1=active")
+
+	set(t, s, "user:2", "active now")
+	set(t, s, "user:3", "active")
+	if err := s.Delete(key{name: "user:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(key{name: "user:3"}, key{name: "user:4"}); err != nil {
+		t.Fatal(err)
+	}
+	tx := s.Begin()
+	tx.Set(key{name: "user:5"}, 0, "active")
+	tx.Set(key{name: "order:2"}, 0, "active")
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	caught_up(t, v)
+	same_rows(t, view_rows(s, v), "view:active:user:2=active now", "view:active:user:4=active", "view:active:user:5=active")
+
+	if err := s.DropView("active"); err != nil {
+		t.Fatal(err)
+	}
+	same_rows(t, view_rows(s, v))
+}
+
+// a view that misses events runs its query again and ends up right anyway
+func TestViewRebuildsAfterDrops(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	v, err := s.CreateView("all", []string{"SCAN", "WHERE", "key", "LIKE", "k:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	//more writes than the view's buffer holds, while it holds the lock and can't take them
+	want := make(map[string]string)
+	v.lock.Lock()
+	for i := 0; i < 2*subscriber_buffer; i++ {
+		want["k:"+strconv.Itoa(i%100)] = strconv.Itoa(i)
+		set(t, s, "k:"+strconv.Itoa(i%100), strconv.Itoa(i))
+	}
+	v.lock.Unlock()
+	set(t, s, "k:0", "last")
+	want["k:0"] = "last"
+
+	status := caught_up(t, v)
+	if status.Rebuilds == 0 {
+		t.Error("events were dropped and the view wasn't rebuilt")
+	}
+	if status.Rows != 100 {
+		t.Errorf("view has %d rows, want 100", status.Rows)
+	}
+	for k, want := range want {
+		if value, _ := s.Get(key{name: "view:all:" + k}); value != want {
+			t.Errorf("view:all:%s = %q, want %q", k, value, want)
+		}
+	}
+}
+
+func TestViewRefusesQueries(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	for _, query := range [][]string{
+		{"SCAN", "SELECT", "count"},
+		{"SCAN", "ORDER", "BY", "key", "LIMIT", "5"},
+		{"SCAN", "FROM", "users.csv"},
+		{"SCAN", "DISTINCT", "value"},
+	} {
+		if _, err := s.CreateView("v", query); err == nil {
+			t.Errorf("%v: a view was created", query)
+		}
+	}
+}
+
+// a view is started again after a restart, catches up with what changed while it was
+// down and can still be dropped
+func TestViewSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "user:1", "active")
+	if _, err := s.CreateView("u", []string{"SCAN", "WHERE", "key", "LIKE", "user:*"}); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "user:2", "active")
+	s.Close()
+
+	s = open_store(t, path, PersistWAL)
+	views := s.Views()
+	if len(views) != 1 || views[0].Name != "u" {
+		t.Fatalf("views after the restart: %+v", views)
+	}
+	if err := s.Delete(key{name: "user:1"}); err != nil {
+		t.Fatal(err)
+	}
+	v := s.views["u"]
+	caught_up(t, v)
+	same_rows(t, view_rows(s, v), "view:u:user:2=active")
+	if err := s.DropView("u"); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s = open_store(t, path, PersistWAL)
+	defer s.Close()
+	if views := s.Views(); len(views) != 0 {
+		t.Errorf("a dropped view came back: %+v", views)
+	}
+	if keys := s.Keys(0, "view:*"); len(keys) != 0 {
+		t.Errorf("a dropped view's keys came back: %v", keys)
+	}
+}
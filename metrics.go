@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/pixperk/go-io-drill/internal/metrics"
+)
+
+// every subsystem's metrics, all in metrics.Default
+// METRICS prints them, metrics.PublishExpvar or a /metrics handler can serve them
+
+var (
+	wal_records_total   = metrics.Default.Counter("wal_records_total", "WAL records written")
+	wal_bytes_total     = metrics.Default.Counter("wal_bytes_total", "bytes written to WAL segments, headers included")
+	wal_fsyncs_total    = metrics.Default.Counter("wal_fsyncs_total", "fsyncs of the active WAL segment")
+	wal_fsync_seconds   = metrics.Default.Histogram("wal_fsync_seconds", "time spent in WAL fsyncs", metrics.LatencyBuckets)
+	wal_rotations_total = metrics.Default.Counter("wal_rotations_total", "WAL segments sealed")
+	wal_archived_total  = metrics.Default.Counter("wal_archived_segments_total", "WAL segments handed to the archiver successfully")
+
+	store_reads_total  = metrics.Default.Counter("store_reads_total", "Get and Exists calls")
+	store_writes_total = metrics.Default.Counter("store_writes_total", "writes applied to the store")
+	expired_keys_total = metrics.Default.Counter("expired_keys_total", "expired keys deleted by the sweeper")
+	evicted_keys_total = metrics.Default.Counter("evicted_keys_total", "keys evicted to stay under MaxMemory")
+
+	store_loads_total       = metrics.Default.Counter("store_loads_total", "keys Options.Load fetched on a Get miss")
+	store_load_errors_total = metrics.Default.Counter("store_load_errors_total", "Options.Load calls that failed")
+
+	events_dropped_total = metrics.Default.Counter("keyspace_events_dropped_total", "keyspace events dropped because a subscriber was behind")
+
+	writes_undone_total = metrics.Default.Counter("writes_undone_total", "writes undone because their group commit batch failed")
+
+	checkpoint_mark_seconds = metrics.Default.Histogram("checkpoint_mark_seconds", "time a checkpoint holds writers up to seal the WAL and take its View", metrics.LatencyBuckets)
+
+	query_total        = metrics.Default.Counter("query_total", "queries run through the operator tree")
+	query_seconds      = metrics.Default.Histogram("query_seconds", "query run time, open to close", metrics.LatencyBuckets)
+	query_rows_scanned = metrics.Default.Counter("query_rows_scanned_total", "rows produced by scan operators")
+
+	query_distinct_spills_total = metrics.Default.Counter("query_distinct_spills_total", "Distinct operators that outgrew MaxRows and spilled to disk")
+	query_sort_spills_total     = metrics.Default.Counter("query_sort_spills_total", "Sort operators that outgrew MaxRows and sorted in runs on disk")
+	query_groupby_spills_total  = metrics.Default.Counter("query_groupby_spills_total", "GroupBy operators that outgrew MaxGroups and spilled rows to disk")
+	query_spill_bytes_total     = metrics.Default.Counter("query_spill_bytes_total", "bytes Sort and GroupBy spilled, see SpillFormat")
+)
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// keyspace notifications: Subscribe hands out a channel that gets an Event for every
+// logged write to a key matching its pattern, so a cache in front of the store can
+// drop what changed instead of polling. like Redis's they are fire and forget: each
+// subscriber has a buffer, and an event that doesn't fit because the subscriber is
+// behind is dropped and counted, the writer never waits on a reader
+//
+// events are sent once the write is logged and in the map, under the store's write
+// lock, so a subscriber that reads the key on an event sees the new value (or
+// something newer) even though Get doesn't wait for that lock.
+// expiries and evictions are DELETEs like in the WAL, a transaction's writes come
+// once it commits
+
+// how many events a subscriber can be behind before they are dropped
+const subscriber_buffer = 1024
+
+// Event is one change to a key: Op is the WAL op that made it (SET, DELETE, EXPIRE,
+// HSET, ...), except for the two keys of a RENAME, RENAME_FROM and RENAME_TO, the
+// destination of a COPY, COPY_TO, and ROLLBACK for a key a failed group commit batch
+// put back as it was (see undo.go)
+type Event struct {
+	Op  string
+	Key string
+	DB  int
+	LSN uint64
+	At  time.Time // when the write was made
+}
+
+type subscriber struct {
+	pattern string
+	ignore  string // keys with this prefix don't match, a view's own (see matview.go)
+	events  chan Event
+	sent    atomic.Uint64 // events sent and dropped, for subscribers inside the store that have to
+	dropped atomic.Uint64 // know whether they are caught up (see matview.go)
+}
+
+type subscribers struct {
+	lock sync.Mutex
+	subs []*subscriber
+}
+
+// Subscribe returns a channel of Events for keys matching pattern (a glob, see Keys) in any database
+// it is closed by Unsubscribe or when the store is closed
+func (s *Store) Subscribe(pattern string) <-chan Event {
+	return s.subscribe(pattern, "").events
+}
+
+func (s *Store) subscribe(pattern, ignore string) *subscriber {
+	sub := &subscriber{pattern: pattern, ignore: ignore, events: make(chan Event, subscriber_buffer)}
+	s.subs.lock.Lock()
+	s.subs.subs = append(s.subs.subs, sub)
+	s.subs.lock.Unlock()
+	return sub
+}
+
+// Unsubscribe stops the events of a channel Subscribe returned and closes it
+func (s *Store) Unsubscribe(events <-chan Event) {
+	s.subs.lock.Lock()
+	defer s.subs.lock.Unlock()
+
+	for i, sub := range s.subs.subs {
+		if sub.events == events {
+			close(sub.events)
+			s.subs.subs = append(s.subs.subs[:i], s.subs.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+// close_all closes every subscriber's channel, for Close
+func (x *subscribers) close_all() {
+	x.lock.Lock()
+	defer x.lock.Unlock()
+
+	for _, sub := range x.subs {
+		close(sub.events)
+	}
+	x.subs = nil
+}
+
+// notify sends the events of a logged record
+// Caller must hold s.lock
+func (s *Store) notify(rec wal_record) {
+	s.subs.lock.Lock()
+	defer s.subs.lock.Unlock()
+
+	if len(s.subs.subs) == 0 || rec.key == "" {
+		return
+	}
+	at := time.Now()
+	events := []Event{{Op: rec.op.String(), Key: rec.key, DB: rec.db, LSN: rec.lsn, At: at}}
+	if rec.op == RENAME || rec.op == COPY {
+		dst, err := move_target(rec)
+		if err != nil {
+			return
+		}
+		events[0].Op = "RENAME_FROM"
+		to := Event{Op: "RENAME_TO", Key: dst.name, DB: dst.db, LSN: rec.lsn, At: at}
+		if rec.op == COPY {
+			events, to.Op = nil, "COPY_TO"
+		}
+		events = append(events, to)
+	}
+
+	for _, ev := range events {
+		for _, sub := range s.subs.subs {
+			if !glob_match(sub.pattern, ev.Key) || (sub.ignore != "" && strings.HasPrefix(ev.Key, sub.ignore)) {
+				continue
+			}
+			select {
+			case sub.events <- ev:
+				sub.sent.Add(1)
+			default:
+				sub.dropped.Add(1)
+				events_dropped_total.Inc()
+			}
+		}
+	}
+}
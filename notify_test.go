@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a subscriber that reads the key on an event gets the write the event is for or a
+// newer one, never the value from before it, even with Get taking only the shard lock
+func TestNotifyAfterApply(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	events := s.Subscribe("k")
+
+	//rounds of fewer writes than subscriber_buffer, so none are dropped
+	const rounds, writes = 20, 500
+	for round := 0; round < rounds; round++ {
+		go func() {
+			for i := 0; i < writes; i++ {
+				if err := s.Set(key{name: "k"}, 0, strconv.Itoa(i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		for i := 0; i < writes; i++ {
+			ev := <-events
+			if _, version, ok := s.GetWithVersion(key{name: "k"}); !ok || version < ev.LSN {
+				t.Fatalf("event for LSN %d, Get found version %d (%t)", ev.LSN, version, ok)
+			}
+		}
+	}
+}
+
+// waiting is "op key" for each event waiting on events
+func waiting(events <-chan Event) string {
+	var got []string
+	for {
+		select {
+		case ev, open := <-events:
+			if !open {
+				return strings.Join(got, ", ")
+			}
+			got = append(got, ev.Op+" "+ev.Key)
+		default:
+			return strings.Join(got, ", ")
+		}
+	}
+}
+
+// a subscriber gets the writes to the keys its pattern matches, a transaction's once
+// it commits and both keys of a RENAME, until it unsubscribes
+func TestSubscribe(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	events := s.Subscribe("user:*")
+	set(t, s, "user:1", "ann")
+	set(t, s, "order:1", "x")
+	s.Delete(key{name: "user:1"})
+	tx := s.Begin()
+	tx.Set(key{name: "user:2"}, 0, "bob")
+	if got := waiting(events); got != "SET user:1, DELETE user:1" {
+		t.Errorf("events: %s", got)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	s.Rename(key{name: "user:2"}, key{name: "user:3"})
+	s.Copy(key{name: "user:3"}, key{name: "order:2"}, false)
+	s.Copy(key{name: "order:2"}, key{name: "user:4"}, false)
+	if got := waiting(events); got != "SET user:2, RENAME_FROM user:2, RENAME_TO user:3, COPY_TO user:4" {
+		t.Errorf("events after the commit: %s", got)
+	}
+
+	//a subscriber that doesn't keep up loses what doesn't fit, the writer doesn't wait
+	for i := range subscriber_buffer + 10 {
+		set(t, s, "user:"+strconv.Itoa(i), "x")
+	}
+	if len(events) != subscriber_buffer {
+		t.Errorf("%d events waiting", len(events))
+	}
+	s.Unsubscribe(events)
+	waiting(events)
+	if _, open := <-events; open {
+		t.Error("the channel is still open after Unsubscribe")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// OBJECT ENCODING reports how a value is held, like Redis does
+// strings are all Go strings, so this tells apart the ones that are
+// canonical integers (what INCR-style commands and a packed int encoding
+// would work on) from plain strings. hashes and sets are Go maps, Redis's
+// hashtable, a list is a ring buffer and a sorted set a sorted slice
+
+const (
+	encoding_int       = "int"         // a canonical base 10 int64, e.g. "42" but not "042" or "+42"
+	encoding_raw       = "raw"         // any other string
+	encoding_hashtable = "hashtable"   // a hash or a set
+	encoding_deque     = "deque"       // a list
+	encoding_sorted    = "sortedslice" // a sorted set
+)
+
+var object_encodings = map[string]string{"hash": encoding_hashtable, "list": encoding_deque, "set": encoding_hashtable, "zset": encoding_sorted}
+
+func value_encoding(v value) string {
+	if v.obj != nil {
+		return object_encodings[v.obj.kind()]
+	}
+	if n, err := strconv.ParseInt(v.data, 10, 64); err == nil && strconv.FormatInt(n, 10) == v.data {
+		return encoding_int
+	}
+	return encoding_raw
+}
+
+// ObjectEncoding returns the encoding of the value at k
+func (s *Store) ObjectEncoding(k key) (string, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		return "", ErrKeyNotFound
+	}
+	return value_encoding(val), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// OBJECT ENCODING, see object.go
+
+// canonical integers are int, any other string raw, and the typed values say what
+// holds them
+func TestObjectEncoding(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for v, want := range map[string]string{"42": "int", "-7": "int", "042": "raw", "+42": "raw", "4.2": "raw", "": "raw", "99999999999999999999": "raw"} {
+		set(t, s, "k", v)
+		if got, err := s.ObjectEncoding(key{name: "k"}); got != want || err != nil {
+			t.Errorf("OBJECT ENCODING of %q: %s %v, want %s", v, got, err, want)
+		}
+	}
+	s.HSet(key{name: "h"}, map[string]string{"f": "1"})
+	s.RPush(key{name: "l"}, "a")
+	s.SAdd(key{name: "s"}, "a")
+	s.ZAdd(key{name: "z"}, map[string]float64{"a": 1})
+	for name, want := range map[string]string{"h": "hashtable", "l": "deque", "s": "hashtable", "z": "sortedslice"} {
+		if got, _ := s.ObjectEncoding(key{name: name}); got != want {
+			t.Errorf("OBJECT ENCODING of %s: %s, want %s", name, got, want)
+		}
+	}
+	s.Set(key{name: "gone"}, time.Millisecond, "1")
+	time.Sleep(5 * time.Millisecond)
+	for _, name := range []string{"gone", "missing"} {
+		if _, err := s.ObjectEncoding(key{name: name}); err != ErrKeyNotFound {
+			t.Errorf("OBJECT ENCODING of %s: %v", name, err)
+		}
+	}
+}
@@ -1,6 +1,19 @@
 package main
 
-import "time"
+import (
+	"bufio"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
 
 type Row struct {
 	Key   key
@@ -15,9 +28,11 @@ type Operator interface {
 	Close() error
 }
 
-// like a table scan operator
+// like a table scan operator, over the keys of one database
 type KVScan struct {
 	store *Store
+	DB    int
+	view  *View
 	keys  []key
 	pos   int
 }
@@ -41,26 +56,99 @@ type Project struct {
 	KeyOnly bool
 }
 
-func NewKVScan(store *Store) *KVScan {
-	return &KVScan{store: store}
+// like an index range scan: walks one sorted set in score order, member → key and
+// score → value. it seeks to Min with a binary search instead of filtering, so a
+// narrow score range of a big set only reads the rows in it
+type ZScan struct {
+	store *Store
+	DB    int
+	Key   string
+	Min   float64
+	Max   float64
+
+	z   *zset_object
+	pos int
+	end int
+}
+
+// like ORDER BY: Open drains the input into memory, Next hands the rows out in the
+// order Less puts them in, ties in the order they came. scans return rows in map
+// order, different every run, so LIMIT over a Sort is the only LIMIT that is repeatable
+//
+// past MaxRows it sorts externally: every MaxRows rows are sorted and spilled to a file
+// of their own, a run (see spill.go), and Next merges the runs and the rows left in
+// memory, so it holds MaxRows rows and a row per run whatever the input
+type Sort struct {
+	Input   Operator
+	Less    func(a, b Row) bool // ByKey, ByValue, ByExpiry, or Desc of one of them
+	MaxRows int                 // rows sorted in memory before a run is spilled, 0 for no limit
+	Dir     string              // where runs go, os.TempDir() if empty
+	Format  SpillFormat         // how the runs are written
+
+	rows    []*Row
+	pos     int
+	runs    []*spill_file
+	merge   *run_merge // nil unless it spilled
+	spilled int64      // bytes of runs written
+}
+
+// the rows the query engine's ORDER BY sorts in memory before spilling a run
+const sort_max_rows = 1 << 17
+
+// like ORDER BY ... LIMIT k without sorting everything: it keeps the K best rows seen
+// so far in a heap with the worst of them on top, each row either beats that one and
+// takes its place or is dropped, so memory is K rows and time n log K whatever the
+// input. Next hands them out in the order Sort then Limit would, ties included
+type TopK struct {
+	Input Operator
+	K     int
+	Less  func(a, b Row) bool // what counts as better, like Sort's
+
+	heap topk_heap
+	rows []*Row
+	pos  int
+}
+
+// like a table scan operator, but over a csv or jsonl file on disk
+// the schema mapping says which column becomes the key and which the value
+type FileScan struct {
+	Path     string
+	Format   string // "CSV" or "JSONL"
+	KeyCol   string
+	ValueCol string
+
+	fd      *os.File
+	csv     *csv.Reader
+	lines   *bufio.Scanner
+	key_idx int
+	val_idx int
+}
+
+func NewKVScan(store *Store, db int) *KVScan {
+	return &KVScan{store: store, DB: db}
 }
 
 // open collects all valid keys at the time of opening
 // it sets the position to 0
-// it locks the store for reading but unlocks it in Close
-// this way, the scan will only see the keys that were valid at the time of opening
+// it reads from a View of the store (see view.go) with only kv.DB in it, taken now and
+// dropped in Close, so the scan only sees what was there at the time of opening and
+// writers don't wait for it
 func (kv *KVScan) Open() error {
-	kv.store.lock.RLock()
+	kv.scan(kv.store.view_db(kv.DB), time.Now())
+	return nil
+}
 
-	kv.keys = make([]key, 0, len(kv.store.data))
-	now := time.Now()
-	for k, v := range kv.store.data {
+// scan starts over on view, with the keys that hadn't expired by now
+func (kv *KVScan) scan(view *View, now time.Time) {
+	kv.view = view
+	kv.keys = make([]key, 0, len(kv.view.data))
+	kv.view.each(func(k key, v value) bool {
 		if v.expires_at.IsZero() || v.expires_at.After(now) {
 			kv.keys = append(kv.keys, k)
 		}
-	}
+		return true
+	})
 	kv.pos = 0
-	return nil
 }
 
 // Next returns the next valid row or nil if there are no more rows
@@ -70,18 +158,167 @@ func (kv *KVScan) Next() (*Row, error) {
 	}
 
 	key := kv.keys[kv.pos]
-	value := kv.store.data[key]
+	value, _ := kv.view.get(key)
 	kv.pos++
+	query_rows_scanned.Inc()
 
 	return &Row{Key: key, Value: value}, nil
 }
 
-// Close unlocks the store
+// Close drops the view
 func (kv *KVScan) Close() error {
-	kv.store.lock.RUnlock()
+	kv.view, kv.keys = nil, nil
+	return nil
+}
+
+// NewZScan scans the members of the sorted set at k in database db scored lo to hi, both included
+func NewZScan(store *Store, db int, k string, lo, hi float64) *ZScan {
+	return &ZScan{store: store, DB: db, Key: k, Min: lo, Max: hi}
+}
+
+// Open finds the set and where the range starts and ends. it holds the read lock only
+// for that, the set is shared copy on write like a View's objects (see view.go)
+// a missing key is an empty set, a key holding anything else an error
+func (zs *ZScan) Open() error {
+	zs.store.lock.RLock()
+	z, err := zs.store.read_zset(zs.store.encode_key(key{name: zs.Key, db: zs.DB}))
+	if err == nil && z != nil {
+		zs.store.share()
+	}
+	zs.store.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	zs.z, zs.pos, zs.end = z, 0, 0
+	if z != nil {
+		zs.pos, zs.end = z.first_at(zs.Min, false), z.first_at(zs.Max, true)
+	}
+	return nil
+}
+
+// Next returns the next member in score order, or nil past the end of the range
+func (zs *ZScan) Next() (*Row, error) {
+	if zs.pos >= zs.end {
+		return nil, nil
+	}
+	m := zs.z.order[zs.pos]
+	zs.pos++
+	query_rows_scanned.Inc()
+	return &Row{Key: key{name: m.Member, db: zs.DB}, Value: value{data: format_score(m.Score)}}, nil
+}
+
+func (zs *ZScan) Close() error {
+	zs.z = nil
 	return nil
 }
 
+// jsonl lines longer than this fail the scan with bufio.ErrTooLong, the Scanner's
+// default of 64KB is too small for a record with a big value
+const max_jsonl_record_size = 64 << 20
+
+// NewFileScan creates a file scan, the format is taken from the file extension
+func NewFileScan(path, key_col, value_col string) *FileScan {
+	format := "CSV"
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jsonl", ".ndjson", ".json":
+		format = "JSONL"
+	}
+	return &FileScan{Path: path, Format: format, KeyCol: key_col, ValueCol: value_col}
+}
+
+// open opens the file and resolves the schema mapping
+// for csv the first line is the header, if it has no column with the
+// mapped name we fall back to the first two columns
+func (fs *FileScan) Open() error {
+	fd, err := os.Open(fs.Path)
+	if err != nil {
+		return err
+	}
+	fs.fd = fd
+
+	if fs.Format == "JSONL" {
+		fs.lines = bufio.NewScanner(fd)
+		fs.lines.Buffer(make([]byte, 0, 64*1024), max_jsonl_record_size)
+		return nil
+	}
+
+	fs.csv = csv.NewReader(fd)
+	header, err := fs.csv.Read()
+	if err != nil {
+		fd.Close()
+		fs.fd = nil
+		return errors.New("reading csv header: " + err.Error())
+	}
+	fs.key_idx, fs.val_idx = 0, 1
+	for i, col := range header {
+		switch strings.TrimSpace(col) {
+		case fs.KeyCol:
+			fs.key_idx = i
+		case fs.ValueCol:
+			fs.val_idx = i
+		}
+	}
+	return nil
+}
+
+// Next streams the next record from the file, rows never come from the store
+// so they have no expiry
+func (fs *FileScan) Next() (*Row, error) {
+	if fs.Format == "JSONL" {
+		for fs.lines.Scan() {
+			line := strings.TrimSpace(fs.lines.Text())
+			if line == "" {
+				continue
+			}
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				return nil, errors.New("invalid jsonl record: " + err.Error())
+			}
+			query_rows_scanned.Inc()
+			return &Row{
+				Key:   key{name: json_field_string(record[fs.KeyCol])},
+				Value: value{data: json_field_string(record[fs.ValueCol])},
+			}, nil
+		}
+		return nil, fs.lines.Err()
+	}
+
+	record, err := fs.csv.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if fs.key_idx >= len(record) || fs.val_idx >= len(record) {
+		return nil, errors.New("csv record has fewer columns than the schema mapping")
+	}
+	query_rows_scanned.Inc()
+	return &Row{Key: key{name: record[fs.key_idx]}, Value: value{data: record[fs.val_idx]}}, nil
+}
+
+func (fs *FileScan) Close() error {
+	if fs.fd == nil {
+		return nil
+	}
+	return fs.fd.Close()
+}
+
+// strings stay as they are, everything else is re-encoded as json
+func json_field_string(v any) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case float64:
+		return fmt.Sprint(t)
+	default:
+		b, _ := json.Marshal(t)
+		return string(b)
+	}
+}
+
 func (f *Filter) Open() error {
 	return f.Input.Open()
 }
@@ -135,3 +372,228 @@ func (p *Project) Next() (*Row, error) {
 	}
 	return row, err
 }
+
+// the comparators Sort comes with
+// ByKey orders by key name, then database
+func ByKey(a, b Row) bool {
+	if a.Key.name != b.Key.name {
+		return a.Key.name < b.Key.name
+	}
+	return a.Key.db < b.Key.db
+}
+
+// ByValue orders by value: numbers by what they are worth (so 9 comes before 10, and
+// counts and sums sort right), then everything else byte by byte
+func ByValue(a, b Row) bool {
+	x, err_x := parse_score(a.Value.data)
+	y, err_y := parse_score(b.Value.data)
+	if (err_x == nil) != (err_y == nil) {
+		return err_x == nil
+	}
+	if err_x == nil && x != y {
+		return x < y
+	}
+	return a.Value.data < b.Value.data
+}
+
+// ByExpiry puts the rows that expire soonest first and the ones that never do last
+func ByExpiry(a, b Row) bool {
+	if a.Value.expires_at.IsZero() || b.Value.expires_at.IsZero() {
+		return !a.Value.expires_at.IsZero() && b.Value.expires_at.IsZero()
+	}
+	return a.Value.expires_at.Before(b.Value.expires_at)
+}
+
+// Desc turns a comparator around
+func Desc(less func(a, b Row) bool) func(a, b Row) bool {
+	return func(a, b Row) bool { return less(b, a) }
+}
+
+// Open buffers the whole input and sorts it, spilling a run every MaxRows rows
+func (so *Sort) Open() error {
+	so.rows, so.pos, so.runs, so.merge, so.spilled = nil, 0, nil, nil, 0
+	err := drain(so.Input, func(row *Row) error {
+		so.rows = append(so.rows, row)
+		if so.MaxRows > 0 && len(so.rows) >= so.MaxRows {
+			return so.spill_run()
+		}
+		return nil
+	})
+	if err == nil {
+		err = so.sorted()
+	}
+	if err != nil {
+		so.remove_spill()
+		return err
+	}
+	return nil
+}
+
+// sort_rows sorts what is in memory
+func (so *Sort) sort_rows() {
+	sort.SliceStable(so.rows, func(i, j int) bool { return so.Less(*so.rows[i], *so.rows[j]) })
+}
+
+// spill_run writes the rows in memory out as a sorted run
+func (so *Sort) spill_run() error {
+	if so.runs == nil {
+		query_sort_spills_total.Inc()
+	}
+	run, err := new_spill_file(so.Dir, "sort-*", so.Format)
+	if err != nil {
+		return err
+	}
+	so.runs = append(so.runs, run)
+	so.sort_rows()
+	for _, row := range so.rows {
+		if err := run.write(row); err != nil {
+			return err
+		}
+	}
+	clear(so.rows)
+	so.rows = so.rows[:0]
+	return nil
+}
+
+// sorted sorts the rows left in memory and, if it spilled, starts merging them with
+// the runs. they came last, so they go last among rows that tie
+func (so *Sort) sorted() error {
+	so.sort_rows()
+	if so.runs == nil {
+		return nil
+	}
+	runs := make([]sorted_run, 0, len(so.runs)+1)
+	for _, run := range so.runs {
+		if err := run.rewind(); err != nil {
+			return err
+		}
+		so.spilled += run.bytes
+		runs = append(runs, run)
+	}
+	query_spill_bytes_total.Add(uint64(so.spilled))
+	runs = append(runs, &memory_run{rows: so.rows})
+	so.rows = nil
+	var err error
+	so.merge, err = new_run_merge(runs, so.Less)
+	return err
+}
+
+// remove_spill closes and removes the runs
+func (so *Sort) remove_spill() {
+	for _, run := range so.runs {
+		run.remove()
+	}
+	so.runs, so.merge = nil, nil
+}
+
+// drain opens input and hands every row it has to fn, for the operators that read all
+// of their input in Open. if that fails part way it closes input again, so the caller
+// only has it open, to Close, after a nil error
+func drain(input Operator, fn func(row *Row) error) error {
+	if err := input.Open(); err != nil {
+		return err
+	}
+	for {
+		row, err := input.Next()
+		if err == nil && row == nil {
+			return nil
+		}
+		if err == nil {
+			err = fn(row)
+		}
+		if err != nil {
+			input.Close()
+			return err
+		}
+	}
+}
+
+func (so *Sort) Next() (*Row, error) {
+	if so.merge != nil {
+		return so.merge.next()
+	}
+	if so.pos >= len(so.rows) {
+		return nil, nil
+	}
+	so.pos++
+	return so.rows[so.pos-1], nil
+}
+
+// Close removes the runs
+func (so *Sort) Close() error {
+	so.remove_spill()
+	so.rows = nil
+	return so.Input.Close()
+}
+
+// topk_heap is TopK's heap, the worst row on top. seq is the order rows came in, a
+// tie goes to the one that came first like it does in a stable sort
+type topk_heap struct {
+	rows []topk_row
+	less func(a, b Row) bool
+}
+
+type topk_row struct {
+	row *Row
+	seq int
+}
+
+// before is the order TopK returns rows in, the heap's is the other way round
+func (h *topk_heap) before(a, b topk_row) bool {
+	if h.less(*a.row, *b.row) {
+		return true
+	}
+	return !h.less(*b.row, *a.row) && a.seq < b.seq
+}
+
+func (h *topk_heap) Len() int           { return len(h.rows) }
+func (h *topk_heap) Less(i, j int) bool { return h.before(h.rows[j], h.rows[i]) }
+func (h *topk_heap) Swap(i, j int)      { h.rows[i], h.rows[j] = h.rows[j], h.rows[i] }
+func (h *topk_heap) Push(x any)         { h.rows = append(h.rows, x.(topk_row)) }
+func (h *topk_heap) Pop() any {
+	last := h.rows[len(h.rows)-1]
+	h.rows = h.rows[:len(h.rows)-1]
+	return last
+}
+
+// Open runs the input to the end, keeping the best K
+func (t *TopK) Open() error {
+	t.heap = topk_heap{less: t.Less}
+	t.rows, t.pos = nil, 0
+	seq := 0
+	err := drain(t.Input, func(row *Row) error {
+		r := topk_row{row: row, seq: seq}
+		seq++
+		switch {
+		case t.heap.Len() < t.K:
+			heap.Push(&t.heap, r)
+		case t.K > 0 && t.heap.before(r, t.heap.rows[0]):
+			t.heap.rows[0] = r
+			heap.Fix(&t.heap, 0)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	//popping gives the worst first
+	t.rows = make([]*Row, t.heap.Len())
+	for i := len(t.rows) - 1; i >= 0; i-- {
+		t.rows[i] = heap.Pop(&t.heap).(topk_row).row
+	}
+	return nil
+}
+
+func (t *TopK) Next() (*Row, error) {
+	if t.pos >= len(t.rows) {
+		return nil, nil
+	}
+	t.pos++
+	return t.rows[t.pos-1], nil
+}
+
+func (t *TopK) Close() error {
+	t.rows = nil
+	return t.Input.Close()
+}
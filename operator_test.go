@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the operators over rows of their own, and the queries that plan them
+
+// query runs q, a shell SCAN, against s
+func query(t *testing.T, s *Store, q string) []*Row {
+	t.Helper()
+	plan, err := ParseQuery(strings.Fields(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := ExecuteQuery(BuildOperatorTree(s, plan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rows
+}
+
+// row_pairs is "key=value" for each row, in order
+func row_pairs(rows []*Row) string {
+	pairs := make([]string, len(rows))
+	for i, row := range rows {
+		pairs[i] = row.Key.name + "=" + row.Value.data
+	}
+	return strings.Join(pairs, " ")
+}
+
+// failing_input hands out rows until it has none left, then fails, and remembers
+// whether it was closed
+type failing_input struct {
+	row_source
+	closed bool
+}
+
+var errInput = errors.New("input failed")
+
+func (f *failing_input) Next() (*Row, error) {
+	row, err := f.row_source.Next()
+	if row == nil && err == nil {
+		return nil, errInput
+	}
+	return row, err
+}
+
+func (f *failing_input) Close() error {
+	f.closed = true
+	return nil
+}
+
+// kv makes a row
+func kv(name, v string) *Row {
+	return &Row{Key: key{name: name}, Value: value{data: v}}
+}
+
+// Sort orders by each comparator, ties in the order they came
+func TestSort(t *testing.T) {
+	now := time.Now()
+	rows := []*Row{kv("a", "10"), kv("b", "9"), kv("c", "x"), kv("d", "9"), kv("e", "-1.5")}
+	rows[0].Value.expires_at = now.Add(time.Hour)
+	rows[3].Value.expires_at = now.Add(time.Minute)
+	for _, tc := range []struct {
+		name string
+		less func(a, b Row) bool
+		want string
+	}{
+		{"by value", ByValue, "e=-1.5 b=9 d=9 a=10 c=x"},
+		{"by value desc", Desc(ByValue), "c=x a=10 b=9 d=9 e=-1.5"},
+		{"by key", ByKey, "a=10 b=9 c=x d=9 e=-1.5"},
+		{"by expiry", ByExpiry, "d=9 a=10 b=9 c=x e=-1.5"},
+	} {
+		if got := row_pairs(run_op(t, &Sort{Input: &row_source{rows: rows}, Less: tc.less})); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+
+	input := &failing_input{row_source: row_source{rows: rows}}
+	if err := (&Sort{Input: input, Less: ByKey}).Open(); !errors.Is(err, errInput) || !input.closed {
+		t.Errorf("Open = %v with the input failing, input closed %v", err, input.closed)
+	}
+}
+
+// ORDER BY makes a query's rows, and what LIMIT keeps of them, the same every run
+func TestOrderBy(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for _, name := range []string{"user:3", "user:1", "order:1", "user:2"} {
+		set(t, s, name, strings.TrimPrefix(name, "user:"))
+	}
+	if got := row_pairs(query(t, s, "SCAN WHERE key LIKE user:* ORDER BY key DESC")); got != "user:3=3 user:2=2 user:1=1" {
+		t.Errorf("ORDER BY key DESC: %s", got)
+	}
+	if got := row_pairs(query(t, s, "SCAN ORDER BY value")); got != "user:1=1 user:2=2 user:3=3 order:1=order:1" {
+		t.Errorf("ORDER BY value: %s", got)
+	}
+}
+
+// TopK returns what Sort then Limit would, ties included, for every K
+func TestTopK(t *testing.T) {
+	rows := spill_rows(2000, 10)
+	for _, less := range []func(a, b Row) bool{ByValue, Desc(ByValue), ByExpiry} {
+		sorted := run_op(t, &Sort{Input: &row_source{rows: rows}, Less: less})
+		for _, k := range []int{0, 1, 10, 1999, 2000, 5000} {
+			got := run_op(t, &TopK{Input: &row_source{rows: rows}, K: k, Less: less})
+			same_spilled(t, got, sorted[:min(k, len(sorted))])
+		}
+	}
+	input := &failing_input{row_source: row_source{rows: rows}}
+	if err := (&TopK{Input: input, K: 3, Less: ByKey}).Open(); !errors.Is(err, errInput) || !input.closed {
+		t.Errorf("Open = %v with the input failing, input closed %v", err, input.closed)
+	}
+}
+
+// ORDER BY with LIMIT plans a TopK
+func TestOrderByLimit(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for i := 0; i < 100; i++ {
+		set(t, s, "k"+strconv.Itoa(i), strconv.Itoa(i%10))
+	}
+	plan, err := ParseQuery(strings.Fields("SCAN ORDER BY value DESC LIMIT 3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := BuildOperatorTree(s, plan).(*TopK); !ok {
+		t.Error("ORDER BY with LIMIT isn't a TopK")
+	}
+	rows := query(t, s, "SCAN ORDER BY value DESC LIMIT 3")
+	if len(rows) != 3 {
+		t.Fatalf("%d rows for LIMIT 3", len(rows))
+	}
+	for _, row := range rows {
+		if row.Value.data != "9" {
+			t.Errorf("%s=%s among the 3 largest", row.Key.name, row.Value.data)
+		}
+	}
+}
+
+// FileScan maps the named columns of a csv or jsonl file to keys and values
+func TestFileScan(t *testing.T) {
+	dir := t.TempDir()
+	csv_path := filepath.Join(dir, "users.csv")
+	jsonl_path := filepath.Join(dir, "users.jsonl")
+	os.WriteFile(csv_path, []byte("age,id,name\n30,u1,\"Smith, J\"\n41,u2,Lee\n"), 0o644)
+	os.WriteFile(jsonl_path, []byte("{\"id\":\"u1\",\"age\":30}\n\n{\"id\":\"u2\",\"tags\":[\"a\"]}\n"), 0o644)
+
+	if got := row_pairs(run_op(t, NewFileScan(csv_path, "id", "name"))); got != "u1=Smith, J u2=Lee" {
+		t.Errorf("csv id,name: %s", got)
+	}
+	//no column by that name: the first two
+	if got := row_pairs(run_op(t, NewFileScan(csv_path, "user", "email"))); got != "30=u1 41=u2" {
+		t.Errorf("csv with columns it doesn't have: %s", got)
+	}
+	if got := row_pairs(run_op(t, NewFileScan(jsonl_path, "id", "age"))); got != "u1=30 u2=" {
+		t.Errorf("jsonl id,age: %s", got)
+	}
+	if got := row_pairs(run_op(t, NewFileScan(jsonl_path, "id", "tags"))); got != `u1= u2=["a"]` {
+		t.Errorf("jsonl id,tags: %s", got)
+	}
+
+	os.WriteFile(jsonl_path, []byte("{\"id\":\"u1\"}\nnot json\n"), 0o644)
+	fs := NewFileScan(jsonl_path, "id", "age")
+	if err := fs.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	if _, err := fs.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Next(); err == nil {
+		t.Error("a line that isn't json scanned")
+	}
+	if err := NewFileScan(filepath.Join(dir, "missing.csv"), "id", "name").Open(); err == nil {
+		t.Error("opened a file that isn't there")
+	}
+}
+
+// SCAN FROM reads the file instead of the store, and the rest of the query runs over it
+func TestScanFrom(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "u9", "in the store")
+	path := filepath.Join(t.TempDir(), "users.csv")
+	os.WriteFile(path, []byte("id,age\nu1,30\nu2,41\nu3,25\n"), 0o644)
+	if got := row_pairs(query(t, s, "SCAN FROM "+path+" MAP id age ORDER BY value DESC LIMIT 2")); got != "u2=41 u1=30" {
+		t.Errorf("SCAN FROM: %s", got)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// each mode's crash semantics: what a store reopened on the files of one that was never
+// closed gets back, and what the mode leaves on disk. the crashed stores are just
+// abandoned, Close would flush and fsync what a crash wouldn't
+
+func open_store(t *testing.T, path string, p Persistence) *Store {
+	t.Helper()
+	s, _, err := Recover("", path, Options{Persistence: p})
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	return s
+}
+
+func set(t *testing.T, s *Store, name, v string) {
+	t.Helper()
+	if err := s.Set(key{name: name}, 0, v); err != nil {
+		t.Fatalf("set %s: %v", name, err)
+	}
+}
+
+// wal_segments lists the WAL segments in dir, not the snapshot or manifest
+func wal_segments(t *testing.T, s *Store) []uint64 {
+	t.Helper()
+	segments, err := s.wal.segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return segments
+}
+
+func TestPersistenceCrash(t *testing.T) {
+	tests := []struct {
+		p Persistence
+		//what survives a crash: a key set before a checkpoint and one set after
+		before, after bool
+		//whether the mode writes WAL segments and snapshots
+		logs, snapshots bool
+	}{
+		{PersistWAL, true, true, true, true},
+		{PersistBoth, true, true, true, true},
+		{PersistSnapshot, true, false, false, true},
+		{PersistNone, false, false, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.p.String(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "wal.log")
+			s := open_store(t, path, tt.p)
+			if n := len(wal_segments(t, s)); !tt.logs && n != 0 {
+				t.Fatalf("opening the store made %d WAL segments", n)
+			}
+			set(t, s, "before", "1")
+			//none never snapshots on its own, only a CHECKPOINT asked for would write one
+			if tt.p != PersistNone {
+				if _, err := s.Checkpoint(); err != nil {
+					t.Fatalf("checkpoint: %v", err)
+				}
+			}
+			set(t, s, "after", "2")
+
+			if logs := len(wal_segments(t, s)) > 0; logs != tt.logs {
+				t.Errorf("WAL segments on disk: %t, want %t", logs, tt.logs)
+			}
+			_, err := os.Stat(s.snapshot_path())
+			if snapshots := err == nil; snapshots != tt.snapshots {
+				t.Errorf("snapshot on disk: %t, want %t", snapshots, tt.snapshots)
+			}
+
+			//crash
+			s = open_store(t, path, tt.p)
+			defer s.Close()
+			if _, ok := s.Get(key{name: "before"}); ok != tt.before {
+				t.Errorf("key set before the checkpoint recovered: %t, want %t", ok, tt.before)
+			}
+			if _, ok := s.Get(key{name: "after"}); ok != tt.after {
+				t.Errorf("key set after the checkpoint recovered: %t, want %t", ok, tt.after)
+			}
+		})
+	}
+}
+
+// turning the WAL on and off at runtime: what was written while it was off is in the
+// checkpoint SetPersistence takes, what was written after is in the log
+func TestPersistenceSwitch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	if err := s.SetPersistence(PersistSnapshot); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "b", "2")
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "c", "3")
+	if err := s.SetPersistence(PersistWAL); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "d", "4")
+
+	//crash
+	s = open_store(t, path, PersistWAL)
+	defer s.Close()
+	for name, want := range map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"} {
+		if v, _ := s.Get(key{name: name}); v != want {
+			t.Errorf("%s = %q after recovery, want %q", name, v, want)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// RecoveryReport is what startup found and did, so every restart doubles as a measurement
+type RecoveryReport struct {
+	SnapshotKeys      int    // keys loaded from the snapshot
+	Segments          int    // WAL segments read
+	Records           int    // WAL records read
+	Applied           int    // records replayed into the store
+	Skipped           int    // records at or below an LSN already applied
+	Damaged           int    // damaged stretches skipped in the middle of a segment
+	TornTail          bool   // the newest segment ended in a torn record that was cut off
+	Uncommitted       int    // transactions in the log without their COMMIT, not applied
+	Expired           int    // keys that expired while the process was down, dropped after replay
+	TombstonesDropped int    // soft deletes whose retention window ran out while we were down
+	Workers           int    // goroutines the records were applied on, see replay.go
+	KeysRestored      int    // live keys once recovery is done
+	LastLSN           uint64 // LSN the next write continues after
+	Duration          time.Duration
+}
+
+// RecordsPerSecond is the replay throughput, snapshot load included
+func (r RecoveryReport) RecordsPerSecond() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Records) / r.Duration.Seconds()
+}
+
+func (r RecoveryReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Recovery: %d keys restored in %s (last LSN %d)\n", r.KeysRestored, r.Duration.Round(time.Microsecond), r.LastLSN)
+	fmt.Fprintf(&sb, "  snapshot:  %d keys\n", r.SnapshotKeys)
+	fmt.Fprintf(&sb, "  WAL:       %d segments, %d records (%.0f records/s)\n", r.Segments, r.Records, r.RecordsPerSecond())
+	fmt.Fprintf(&sb, "  records:   %d applied on %d workers, %d already applied, %d expired\n", r.Applied, r.Workers, r.Skipped, r.Expired)
+	fmt.Fprintf(&sb, "  damage:    %d stretches skipped, torn tail: %t\n", r.Damaged, r.TornTail)
+	fmt.Fprintf(&sb, "  transactions: %d never committed\n", r.Uncommitted)
+	fmt.Fprintf(&sb, "  tombstones: %d dropped\n", r.TombstonesDropped)
+	return sb.String()
+}
+
+// Recover opens a store on the WAL at wal_path and starts it from the snapshot at
+// snapshot_path, a backup SaveSnapshot wrote, say, rather than the store's own (an empty
+// snapshot_path is the store's own). only the WAL records after the snapshot's LSN are
+// replayed on top of it. a snapshot older than the start of the WAL fails: a checkpoint
+// or COMPACT has thrown away the writes in between. the store is closed on error
+func Recover(snapshot_path, wal_path string, opts Options) (*Store, RecoveryReport, error) {
+	s := New_Store(wal_path, opts)
+	if snapshot_path == "" {
+		snapshot_path = s.snapshot_path()
+	}
+	report, err := s.recover(snapshot_path)
+	if err != nil {
+		s.Close()
+		return nil, report, err
+	}
+	s.restore_views()
+	s.start_warm_up()
+	return s, report, nil
+}
+
+// Recover rebuilds the in-memory map from the snapshot and the WAL (see Replay_wal),
+// starts the materialized views again and reports what it found. the report is filled in as far as recovery got, also on error
+func (s *Store) Recover() (RecoveryReport, error) {
+	report, err := s.recover(s.snapshot_path())
+	if err == nil {
+		s.restore_views()
+		s.start_warm_up()
+	}
+	return report, err
+}
+
+func (s *Store) recover(snapshot_path string) (report RecoveryReport, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	start := time.Now()
+	defer func() {
+		report.Duration = time.Since(start)
+		report.KeysRestored = s.data.len()
+		report.LastLSN = s.last_lsn
+	}()
+
+	if s.persistence == PersistNone {
+		log.Println("Persistence is off, starting with an empty store")
+		return report, nil
+	}
+
+	from, err := s.load_snapshot(snapshot_path)
+	if err != nil {
+		return report, err
+	}
+	report.SnapshotKeys = s.data.len()
+	//segments a checkpoint kept for the archiver
+	s.wal.wal_lock.Lock()
+	s.wal.retire(from)
+	s.wal.wal_lock.Unlock()
+
+	segments, err := s.wal.segments_from(from)
+	if err != nil {
+		return report, err
+	}
+	report.Segments = len(segments)
+
+	//LSNs only go up, so a record at or below the last one applied (by the snapshot
+	//or earlier in the log) is one we've already got: a segment the snapshot
+	//overlaps, or a record written twice. applying it again could undo later writes
+	applied := s.last_lsn
+	lsns := lsn_counter{last: s.last_lsn}
+	damaged := s.wal.damaged
+	var txs tx_buffer
+	replay := s.new_replayer(&report)
+	report.Workers = max(len(replay.lanes), 1)
+	err = s.wal.for_each_record_from(from, func(rec wal_record) error {
+		report.Records++
+		lsns.stamp(&rec)
+		if rec.lsn <= applied {
+			report.Skipped++
+			return nil
+		}
+		applied = rec.lsn
+		s.last_lsn = max(s.last_lsn, rec.lsn)
+		return txs.feed(rec.op, rec.value, func() error { return replay.apply(rec) })
+	})
+	if finished := replay.finish(); err == nil {
+		err = finished
+	}
+	report.Damaged = s.wal.damaged - damaged
+
+	//everything before the torn record has been applied,
+	//so in recovery mode we cut it off and carry on. a striped batch the crash left in
+	//some stripes only was never acknowledged, that is cut off whatever the mode
+	if tails := torn_tails(err); len(tails) > 0 && (s.truncate_torn_tail || unfinished(tails)) {
+		report.TornTail = true
+		err = nil
+		for _, torn := range tails {
+			log.Printf("WARNING: %v, truncating the log to the last valid record\n", torn)
+			if err = s.wal.truncate_torn_tail(torn); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return report, err
+	}
+	err = s.roll_back_open_tx(&txs)
+	report.Uncommitted = txs.discarded
+	if err != nil {
+		return report, err
+	}
+	report.Expired = s.drop_expired()
+	if report.Skipped > 0 {
+		log.Printf("Skipped %d WAL records already applied (LSN at or below the last one replayed)\n", report.Skipped)
+	}
+	return report, s.check_key_codec(s.key_codec_set)
+}
+
+// count_recovered notes the soft deletes whose window ran out while the store was down
+// Caller must hold s.lock, before the record is applied
+func (s *Store) count_recovered(report *RecoveryReport, rec wal_record) {
+	if rec.op != DELETE && rec.op != GETDEL {
+		return
+	}
+	if _, exists := s.data.get(key{name: rec.key, db: rec.db}); exists && !rec.expires_at.IsZero() && !rec.expires_at.After(time.Now()) {
+		report.TombstonesDropped++
+	}
+}
+
+// drop_expired deletes the keys that have expired, without logging anything:
+// the records that set their expiry replay to the same verdict
+// Caller must hold s.lock
+func (s *Store) drop_expired() int {
+	now := time.Now()
+	n := 0
+	s.data.each(0, func(k key, v value) bool {
+		if !v.expires_at.IsZero() && !v.expires_at.After(now) {
+			s.drop(k)
+			n++
+		}
+		return true
+	})
+	return n
+}
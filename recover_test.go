@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startup recovery and its report, see recover.go
+
+// logged writes n keys to a new log at path and closes it
+func logged(t *testing.T, path string, n int) {
+	t.Helper()
+	s := open_store(t, path, PersistWAL)
+	for i := range n {
+		set(t, s, "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// a record cut short at the end of the log fails recovery, unless TruncateTornTail
+// cuts it off and carries on from the records before it
+func TestTornTail(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	logged(t, path, 5)
+	info, _ := os.Stat(path)
+	torn := codec_for(WALBinary).encode(wal_record{lsn: 6, op: SET, key: "k5", value: "5"})
+	//cut after a byte that isn't 0, one that is looks like preallocated zero fill
+	cut := len(torn) / 2
+	for torn[cut-1] == 0 {
+		cut--
+	}
+	fd, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	fd.Write(torn[:cut])
+	fd.Close()
+
+	if _, _, err := Recover("", path, Options{}); err == nil {
+		t.Fatal("recovered past a torn record without TruncateTornTail")
+	}
+	s, report, err := Recover("", path, Options{TruncateTornTail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.TornTail || report.KeysRestored != 5 || report.LastLSN != 5 {
+		t.Errorf("report %+v", report)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Errorf("segment is %d bytes after the cut, was %d before the torn write", after.Size(), info.Size())
+	}
+	set(t, s, "k5", "again")
+	s.Close()
+
+	s, report, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.TornTail || get(t, s, "k5") != "again" || report.LastLSN != 6 {
+		t.Errorf("after writing on from the cut: k5=%q, report %+v", get(t, s, "k5"), report)
+	}
+}
+
+// a ttl is logged as the time it runs out, so a restart neither gives the key a fresh
+// ttl nor brings back one that expired while the store was down
+func TestExpiryAcrossRestart(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	s.Set(key{name: "short"}, 50*time.Millisecond, "x")
+	s.Set(key{name: "long"}, time.Hour, "y")
+	set(t, s, "forever", "z")
+	s.Expire(key{name: "forever"}, 300*time.Millisecond)
+	long, _ := s.data.get(key{name: "long"})
+	s.Close()
+
+	time.Sleep(100 * time.Millisecond)
+	s, report, err := Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Expired != 1 || s.Exists(key{name: "short"}) {
+		t.Errorf("short after a restart past its ttl: expired %d, exists %v", report.Expired, s.Exists(key{name: "short"}))
+	}
+	if v, _ := s.data.get(key{name: "long"}); !v.expires_at.Equal(long.expires_at) {
+		t.Errorf("long expires at %s after a restart, %s before", v.expires_at, long.expires_at)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "forever"}); ttl <= 0 || ttl > 200*time.Millisecond {
+		t.Errorf("forever's EXPIRE started over on replay, %v left", ttl)
+	}
+	s.Close()
+}
+
+// a damaged record with intact ones after it fails recovery, unless TruncateTornTail
+// skips it: the record markers find the next one and only the damaged write is lost
+func TestDamagedRecord(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	logged(t, path, 10)
+	r, err := OpenWALReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := read_all(t, r)
+	r.Close()
+	//a byte of k4's body, and of the length after it
+	data, _ := os.ReadFile(path)
+	data[all[4].Offset+12] ^= 0xff
+	data[all[5].Offset-8] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	if _, _, err := Recover("", path, Options{}); err == nil {
+		t.Fatal("recovered past a damaged record without TruncateTornTail")
+	}
+	s, report, err := Recover("", path, Options{TruncateTornTail: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.Damaged != 1 || report.TornTail || report.KeysRestored != 9 || s.Exists(key{name: "k4"}) || get(t, s, "k9") != "9" {
+		t.Errorf("report %+v, k4 there %v", report, s.Exists(key{name: "k4"}))
+	}
+
+	r, err = OpenWALReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var damaged []int64
+	r.SkipDamaged(func(_ string, offset, _ int64) { damaged = append(damaged, offset) })
+	if got := read_all(t, r); len(got) != 9 || len(damaged) != 1 || damaged[0] != all[4].Offset {
+		t.Errorf("WALReader skipping damage: %d records, damage at %v, k4 at %d", len(got), damaged, all[4].Offset)
+	}
+}
+
+// EXPIRE logs when the key runs out, not the ttl, and an EXPIRE from an old log that
+// only has the ttl still counts it from the replay
+func TestExpireRecord(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	s.Expire(key{name: "a"}, time.Hour)
+	want, _ := s.data.get(key{name: "a"})
+	s.Close()
+
+	r, err := OpenWALReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := read_all(t, r)
+	r.Close()
+	if e := all[1]; e.Op != "EXPIRE" || e.TTL != 0 || !e.ExpiresAt.Equal(want.expires_at) {
+		t.Errorf("the EXPIRE record: %+v, key expires at %s", e, want.expires_at)
+	}
+
+	old := filepath.Join(t.TempDir(), "old.log")
+	lines := []string{"SET b 2", "EXPIRE b 1h0m0s"}
+	var text []byte
+	for _, line := range lines {
+		text = append(text, line+"|"+compute_crc(line)+"\n"...)
+	}
+	os.WriteFile(old, text, 0o644)
+	s = open_store(t, old, PersistWAL)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "b"}); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("b's ttl from a relative EXPIRE: %v", ttl)
+	}
+}
+
+// a snapshot that overlaps the log and a record logged twice: every record at or
+// below the last LSN applied is skipped, the newer writes it could undo stay
+func TestLSNDedup(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	backup := filepath.Join(dir, "backup.snap")
+	logged(t, path, 10)
+	s := open_store(t, path, PersistWAL)
+	if _, err := s.SaveSnapshot(backup); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "k3", "new")
+	s.Close()
+	//a redelivered copy of k3's first write, after the one that replaced it
+	fd, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	fd.Write(codec_for(WALBinary).encode(wal_record{lsn: 4, op: SET, key: "k3", value: "3"}))
+	fd.Close()
+
+	s, report, err := Recover(backup, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.SnapshotKeys != 10 || report.Records != 12 || report.Skipped != 11 || report.Applied != 1 {
+		t.Errorf("report %+v", report)
+	}
+	if got := get(t, s, "k3"); got != "new" || s.LastLSN() != 11 {
+		t.Errorf("k3=%q, LastLSN %d after the duplicate", got, s.LastLSN())
+	}
+}
+
+// the report counts what recovery read and did, a transaction the crash cut off
+// included, and the ROLLBACK logged after it keeps the next writes out of it
+func TestRecoveryReport(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{WALSegmentSize: 1 << 10}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 100)
+	for i := range 40 {
+		set(t, s, "k"+strconv.Itoa(i%20), value)
+	}
+	segments := wal_segments(t, s)
+	last := s.wal.segment_path(segments[len(segments)-1])
+	s.Close()
+	codec := codec_for(WALBinary)
+	fd, _ := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0)
+	fd.Write(codec.encode(wal_record{lsn: 41, op: BEGIN, value: "2"}))
+	fd.Write(codec.encode(wal_record{lsn: 42, op: SET, key: "half", value: "1"}))
+	fd.Close()
+
+	s, report, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Segments != len(segments) || report.Records != 42 || report.Applied != 40 || report.Uncommitted != 1 || report.KeysRestored != 20 || report.LastLSN != 43 {
+		t.Errorf("report %+v, %d segments", report, segments)
+	}
+	if s.Exists(key{name: "half"}) {
+		t.Error("half of a transaction applied")
+	}
+	if report.Duration <= 0 || report.RecordsPerSecond() <= 0 {
+		t.Errorf("took %s, %.0f records/s", report.Duration, report.RecordsPerSecond())
+	}
+	for _, line := range []string{"20 keys restored", "42 records", "40 applied", "1 never committed"} {
+		if !strings.Contains(report.String(), line) {
+			t.Errorf("%q isn't in\n%s", line, report)
+		}
+	}
+	set(t, s, "after", "1")
+	s.Close()
+
+	s, report, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.Uncommitted != 1 || report.Applied != 41 || get(t, s, "after") != "1" {
+		t.Errorf("after the ROLLBACK: %+v", report)
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RENAME moves a key's value to another key and COPY duplicates it, expiry and all,
+// in one step under the write lock and as one WAL record. done from the outside as
+// a GET, a SET and a DELETE, another writer could get in between, and a crash could
+// leave the value under both keys or (with the DELETE logged first) under neither
+//
+// the record is logged under the source key with the destination (name and db, it
+// can be in another database) packed into its value. replay moves or copies whatever
+// the source holds at that point, which is what it held when the record was written
+
+// move_target is the destination key of a RENAME or COPY record
+func move_target(rec wal_record) (key, error) {
+	args, err := decode_args(rec.value)
+	if err != nil {
+		return key{}, err
+	}
+	if len(args) != 2 {
+		return key{}, errors.New(rec.op.String() + " record needs a destination key and db")
+	}
+	db, err := strconv.Atoi(args[1])
+	if err != nil || db < 0 {
+		return key{}, errors.New("invalid destination db in " + rec.op.String() + " record: " + args[1])
+	}
+	return key{name: args[0], db: db}, nil
+}
+
+// describe_key is k for people, with its db unless that is 0
+func describe_key(k key) string {
+	if k.db != 0 {
+		return k.name + " (db " + strconv.Itoa(k.db) + ")"
+	}
+	return k.name
+}
+
+// Rename moves src's value and expiry to dst, replacing whatever dst held
+// renaming a key to itself does nothing
+func (s *Store) Rename(src, dst key) error {
+	_, err := s.move(RENAME, src, dst, true)
+	return err
+}
+
+// Copy puts a copy of src's value and expiry under dst and reports whether it did
+// if dst already holds a live value it is only replaced with replace set
+func (s *Store) Copy(src, dst key, replace bool) (bool, error) {
+	return s.move(COPY, src, dst, replace)
+}
+
+func (s *Store) move(op operation_type, src, dst key, replace bool) (bool, error) {
+	src, dst = s.encode_key(src), s.encode_key(dst)
+	s.lock.Lock()
+
+	if err := s.check_frozen(src); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	if err := s.check_frozen(dst); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	val, exists := s.data.get(src)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		s.lock.Unlock()
+		return false, ErrKeyNotFound
+	}
+	if src == dst {
+		s.lock.Unlock()
+		if op == COPY {
+			return false, errors.New("source and destination are the same key")
+		}
+		return true, nil
+	}
+	if !replace {
+		if old, exists := s.data.get(dst); exists && (old.expires_at.IsZero() || time.Now().Before(old.expires_at)) {
+			s.lock.Unlock()
+			return false, nil
+		}
+	}
+	if val.obj == nil {
+		if err := s.validate(dst, val.data); err != nil {
+			s.lock.Unlock()
+			return false, err
+		}
+	}
+	//a rename frees src as it fills dst, only the difference in key length needs room
+	size := entry_size(dst, val)
+	if op == RENAME {
+		size -= entry_size(src, val)
+	}
+	if err := s.make_room_for(dst, size, src); err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+
+	rec := wal_record{lsn: s.next_lsn(), op: op, key: src.name, db: src.db, value: encode_args([]string{dst.name, strconv.Itoa(dst.db)})}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	//Get mustn't see the key under both names, or neither
+	s.data.lock_all()
+	err = s.replay_move(rec)
+	s.data.unlock_all()
+	if err != nil {
+		s.lock.Unlock()
+		return false, err
+	}
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return true, s.wait(ack)
+}
+
+// replay_move applies a RENAME or COPY record
+// Caller must hold s.lock
+func (s *Store) replay_move(rec wal_record) error {
+	dst, val, ok, err := s.take_moved(rec)
+	if ok {
+		s.put_moved(dst, val)
+	}
+	return err
+}
+
+// take_moved is the source's half of replay_move: the value for the destination, and
+// the source gone if it is a RENAME. not ok if there is nothing to move
+// Caller must hold s.lock
+func (s *Store) take_moved(rec wal_record) (key, value, bool, error) {
+	dst, err := move_target(rec)
+	if err != nil {
+		return dst, value{}, false, err
+	}
+	src := key{name: rec.key, db: rec.db}
+	val, exists := s.data.get(src)
+	if !exists {
+		return dst, val, false, nil
+	}
+	val.lsn = rec.lsn
+	if rec.op == RENAME {
+		s.drop(src)
+	} else {
+		//the copy can't share the object (it changes in place) or the access stats
+		if val.obj != nil {
+			if val.obj, err = load_object(dump_object(val.obj)); err != nil {
+				return dst, val, false, err
+			}
+			val.gen = s.view_gen.Load()
+		}
+		val.access = nil
+	}
+	return dst, val, true, nil
+}
+
+// put_moved is the destination's half
+// Caller must hold s.lock
+func (s *Store) put_moved(dst key, val value) {
+	s.put(dst, val)
+	delete(s.tombstones, dst)
+}
+
+// RENAME src dst, COPY src dst [DB n] [REPLACE]
+func (s *Store) process_move(cmd string, input_parts []string) error {
+	if len(input_parts) < 3 || (cmd == "RENAME" && len(input_parts) != 3) {
+		return errors.New(cmd + " command requires a source and a destination key")
+	}
+	src, dst := s.shell_key(input_parts[1]), s.shell_key(input_parts[2])
+	if cmd == "RENAME" {
+		if err := s.Rename(src, dst); err != nil {
+			return err
+		}
+		log.Printf("Key %s renamed to %s\n", input_parts[1], input_parts[2])
+		return nil
+	}
+
+	replace := false
+	for i := 3; i < len(input_parts); i++ {
+		switch strings.ToUpper(input_parts[i]) {
+		case "REPLACE":
+			replace = true
+		case "DB":
+			if i+1 >= len(input_parts) {
+				return errors.New("COPY DB requires a database number")
+			}
+			db, err := strconv.Atoi(input_parts[i+1])
+			if err != nil || db < 0 || db >= s.databases {
+				return errors.New("invalid database number: " + input_parts[i+1])
+			}
+			dst.db = db
+			i++
+		default:
+			return errors.New("COPY takes DB and REPLACE, got: " + input_parts[i])
+		}
+	}
+	copied, err := s.Copy(src, dst, replace)
+	if err != nil {
+		return err
+	}
+	if !copied {
+		return errors.New("key " + describe_key(dst) + " already exists, COPY it with REPLACE")
+	}
+	log.Printf("Key %s copied to %s\n", input_parts[1], describe_key(dst))
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// RENAME and COPY, see rename.go
+
+// RENAME moves the value and its ttl in one record, over whatever the destination
+// held and into another database too
+func TestRename(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	s.Set(key{name: "a"}, time.Hour, "1")
+	set(t, s, "b", "2")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	last := s.LastLSN()
+	if err := s.Rename(key{name: "a"}, key{name: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if s.LastLSN() != last+1 {
+		t.Errorf("RENAME logged %d records", s.LastLSN()-last)
+	}
+	if err := s.Rename(key{name: "h"}, key{name: "h", db: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Rename(key{name: "a"}, key{name: "c"}); err != ErrKeyNotFound {
+		t.Errorf("RENAME of a missing key: %v", err)
+	}
+	if err := s.Rename(key{name: "b"}, key{name: "b"}); err != nil || get(t, s, "b") != "1" {
+		t.Errorf("RENAME b b: %v", err)
+	}
+
+	for restart := range 2 {
+		if _, ttl, _, _ := s.Ttl(key{name: "b"}); get(t, s, "b") != "1" || ttl <= 59*time.Minute || s.Exists(key{name: "a"}) {
+			t.Errorf("restart %d: b=%q with %v left, a there %v", restart, get(t, s, "b"), ttl, s.Exists(key{name: "a"}))
+		}
+		if all, _ := s.HGetAll(key{name: "h", db: 2}); !maps.Equal(all, map[string]string{"f": "v"}) || s.Type(key{name: "h"}) != "none" {
+			t.Errorf("restart %d: h in db 2 %v, in db 0 a %s", restart, all, s.Type(key{name: "h"}))
+		}
+		s = reopen(t, s, path)
+	}
+	s.Close()
+}
+
+// COPY leaves a live destination alone unless told to replace it, and the copy of an
+// object is its own
+func TestCopy(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	s.Set(key{name: "a"}, time.Hour, "1")
+	set(t, s, "b", "2")
+	if ok, err := s.Copy(key{name: "a"}, key{name: "b"}, false); ok || err != nil || get(t, s, "b") != "2" {
+		t.Errorf("COPY a b without REPLACE: %v %v, b=%s", ok, err, get(t, s, "b"))
+	}
+	if ok, err := s.Copy(key{name: "a"}, key{name: "b"}, true); !ok || err != nil || get(t, s, "b") != "1" {
+		t.Errorf("COPY a b REPLACE: %v %v, b=%s", ok, err, get(t, s, "b"))
+	}
+	if _, err := s.Copy(key{name: "a"}, key{name: "a"}, true); err == nil {
+		t.Error("COPY a a")
+	}
+	s.SAdd(key{name: "s"}, "x")
+	s.Copy(key{name: "s"}, key{name: "t"}, false)
+	s.SAdd(key{name: "t"}, "y")
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if _, ttl, _, _ := s.Ttl(key{name: "b"}); get(t, s, "a") != "1" || get(t, s, "b") != "1" || ttl <= 59*time.Minute {
+		t.Errorf("after a restart a=%s b=%s with %v left", get(t, s, "a"), get(t, s, "b"), ttl)
+	}
+	if n, _ := s.SCard(key{name: "s"}); n != 1 {
+		t.Errorf("adding to the copy changed the source, %d members", n)
+	}
+}
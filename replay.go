@@ -0,0 +1,209 @@
+package main
+
+import (
+	"hash/maphash"
+	"log"
+	"sync"
+)
+
+// replay applies the WAL's records on one goroutine unless Options.ReplayWorkers asks for
+// more. then every worker owns every n-th shard of the map and applies the records for
+// the keys in its shards in log order, so each key still sees its writes in the order
+// they were made while keys in other shards are replayed at the same time. reading and
+// decoding the log stays on the recover loop, it hands the records out in batches
+//
+// the memory estimate, the scan index and the tombstones aren't per shard. each worker
+// applies through a lane, a Store of its own over the same shard map with its own memory
+// count and tombstones, and they are added back up when replay is done, the scan index is
+// rebuilt from the map. a RENAME or COPY from one worker's shards to another's waits for
+// the two to be done with what came before it, then takes the value out of the one and
+// puts it in the other
+
+// records handed to a worker at once, so the channel isn't in the way of every record
+const replay_batch = 256
+
+type replayer struct {
+	s      *Store
+	report *RecoveryReport
+	lanes  []*replay_lane // none when replay is on one goroutine
+}
+
+type replay_lane struct {
+	s       *Store // applies to the store's map, with counts of its own
+	queue   chan []wal_record
+	batch   []wal_record
+	pending sync.WaitGroup // batches queued and not applied yet
+	report  RecoveryReport // what count_recovered counted for the lane's keys
+	err     error          // the first record that failed, the lane skips the rest
+}
+
+// new_replayer starts the store's replay workers, as many as it may start
+// Caller must hold s.lock
+func (s *Store) new_replayer(report *RecoveryReport) *replayer {
+	r := &replayer{s: s, report: report}
+	//more workers than shards would have nothing to do
+	workers := min(s.replay_workers, len(s.data.shards))
+	for i := 0; i < workers && workers > 1; i++ {
+		lane := &replay_lane{
+			s: &Store{
+				data:        s.data,
+				scan:        &scan_index{seed: maphash.MakeSeed()},
+				wal:         s.wal,
+				persistence: s.persistence,
+				soft_delete: s.soft_delete,
+				max_memory:  s.max_memory,
+				key_codec:   s.key_codec,
+			},
+			queue: make(chan []wal_record, 4),
+		}
+		lane.s.view_gen.Store(s.view_gen.Load())
+		if err := s.wal.res.try_start("replay worker", lane.run); err != nil {
+			log.Printf("WARNING: %v, replaying with %d workers\n", err, len(r.lanes))
+			break
+		}
+		r.lanes = append(r.lanes, lane)
+	}
+	r.split()
+	return r
+}
+
+func (l *replay_lane) run() {
+	for batch := range l.queue {
+		for _, rec := range batch {
+			if l.err != nil {
+				break
+			}
+			l.s.count_recovered(&l.report, rec)
+			l.err = l.s.replayEntry(rec)
+		}
+		l.pending.Done()
+	}
+}
+
+// hand batches rec for the lane's worker
+func (l *replay_lane) hand(rec wal_record) {
+	l.batch = append(l.batch, rec)
+	if len(l.batch) == replay_batch {
+		l.flush()
+	}
+}
+
+func (l *replay_lane) flush() {
+	if len(l.batch) == 0 {
+		return
+	}
+	l.pending.Add(1)
+	l.queue <- l.batch
+	l.batch = make([]wal_record, 0, replay_batch)
+}
+
+// lane is the lane whose shards k is in
+func (r *replayer) lane(k key) *replay_lane {
+	return r.lanes[r.s.data.index(k)%len(r.lanes)]
+}
+
+// apply replays rec, on the store or handed to the worker for its key
+func (r *replayer) apply(rec wal_record) error {
+	r.report.Applied++
+	log.Printf("Replayed WAL entry: %s\n", rec)
+	if len(r.lanes) == 0 {
+		r.s.count_recovered(r.report, rec)
+		return r.s.replayEntry(rec)
+	}
+
+	lane := r.lane(key{name: rec.key, db: rec.db})
+	keys := record_keys(rec)
+	if len(keys) < 2 || r.lane(keys[1]) == lane {
+		lane.hand(rec)
+		return nil
+	}
+	//between two workers' shards: what they have before it first, then each one's half
+	//of it on this goroutine while they wait. the other workers carry on
+	to := r.lane(keys[1])
+	if err := r.wait(lane, to); err != nil {
+		return err
+	}
+	dst, val, ok, err := lane.s.take_moved(rec)
+	if ok {
+		to.s.put_moved(dst, val)
+	}
+	return err
+}
+
+// load applies a record of a snapshot, on the store or handed to the worker for its key
+// a snapshot has one record for each key and none that move a value to another
+func (r *replayer) load(rec wal_record) error {
+	if len(r.lanes) == 0 {
+		return r.s.replayEntry(rec)
+	}
+	r.lane(key{name: rec.key, db: rec.db}).hand(rec)
+	return nil
+}
+
+// wait hands out what is batched for lanes and waits for their workers to apply it
+func (r *replayer) wait(lanes ...*replay_lane) error {
+	for _, lane := range lanes {
+		lane.flush()
+	}
+	for _, lane := range lanes {
+		lane.pending.Wait()
+		if lane.err != nil {
+			return lane.err
+		}
+	}
+	return nil
+}
+
+// split hands the store's tombstones (the snapshot's) to the lanes their keys are in
+func (r *replayer) split() {
+	if len(r.lanes) == 0 {
+		return
+	}
+	for k, t := range r.s.tombstones {
+		lane := r.lane(k)
+		if lane.s.tombstones == nil {
+			lane.s.tombstones = make(map[key]tombstone)
+		}
+		lane.s.tombstones[k] = t
+	}
+	r.s.tombstones = nil
+}
+
+// merge adds the lanes' memory counts and tombstones back up into the store, once the
+// workers are done
+func (r *replayer) merge() {
+	for _, lane := range r.lanes {
+		r.s.memory += lane.s.memory
+		lane.s.memory = 0
+		for k, t := range lane.s.tombstones {
+			if r.s.tombstones == nil {
+				r.s.tombstones = make(map[key]tombstone)
+			}
+			r.s.tombstones[k] = t
+		}
+		lane.s.tombstones = nil
+	}
+}
+
+// finish waits for the workers and stops them, and leaves the store as replaying it
+// all on one goroutine would have. it has to be called whatever replay returned
+func (r *replayer) finish() error {
+	if len(r.lanes) == 0 {
+		return nil
+	}
+	err := r.wait(r.lanes...)
+	for _, lane := range r.lanes {
+		close(lane.queue)
+	}
+	r.merge()
+	for _, lane := range r.lanes {
+		r.report.TombstonesDropped += lane.report.TombstonesDropped
+	}
+	//the lanes' scan indexes only have what they added
+	r.s.scan = &scan_index{seed: maphash.MakeSeed()}
+	r.s.data.each(0, func(k key, _ value) bool {
+		r.s.scan.add(k)
+		return true
+	})
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// write_history fills a WAL with n rounds of every kind of write, transactions over
+// several keys included, and with moves RENAMEs and COPYs, between keys in different
+// shards as often as not
+func write_history(t testing.TB, path string, n int, moves bool) {
+	s := New_Store(path, Options{SoftDelete: time.Hour})
+	defer s.Close()
+	for i := 0; i < n; i++ {
+		k := func(j int) key { return key{name: "key:" + strconv.Itoa((i+j)%500)} }
+		if err := s.Set(k(0), 0, "v"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		op := i % 7
+		if !moves && (op == 3 || op == 4) {
+			op = 0
+		}
+		switch op {
+		case 1:
+			s.Delete(k(3))
+		case 2:
+			s.Undelete(k(3))
+		case 3:
+			s.Rename(k(0), k(11))
+		case 4:
+			s.Copy(k(5), key{name: "copy:" + strconv.Itoa(i%50), db: 1}, true)
+		case 5:
+			s.HSet(key{name: "hash:" + strconv.Itoa(i%20)}, map[string]string{"f" + strconv.Itoa(i%3): "x"})
+		case 6:
+			tx := s.Begin()
+			tx.Set(k(1), 0, "tx")
+			tx.Delete(k(2))
+			tx.Set(key{name: "tx:" + strconv.Itoa(i%30)}, 0, "tx")
+			if err := tx.Commit(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// what a recovered store holds, to compare two recoveries by
+func recovered_state(s *Store) map[string]string {
+	state := make(map[string]string)
+	s.data.each(0, func(k key, val value) bool {
+		v := val.data
+		if val.obj != nil {
+			v = dump_object(val.obj)
+		}
+		state[describe_key(k)] = fmt.Sprintf("%q lsn %d", v, val.lsn)
+		return true
+	})
+	for k, t := range s.tombstones {
+		state["tombstone "+describe_key(k)] = fmt.Sprintf("%q lsn %d", t.val.data, t.lsn)
+	}
+	state["memory"] = strconv.FormatInt(s.memory, 10)
+	return state
+}
+
+func quiet_log(t testing.TB) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+// replay on several workers ends up where replay on one does, scan index included
+func TestReplayWorkers(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	write_history(t, path, 5000, true)
+
+	one, _, err := Recover("", path, Options{SoftDelete: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer one.Close()
+	want := recovered_state(one)
+
+	for _, workers := range []int{2, 8} {
+		s, report, err := Recover("", path, Options{SoftDelete: time.Hour, ReplayWorkers: workers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Workers != workers {
+			t.Errorf("replayed on %d workers, want %d", report.Workers, workers)
+		}
+		got := recovered_state(s)
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%d workers: %s = %s, want %s", workers, k, got[k], v)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%d workers: %d entries, want %d", workers, len(got), len(want))
+		}
+		keys, _ := s.Scan(0, 0, "*", 1<<20)
+		if n := len(s.Keys(0, "*")); len(keys) != n {
+			t.Errorf("%d workers: SCAN found %d keys of %d", workers, len(keys), n)
+		}
+		s.Close()
+	}
+}
+
+// restart time by how many workers apply the records, compare
+//
+//	go test -run XXX -bench Replay -cpu 8
+//
+// the log is read and decoded on one goroutine whatever the count, so that is the floor,
+// and every RENAME or COPY between two workers has them all wait for it
+func BenchmarkReplay(b *testing.B) {
+	quiet_log(b)
+	for _, moves := range []bool{false, true} {
+		path := filepath.Join(b.TempDir(), "wal.log")
+		write_history(b, path, 50000, moves)
+		for _, workers := range []int{1, 2, 4, 8} {
+			b.Run(fmt.Sprintf("moves=%t/workers=%d", moves, workers), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s, report, err := Recover("", path, Options{SoftDelete: time.Hour, ReplayWorkers: workers})
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.ReportMetric(report.RecordsPerSecond(), "records/s")
+					s.Close()
+				}
+			})
+		}
+	}
+}
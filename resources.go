@@ -0,0 +1,190 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// resource accounting: every file the store and its WAL open and every goroutine
+// they start goes through the WAL's `res`, counted by kind, so a leak in IO code
+// shows up in Store.Resources() (RESOURCES in the shell) as a count that keeps
+// growing, and the limits in Options turn it into a *ResourceLimitError
+//
+// files are counted per *os.File, so closing one twice only counts once
+// only the goroutines started on demand (segment compression) can be refused,
+// the background ones a store needs to work are counted but always started
+//
+// not counted: the few short-lived opens in helpers that take no store (manifest
+// reads and rewrites, directory fsyncs), WALReader and the query engine's FileScan,
+// which aren't the store's, and mmaps, since nothing here maps anything
+
+// ResourceLimitError is returned when opening a file, starting a goroutine or
+// writing a key would take the store past Options.MaxOpenFiles, MaxGoroutines or MaxMemory
+type ResourceLimitError struct {
+	Resource string // "open files", "goroutines" or "bytes of memory"
+	Kind     string // what it was for, e.g. "segment"
+	Limit    int
+}
+
+func (e *ResourceLimitError) Error() string {
+	return "store has reached its limit of " + strconv.Itoa(e.Limit) + " " + e.Resource + " (for " + e.Kind + ")"
+}
+
+// ResourceStats is what the store holds right now, and the most it ever held at once
+type ResourceStats struct {
+	OpenFiles      int
+	Goroutines     int
+	PeakOpenFiles  int
+	PeakGoroutines int
+	MaxOpenFiles   int            // 0 = no limit
+	MaxGoroutines  int            // 0 = no limit
+	Files          map[string]int // open files by kind (wal, segment, snapshot, temp...)
+	Routines       map[string]int // goroutines by kind
+}
+
+type resources struct {
+	lock           sync.Mutex
+	files          map[*os.File]string // open file → kind
+	routines       map[string]int
+	goroutines     int
+	peak_files     int
+	peak_routines  int
+	max_files      int
+	max_goroutines int
+}
+
+// open opens a file through `open`, counted as `kind`
+func (r *resources) open(kind string, open func() (*os.File, error)) (*os.File, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.max_files > 0 && len(r.files) >= r.max_files {
+		return nil, &ResourceLimitError{Resource: "open files", Kind: kind, Limit: r.max_files}
+	}
+	fd, err := open()
+	if err != nil {
+		return nil, err
+	}
+	if r.files == nil {
+		r.files = make(map[*os.File]string)
+	}
+	r.files[fd] = kind
+	r.peak_files = max(r.peak_files, len(r.files))
+	return fd, nil
+}
+
+// open_file is os.OpenFile through open
+func (r *resources) open_file(kind string, path string, flag int, perm os.FileMode) (*os.File, error) {
+	return r.open(kind, func() (*os.File, error) { return os.OpenFile(path, flag, perm) })
+}
+
+// close closes a file opened through open, it only counts the first time
+func (r *resources) close(fd *os.File) error {
+	r.lock.Lock()
+	delete(r.files, fd)
+	r.lock.Unlock()
+	return fd.Close()
+}
+
+// start runs fn in a goroutine counted as `kind`, whatever the limit says
+func (r *resources) start(kind string, fn func()) {
+	r.lock.Lock()
+	r.add_routine(kind)
+	r.lock.Unlock()
+	go r.run(kind, fn)
+}
+
+// try_start is start for goroutines the store can do without, it refuses to go over the limit
+func (r *resources) try_start(kind string, fn func()) error {
+	r.lock.Lock()
+	if r.max_goroutines > 0 && r.goroutines >= r.max_goroutines {
+		r.lock.Unlock()
+		return &ResourceLimitError{Resource: "goroutines", Kind: kind, Limit: r.max_goroutines}
+	}
+	r.add_routine(kind)
+	r.lock.Unlock()
+	go r.run(kind, fn)
+	return nil
+}
+
+// caller must hold r.lock
+func (r *resources) add_routine(kind string) {
+	if r.routines == nil {
+		r.routines = make(map[string]int)
+	}
+	r.routines[kind]++
+	r.goroutines++
+	r.peak_routines = max(r.peak_routines, r.goroutines)
+}
+
+func (r *resources) run(kind string, fn func()) {
+	defer func() {
+		r.lock.Lock()
+		r.goroutines--
+		if r.routines[kind]--; r.routines[kind] == 0 {
+			delete(r.routines, kind)
+		}
+		r.lock.Unlock()
+	}()
+	fn()
+}
+
+func (r *resources) stats() ResourceStats {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	stats := ResourceStats{
+		OpenFiles:      len(r.files),
+		Goroutines:     r.goroutines,
+		PeakOpenFiles:  r.peak_files,
+		PeakGoroutines: r.peak_routines,
+		MaxOpenFiles:   r.max_files,
+		MaxGoroutines:  r.max_goroutines,
+		Files:          make(map[string]int),
+		Routines:       make(map[string]int),
+	}
+	for _, kind := range r.files {
+		stats.Files[kind]++
+	}
+	for kind, n := range r.routines {
+		stats.Routines[kind] = n
+	}
+	return stats
+}
+
+// Resources reports the files and goroutines the store holds, see resources.go
+func (s *Store) Resources() ResourceStats {
+	return s.wal.res.stats()
+}
+
+// resource_lines renders stats for RESOURCES, one "kind count" per line
+func resource_lines(stats ResourceStats) []string {
+	limit := func(n int) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(n)
+	}
+	lines := []string{
+		"open files: " + strconv.Itoa(stats.OpenFiles) + " (peak " + strconv.Itoa(stats.PeakOpenFiles) + ", limit " + limit(stats.MaxOpenFiles) + ")",
+	}
+	lines = append(lines, by_kind(stats.Files)...)
+	lines = append(lines, "goroutines: "+strconv.Itoa(stats.Goroutines)+" (peak "+strconv.Itoa(stats.PeakGoroutines)+", limit "+limit(stats.MaxGoroutines)+")")
+	lines = append(lines, by_kind(stats.Routines)...)
+	return lines
+}
+
+func by_kind(counts map[string]int) []string {
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	lines := make([]string, len(kinds))
+	for i, kind := range kinds {
+		lines[i] = "  " + kind + ": " + strconv.Itoa(counts[kind])
+	}
+	return lines
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// resource accounting and its limits, see resources.go
+
+// files past the limit are refused with a *ResourceLimitError, a file closed twice
+// only counts once and the peak stays where it got to
+func TestResourceFiles(t *testing.T) {
+	dir := t.TempDir()
+	r := &resources{max_files: 2}
+	var fds []*os.File
+	for i := range 2 {
+		fd, err := r.open_file("temp", filepath.Join(dir, strconv.Itoa(i)), os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, fd)
+	}
+	_, err := r.open_file("segment", filepath.Join(dir, "2"), os.O_CREATE|os.O_WRONLY, 0o644)
+	var limit *ResourceLimitError
+	if !errors.As(err, &limit) || limit.Resource != "open files" || limit.Kind != "segment" || limit.Limit != 2 {
+		t.Fatalf("the third file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "2")); err == nil {
+		t.Error("the refused file was created")
+	}
+	r.close(fds[0])
+	r.close(fds[0])
+	if stats := r.stats(); stats.OpenFiles != 1 || stats.PeakOpenFiles != 2 || stats.Files["temp"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	r.close(fds[1])
+}
+
+// try_start refuses to go past MaxGoroutines, start doesn't, and a goroutine stops
+// counting once it returns
+func TestResourceGoroutines(t *testing.T) {
+	r := &resources{max_goroutines: 1}
+	release := make(chan struct{})
+	done := make(chan struct{}, 2)
+	if err := r.try_start("compression", func() { <-release; done <- struct{}{} }); err != nil {
+		t.Fatal(err)
+	}
+	var limit *ResourceLimitError
+	if err := r.try_start("indexing", func() {}); !errors.As(err, &limit) || limit.Resource != "goroutines" {
+		t.Errorf("a second goroutine over a limit of 1: %v", err)
+	}
+	r.start("sweeper", func() { <-release; done <- struct{}{} })
+	if stats := r.stats(); stats.Goroutines != 2 || stats.Routines["compression"] != 1 || stats.Routines["sweeper"] != 1 {
+		t.Errorf("stats %+v", stats)
+	}
+	close(release)
+	<-done
+	<-done
+	//run's deferred bookkeeping comes after fn returns
+	for r.stats().Goroutines != 0 {
+		runtime.Gosched()
+	}
+	if stats := r.stats(); len(stats.Routines) != 0 || stats.PeakGoroutines != 2 {
+		t.Errorf("stats once they returned %+v", stats)
+	}
+}
+
+// a store rolling over segments holds the same files as before, and RESOURCES says which
+func TestStoreResources(t *testing.T) {
+	quiet_log(t)
+	s, _, err := Recover("", filepath.Join(t.TempDir(), "wal.log"), Options{WALSegmentSize: 4 << 10, ExpireInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	before := s.Resources()
+	value := strings.Repeat("v", 100)
+	for i := range 200 {
+		set(t, s, "k"+strconv.Itoa(i), value)
+	}
+	if after := s.Resources(); after.OpenFiles != before.OpenFiles || after.Files["wal"] != 1 {
+		t.Errorf("files before %v, after %d segments %v", before.Files, len(wal_segments(t, s)), after.Files)
+	}
+	lines := resource_lines(s.Resources())
+	if !strings.HasPrefix(lines[0], "open files: ") || !strings.Contains(lines[0], "limit unlimited") || !slices.Contains(lines, "  wal: 1") {
+		t.Errorf("RESOURCES: %q", lines)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"hash/maphash"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cursor SCAN: KEYS walks the whole map under the read lock, which on a big store
+// holds every writer up for the duration. Scan walks it a bit at a time instead
+//
+// Go maps can't be resumed from a position, so put and drop also file every key
+// under one of scan_slots slots by the hash of its name, and a cursor is simply the
+// next slot to look at. each call takes the read lock for just the slots it reads.
+// like Redis, a key that is there for the whole scan comes back exactly once, one
+// added or deleted meanwhile may or may not, and a call can return more than
+// count keys since a slot is never split
+//
+// the hash seed is per store, so a cursor only means something to the store that
+// handed it out, and only until it is closed
+
+// slots the keyspace is split into for Scan, a power of two
+const scan_slots = 4096
+
+// how many keys Scan aims for when count is 0
+const default_scan_count = 10
+
+type scan_index struct {
+	seed  maphash.Seed
+	slots [scan_slots]map[key]struct{}
+}
+
+func (x *scan_index) slot(k key) int {
+	return int(maphash.String(x.seed, k.name) & (scan_slots - 1))
+}
+
+// caller must hold s.lock
+func (x *scan_index) add(k key) {
+	i := x.slot(k)
+	if x.slots[i] == nil {
+		x.slots[i] = make(map[key]struct{})
+	}
+	x.slots[i][k] = struct{}{}
+}
+
+// caller must hold s.lock
+func (x *scan_index) remove(k key) {
+	delete(x.slots[x.slot(k)], k)
+}
+
+// Scan returns about count live keys of database db matching the glob `match` ("" matches
+// all, see Keys for the syntax) starting at cursor, and the cursor to continue from
+// start with 0, the scan is done when the returned cursor is 0 again
+// the slots hold every database's keys, the ones of other databases count towards count
+func (s *Store) Scan(db int, cursor uint64, match string, count int) ([]string, uint64) {
+	if count <= 0 {
+		count = default_scan_count
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	var keys []string
+	looked := 0
+	for ; cursor < scan_slots && looked < count; cursor++ {
+		for k := range s.scan.slots[cursor] {
+			looked++
+			val, _ := s.data.get(k)
+			if k.db != db || (!val.expires_at.IsZero() && now.After(val.expires_at)) {
+				continue
+			}
+			if match == "" || glob_match(match, k.name) {
+				keys = append(keys, k.name)
+			}
+		}
+	}
+	if cursor >= scan_slots {
+		cursor = 0
+	}
+	return keys, cursor
+}
+
+// process_scan is SCAN cursor [MATCH pattern] [COUNT n]
+func (s *Store) process_scan(cursor uint64, args []string) error {
+	match, count := "", 0
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			return errors.New("SCAN " + args[i] + " requires a value")
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			match = args[i+1]
+		case "COUNT":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n <= 0 {
+				return errors.New("invalid COUNT value: " + args[i+1])
+			}
+			count = n
+		default:
+			return errors.New("SCAN takes MATCH and COUNT, got: " + args[i])
+		}
+	}
+	keys, next := s.Scan(s.db, cursor, match, count)
+	log.Printf("Next cursor: %d (%d keys)\n", next, len(keys))
+	for _, k := range keys {
+		log.Printf("  %s\n", k)
+	}
+	return nil
+}
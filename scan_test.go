@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// cursor SCAN, see scan.go
+
+// scan_all runs a Scan from cursor 0 until it comes back to 0, calling between after every call
+func scan_all(t *testing.T, s *Store, db int, match string, count int, between func()) map[string]int {
+	t.Helper()
+	seen := map[string]int{}
+	cursor := uint64(0)
+	for calls := 0; ; calls++ {
+		if calls > scan_slots {
+			t.Fatal("SCAN never came back to cursor 0")
+		}
+		var keys []string
+		keys, cursor = s.Scan(db, cursor, match, count)
+		for _, k := range keys {
+			seen[k]++
+		}
+		if cursor == 0 {
+			return seen
+		}
+		between()
+	}
+}
+
+// a key that is there for the whole scan comes back exactly once, whatever is
+// written and deleted meanwhile, and only the database's keys that match come back
+func TestScan(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for i := range 1000 {
+		set(t, s, "k:"+strconv.Itoa(i), "x")
+	}
+	s.Set(key{name: "k:other", db: 1}, 0, "x")
+	i := 0
+	seen := scan_all(t, s, 0, "", 50, func() {
+		set(t, s, "new:"+strconv.Itoa(i), "x")
+		s.Delete(key{name: "k:" + strconv.Itoa(900+i%100)})
+		i++
+	})
+	for n := range 900 {
+		if k := "k:" + strconv.Itoa(n); seen[k] != 1 {
+			t.Fatalf("%s came back %d times", k, seen[k])
+		}
+	}
+	for k, n := range seen {
+		if n != 1 || k == "k:other" {
+			t.Errorf("%s came back %d times", k, n)
+		}
+	}
+
+	seen = scan_all(t, s, 0, "k:1?", 0, func() {})
+	if len(seen) != 10 {
+		t.Errorf("MATCH k:1?: %v", seen)
+	}
+	if seen = scan_all(t, s, 1, "", 1000, func() {}); len(seen) != 1 || seen["k:other"] != 1 {
+		t.Errorf("db 1: %v", seen)
+	}
+}
+
+// the shell's SCAN cursor [MATCH pattern] [COUNT n]
+func TestProcessScan(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	if err := s.process_scan(0, []string{"MATCH", "user:*", "count", "5"}); err != nil {
+		t.Error(err)
+	}
+	for _, args := range []string{"MATCH", "COUNT 0", "COUNT x", "TYPE string"} {
+		if err := s.process_scan(0, strings.Fields(args)); err == nil {
+			t.Errorf("SCAN 0 %s", args)
+		}
+	}
+}
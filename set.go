@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sort"
+)
+
+// sets: an unordered collection of distinct strings. SADD logs only the members
+// that weren't there and SREM only the ones that were, so replaying either is
+// the same change again. the ttl belongs to the whole set, EXPIRE works on it
+// like on any key and adding or removing members keeps it
+
+type set_object struct {
+	items map[string]struct{}
+	bytes int64
+}
+
+func (st *set_object) kind() string { return "set" }
+func (st *set_object) len() int     { return len(st.items) }
+func (st *set_object) size() int64  { return st.bytes }
+
+// members is sorted so a dump is always the same
+func (st *set_object) members() []string {
+	out := make([]string, 0, len(st.items))
+	for m := range st.items {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func (st *set_object) has(m string) bool {
+	_, ok := st.items[m]
+	return ok
+}
+
+func (st *set_object) apply(op operation_type, args []string) error {
+	switch op {
+	case SADD, RESTORE:
+		for _, m := range args {
+			if !st.has(m) {
+				st.items[m] = struct{}{}
+				st.bytes += int64(len(m)) + element_overhead
+			}
+		}
+	case SREM:
+		for _, m := range args {
+			if st.has(m) {
+				delete(st.items, m)
+				st.bytes -= int64(len(m)) + element_overhead
+			}
+		}
+	default:
+		return errors.New(op.String() + " is not a set operation")
+	}
+	return nil
+}
+
+// SAdd adds members to the set at k, creating it if needed, and returns how many were new
+func (s *Store) SAdd(k key, members ...string) (int, error) {
+	if len(members) == 0 {
+		return 0, errors.New("SADD needs at least one member")
+	}
+	var added []string
+	err := s.write_object(k, "set", SADD, func(obj object) ([]string, error) {
+		seen := make(map[string]bool)
+		for _, m := range members {
+			if seen[m] || (obj != nil && obj.(*set_object).has(m)) {
+				continue
+			}
+			seen[m] = true
+			added = append(added, m)
+		}
+		return added, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(added), nil
+}
+
+// SRem removes members from the set at k and returns how many were there
+// the set goes when its last member does
+func (s *Store) SRem(k key, members ...string) (int, error) {
+	var removed []string
+	err := s.write_object(k, "set", SREM, func(obj object) ([]string, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		seen := make(map[string]bool)
+		for _, m := range members {
+			if !seen[m] && obj.(*set_object).has(m) {
+				seen[m] = true
+				removed = append(removed, m)
+			}
+		}
+		return removed, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// SIsMember says whether m is in the set at k
+func (s *Store) SIsMember(k key, m string) (bool, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "set")
+	if obj == nil {
+		return false, err
+	}
+	return obj.(*set_object).has(m), nil
+}
+
+// SMembers returns the members of the set at k, sorted, none if k is missing
+func (s *Store) SMembers(k key) ([]string, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "set")
+	if obj == nil {
+		return nil, err
+	}
+	return obj.members(), nil
+}
+
+// SCard is how many members the set at k has, 0 if k is missing
+func (s *Store) SCard(k key) (int, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	obj, err := s.read_object(k, "set")
+	if obj == nil {
+		return 0, err
+	}
+	return obj.len(), nil
+}
+
+// SADD/SREM key member [member ...], SISMEMBER key member, SMEMBERS key, SCARD key
+func (s *Store) process_set(cmd string, input_parts []string) error {
+	switch cmd {
+	case "SADD", "SREM":
+		if len(input_parts) < 3 {
+			return errors.New(cmd + " command requires a key and at least one member")
+		}
+		if cmd == "SADD" {
+			added, err := s.SAdd(s.shell_key(input_parts[1]), input_parts[2:]...)
+			if err != nil {
+				return err
+			}
+			log.Printf("Set %s: %d members added\n", input_parts[1], added)
+			return nil
+		}
+		removed, err := s.SRem(s.shell_key(input_parts[1]), input_parts[2:]...)
+		if err != nil {
+			return err
+		}
+		log.Printf("Set %s: %d members removed\n", input_parts[1], removed)
+
+	case "SISMEMBER":
+		if len(input_parts) != 3 {
+			return errors.New("SISMEMBER command requires a key and a member")
+		}
+		ok, err := s.SIsMember(s.shell_key(input_parts[1]), input_parts[2])
+		if err != nil {
+			return err
+		}
+		if ok {
+			log.Printf("%s is a member of %s\n", input_parts[2], input_parts[1])
+		} else {
+			log.Printf("%s is not a member of %s\n", input_parts[2], input_parts[1])
+		}
+
+	case "SMEMBERS":
+		if len(input_parts) != 2 {
+			return errors.New("SMEMBERS command requires a key")
+		}
+		members, err := s.SMembers(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			log.Printf("  %s\n", m)
+		}
+		log.Printf("%d members\n", len(members))
+
+	case "SCARD":
+		if len(input_parts) != 2 {
+			return errors.New("SCARD command requires a key")
+		}
+		n, err := s.SCard(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		log.Printf("Set %s has %d members\n", input_parts[1], n)
+	}
+	return nil
+}
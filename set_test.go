@@ -0,0 +1,76 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sets, see set.go
+
+// SADD logs only the members that are new, SREM only the ones that were there, and a
+// set with a ttl comes back from a snapshot and the log after it with its members and ttl
+func TestSet(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	tags := key{name: "tags"}
+	if n, err := s.SAdd(tags, "go", "db", "go"); n != 2 || err != nil {
+		t.Errorf("SADD go db go: %d %v", n, err)
+	}
+	if n, _ := s.SAdd(tags, "db", "wal"); n != 1 {
+		t.Errorf("SADD db wal: %d", n)
+	}
+	if n, _ := s.SAdd(tags, "db"); n != 0 {
+		t.Errorf("SADD of a member that is there: %d", n)
+	}
+	if n, _ := s.SRem(tags, "db", "db", "io"); n != 1 {
+		t.Errorf("SREM db db io: %d", n)
+	}
+	if ok, _ := s.SIsMember(tags, "go"); !ok {
+		t.Error("go isn't a member")
+	}
+	if ok, _ := s.SIsMember(tags, "db"); ok {
+		t.Error("db is still a member")
+	}
+	if _, err := s.SAdd(tags); err == nil {
+		t.Error("SADD without members")
+	}
+	set(t, s, "str", "x")
+	if _, err := s.SIsMember(key{name: "str"}, "x"); err != ErrWrongType {
+		t.Errorf("SISMEMBER on a string: %v", err)
+	}
+	s.SAdd(key{name: "gone"}, "a")
+	s.SRem(key{name: "gone"}, "a")
+	if s.Type(key{name: "gone"}) != "none" {
+		t.Error("a set without members is still there")
+	}
+
+	var logged []string
+	s.ReplayFrom(0, func(e Entry) error {
+		if e.Key == tags.name {
+			args, _ := decode_args(e.Value)
+			logged = append(logged, e.Op+" "+strings.Join(args, " "))
+		}
+		return nil
+	})
+	if got := strings.Join(logged, ", "); got != "SADD go db, SADD wal, SREM db" {
+		t.Errorf("logged %s", got)
+	}
+
+	s.Expire(tags, time.Hour)
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.SAdd(tags, "io")
+	s = reopen(t, s, path)
+	defer s.Close()
+	members, _ := s.SMembers(tags)
+	if n, _ := s.SCard(tags); strings.Join(members, " ") != "go io wal" || n != 3 {
+		t.Errorf("after a restart SMEMBERS %v, SCARD %d", members, n)
+	}
+	if _, ttl, _, _ := s.Ttl(tags); ttl <= 59*time.Minute {
+		t.Errorf("ttl after a restart: %v", ttl)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/rand/v2"
+	"sync"
+)
+
+// the map is split into shards, each with its own lock, so Get doesn't take the
+// store lock at all. writers still do: LSNs are handed out under s.lock so LSN order
+// is WAL order, and the memory cap, the scan index, tombstones and transactions all
+// count on one writer at a time. what the shards buy is that a read never waits for
+// a write to a key in another shard, least of all for the fsync a write does under
+// s.lock without group commit, and that readers don't all hit the same lock
+//
+// the rule: a shard's map is only written with s.lock held for writing and the
+// shard's lock, and read with s.lock held (a read lock will do) or the shard's lock
+// held for reading. put and drop take the shard lock around the map write, writes
+// that change several keys at once (a transaction, RENAME) hold every shard's lock
+// around the lot with lock_all, so a Get of one key and then another never sees half
+// of them. everything but Get still reads under s.lock, and iterates with each
+
+// how many shards the map is split into when Options.Shards isn't set
+const default_shards = 32
+
+type shard struct {
+	lock sync.RWMutex
+	data map[key]value
+}
+
+type shard_map struct {
+	seed     maphash.Seed
+	shards   []shard
+	all_held bool        // lock_all holds every shard's lock, put and drop don't take it again
+	freeze   *map_freeze // a frozen View's, set and remove keep what they replace for it, see view.go
+}
+
+func new_shard_map(n int) *shard_map {
+	if n <= 0 {
+		n = default_shards
+	}
+	m := &shard_map{seed: maphash.MakeSeed(), shards: make([]shard, n)}
+	for i := range m.shards {
+		m.shards[i].data = make(map[key]value)
+	}
+	return m
+}
+
+func (m *shard_map) shard(k key) *shard {
+	return &m.shards[m.index(k)]
+}
+
+// index is which shard k is in
+func (m *shard_map) index(k key) int {
+	h := maphash.String(m.seed, k.name) + uint64(k.db)
+	return int(h % uint64(len(m.shards)))
+}
+
+// get reads k
+// Caller must hold s.lock (a read lock will do)
+func (m *shard_map) get(k key) (value, bool) {
+	val, exists := m.shard(k).data[k]
+	return val, exists
+}
+
+// load reads k under its shard's read lock, for readers that don't hold s.lock
+func (m *shard_map) load(k key) (value, bool) {
+	sh := m.shard(k)
+	sh.lock.RLock()
+	defer sh.lock.RUnlock()
+	val, exists := sh.data[k]
+	return val, exists
+}
+
+// set and remove are put's and drop's map writes
+// Caller must hold s.lock for writing
+func (m *shard_map) set(k key, val value) {
+	sh := m.shard(k)
+	m.keep(k)
+	if !m.all_held {
+		sh.lock.Lock()
+		defer sh.lock.Unlock()
+	}
+	sh.data[k] = val
+}
+
+func (m *shard_map) remove(k key) {
+	sh := m.shard(k)
+	m.keep(k)
+	if !m.all_held {
+		sh.lock.Lock()
+		defer sh.lock.Unlock()
+	}
+	delete(sh.data, k)
+}
+
+// keep hands what k holds to the frozen View, if there is one, before a write changes it
+// Caller must hold s.lock for writing
+func (m *shard_map) keep(k key) {
+	if m.freeze == nil {
+		return
+	}
+	i := m.index(k)
+	old, exists := m.shards[i].data[k]
+	m.freeze.keep(i, k, old, exists)
+}
+
+// lock_all keeps Get out of every shard until unlock_all, for writes to several keys
+// Caller must hold s.lock for writing
+func (m *shard_map) lock_all() {
+	for i := range m.shards {
+		m.shards[i].lock.Lock()
+	}
+	m.all_held = true
+}
+
+func (m *shard_map) unlock_all() {
+	m.all_held = false
+	for i := range m.shards {
+		m.shards[i].lock.Unlock()
+	}
+}
+
+// len is how many keys there are, live or expired
+// Caller must hold s.lock (a read lock will do)
+func (m *shard_map) len() int {
+	n := 0
+	for i := range m.shards {
+		n += len(m.shards[i].data)
+	}
+	return n
+}
+
+// random_shard is somewhere to start each from for walks that only want a sample,
+// map iteration starts somewhere random within a shard but each goes shard by shard
+func (m *shard_map) random_shard() int {
+	return rand.IntN(len(m.shards))
+}
+
+// sample returns up to n distinct keys that ok accepts, taking a few from each shard
+// in a random order so they don't all come from one, and more from each if that isn't
+// enough. map iteration picks where to start in a shard. it reads the shards one at
+// a time under their own read lock, the caller holds no lock
+func (m *shard_map) sample(n int, ok func(k key, val value) bool) []key {
+	keys := make([]key, 0, n)
+	taken := make(map[key]bool, n)
+	order := rand.Perm(len(m.shards))
+	per_shard := (n + len(m.shards) - 1) / len(m.shards)
+	for _, limit := range []int{per_shard, n} {
+		for _, i := range order {
+			sh := &m.shards[i]
+			sh.lock.RLock()
+			got := 0
+			for k, val := range sh.data {
+				if len(keys) == n || got == limit {
+					break
+				}
+				if !taken[k] && ok(k, val) {
+					keys = append(keys, k)
+					taken[k] = true
+					got++
+				}
+			}
+			sh.lock.RUnlock()
+			if len(keys) == n {
+				return keys
+			}
+		}
+	}
+	return keys
+}
+
+// each calls fn with every key and value, shard by shard from shard `from` on, until fn returns false
+// Caller must hold s.lock (a read lock will do), and for writing if fn puts or drops
+func (m *shard_map) each(from int, fn func(k key, val value) bool) {
+	for i := range m.shards {
+		for k, val := range m.shards[(from+i)%len(m.shards)].data {
+			if !fn(k, val) {
+				return
+			}
+		}
+	}
+}
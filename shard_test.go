@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// Get only takes its key's shard lock, so with more shards parallel reads stop queueing
+// on one lock, and a writer holding s.lock doesn't hold them up either. compare
+//
+//	go test -bench GetParallel -cpu 1,4,16
+//
+// across shard counts: with 1 shard every reader shares a lock (and its cache line)
+
+const bench_keys = 1 << 14
+
+func bench_store(b *testing.B, shards int) (*Store, []key) {
+	b.Helper()
+	s := New_Store(filepath.Join(b.TempDir(), "wal.log"), Options{Shards: shards, Persistence: PersistNone})
+	b.Cleanup(func() { s.Close() })
+	keys := make([]key, bench_keys)
+	for i := range keys {
+		keys[i] = key{name: "key:" + strconv.Itoa(i)}
+		if err := s.Set(keys[i], 0, "value"); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return s, keys
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s, keys := bench_store(b, shards)
+			var seed atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seed.Add(7919)
+				for pb.Next() {
+					s.Get(keys[i%bench_keys])
+					i++
+				}
+			})
+		})
+	}
+}
+
+// the same reads with one goroutine writing all the while
+func BenchmarkGetParallelWithWriter(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			s, keys := bench_store(b, shards)
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					s.Set(keys[i%bench_keys], 0, "other value")
+				}
+			}()
+			var seed atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := seed.Add(7919)
+				for pb.Next() {
+					s.Get(keys[i%bench_keys])
+					i++
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
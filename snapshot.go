@@ -0,0 +1,510 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// a checkpoint writes the whole live map to a snapshot file and drops the
+// WAL segments it covers, so startup is "load snapshot + replay the WAL
+// suffix" instead of replaying every write since the beginning of time
+//
+// snapshot file (<wal>.snapshot):
+//
+//	"QSNP" | version (1 byte) | first WAL segment not covered (u64) | last LSN covered (u64) | records (u64)
+//	binary (or encrypted) WAL header | one SET (RESTORE for an object) record per live key (same framing + CRC as the WAL)
+//
+// version 1 had no LSN, version 2 no record count. the CRCs catch a damaged record,
+// the count a file cut short on a record boundary, which would otherwise load fine.
+// version 4 is the manifest of a snapshot split in parts, see snapshot_parts.go
+//
+// SaveSnapshot writes the same file anywhere else, for backups or to start another store
+
+const snapshot_version byte = 3
+
+var snapshot_magic = []byte{'Q', 'S', 'N', 'P'}
+
+func (s *Store) snapshot_path() string {
+	return s.wal.filename + ".snapshot"
+}
+
+// Persistence picks what gets written to disk, and so what survives a crash
+type Persistence int
+
+const (
+	PersistWAL      Persistence = iota // every write is logged, snapshots only on CHECKPOINT (default). a crash loses nothing the durability setting has fsynced
+	PersistSnapshot                    // no WAL, a snapshot every SnapshotInterval. a crash loses everything since the last snapshot
+	PersistBoth                        // every write is logged and the WAL is checkpointed every SnapshotInterval. like PersistWAL, with shorter replays
+	PersistNone                        // nothing is written or loaded, everything is lost on exit
+)
+
+var persistence_names = map[Persistence]string{
+	PersistWAL:      "wal",
+	PersistSnapshot: "snapshot",
+	PersistBoth:     "both",
+	PersistNone:     "none",
+}
+
+func (p Persistence) String() string {
+	return persistence_names[p]
+}
+
+// ParsePersistence maps "wal", "snapshot", "both" or "none" to a Persistence
+func ParsePersistence(name string) (Persistence, error) {
+	for p, n := range persistence_names {
+		if strings.EqualFold(n, name) {
+			return p, nil
+		}
+	}
+	return PersistWAL, errors.New("persistence must be wal, snapshot, both or none")
+}
+
+func (p Persistence) logs() bool      { return p == PersistWAL || p == PersistBoth }
+func (p Persistence) snapshots() bool { return p == PersistSnapshot || p == PersistBoth }
+
+// how often snapshot and both take a snapshot when Options.SnapshotInterval is not set
+const default_snapshot_interval = 5 * time.Minute
+
+// SetPersistence switches the persistence mode of a running store
+// turning the WAL back on takes a checkpoint first: the writes made while it
+// was off are only in memory, and a log replayed on top of a snapshot that
+// misses them would not add up to the current state
+func (s *Store) SetPersistence(p Persistence) error {
+	s.checkpoint_lock.Lock()
+	defer s.checkpoint_lock.Unlock()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if p.logs() && !s.persistence.logs() {
+		if _, err := s.checkpoint(); err != nil {
+			return err
+		}
+	}
+	s.persistence = p
+	return nil
+}
+
+// Persistence returns the current persistence mode
+func (s *Store) Persistence() Persistence {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.persistence
+}
+
+// log_write logs rec if the persistence mode keeps a WAL. the caller applies it to the
+// map and then announces it
+// caller must hold s.lock
+func (s *Store) log_write(rec wal_record) (<-chan error, error) {
+	store_writes_total.Inc()
+	ack := acked(nil)
+	if s.persistence.logs() {
+		rec.at = time.Now()
+		s.keep_undo(rec)
+		var err error
+		if ack, err = s.wal.append(rec); err != nil {
+			s.drop_undo([]wal_record{rec})
+			return nil, err
+		}
+	}
+	return ack, nil
+}
+
+// announce tells subscribers and watchers about rec, once the map has it: a subscriber
+// that reads the key on the event, without s.lock, must find the new value
+// caller must hold s.lock
+func (s *Store) announce(rec wal_record) {
+	s.notify(rec)
+	s.touch_watched(rec)
+}
+
+// snapshot_every checkpoints on a ticker while the mode asks for snapshots, until Close
+func (s *Store) snapshot_every(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !s.Persistence().snapshots() {
+				continue
+			}
+			if _, err := s.Checkpoint(); err != nil {
+				log.Printf("ERROR: scheduled snapshot failed: %v\n", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// Checkpoint snapshots the current map and truncates the WAL up to it
+// writers are only held up while the WAL is sealed and a frozen View taken (the mark),
+// and while the old segments are removed, not while the snapshot is written and fsynced:
+// the View keeps what they change until it has read it, see view.go
+func (s *Store) Checkpoint() (int, error) {
+	s.checkpoint_lock.Lock()
+	defer s.checkpoint_lock.Unlock()
+
+	s.lock.Lock()
+	marked := time.Now()
+	next, err := s.seal_checkpoint()
+	if err != nil {
+		s.lock.Unlock()
+		return 0, err
+	}
+	//every write from here on goes to `next` or later and has an LSN above the view's
+	v := s.frozen_view()
+	s.lock.Unlock()
+	checkpoint_mark_seconds.Observe(time.Since(marked).Seconds())
+
+	n, err := s.save_store_snapshot(next, v)
+	s.lock.Lock()
+	s.thaw()
+	s.lock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	//a ReplayFrom or GetAsOf that read the old start holds the lock while it reads the
+	//log, the segments only go once it is done
+	if err := s.set_log_start(v.last_lsn); err != nil {
+		return n, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return n, s.drop_checkpointed(next, n)
+}
+
+// checkpoint is Checkpoint for a caller that holds the lock already, writers wait for
+// all of it
+// caller must hold s.checkpoint_lock and s.lock
+func (s *Store) checkpoint() (int, error) {
+	next, err := s.seal_checkpoint()
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.write_snapshot(next)
+	if err != nil {
+		return 0, err
+	}
+	return n, s.finish_checkpoint(next, s.last_lsn, n)
+}
+
+// seal_checkpoint starts a new segment for the writes after the checkpoint and returns it
+// caller must hold s.lock
+func (s *Store) seal_checkpoint() (uint64, error) {
+	//records still queued for group commit must land in the segments we seal, and
+	//ones that didn't mustn't be in the snapshot
+	s.undo_failed()
+	if err := s.wal.wait_pending(); err != nil {
+		return 0, err
+	}
+
+	//everything in the map is in segments below `next`, and every
+	//write from here on goes to `next` or later. without the WAL the writes since the
+	//last checkpoint are in no segment at all, the snapshot is all there is
+	seal := s.wal.seal
+	if !s.persistence.logs() {
+		seal = s.wal.idle
+	}
+	return seal()
+}
+
+// finish_checkpoint drops the history the snapshot of everything up to last_lsn covers,
+// the segments below next
+// caller must hold s.lock
+func (s *Store) finish_checkpoint(next uint64, last_lsn uint64, n int) error {
+	if err := s.set_log_start(last_lsn); err != nil {
+		return err
+	}
+	return s.drop_checkpointed(next, n)
+}
+
+// drop_checkpointed removes the segments below next once the log start is past them
+// caller must hold s.lock
+func (s *Store) drop_checkpointed(next uint64, n int) error {
+	if err := s.wal.remove_before(next); err != nil {
+		return err
+	}
+	log.Printf("Checkpoint: %d keys snapshotted, WAL now starts at %s\n", n, s.wal.segment_path(next))
+	return nil
+}
+
+// replace_stale_snapshot is for COMPACT: a snapshot from before it would be loaded
+// and then only the rewritten log replayed on top, so deletes logged since the
+// snapshot would be lost with the old segments. it is replaced by one that
+// starts at the rewritten segment before the old segments go
+// caller must hold s.lock
+func (s *Store) replace_stale_snapshot(seq uint64) error {
+	if _, err := os.Stat(s.snapshot_path()); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	_, err := s.write_snapshot(seq)
+	return err
+}
+
+// SaveSnapshot writes a View of the store to path, a point in time copy in the snapshot
+// format: a header with the last LSN it covers, then every live key with its value and
+// absolute expiry, each record with its CRC. Recover can start a store from it. the
+// lock is only held to take the View, writers carry on while it is written, and the
+// WAL is left as it is
+func (s *Store) SaveSnapshot(path string) (int, error) {
+	s.lock.RLock()
+	//writes need the write lock, so every record above the view's last LSN will land
+	//in the active segment or later. records below it there are skipped by LSN on replay
+	s.wal.wal_lock.Lock()
+	next := s.wal.active
+	s.wal.wal_lock.Unlock()
+	v := s.view()
+	s.lock.RUnlock()
+
+	n, err := s.save_snapshot(path, next, v)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Snapshot of %d keys saved to %s (last LSN %d)\n", n, path, v.last_lsn)
+	return n, nil
+}
+
+// write_snapshot writes the live map over the store's own snapshot
+// caller must hold s.lock
+func (s *Store) write_snapshot(next_segment uint64) (int, error) {
+	return s.save_store_snapshot(next_segment, s.live_view())
+}
+
+// save_snapshot writes v to a temp file and renames it over path
+// caller must hold s.lock if v is the live_view
+func (s *Store) save_snapshot(path string, next_segment uint64, v *View) (int, error) {
+	w, err := s.new_snapshot_writer(path, next_segment, v.last_lsn)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	v.each(func(k key, val value) bool {
+		if w.live(val) {
+			w.write(value_record(k, val))
+			n++
+		}
+		return true
+	})
+	for _, rec := range v.tombstones {
+		w.write(rec)
+	}
+	if err := w.commit(); err != nil {
+		return 0, err
+	}
+	return n, sync_dir(filepath.Dir(path))
+}
+
+// save_store_snapshot writes v as the store's own snapshot, split in Options.SnapshotParts
+// files when that is more than one (see snapshot_parts.go), and removes the parts of the
+// snapshot it replaces. with WarmUp it lists the hot keys next to it (see warmup.go)
+// caller must hold s.lock if v is the live_view
+func (s *Store) save_store_snapshot(next_segment uint64, v *View) (int, error) {
+	path := s.snapshot_path()
+	n, err := s.save_snapshot_files(path, next_segment, v)
+	if err != nil || s.warm_up <= 0 {
+		return n, err
+	}
+	//the list only makes the next start quicker, a checkpoint without one still is one
+	if err := s.save_hot_keys(v); err != nil {
+		log.Printf("WARNING: listing the hot keys: %v\n", err)
+	}
+	return n, nil
+}
+
+func (s *Store) save_snapshot_files(path string, next_segment uint64, v *View) (int, error) {
+	if s.snapshot_parts > 1 {
+		return s.save_parts(path, next_segment, v)
+	}
+	n, err := s.save_snapshot(path, next_segment, v)
+	if err != nil {
+		return 0, err
+	}
+	return n, remove_parts(path, "")
+}
+
+// snapshot_writer writes one snapshot file, into a temp file commit renames into place
+type snapshot_writer struct {
+	path   string
+	fd     *os.File
+	writer *bufio.Writer
+	codec  wal_codec
+	res    *resources
+	now    time.Time
+	n      int // records written
+}
+
+// count_at is where the record count goes in the header, after the magic, the version,
+// the next segment and the last LSN. it is filled in once the records are written, a
+// frozen View is read once
+const count_at = 4 + 1 + 8 + 8
+
+func (s *Store) new_snapshot_writer(path string, next_segment uint64, last_lsn uint64) (*snapshot_writer, error) {
+	fd, err := s.wal.res.open_file("snapshot", path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	//the records are in the binary format, encrypted like the WAL if it is
+	var codec wal_codec = binary_codec{}
+	if s.wal.aead != nil {
+		codec = encrypted_codec{aead: s.wal.aead}
+	}
+	w := &snapshot_writer{path: path, fd: fd, writer: bufio.NewWriter(fd), codec: codec, res: s.wal.res, now: time.Now()}
+	w.writer.Write(snapshot_magic)
+	w.writer.WriteByte(snapshot_version)
+	binary.Write(w.writer, binary.LittleEndian, next_segment)
+	binary.Write(w.writer, binary.LittleEndian, last_lsn)
+	binary.Write(w.writer, binary.LittleEndian, uint64(0))
+	w.writer.Write(codec.header())
+	return w, nil
+}
+
+// live says whether a value goes in the snapshot, expired ones don't
+func (w *snapshot_writer) live(val value) bool {
+	return val.expires_at.IsZero() || val.expires_at.After(w.now)
+}
+
+// write buffers a record, an error comes out of commit
+func (w *snapshot_writer) write(rec wal_record) {
+	w.writer.Write(w.codec.encode(rec))
+	w.n++
+}
+
+// commit fills in the record count, fsyncs the file and renames it over path
+// the directory isn't synced, the caller does that once for all it wrote
+func (w *snapshot_writer) commit() error {
+	err := w.writer.Flush()
+	if err == nil {
+		_, err = w.fd.WriteAt(binary.LittleEndian.AppendUint64(nil, uint64(w.n)), count_at)
+	}
+	if err == nil {
+		err = sync_file(w.fd)
+	}
+	if closed := w.res.close(w.fd); err == nil {
+		err = closed
+	}
+	if err != nil {
+		os.Remove(w.path + ".tmp")
+		return err
+	}
+	return os.Rename(w.path+".tmp", w.path)
+}
+
+// abort drops what was written
+func (w *snapshot_writer) abort() {
+	w.res.close(w.fd)
+	os.Remove(w.path + ".tmp")
+}
+
+// load_snapshot fills the map from the snapshot at path, if there is one
+// returns the first WAL segment that still has to be replayed on top of it
+// caller must hold s.lock
+func (s *Store) load_snapshot(path string) (uint64, error) {
+	if s.wal.key_err != nil {
+		return 0, s.wal.key_err
+	}
+	file, err := s.wal.res.open_file("snapshot", path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer s.wal.res.close(file)
+
+	reader := bufio.NewReader(file)
+	h, err := read_snapshot_header(reader)
+	if err != nil {
+		return 0, err
+	}
+	s.last_lsn = h.last_lsn
+	//a snapshot from before the start of the WAL (a backup older than the last checkpoint
+	//or COMPACT) would come back without the writes in between, deletes included
+	if h.version >= 2 {
+		start, err := s.log_start()
+		if err != nil {
+			return 0, err
+		}
+		if start > s.last_lsn {
+			return 0, fmt.Errorf("snapshot: covers up to LSN %d but the WAL starts after %d, the writes in between are gone", s.last_lsn, start)
+		}
+	}
+
+	var n int
+	if h.version == snapshot_parts_version {
+		n, err = s.load_parts(path, h)
+	} else {
+		n, err = s.load_records(reader, h, func(rec wal_record) error {
+			s.last_lsn = max(s.last_lsn, rec.lsn)
+			return s.replayEntry(rec)
+		})
+	}
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Loaded snapshot with %d keys, replaying WAL from %s\n", n, s.wal.segment_path(h.next_segment))
+	return h.next_segment, nil
+}
+
+// snapshot_header is what a snapshot starts with
+type snapshot_header struct {
+	version      byte
+	next_segment uint64 // first WAL segment not covered
+	last_lsn     uint64 // 0 before version 2
+	records      uint64 // 0 before version 3
+}
+
+func read_snapshot_header(reader *bufio.Reader) (snapshot_header, error) {
+	var h snapshot_header
+	header := make([]byte, len(snapshot_magic)+1+8)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return h, errors.New("snapshot: truncated header")
+	}
+	if !bytes.Equal(header[:len(snapshot_magic)], snapshot_magic) {
+		return h, errors.New("snapshot: bad magic")
+	}
+	h.version = header[len(snapshot_magic)]
+	if h.version < 1 || h.version > snapshot_parts_version {
+		return h, errors.New("snapshot: unsupported version")
+	}
+	h.next_segment = binary.LittleEndian.Uint64(header[len(snapshot_magic)+1:])
+	if h.version >= 2 {
+		if err := binary.Read(reader, binary.LittleEndian, &h.last_lsn); err != nil {
+			return h, errors.New("snapshot: truncated header")
+		}
+	}
+	if h.version >= 3 {
+		if err := binary.Read(reader, binary.LittleEndian, &h.records); err != nil {
+			return h, errors.New("snapshot: truncated header")
+		}
+	}
+	return h, nil
+}
+
+// load_records hands every record of a snapshot file after its header to apply,
+// and checks there were as many as the header says
+func (s *Store) load_records(reader *bufio.Reader, h snapshot_header, apply func(rec wal_record) error) (int, error) {
+	n := 0
+	peek, _ := reader.Peek(max_codec_header_len)
+	err := read_records(s.wal.segment_codec(peek).records(reader), func(rec wal_record) error {
+		n++
+		return apply(rec)
+	})
+	if err != nil {
+		return 0, errors.New("snapshot: " + err.Error())
+	}
+	if h.version >= 3 && uint64(n) != h.records {
+		return 0, fmt.Errorf("snapshot: truncated, %d of %d records", n, h.records)
+	}
+	return n, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// with Options.SnapshotParts above one a checkpoint splits the snapshot in that many
+// files, each key in the one its hash picks, written at once by a goroutine each. each
+// part is a snapshot of its own (version 3, same header), and <wal>.snapshot becomes the
+// manifest listing them, so loading can read and decode the parts at once too, handing
+// the records to the replay workers of their keys' shards (see replay.go)
+//
+// manifest: "QSNP" | 4 | first WAL segment not covered | last LSN covered | records |
+// parts (u32) | generation (length byte + name) | parts × records (u64) | crc32 of all before
+//
+// a part is <wal>.snapshot.part.<generation>.<n>, the generation is new for every
+// snapshot: the parts are renamed into place first and the manifest last, so a crash
+// on the way leaves the old manifest and its own parts. the parts of older generations
+// are removed once the new manifest is in place, and all of them once a snapshot is
+// written as a single file again
+
+const snapshot_parts_version byte = 4
+
+func part_path(path string, generation string, i int) string {
+	return path + ".part." + generation + "." + strconv.Itoa(i)
+}
+
+// part_of is the part k goes in
+func part_of(k key, parts int) int {
+	return int(key_hash(k) % uint64(parts))
+}
+
+type parts_manifest struct {
+	header     snapshot_header
+	generation string
+	counts     []uint64 // records in each part
+}
+
+func (m *parts_manifest) encode() []byte {
+	buf := append([]byte{}, snapshot_magic...)
+	buf = append(buf, snapshot_parts_version)
+	buf = binary.LittleEndian.AppendUint64(buf, m.header.next_segment)
+	buf = binary.LittleEndian.AppendUint64(buf, m.header.last_lsn)
+	buf = binary.LittleEndian.AppendUint64(buf, m.header.records)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(m.counts)))
+	buf = append(buf, byte(len(m.generation)))
+	buf = append(buf, m.generation...)
+	for _, n := range m.counts {
+		buf = binary.LittleEndian.AppendUint64(buf, n)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+var errBadPartsManifest = errors.New("snapshot: damaged manifest")
+
+func decode_parts_manifest(data []byte, h snapshot_header) (*parts_manifest, error) {
+	//the header has been read already
+	at := len(snapshot_magic) + 1 + 8 + 8 + 8
+	if len(data) < at+4+1+4 {
+		return nil, errBadPartsManifest
+	}
+	body, crc := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, errBadPartsManifest
+	}
+	parts := int(binary.LittleEndian.Uint32(body[at:]))
+	length := int(body[at+4])
+	at += 5
+	if parts == 0 || len(body) != at+length+parts*8 {
+		return nil, errBadPartsManifest
+	}
+	m := &parts_manifest{header: h, generation: string(body[at : at+length])}
+	at += length
+	var total uint64
+	for i := 0; i < parts; i++ {
+		m.counts = append(m.counts, binary.LittleEndian.Uint64(body[at:]))
+		total += m.counts[i]
+		at += 8
+	}
+	if total != h.records {
+		return nil, errBadPartsManifest
+	}
+	return m, nil
+}
+
+// save_parts writes v as a snapshot in s.snapshot_parts parts and its manifest at path
+// caller must hold s.lock if v is the live_view
+func (s *Store) save_parts(path string, next_segment uint64, v *View) (int, error) {
+	parts := s.snapshot_parts
+	m := &parts_manifest{
+		header:     snapshot_header{version: snapshot_parts_version, next_segment: next_segment, last_lsn: v.last_lsn},
+		generation: strconv.FormatInt(time.Now().UnixNano(), 36),
+		counts:     make([]uint64, parts),
+	}
+	writers := make([]*snapshot_writer, parts)
+	for i := range writers {
+		w, err := s.new_snapshot_writer(part_path(path, m.generation, i), next_segment, v.last_lsn)
+		if err != nil {
+			for _, w := range writers[:i] {
+				w.abort()
+			}
+			return 0, err
+		}
+		writers[i] = w
+	}
+
+	//the View is read once, here, and each part's records go to a goroutine that encodes
+	//and writes them. a part whose goroutine can't be started is written on this one
+	queues := make([]chan []wal_record, parts)
+	errs := make([]error, parts)
+	var written sync.WaitGroup
+	for i, w := range writers {
+		queue := make(chan []wal_record, 4)
+		written.Add(1)
+		err := s.wal.res.try_start("snapshot writer", func() {
+			defer written.Done()
+			for batch := range queue {
+				for _, rec := range batch {
+					w.write(rec)
+				}
+			}
+			errs[i] = w.commit()
+		})
+		if err != nil {
+			written.Done()
+			continue
+		}
+		queues[i] = queue
+	}
+	batches := make([][]wal_record, parts)
+	hand := func(k key, rec wal_record) {
+		i := part_of(k, parts)
+		if queues[i] == nil {
+			writers[i].write(rec)
+			return
+		}
+		batches[i] = append(batches[i], rec)
+		if len(batches[i]) == replay_batch {
+			queues[i] <- batches[i]
+			batches[i] = nil
+		}
+	}
+
+	n := 0
+	v.each(func(k key, val value) bool {
+		if writers[0].live(val) {
+			hand(k, value_record(k, val))
+			n++
+		}
+		return true
+	})
+	for _, rec := range v.tombstones {
+		hand(key{name: rec.key, db: rec.db}, rec)
+	}
+	for i, queue := range queues {
+		if queue == nil {
+			errs[i] = writers[i].commit()
+			continue
+		}
+		if len(batches[i]) > 0 {
+			queue <- batches[i]
+		}
+		close(queue)
+	}
+	written.Wait()
+	if err := errors.Join(errs...); err != nil {
+		for i := range writers {
+			os.Remove(part_path(path, m.generation, i))
+		}
+		return 0, err
+	}
+
+	for i, w := range writers {
+		m.counts[i] = uint64(w.n)
+		m.header.records += uint64(w.n)
+	}
+	//the parts are in place, the manifest swaps them in
+	if err := replace_file(path, m.encode()); err != nil {
+		return 0, err
+	}
+	if err := sync_dir(filepath.Dir(path)); err != nil {
+		return 0, err
+	}
+	return n, remove_parts(path, m.generation)
+}
+
+// remove_parts deletes the parts of path's snapshots but the generation kept, all of
+// them if it is empty, and any a crash left half written
+func remove_parts(path string, kept string) error {
+	files, err := filepath.Glob(path + ".part.*")
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if kept != "" && strings.HasPrefix(file, path+".part."+kept+".") && !strings.HasSuffix(file, ".tmp") {
+			continue
+		}
+		if err := os.Remove(file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// load_parts loads the parts of the snapshot whose manifest is at path all at once: a
+// goroutine for each reads and decodes it, and the records are applied by the replay
+// workers of their keys' shards, or on this goroutine without ReplayWorkers. a part
+// whose goroutine can't be started is loaded here once the others are done
+// caller must hold s.lock
+func (s *Store) load_parts(path string, h snapshot_header) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	m, err := decode_parts_manifest(data, h)
+	if err != nil {
+		return 0, err
+	}
+	var report RecoveryReport
+	replay := s.new_replayer(&report)
+
+	n := 0
+	var failed error
+	apply := func(batch []wal_record) {
+		for _, rec := range batch {
+			n++
+			s.last_lsn = max(s.last_lsn, rec.lsn)
+			if failed == nil {
+				failed = replay.load(rec)
+			}
+		}
+	}
+	batches := make(chan []wal_record, len(m.counts))
+	done := make(chan error, len(m.counts))
+	running := 0
+	var later []int
+	for i := range m.counts {
+		err := s.wal.res.try_start("snapshot loader", func() {
+			done <- s.load_part(part_path(path, m.generation, i), h, m.counts[i], func(batch []wal_record) { batches <- batch })
+		})
+		if err != nil {
+			later = append(later, i)
+			continue
+		}
+		running++
+	}
+	//a part's batches are all queued before it is done, what's left once they all are
+	//is in the channel
+	for running > 0 {
+		select {
+		case batch := <-batches:
+			apply(batch)
+		case err := <-done:
+			running--
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	for len(batches) > 0 {
+		apply(<-batches)
+	}
+	for _, i := range later {
+		if failed == nil {
+			failed = s.load_part(part_path(path, m.generation, i), h, m.counts[i], apply)
+		}
+	}
+	if finished := replay.finish(); failed == nil {
+		failed = finished
+	}
+	if failed != nil {
+		return 0, failed
+	}
+	return n, nil
+}
+
+// load_part reads a part of the snapshot h is the manifest of, which has to have count
+// records, and hands them to emit in batches
+func (s *Store) load_part(path string, h snapshot_header, count uint64, emit func(batch []wal_record)) error {
+	file, err := s.wal.res.open_file("snapshot", path, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("snapshot: part missing: %w", err)
+	}
+	defer s.wal.res.close(file)
+
+	reader := bufio.NewReader(file)
+	part, err := read_snapshot_header(reader)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if part.version != snapshot_version || part.next_segment != h.next_segment || part.last_lsn != h.last_lsn || part.records != count {
+		return fmt.Errorf("snapshot: %s isn't a part of this snapshot", path)
+	}
+	batch := make([]wal_record, 0, replay_batch)
+	_, err = s.load_records(reader, part, func(rec wal_record) error {
+		batch = append(batch, rec)
+		if len(batch) == replay_batch {
+			emit(batch)
+			batch = make([]wal_record, 0, replay_batch)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if len(batch) > 0 {
+		emit(batch)
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// snapshots split in parts, see snapshot_parts.go
+
+// checkpointed recovers the log at path with opts, checkpoints it and closes it
+func checkpointed(t *testing.T, path string, opts Options) {
+	t.Helper()
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func parts_on_disk(t *testing.T, path string) []string {
+	t.Helper()
+	files, err := filepath.Glob(path + ".snapshot.part.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+// a snapshot in parts loads to what the same snapshot in one file does, on one
+// goroutine or several, and only the newest parts are kept
+func TestSnapshotParts(t *testing.T) {
+	quiet_log(t)
+	single := filepath.Join(t.TempDir(), "wal.log")
+	write_history(t, single, 5000, true)
+	parted := filepath.Join(t.TempDir(), "wal.log")
+	files, _ := filepath.Glob(single + "*")
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(filepath.Dir(parted), filepath.Base(file)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	opts := Options{SoftDelete: time.Hour}
+	checkpointed(t, single, opts)
+	want_store, _, err := Recover("", single, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := recovered_state(want_store)
+	want_store.Close()
+
+	opts.SnapshotParts = 4
+	checkpointed(t, parted, opts)
+	checkpointed(t, parted, opts)
+	if files := parts_on_disk(t, parted); len(files) != 4 {
+		t.Errorf("%d parts on disk after two checkpoints, want 4: %v", len(files), files)
+	}
+	for _, workers := range []int{1, 4} {
+		opts.ReplayWorkers = workers
+		s, report, err := Recover("", parted, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.SnapshotKeys == 0 {
+			t.Error("nothing came from the snapshot")
+		}
+		got := recovered_state(s)
+		for k, v := range want {
+			if got[k] != v {
+				t.Errorf("%d workers: %s = %s, want %s", workers, k, got[k], v)
+			}
+		}
+		if len(got) != len(want) {
+			t.Errorf("%d workers: %d entries, want %d", workers, len(got), len(want))
+		}
+		keys, _ := s.Scan(0, 0, "*", 1<<20)
+		if n := len(s.Keys(0, "*")); len(keys) != n {
+			t.Errorf("%d workers: SCAN found %d keys of %d", workers, len(keys), n)
+		}
+		s.Close()
+	}
+
+	//a part gone is an error, not a store with a quarter of its keys
+	files = parts_on_disk(t, parted)
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(files[0])
+	if _, _, err := Recover("", parted, opts); err == nil {
+		t.Error("loaded a snapshot with a part missing")
+	}
+	os.WriteFile(files[0], data, 0644)
+
+	//back to one file, the parts go
+	opts.SnapshotParts = 1
+	checkpointed(t, parted, opts)
+	if files := parts_on_disk(t, parted); len(files) != 0 {
+		t.Errorf("parts left over after a single file snapshot: %v", files)
+	}
+	s, _, err := Recover("", parted, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got := recovered_state(s); len(got) != len(want) {
+		t.Errorf("%d entries from the single file, want %d", len(got), len(want))
+	}
+}
+
+// loading a snapshot of a million keys by parts and replay workers, compare
+//
+//	go test -run XXX -bench SnapshotLoad -cpu 8
+//
+// one file is read and decoded on one goroutine whatever the workers, parts are read
+// and decoded at once. on one core that only costs: about 0.34M keys/s from one file,
+// 0.37M from 8 parts with one worker, 0.14M with 4
+func BenchmarkSnapshotLoad(b *testing.B) {
+	quiet_log(b)
+	for _, parts := range []int{1, 4, 8} {
+		s := checkpoint_store(b, 1_000_000)
+		s.snapshot_parts = parts
+		if _, err := s.Checkpoint(); err != nil {
+			b.Fatal(err)
+		}
+		path := s.wal.filename
+		s.Close()
+		for _, workers := range []int{1, 4} {
+			b.Run(fmt.Sprintf("parts=%d/workers=%d", parts, workers), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s, report, err := Recover("", path, Options{SnapshotParts: parts, ReplayWorkers: workers})
+					if err != nil {
+						b.Fatal(err)
+					}
+					b.ReportMetric(float64(report.SnapshotKeys)/report.Duration.Seconds(), "keys/s")
+					s.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// SaveSnapshot and starting a store from what it wrote, see snapshot.go
+
+// a snapshot holds the live keys with their absolute expiries and objects as of when
+// it was taken, the WAL stays as it was, and a byte changed in it fails the load
+func TestSaveSnapshot(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	backup := filepath.Join(dir, "backup.snap")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "1")
+	s.Set(key{name: "ttl"}, time.Hour, "x")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	s.Set(key{name: "gone"}, time.Millisecond, "old")
+	time.Sleep(5 * time.Millisecond)
+	segments, last := wal_segments(t, s), s.LastLSN()
+	n, err := s.SaveSnapshot(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("%d keys saved, want 3", n)
+	}
+	if got := wal_segments(t, s); s.LastLSN() != last || !slices.Equal(got, segments) {
+		t.Errorf("the WAL changed: LSN %d, segments %v", s.LastLSN(), got)
+	}
+	set(t, s, "after", "v")
+	s.Close()
+
+	fd, err := os.Open(backup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := read_snapshot_header(bufio.NewReader(fd))
+	fd.Close()
+	if err != nil || h.version != snapshot_version || h.last_lsn != last || h.records != 3 {
+		t.Errorf("header %+v, %v", h, err)
+	}
+
+	//a store of its own from the snapshot alone
+	s, report, err := Recover(backup, filepath.Join(t.TempDir(), "wal.log"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "ttl"}); report.SnapshotKeys != 3 || get(t, s, "a") != "1" || ttl <= 59*time.Minute || get(t, s, "after") != "" {
+		t.Errorf("from the snapshot: %d keys, a=%s, ttl with %v left, after=%s", report.SnapshotKeys, get(t, s, "a"), ttl, get(t, s, "after"))
+	}
+	if all, _ := s.HGetAll(key{name: "h"}); !maps.Equal(all, map[string]string{"f": "v"}) {
+		t.Errorf("h from the snapshot: %v", all)
+	}
+	s.Close()
+
+	data, _ := os.ReadFile(backup)
+	data[len(data)-3] ^= 0xff
+	os.WriteFile(backup, data, 0o644)
+	if _, _, err := Recover(backup, filepath.Join(t.TempDir(), "wal.log"), Options{}); err == nil {
+		t.Error("loaded a damaged snapshot")
+	}
+	os.WriteFile(backup, []byte("not a snapshot"), 0o644)
+	if _, _, err := Recover(backup, filepath.Join(t.TempDir(), "wal.log"), Options{}); err == nil {
+		t.Error("loaded a file that isn't a snapshot")
+	}
+}
+
+// the shell's SAVE
+func TestProcessSave(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "a", "1")
+	backup := filepath.Join(t.TempDir(), "backup.snap")
+	if err := s.Process([]string{"SAVE", backup}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backup); err != nil {
+		t.Error(err)
+	}
+	if err := s.Process([]string{"SAVE"}); err == nil {
+		t.Error("SAVE without a file")
+	}
+}
+
+// Recover from a backup applies only the WAL after it, and refuses a backup older than
+// what a checkpoint left of the WAL
+func TestRecoverFromBackup(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	backup := filepath.Join(dir, "backup.snap")
+	opts := Options{WALSegmentSize: 1 << 10}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 50 {
+		set(t, s, "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	if _, err := s.SaveSnapshot(backup); err != nil {
+		t.Fatal(err)
+	}
+	s.Delete(key{name: "k0"})
+	set(t, s, "k1", "new")
+	set(t, s, "after", "v")
+	s.Close()
+
+	s, report, err := Recover(backup, path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.SnapshotKeys != 50 || report.Applied != 3 {
+		t.Errorf("%d keys from the backup and %d records applied, want 50 and 3", report.SnapshotKeys, report.Applied)
+	}
+	if get(t, s, "k0") != "" || get(t, s, "k1") != "new" || get(t, s, "k2") != "2" || get(t, s, "after") != "v" || s.LastLSN() != 53 {
+		t.Errorf("k0=%s k1=%s k2=%s after=%s, LastLSN %d", get(t, s, "k0"), get(t, s, "k1"), get(t, s, "k2"), get(t, s, "after"), s.LastLSN())
+	}
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	if _, _, err := Recover(backup, path, opts); err == nil {
+		t.Error("recovered from a backup the checkpoint left behind")
+	}
+}
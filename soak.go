@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// `go-io-drill soak -duration 4h` runs a steady mixed workload (SET with and without
+// a ttl, GET, DELETE, EXPIRE) for hours, checkpointing and restarting the store
+// (close, reopen, recover) on a schedule, and every -interval it stops the writers,
+// checks the invariants and appends a row to a CSV report, one line per check,
+// ready to be plotted. the slow leaks it's after show up as columns that keep growing
+//
+// each worker owns its own slice of the key space and keeps a model of what the
+// store should hold, so a check can compare every key against the model:
+//   - every live key reads back its value, every deleted or expired one reads missing
+//   - after a restart the process holds no more file descriptors than after the first open
+//
+// expiries near the check are given some slack, the store stamps them a moment
+// after the model does
+
+const soak_expiry_slack = 250 * time.Millisecond
+
+type soak_entry struct {
+	value      string
+	expires_at time.Time // zero for no ttl
+}
+
+// soak_worker's model only ever has one writer, the worker itself
+type soak_worker struct {
+	rng   *rand.Rand
+	model map[string]soak_entry
+	keys  []string
+}
+
+type soak_run struct {
+	path       string
+	value_size int
+
+	// workers hold it for reading around every op, checks and restarts take it for writing
+	pause sync.RWMutex
+	store *Store
+
+	ops         atomic.Uint64
+	violations  atomic.Uint64
+	restarts    int
+	checkpoints int
+	base_fds    int // open fds right after the first open, -1 where they can't be counted
+}
+
+func run_soak(args []string) error {
+	flags := flag.NewFlagSet("soak", flag.ContinueOnError)
+	duration := flags.Duration("duration", time.Hour, "how long to run")
+	interval := flags.Duration("interval", 10*time.Second, "how often to check the invariants and write a report row")
+	checkpoint_every := flags.Duration("checkpoint", time.Minute, "how often to CHECKPOINT, 0 for never")
+	restart_every := flags.Duration("restart", 5*time.Minute, "how often to close and reopen the store, 0 for never")
+	keys := flags.Int("keys", 10000, "size of the key space")
+	workers := flags.Int("workers", 4, "concurrent clients")
+	value_size := flags.Int("value", 100, "value size in bytes")
+	dir := flags.String("dir", "", "where the WAL goes (default: a temp dir, removed afterwards)")
+	report_path := flags.String("report", "soak.csv", "CSV the checks are appended to")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *keys <= 0 || *workers <= 0 || *interval <= 0 {
+		return errors.New("soak: -keys, -workers and -interval must be positive")
+	}
+
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "soak")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	report, err := open_soak_report(*report_path)
+	if err != nil {
+		return err
+	}
+	defer report.Close()
+
+	//the store logs every write, which would be the whole run
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	run := &soak_run{path: filepath.Join(*dir, "soak_wal.log"), value_size: *value_size}
+	if err := run.open(); err != nil {
+		return err
+	}
+	run.base_fds = open_fds()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	ctx, cancel = context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	soak_workers := make([]*soak_worker, *workers)
+	for w := range soak_workers {
+		soak_workers[w] = &soak_worker{rng: rand.New(rand.NewSource(int64(w))), model: make(map[string]soak_entry)}
+	}
+	for i := 0; i < *keys; i++ {
+		w := soak_workers[i%*workers]
+		w.keys = append(w.keys, "soak:"+strconv.Itoa(i))
+	}
+
+	var wg sync.WaitGroup
+	for _, w := range soak_workers {
+		wg.Add(1)
+		go func(w *soak_worker) {
+			defer wg.Done()
+			run.work(ctx, w)
+		}(w)
+	}
+
+	fmt.Printf("soaking for %s, %d keys, %d workers, report in %s\n", *duration, *keys, *workers, *report_path)
+	start := time.Now()
+	last_ops := uint64(0)
+	last_check := start
+	next_checkpoint := start.Add(*checkpoint_every)
+	next_restart := start.Add(*restart_every)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			done = true
+		case now := <-ticker.C:
+			if *checkpoint_every > 0 && !now.Before(next_checkpoint) {
+				run.checkpoint()
+				next_checkpoint = now.Add(*checkpoint_every)
+			}
+			if *restart_every > 0 && !now.Before(next_restart) {
+				if err := run.restart(); err != nil {
+					cancel()
+					wg.Wait()
+					return err
+				}
+				next_restart = now.Add(*restart_every)
+			}
+
+			row := run.check(soak_workers)
+			ops := run.ops.Load()
+			row.elapsed = now.Sub(start)
+			row.ops_per_sec = float64(ops-last_ops) / now.Sub(last_check).Seconds()
+			last_ops, last_check = ops, now
+			if err := report.add(row); err != nil {
+				cancel()
+				wg.Wait()
+				return err
+			}
+		}
+	}
+	wg.Wait()
+	close_err := run.store.Close()
+
+	fmt.Printf("%d ops in %s, %d checkpoints, %d restarts, %d invariant violations\n",
+		run.ops.Load(), time.Since(start).Round(time.Second), run.checkpoints, run.restarts, run.violations.Load())
+	if run.violations.Load() > 0 {
+		return errors.New("soak: invariants violated, see " + *report_path)
+	}
+	return close_err
+}
+
+func (run *soak_run) open() error {
+	run.store = New_Store(run.path, Options{TruncateTornTail: true})
+	if err := run.store.Replay_wal(); err != nil {
+		run.store.Close()
+		return err
+	}
+	return nil
+}
+
+// work runs ops against the worker's keys until ctx is done
+// the mix is half SETs (a third of them with a ttl), 30% GETs, 10% DELETEs and 10% EXPIREs
+func (run *soak_run) work(ctx context.Context, w *soak_worker) {
+	value := strings.Repeat("v", run.value_size)
+	for ctx.Err() == nil {
+		k := w.keys[w.rng.Intn(len(w.keys))]
+		op := w.rng.Intn(10)
+
+		run.pause.RLock()
+		var err error
+		switch {
+		case op < 5:
+			var ttl time.Duration
+			if w.rng.Intn(3) == 0 {
+				ttl = time.Duration(1+w.rng.Intn(5)) * time.Second
+			}
+			v := k + ":" + strconv.FormatUint(run.ops.Load(), 10) + ":" + value
+			entry := soak_entry{value: v}
+			if ttl > 0 {
+				entry.expires_at = time.Now().Add(ttl)
+			}
+			if err = run.store.Set(key{name: k}, ttl, v); err == nil {
+				w.model[k] = entry
+			}
+		case op < 8:
+			got, ok := run.store.Get(key{name: k})
+			if !w.agrees(k, got, ok, time.Now()) {
+				run.violation("GET %s returned %t, the model disagrees", k, ok)
+			}
+		case op < 9:
+			if err = run.store.Delete(key{name: k}); err == nil {
+				delete(w.model, k)
+			}
+		default:
+			//only keys that are clearly live, EXPIRE on a missing key is an error
+			entry, exists := w.model[k]
+			if !exists || (!entry.expires_at.IsZero() && time.Until(entry.expires_at) < soak_expiry_slack) {
+				break
+			}
+			ttl := time.Duration(1+w.rng.Intn(5)) * time.Second
+			entry.expires_at = time.Now().Add(ttl)
+			if err = run.store.Expire(key{name: k}, ttl); err == nil {
+				w.model[k] = entry
+			}
+		}
+		run.pause.RUnlock()
+
+		if err != nil {
+			run.violation("write to %s failed: %v", k, err)
+		}
+		run.ops.Add(1)
+	}
+}
+
+// agrees says whether a read of k matches the model, always true within the slack of an expiry
+func (w *soak_worker) agrees(k string, got string, ok bool, now time.Time) bool {
+	entry, exists := w.model[k]
+	if exists && !entry.expires_at.IsZero() {
+		if entry.expires_at.Sub(now).Abs() < soak_expiry_slack {
+			return true
+		}
+		if entry.expires_at.Before(now) {
+			delete(w.model, k)
+			exists = false
+		}
+	}
+	if !exists {
+		return !ok
+	}
+	return ok && got == entry.value
+}
+
+func (run *soak_run) violation(format string, args ...any) {
+	run.violations.Add(1)
+	fmt.Fprintf(os.Stderr, "VIOLATION: "+format+"\n", args...)
+}
+
+func (run *soak_run) checkpoint() {
+	if _, err := run.store.Checkpoint(); err != nil {
+		run.violation("checkpoint failed: %v", err)
+		return
+	}
+	run.checkpoints++
+}
+
+// restart closes the store and recovers it from disk like a process restart would
+func (run *soak_run) restart() error {
+	run.pause.Lock()
+	defer run.pause.Unlock()
+
+	if err := run.store.Close(); err != nil {
+		return err
+	}
+	if err := run.open(); err != nil {
+		return err
+	}
+	run.restarts++
+	//the background goroutines of the old store are on their way out, give them a moment
+	time.Sleep(10 * time.Millisecond)
+	if fds := open_fds(); run.base_fds >= 0 && fds > run.base_fds {
+		run.violation("%d fds open after restart %d, %d after the first open", fds, run.restarts, run.base_fds)
+	}
+	return nil
+}
+
+// soak_row is one line of the report
+type soak_row struct {
+	elapsed     time.Duration
+	ops_per_sec float64
+	keys        int // keys in memory, expired ones included
+	expired     int // keys in memory that expired more than a second ago
+	disk_bytes  int64
+	segments    int
+	open_fds    int
+	goroutines  int
+	heap_bytes  uint64
+	mismatches  int
+	checkpoints int
+	restarts    int
+	violations  uint64
+}
+
+// check pauses the workers and compares every key against the model
+func (run *soak_run) check(workers []*soak_worker) soak_row {
+	run.pause.Lock()
+	defer run.pause.Unlock()
+
+	now := time.Now()
+	row := soak_row{checkpoints: run.checkpoints, restarts: run.restarts}
+	for _, w := range workers {
+		for _, k := range w.keys {
+			got, ok := run.store.Get(key{name: k})
+			if !w.agrees(k, got, ok, now) {
+				row.mismatches++
+			}
+		}
+	}
+	if row.mismatches > 0 {
+		run.violation("%d keys disagree with the model", row.mismatches)
+	}
+
+	run.store.lock.RLock()
+	row.keys = run.store.data.len()
+	run.store.data.each(0, func(_ key, val value) bool {
+		if !val.expires_at.IsZero() && now.Sub(val.expires_at) > time.Second {
+			row.expired++
+		}
+		return true
+	})
+	run.store.lock.RUnlock()
+
+	files, _ := filepath.Glob(run.path + "*")
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			row.disk_bytes += info.Size()
+		}
+	}
+	if segments, err := run.store.wal.segments(); err == nil {
+		row.segments = len(segments)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	row.heap_bytes = mem.HeapAlloc
+	row.open_fds = open_fds()
+	row.goroutines = runtime.NumGoroutine()
+	row.violations = run.violations.Load()
+	return row
+}
+
+// open_fds counts the process's open file descriptors, -1 where there's no /proc
+func open_fds() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+type soak_report struct {
+	file *os.File
+	csv  *csv.Writer
+}
+
+var soak_report_header = []string{"time", "elapsed_s", "ops_per_s", "keys", "expired_in_memory", "disk_bytes",
+	"wal_segments", "open_fds", "goroutines", "heap_bytes", "mismatches", "checkpoints", "restarts", "violations"}
+
+// open_soak_report appends to the report, with a header if it is new
+func open_soak_report(path string) (*soak_report, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	report := &soak_report{file: file, csv: csv.NewWriter(file)}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		report.csv.Write(soak_report_header)
+	}
+	return report, nil
+}
+
+// add writes a row and flushes it, a report is only useful if it survives the run being killed
+func (r *soak_report) add(row soak_row) error {
+	r.csv.Write([]string{
+		time.Now().Format(time.RFC3339),
+		strconv.FormatFloat(row.elapsed.Seconds(), 'f', 0, 64),
+		strconv.FormatFloat(row.ops_per_sec, 'f', 0, 64),
+		strconv.Itoa(row.keys),
+		strconv.Itoa(row.expired),
+		strconv.FormatInt(row.disk_bytes, 10),
+		strconv.Itoa(row.segments),
+		strconv.Itoa(row.open_fds),
+		strconv.Itoa(row.goroutines),
+		strconv.FormatUint(row.heap_bytes, 10),
+		strconv.Itoa(row.mismatches),
+		strconv.Itoa(row.checkpoints),
+		strconv.Itoa(row.restarts),
+		strconv.FormatUint(row.violations, 10),
+	})
+	r.csv.Flush()
+	return r.csv.Error()
+}
+
+func (r *soak_report) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the soak subcommand, see soak.go
+
+// a short soak checkpoints, restarts and checks without a violation, and a second
+// run appends to the report under the same header
+func TestSoak(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	report := filepath.Join(dir, "soak.csv")
+	for range 2 {
+		args := []string{"-duration", "700ms", "-interval", "100ms", "-checkpoint", "200ms", "-restart", "300ms",
+			"-keys", "200", "-workers", "2", "-value", "10", "-dir", t.TempDir(), "-report", report}
+		var err error
+		out := stdout(t, func() { err = run_soak(args) })
+		if err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+		if !strings.Contains(out, " 0 invariant violations") {
+			t.Errorf("output:\n%s", out)
+		}
+	}
+
+	fd, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	rows, err := csv.NewReader(fd).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) < 9 || !slices.Equal(rows[0], soak_report_header) {
+		t.Fatalf("%d rows, header %v", len(rows), rows[0])
+	}
+	column := func(row []string, name string) string { return row[slices.Index(soak_report_header, name)] }
+	for _, row := range rows[1:] {
+		if row[0] == "time" {
+			t.Fatal("the header written twice")
+		}
+		if column(row, "violations") != "0" || column(row, "mismatches") != "0" {
+			t.Errorf("row %v", row)
+		}
+	}
+	last := rows[len(rows)-1]
+	if column(last, "checkpoints") == "0" || column(last, "restarts") == "0" {
+		t.Errorf("no checkpoint or restart by the last row: %v", last)
+	}
+
+	for _, bad := range [][]string{{"-keys", "0"}, {"-workers", "-1"}, {"-interval", "0s"}} {
+		if err := run_soak(append(bad, "-report", report)); err == nil {
+			t.Errorf("soak %v", bad)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// soft delete: with Options.SoftDelete set, DELETE and GETDEL keep the old value
+// as a tombstone for that long, and UNDELETE puts it back. once the window is over
+// the tombstone is gone for good (purge_tombstones_every frees the memory)
+//
+// the purge time rides in the DELETE/GETDEL record's expires_at, so a replay rebuilds
+// the same tombstones with the same deadlines, and checkpoints/compaction keep them
+// around as a SET followed by that DELETE
+
+type tombstone struct {
+	val      value     // what the key held when it was deleted
+	lsn      uint64    // LSN of the delete
+	purge_at time.Time // after this it can't be undeleted
+}
+
+// purge_time is when a delete of k now stops being undoable, zero for a hard delete
+// (soft delete off, or nothing live to keep)
+// Caller must hold s.lock
+func (s *Store) purge_time(k key) time.Time {
+	if s.soft_delete <= 0 {
+		return time.Time{}
+	}
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		return time.Time{}
+	}
+	return time.Now().Add(s.soft_delete)
+}
+
+// remove deletes k, keeping its value as a tombstone until purge_at if that is still ahead
+// Caller must hold s.lock
+func (s *Store) remove(k key, lsn uint64, purge_at time.Time) {
+	if val, exists := s.data.get(k); exists && purge_at.After(time.Now()) {
+		if s.tombstones == nil {
+			s.tombstones = make(map[key]tombstone)
+		}
+		s.tombstones[k] = tombstone{val: val, lsn: lsn, purge_at: purge_at}
+	}
+	s.drop(k)
+}
+
+// Undelete restores a soft-deleted key to the value it had when it was deleted,
+// expiry included. it fails once the retention window is over, if the key was written
+// again since, or if the value would already have expired on its own
+func (s *Store) Undelete(k key) error {
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	t, ok := s.tombstones[k]
+	if !ok || !t.purge_at.After(time.Now()) {
+		delete(s.tombstones, k)
+		s.lock.Unlock()
+		return errors.New("no deleted value to restore")
+	}
+	if !t.val.expires_at.IsZero() && time.Now().After(t.val.expires_at) {
+		delete(s.tombstones, k)
+		s.lock.Unlock()
+		return errors.New("deleted value has expired")
+	}
+	if err := s.make_room_for(k, entry_size(k, t.val)); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	rec := wal_record{lsn: s.next_lsn(), op: UNDELETE, key: k.name, db: k.db}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	val := t.val
+	val.lsn = rec.lsn
+	s.put(k, val)
+	delete(s.tombstones, k)
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return s.wait(ack)
+}
+
+// replay_undelete is Undelete for a replayed record, a tombstone that is gone stays gone
+// Caller must hold s.lock
+func (s *Store) replay_undelete(k key, lsn uint64) {
+	t, ok := s.tombstones[k]
+	if !ok {
+		return
+	}
+	delete(s.tombstones, k)
+	if !t.val.expires_at.IsZero() && !t.val.expires_at.After(time.Now()) {
+		return
+	}
+	val := t.val
+	val.lsn = lsn
+	s.put(k, val)
+}
+
+// tombstone_records is the SET + DELETE pair that brings each live tombstone back on replay
+// Caller must hold s.lock
+func (s *Store) tombstone_records() []wal_record {
+	now := time.Now()
+	var records []wal_record
+	for k, t := range s.tombstones {
+		if !t.purge_at.After(now) {
+			continue
+		}
+		records = append(records,
+			value_record(k, t.val),
+			wal_record{lsn: t.lsn, op: DELETE, key: k.name, db: k.db, expires_at: t.purge_at})
+	}
+	return records
+}
+
+// purge_tombstones drops the tombstones whose window is over, returns how many
+func (s *Store) purge_tombstones() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	n := 0
+	for k, t := range s.tombstones {
+		if !t.purge_at.After(now) {
+			delete(s.tombstones, k)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *Store) purge_tombstones_every(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.purge_tombstones()
+		case <-s.stop:
+			return
+		}
+	}
+}
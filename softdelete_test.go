@@ -0,0 +1,91 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// soft deletes and UNDELETE, see softdelete.go
+
+func open_soft(t *testing.T, path string, window time.Duration) *Store {
+	t.Helper()
+	s, _, err := Recover("", path, Options{SoftDelete: window})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func reopen_soft(t *testing.T, s *Store, path string) *Store {
+	t.Helper()
+	s.Close()
+	return open_soft(t, path, time.Hour)
+}
+
+// a deleted value comes back with its expiry, once, until the key is written again,
+// across a restart and a checkpoint
+func TestUndelete(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_soft(t, path, time.Hour)
+	s.Set(key{name: "a"}, time.Hour, "1")
+	set(t, s, "b", "2")
+	set(t, s, "c", "3")
+	s.Delete(key{name: "a"})
+	if _, ok, _ := s.GetDel(key{name: "b"}); !ok {
+		t.Fatal("GETDEL b")
+	}
+	s.Delete(key{name: "c"})
+	set(t, s, "c", "again")
+
+	if err := s.Undelete(key{name: "c"}); err == nil {
+		t.Error("UNDELETE of a key written since its delete")
+	}
+	if err := s.Undelete(key{name: "missing"}); err == nil {
+		t.Error("UNDELETE of a key never deleted")
+	}
+
+	s = reopen_soft(t, s, path)
+	if err := s.Undelete(key{name: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "a"}); get(t, s, "a") != "1" || ttl <= 59*time.Minute {
+		t.Errorf("a after UNDELETE: %q, ttl %v", get(t, s, "a"), ttl)
+	}
+	if err := s.Undelete(key{name: "a"}); err == nil {
+		t.Error("a second UNDELETE")
+	}
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = reopen_soft(t, s, path)
+	defer s.Close()
+	if get(t, s, "a") != "1" {
+		t.Error("the undeleted a is gone after a restart")
+	}
+	if err := s.Undelete(key{name: "b"}); err != nil || get(t, s, "b") != "2" {
+		t.Errorf("UNDELETE b after a checkpoint and restarts: %v, b=%q", err, get(t, s, "b"))
+	}
+}
+
+// past the window, and without one, a delete is for good
+func TestUndeleteWindow(t *testing.T) {
+	s := open_soft(t, filepath.Join(t.TempDir(), "wal.log"), 20*time.Millisecond)
+	defer s.Close()
+	set(t, s, "a", "1")
+	s.Delete(key{name: "a"})
+	time.Sleep(30 * time.Millisecond)
+	if err := s.Undelete(key{name: "a"}); err == nil {
+		t.Error("UNDELETE past the window")
+	}
+
+	hard := open_store(t, filepath.Join(t.TempDir(), "wal.log"), PersistWAL)
+	defer hard.Close()
+	set(t, hard, "a", "1")
+	hard.Delete(key{name: "a"})
+	if err := hard.Undelete(key{name: "a"}); err == nil {
+		t.Error("UNDELETE without SoftDelete")
+	}
+}
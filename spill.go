@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"time"
+)
+
+// spill files: where Sort and GroupBy put rows that don't fit under their limit, see
+// Sort.MaxRows and GroupBy.MaxGroups. a spill file is written once and read back once,
+// in the order it was written, in one of two formats
+//
+// SpillRows writes a record per row, its length then its fields packed with
+// encode_args, like Distinct's spill files
+//
+// SpillColumns buffers spill_block_rows rows and writes them a column at a time: the
+// key names, the databases, the values, the expiries and the objects, each column
+// compressed with flate on its own. a column holds one kind of thing, so it compresses
+// better than the rows mixed together, and the databases and expiries, mostly the same
+// or close to each other, shrink to next to nothing (the expiries are kept as deltas)
+//
+// block: rows (uvarint) | 5 × (compressed length (uvarint) | compressed column)
+// in a column a string is its length (uvarint) and its bytes, a database a uvarint and
+// an expiry the varint of its unix nanoseconds less the previous row's, 0 for none
+
+type SpillFormat int
+
+const (
+	SpillRows    SpillFormat = iota // a record per row
+	SpillColumns                    // blocks of rows a column at a time, each column compressed
+)
+
+// what the query engine's ORDER BY and GROUP BY spill in: about as fast as SpillRows
+// and a third of the bytes, see BenchmarkSpill
+const query_spill_format = SpillColumns
+
+// rows in a block of SpillColumns
+const spill_block_rows = 4096
+
+// the columns of a SpillColumns block, in the order they are written
+const (
+	column_keys = iota
+	column_dbs
+	column_values
+	column_expiries
+	column_objects
+	spill_columns
+)
+
+// ParseSpillFormat turns "rows" or "columns" into a SpillFormat
+func ParseSpillFormat(name string) (SpillFormat, bool) {
+	switch name {
+	case "rows":
+		return SpillRows, true
+	case "columns":
+		return SpillColumns, true
+	}
+	return SpillRows, false
+}
+
+type spill_file struct {
+	fd      *os.File
+	writer  *bufio.Writer
+	reader  *bufio.Reader
+	format  SpillFormat
+	block   []*Row // SpillColumns: the rows written since the last block
+	pending []*Row // SpillColumns: the block being read back
+	bytes   int64  // written to the file
+
+	//SpillColumns: the compressor, decompressor and column buffers, kept from block to block
+	zw         *flate.Writer
+	zr         io.ReadCloser
+	columns    [spill_columns][]byte
+	compressed bytes.Buffer
+}
+
+func new_spill_file(dir string, pattern string, format SpillFormat) (*spill_file, error) {
+	fd, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &spill_file{fd: fd, writer: bufio.NewWriter(fd), format: format}, nil
+}
+
+// row_args are a row's fields for encode_args: key name, database, value, expiry and object
+func row_args(row *Row) []string {
+	var expires_at, obj string
+	if !row.Value.expires_at.IsZero() {
+		expires_at = strconv.FormatInt(row.Value.expires_at.UnixNano(), 10)
+	}
+	if row.Value.obj != nil {
+		obj = dump_object(row.Value.obj)
+	}
+	return []string{row.Key.name, strconv.Itoa(row.Key.db), row.Value.data, expires_at, obj}
+}
+
+// args_to_row is row_args the other way round
+func args_to_row(args []string) (*Row, error) {
+	if len(args) != 5 {
+		return nil, errors.New("malformed row in a spill file")
+	}
+	db, _ := strconv.Atoi(args[1])
+	row := &Row{Key: key{name: args[0], db: db}, Value: value{data: args[2]}}
+	if args[3] != "" {
+		ns, _ := strconv.ParseInt(args[3], 10, 64)
+		row.Value.expires_at = time.Unix(0, ns)
+	}
+	if args[4] != "" {
+		obj, err := load_object(args[4])
+		if err != nil {
+			return nil, err
+		}
+		row.Value.obj = obj
+	}
+	return row, nil
+}
+
+// write appends row, SpillColumns only writes a block once it is full
+func (f *spill_file) write(row *Row) error {
+	if f.format == SpillColumns {
+		f.block = append(f.block, row)
+		if len(f.block) < spill_block_rows {
+			return nil
+		}
+		return f.write_block()
+	}
+	packed := encode_args(row_args(row))
+	n, _ := f.writer.Write(binary.AppendUvarint(nil, uint64(len(packed))))
+	m, err := f.writer.WriteString(packed)
+	f.bytes += int64(n + m)
+	return err
+}
+
+func (f *spill_file) write_block() error {
+	columns := &f.columns
+	for c := range columns {
+		columns[c] = columns[c][:0]
+	}
+	put_string := func(c int, s string) {
+		columns[c] = binary.AppendUvarint(columns[c], uint64(len(s)))
+		columns[c] = append(columns[c], s...)
+	}
+	var last int64
+	for _, row := range f.block {
+		put_string(column_keys, row.Key.name)
+		columns[column_dbs] = binary.AppendUvarint(columns[column_dbs], uint64(row.Key.db))
+		put_string(column_values, row.Value.data)
+		var at int64
+		if !row.Value.expires_at.IsZero() {
+			at = row.Value.expires_at.UnixNano()
+		}
+		columns[column_expiries] = binary.AppendVarint(columns[column_expiries], at-last)
+		last = at
+		var obj string
+		if row.Value.obj != nil {
+			obj = dump_object(row.Value.obj)
+		}
+		put_string(column_objects, obj)
+	}
+
+	if f.zw == nil {
+		f.zw, _ = flate.NewWriter(nil, flate.BestSpeed)
+	}
+	n, err := f.writer.Write(binary.AppendUvarint(nil, uint64(len(f.block))))
+	f.bytes += int64(n)
+	for _, column := range columns {
+		f.compressed.Reset()
+		f.zw.Reset(&f.compressed)
+		f.zw.Write(column)
+		if err := f.zw.Close(); err != nil {
+			return err
+		}
+		n, _ := f.writer.Write(binary.AppendUvarint(nil, uint64(f.compressed.Len())))
+		m, err := f.writer.Write(f.compressed.Bytes())
+		f.bytes += int64(n + m)
+		if err != nil {
+			return err
+		}
+	}
+	clear(f.block)
+	f.block = f.block[:0]
+	return err
+}
+
+// rewind finishes writing and starts reading from the first row
+func (f *spill_file) rewind() error {
+	if len(f.block) > 0 {
+		if err := f.write_block(); err != nil {
+			return err
+		}
+	}
+	if err := f.writer.Flush(); err != nil {
+		return err
+	}
+	if _, err := f.fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f.reader = bufio.NewReader(f.fd)
+	return nil
+}
+
+// next is the next row written, nil at the end
+func (f *spill_file) next() (*Row, error) {
+	if f.format == SpillColumns {
+		if len(f.pending) == 0 {
+			if err := f.read_block(); err == io.EOF {
+				return nil, nil
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		row := f.pending[0]
+		f.pending = f.pending[1:]
+		return row, nil
+	}
+	n, err := binary.ReadUvarint(f.reader)
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(f.reader, buf); err != nil {
+		return nil, err
+	}
+	args, err := decode_args(string(buf))
+	if err != nil {
+		return nil, err
+	}
+	return args_to_row(args)
+}
+
+var errBadSpillBlock = errors.New("malformed block in a spill file")
+
+func (f *spill_file) read_block() error {
+	rows, err := binary.ReadUvarint(f.reader)
+	if err != nil {
+		return err
+	}
+	columns := &f.columns
+	for c := range columns {
+		n, err := binary.ReadUvarint(f.reader)
+		if err != nil {
+			return noEOF(err)
+		}
+		f.compressed.Reset()
+		if _, err := io.CopyN(&f.compressed, f.reader, int64(n)); err != nil {
+			return noEOF(err)
+		}
+		if f.zr == nil {
+			f.zr = flate.NewReader(&f.compressed)
+		} else {
+			f.zr.(flate.Resetter).Reset(&f.compressed, nil)
+		}
+		column := bytes.NewBuffer(columns[c][:0])
+		if _, err := column.ReadFrom(f.zr); err != nil {
+			return err
+		}
+		columns[c] = column.Bytes()
+	}
+	//parsed off a copy, the buffers keep their length for the next block
+	parsed := f.columns
+	columns = &parsed
+
+	get_string := func(c int) (string, error) {
+		n, size := binary.Uvarint(columns[c])
+		if size <= 0 || uint64(len(columns[c])-size) < n {
+			return "", errBadSpillBlock
+		}
+		s := string(columns[c][size : size+int(n)])
+		columns[c] = columns[c][size+int(n):]
+		return s, nil
+	}
+	f.pending = make([]*Row, rows)
+	var last int64
+	for i := range f.pending {
+		row := &Row{}
+		var obj string
+		if row.Key.name, err = get_string(column_keys); err != nil {
+			return err
+		}
+		db, size := binary.Uvarint(columns[column_dbs])
+		if size <= 0 {
+			return errBadSpillBlock
+		}
+		row.Key.db, columns[column_dbs] = int(db), columns[column_dbs][size:]
+		if row.Value.data, err = get_string(column_values); err != nil {
+			return err
+		}
+		delta, size := binary.Varint(columns[column_expiries])
+		if size <= 0 {
+			return errBadSpillBlock
+		}
+		columns[column_expiries] = columns[column_expiries][size:]
+		if last += delta; last != 0 {
+			row.Value.expires_at = time.Unix(0, last)
+		}
+		if obj, err = get_string(column_objects); err != nil {
+			return err
+		}
+		if obj != "" {
+			if row.Value.obj, err = load_object(obj); err != nil {
+				return err
+			}
+		}
+		f.pending[i] = row
+	}
+	return nil
+}
+
+// noEOF is for a read that can't be the end of the file, a block cut short
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// remove closes and deletes the file
+func (f *spill_file) remove() {
+	f.fd.Close()
+	os.Remove(f.fd.Name())
+}
+
+// ---- merging sorted runs ----
+
+// sorted_run is a run of rows in order, a spill file or rows still in memory
+type sorted_run interface {
+	next() (*Row, error)
+}
+
+type memory_run struct {
+	rows []*Row
+}
+
+func (r *memory_run) next() (*Row, error) {
+	if len(r.rows) == 0 {
+		return nil, nil
+	}
+	row := r.rows[0]
+	r.rows = r.rows[1:]
+	return row, nil
+}
+
+// run_merge hands out the rows of sorted runs in order, the heads of the runs in a
+// heap. a tie goes to the earlier run, so runs of a stable sort cut in input order
+// merge into a stable sort
+type run_merge struct {
+	runs  []sorted_run
+	heads []merge_head
+	less  func(a, b Row) bool
+}
+
+type merge_head struct {
+	row *Row
+	run int
+}
+
+func (m *run_merge) Len() int { return len(m.heads) }
+func (m *run_merge) Less(i, j int) bool {
+	a, b := m.heads[i], m.heads[j]
+	if m.less(*a.row, *b.row) {
+		return true
+	}
+	return !m.less(*b.row, *a.row) && a.run < b.run
+}
+func (m *run_merge) Swap(i, j int) { m.heads[i], m.heads[j] = m.heads[j], m.heads[i] }
+func (m *run_merge) Push(x any)    { m.heads = append(m.heads, x.(merge_head)) }
+func (m *run_merge) Pop() any {
+	last := m.heads[len(m.heads)-1]
+	m.heads = m.heads[:len(m.heads)-1]
+	return last
+}
+
+func new_run_merge(runs []sorted_run, less func(a, b Row) bool) (*run_merge, error) {
+	m := &run_merge{runs: runs, less: less}
+	for i, run := range runs {
+		row, err := run.next()
+		if err != nil {
+			return nil, err
+		}
+		if row != nil {
+			m.heads = append(m.heads, merge_head{row: row, run: i})
+		}
+	}
+	heap.Init(m)
+	return m, nil
+}
+
+// next is the smallest head, replaced by the next row of its run
+func (m *run_merge) next() (*Row, error) {
+	if len(m.heads) == 0 {
+		return nil, nil
+	}
+	top := m.heads[0]
+	row, err := m.runs[top.run].next()
+	if err != nil {
+		return nil, err
+	}
+	if row == nil {
+		heap.Pop(m)
+	} else {
+		m.heads[0].row = row
+		heap.Fix(m, 0)
+	}
+	return top.row, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Stats is the INFO of one store, what the process wide metrics (METRICS) can't
+// say per store: what it holds, how big it is on disk and how it has been used
+// since it was opened
+
+// Stats is a store at one point in time
+type Stats struct {
+	Keys        int   // keys in memory, expired ones the sweeper hasn't got to included
+	Expired     int   // keys that have expired but are still in memory
+	Memory      int64 // estimated bytes of keys and values, see eviction.go
+	MaxMemory   int64 // the cap on Memory, 0 if there is none
+	WALBytes    int64 // bytes of WAL segments on disk, the stripes' too, compressed ones as compressed
+	WALSegments int
+	LastLSN     uint64
+
+	Gets    uint64 // Get calls
+	Hits    uint64 // Gets that found a value, loaded ones included
+	Misses  uint64 // Gets that didn't
+	Sets    uint64 // values written by Set, SetOpts, GetSet, loads and transactions
+	Deletes uint64 // Delete calls and a transaction's deletes
+
+	Uptime time.Duration // since the store was opened
+
+	WarmUpKeys   int           // hot keys the warm-up after the restart had to go through, 0 without one, see warmup.go
+	WarmedUp     int           // how many it has been through
+	WarmUpLoaded int           // those of them it loaded through Options.Load
+	WarmUpTook   time.Duration // how long it took, 0 while it runs
+}
+
+// op_counters are the counts behind Stats, atomics so Get can bump them without s.lock
+type op_counters struct {
+	gets    atomic.Uint64
+	hits    atomic.Uint64
+	misses  atomic.Uint64
+	sets    atomic.Uint64
+	deletes atomic.Uint64
+}
+
+// hit counts a Get and passes its result through
+func (c *op_counters) hit(v string, found bool) (string, bool) {
+	c.gets.Add(1)
+	if found {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+	return v, found
+}
+
+// Stats reports the store's size and use. counting the expired keys walks the
+// map under the read lock, writers wait for it like they do for KEYS
+func (s *Store) Stats() Stats {
+	stats := Stats{
+		MaxMemory: s.max_memory,
+		Gets:      s.counters.gets.Load(),
+		Hits:      s.counters.hits.Load(),
+		Misses:    s.counters.misses.Load(),
+		Sets:      s.counters.sets.Load(),
+		Deletes:   s.counters.deletes.Load(),
+		Uptime:    time.Since(s.opened),
+
+		WarmUpKeys:   int(s.warming.total.Load()),
+		WarmedUp:     int(s.warming.done.Load()),
+		WarmUpLoaded: int(s.warming.loaded.Load()),
+		WarmUpTook:   time.Duration(s.warming.took.Load()),
+	}
+
+	s.lock.RLock()
+	now := time.Now()
+	stats.Keys = s.data.len()
+	s.data.each(0, func(_ key, val value) bool {
+		if !val.expires_at.IsZero() && !val.expires_at.After(now) {
+			stats.Expired++
+		}
+		return true
+	})
+	stats.Memory = s.memory
+	stats.LastLSN = s.last_lsn
+	s.lock.RUnlock()
+
+	//a segment can go (checkpoint, archiver) between listing and stat, it is just not counted
+	//a striped segment is one file in every stripe, counted once
+	segments, _ := s.wal.log_segments()
+	stats.WALSegments = len(segments)
+	for _, l := range append([]*wal{s.wal}, s.wal.stripes...) {
+		segments, _ := l.segments()
+		for _, seq := range segments {
+			if info, err := os.Stat(l.segment_path(seq)); err == nil {
+				stats.WALBytes += info.Size()
+			}
+		}
+	}
+	return stats
+}
+
+// info_lines renders stats for INFO, one "name: value" per line
+func info_lines(stats Stats) []string {
+	hit_rate := "-"
+	if stats.Gets > 0 {
+		hit_rate = strconv.FormatFloat(100*float64(stats.Hits)/float64(stats.Gets), 'f', 1, 64) + "%"
+	}
+	max_memory := "unlimited"
+	if stats.MaxMemory > 0 {
+		max_memory = strconv.FormatInt(stats.MaxMemory, 10)
+	}
+	u := func(n uint64) string { return strconv.FormatUint(n, 10) }
+	lines := []string{
+		"keys: " + strconv.Itoa(stats.Keys) + " (" + strconv.Itoa(stats.Expired) + " expired, not swept yet)",
+		"memory: " + strconv.FormatInt(stats.Memory, 10) + " bytes (limit " + max_memory + ")",
+		"wal: " + strconv.FormatInt(stats.WALBytes, 10) + " bytes in " + strconv.Itoa(stats.WALSegments) + " segments, last LSN " + u(stats.LastLSN),
+		"gets: " + u(stats.Gets) + " (" + u(stats.Hits) + " hits, " + u(stats.Misses) + " misses, hit rate " + hit_rate + ")",
+		"sets: " + u(stats.Sets),
+		"deletes: " + u(stats.Deletes),
+		"uptime: " + stats.Uptime.Round(time.Second).String(),
+	}
+	if stats.WarmUpKeys > 0 {
+		state := "running"
+		if stats.WarmUpTook > 0 {
+			state = "done in " + stats.WarmUpTook.Round(time.Millisecond).String()
+		}
+		lines = append(lines, "warm-up: "+strconv.Itoa(stats.WarmedUp)+"/"+strconv.Itoa(stats.WarmUpKeys)+" hot keys ("+strconv.Itoa(stats.WarmUpLoaded)+" loaded), "+state)
+	}
+	return lines
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Stats and INFO, see stats.go
+
+// what a store holds and has done, counted since it was opened
+func TestStats(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := New_Store(path, Options{ExpireInterval: -1})
+	defer s.Close()
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+	s.Set(key{name: "gone"}, time.Millisecond, "x")
+	time.Sleep(5 * time.Millisecond)
+	s.Get(key{name: "a"})
+	s.Get(key{name: "missing"})
+	s.Delete(key{name: "b"})
+	memory := s.Stats().Memory
+	set(t, s, "big", string(make([]byte, 1000)))
+
+	stats := s.Stats()
+	if stats.Keys != 3 || stats.Expired != 1 || stats.LastLSN != 5 {
+		t.Errorf("%d keys, %d expired, LastLSN %d", stats.Keys, stats.Expired, stats.LastLSN)
+	}
+	if stats.Gets != 2 || stats.Hits != 1 || stats.Misses != 1 || stats.Sets != 4 || stats.Deletes != 1 {
+		t.Errorf("gets %d (%d hits, %d misses), sets %d, deletes %d", stats.Gets, stats.Hits, stats.Misses, stats.Sets, stats.Deletes)
+	}
+	if stats.Memory < memory+1000 || stats.MaxMemory != 0 {
+		t.Errorf("memory %d after a 1000 byte value, from %d, limit %d", stats.Memory, memory, stats.MaxMemory)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.WALSegments != 1 || stats.WALBytes != info.Size() {
+		t.Errorf("%d bytes in %d segments, the WAL is %d", stats.WALBytes, stats.WALSegments, info.Size())
+	}
+	if stats.Uptime <= 0 {
+		t.Errorf("uptime %v", stats.Uptime)
+	}
+}
+
+// INFO's lines, the hit rate only once there has been a Get
+func TestInfoLines(t *testing.T) {
+	stats := Stats{Keys: 10, Expired: 2, Memory: 640, MaxMemory: 1024, WALBytes: 300, WALSegments: 2, LastLSN: 12,
+		Gets: 8, Hits: 6, Misses: 2, Sets: 12, Deletes: 1, Uptime: 90 * time.Second}
+	want := []string{
+		"keys: 10 (2 expired, not swept yet)",
+		"memory: 640 bytes (limit 1024)",
+		"wal: 300 bytes in 2 segments, last LSN 12",
+		"gets: 8 (6 hits, 2 misses, hit rate 75.0%)",
+		"sets: 12",
+		"deletes: 1",
+		"uptime: 1m30s",
+	}
+	got := info_lines(stats)
+	if len(got) != len(want) {
+		t.Fatalf("%d lines: %q", len(got), got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("line %d: %q, want %q", i, got[i], want[i])
+		}
+	}
+	got = info_lines(Stats{WarmUpKeys: 500, WarmedUp: 120, WarmUpLoaded: 3})
+	if got[1] != "memory: 0 bytes (limit unlimited)" || got[3] != "gets: 0 (0 hits, 0 misses, hit rate -)" || got[len(got)-1] != "warm-up: 120/500 hot keys (3 loaded), running" {
+		t.Errorf("%q", got)
+	}
+}
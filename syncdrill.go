@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// `go-io-drill syncdrill` appends small records to a file and makes each one
+// durable with every sync primitive the platform has, to show what they cost:
+// fdatasync vs fsync on Linux, fsync vs F_FULLFSYNC on macOS (where only the
+// latter gets past the drive's cache), FlushFileBuffers on Windows. "none",
+// the write without any sync, is the baseline everywhere
+//
+// only the sync is timed. -csv appends the results with the OS and arch, so
+// runs on different machines end up in one file to compare
+
+// sync_primitive is one way of making a file's writes durable, see wal_<os>.go
+type sync_primitive struct {
+	name    string
+	durable bool   // survives a power cut, not just the process dying
+	note    string // what it does and doesn't do, for the drill
+	sync    func(fd *os.File) error
+}
+
+var syncdrill_none = sync_primitive{name: "none", sync: func(*os.File) error { return nil },
+	note: "the write only reaches the page cache"}
+
+var syncdrill_header = []string{"os", "arch", "primitive", "durable", "syncs", "syncs_per_sec", "p50_us", "p99_us", "max_us"}
+
+func run_syncdrill(args []string) error {
+	flags := flag.NewFlagSet("syncdrill", flag.ContinueOnError)
+	syncs := flags.Int("syncs", 500, "write+sync rounds per primitive")
+	size := flags.Int("size", 4096, "bytes written before each sync")
+	dir := flags.String("dir", "", "where the test files go (default: a temp dir, removed afterwards)")
+	only := flags.String("primitives", "", "comma separated primitives to run (default: all this platform has)")
+	report := flags.String("csv", "", "append the results to this CSV file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *syncs <= 0 || *size <= 0 {
+		return errors.New("syncdrill: -syncs and -size must be positive")
+	}
+
+	primitives := append([]sync_primitive{syncdrill_none}, sync_primitives...)
+	if *only != "" {
+		var picked []sync_primitive
+		for _, name := range strings.Split(*only, ",") {
+			p, ok := find_sync_primitive(primitives, strings.TrimSpace(name))
+			if !ok {
+				return errors.New("syncdrill: " + name + " is not a sync primitive on " + runtime.GOOS)
+			}
+			picked = append(picked, p)
+		}
+		primitives = picked
+	}
+
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "syncdrill")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	fmt.Printf("%s/%s: %d syncs of %d byte appends per primitive\n\n", runtime.GOOS, runtime.GOARCH, *syncs, *size)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "primitive\tdurable\tsyncs/s\tp50\tp99\tmax\tnote")
+	var rows [][]string
+	for _, p := range primitives {
+		stats, err := syncdrill_run(filepath.Join(*dir, p.name+".dat"), p, *syncs, *size)
+		if err != nil {
+			fmt.Fprintf(table, "%s\t%t\tfailed: %v\t\t\t\t\n", p.name, p.durable, err)
+			continue
+		}
+		per_sec := 0.0
+		if stats.Total > 0 {
+			per_sec = float64(stats.Fsyncs) / stats.Total.Seconds()
+		}
+		fmt.Fprintf(table, "%s\t%t\t%.0f\t%s\t%s\t%s\t%s\n", p.name, p.durable, per_sec, stats.P50, stats.P99, stats.Max, p.note)
+		rows = append(rows, []string{runtime.GOOS, runtime.GOARCH, p.name, strconv.FormatBool(p.durable),
+			strconv.FormatUint(stats.Fsyncs, 10), strconv.FormatFloat(per_sec, 'f', 0, 64),
+			strconv.FormatInt(stats.P50.Microseconds(), 10), strconv.FormatInt(stats.P99.Microseconds(), 10),
+			strconv.FormatInt(stats.Max.Microseconds(), 10)})
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	if *report == "" {
+		return nil
+	}
+	return syncdrill_report(*report, rows)
+}
+
+func find_sync_primitive(primitives []sync_primitive, name string) (sync_primitive, bool) {
+	for _, p := range primitives {
+		if strings.EqualFold(p.name, name) {
+			return p, true
+		}
+	}
+	return sync_primitive{}, false
+}
+
+// syncdrill_run appends size bytes and syncs, `syncs` times, timing the syncs
+// into the same histogram the WAL uses for its fsyncs
+func syncdrill_run(path string, p sync_primitive, syncs int, size int) (WALStats, error) {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return WALStats{}, err
+	}
+	defer os.Remove(path)
+	defer fd.Close()
+
+	block := []byte(strings.Repeat("s", size))
+	var latency latency_histogram
+	for i := 0; i < syncs; i++ {
+		if _, err := fd.Write(block); err != nil {
+			return WALStats{}, err
+		}
+		start := time.Now()
+		if err := p.sync(fd); err != nil {
+			return WALStats{}, err
+		}
+		latency.observe(time.Since(start))
+	}
+	return latency.stats(), nil
+}
+
+// syncdrill_report appends rows to a CSV file, with the header if the file is new
+func syncdrill_report(path string, rows [][]string) error {
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	out := csv.NewWriter(fd)
+	if info.Size() == 0 {
+		out.Write(syncdrill_header)
+	}
+	out.WriteAll(rows)
+	if err := out.Error(); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
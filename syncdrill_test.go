@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// the syncdrill subcommand, see syncdrill.go
+
+// every primitive the platform has gets a row, durable or not, and -csv appends the
+// results under one header
+func TestSyncDrill(t *testing.T) {
+	dir := t.TempDir()
+	report := filepath.Join(dir, "sync.csv")
+	args := []string{"-syncs", "20", "-size", "512", "-dir", dir, "-csv", report}
+	for range 2 {
+		var err error
+		out := stdout(t, func() { err = run_syncdrill(args) })
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range append([]sync_primitive{syncdrill_none}, sync_primitives...) {
+			if !strings.Contains(out, "\n"+p.name+" ") {
+				t.Errorf("no row for %s:\n%s", p.name, out)
+			}
+		}
+		if strings.Contains(out, "failed") {
+			t.Errorf("a primitive failed:\n%s", out)
+		}
+	}
+
+	fd, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	rows, err := csv.NewReader(fd).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 1 + 2*(1+len(sync_primitives)); len(rows) != want || !slices.Equal(rows[0], syncdrill_header) {
+		t.Fatalf("%d rows, want %d, header %v", len(rows), want, rows[0])
+	}
+	for _, row := range rows[1:] {
+		if row[0] != runtime.GOOS || row[4] != "20" {
+			t.Errorf("row %v", row)
+		}
+	}
+	//the test files are gone, only the report is left
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the drill's dir", len(files))
+	}
+}
+
+// -primitives picks some by name, any case, and one the platform doesn't have fails
+func TestSyncDrillPrimitives(t *testing.T) {
+	var err error
+	out := stdout(t, func() { err = run_syncdrill([]string{"-syncs", "5", "-primitives", "NONE", "-dir", t.TempDir()}) })
+	if err != nil || !strings.Contains(out, "\nnone ") || strings.Contains(out, "\n"+sync_primitives[0].name+" ") {
+		t.Errorf("-primitives NONE: %v\n%s", err, out)
+	}
+	for _, args := range [][]string{{"-primitives", "none,F_NOSYNC"}, {"-syncs", "0"}, {"-size", "-1"}} {
+		stdout(t, func() { err = run_syncdrill(args) })
+		if err == nil {
+			t.Errorf("syncdrill %v", args)
+		}
+	}
+}
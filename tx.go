@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// transactions: a Tx buffers Sets and Deletes and Commit applies them all or none.
+// they are logged as one batch, BEGIN <n>, the n records, COMMIT, written in a
+// single append behind a single fsync (one group commit batch with GroupCommit),
+// and applied to the map under the same lock acquisition, so readers never see half of one
+//
+// a crash halfway through writing the batch leaves a BEGIN without its COMMIT at the
+// end of the log. replay buffers a transaction's records until its COMMIT and drops
+// them if it never comes, and recovery logs a ROLLBACK after such a leftover so the
+// writes that follow it aren't taken for the rest of that transaction
+//
+// a Tx doesn't read, so on its own there is nothing to conflict with. reads the caller
+// makes around it can be guarded with Watch, optimistically: see watch.go
+
+// Tx is a batch of writes that commit together, from Store.Begin
+type Tx struct {
+	s       *Store
+	ops     []tx_op
+	watches map[key]tx_watch // see Watch
+	done    bool
+}
+
+type tx_op struct {
+	op  operation_type // SET or DELETE
+	k   key
+	v   string
+	ttl time.Duration
+}
+
+var errTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Begin starts a transaction, nothing is written until Commit
+func (s *Store) Begin() *Tx {
+	return &Tx{s: s}
+}
+
+// Set queues a Set of k
+func (tx *Tx) Set(k key, ttl time.Duration, v string) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.ops = append(tx.ops, tx_op{op: SET, k: k, v: v, ttl: ttl})
+	return nil
+}
+
+// Delete queues a Delete of k
+func (tx *Tx) Delete(k key) error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.ops = append(tx.ops, tx_op{op: DELETE, k: k})
+	return nil
+}
+
+// Rollback throws the queued writes away
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.ops = nil
+	if len(tx.watches) > 0 {
+		tx.s.lock.Lock()
+		tx.unwatch()
+		tx.s.lock.Unlock()
+	}
+}
+
+// Commit writes the queued writes as one atomic WAL batch and applies them
+// a frozen key or a value that fails validation fails the whole transaction
+// before anything is written. the memory cap makes room for the whole transaction
+// at once, what its keys will hold less what they hold now, evictions are logged on
+// their own, ahead of the batch
+// if a watched key changed it fails with errTxConflict and nothing is written
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return errTxDone
+	}
+	tx.done = true
+	if len(tx.ops) == 0 && len(tx.watches) == 0 {
+		return nil
+	}
+	s := tx.s
+
+	ops := make([]tx_op, len(tx.ops))
+	for i, op := range tx.ops {
+		op.k = s.encode_key(op.k)
+		ops[i] = op
+	}
+
+	s.lock.Lock()
+	changed := tx.watched_changed()
+	tx.unwatch()
+	if changed {
+		s.lock.Unlock()
+		return errTxConflict
+	}
+	if len(ops) == 0 {
+		s.lock.Unlock()
+		return nil
+	}
+	for _, op := range ops {
+		if err := s.check_frozen(op.k); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		if op.op != SET {
+			continue
+		}
+		if err := s.validate(op.k, op.v); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	if err := s.make_room_for_tx(ops); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+
+	now := time.Now()
+	live := make(map[key]bool) // keys this transaction set (true) or deleted (false) so far
+	records := make([]wal_record, 0, len(ops)+2)
+	records = append(records, wal_record{lsn: s.next_lsn(), op: BEGIN, value: strconv.Itoa(len(ops))})
+	for _, op := range ops {
+		rec := wal_record{lsn: s.next_lsn(), op: op.op, key: op.k.name, db: op.k.db, value: op.v}
+		switch op.op {
+		case SET:
+			if op.ttl != 0 {
+				rec.expires_at = now.Add(op.ttl)
+			}
+			live[op.k] = true
+		case DELETE:
+			//a delete keeps a tombstone if there is something live to keep, which
+			//for a key set earlier in this transaction purge_time can't see yet
+			if set, ok := live[op.k]; ok {
+				if set && s.soft_delete > 0 {
+					rec.expires_at = now.Add(s.soft_delete)
+				}
+			} else {
+				rec.expires_at = s.purge_time(op.k)
+			}
+			live[op.k] = false
+		}
+		records = append(records, rec)
+	}
+	records = append(records, wal_record{lsn: s.next_lsn(), op: COMMIT})
+
+	ack, err := s.log_batch(records)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	//applied the way replay applies them, so both end up in the same place,
+	//with Get kept out until all of them are
+	s.data.lock_all()
+	for _, rec := range records[1 : len(records)-1] {
+		old, _ := s.data.get(key{name: rec.key, db: rec.db})
+		if err := s.replayEntry(rec); err != nil {
+			s.data.unlock_all()
+			s.lock.Unlock()
+			return err
+		}
+		if rec.op == SET && old.access != nil {
+			old.access.touch()
+		}
+	}
+	s.data.unlock_all()
+	for _, rec := range records {
+		s.announce(rec)
+	}
+	s.lock.Unlock()
+	for _, op := range ops {
+		if op.op == SET {
+			s.counters.sets.Add(1)
+		} else {
+			s.counters.deletes.Add(1)
+		}
+	}
+	if err := s.wait(ack); err != nil {
+		return err
+	}
+	//write-through sees the writes once they are durable, like Set's and Delete's
+	for _, op := range ops {
+		if err := s.write_through(op.op.String(), op.k, op.v, op.ttl); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// make_room_for_tx is make_room for a transaction: its keys as the last of ops leaves
+// them, against what they hold now, none of them evicted
+// Caller must hold s.lock
+func (s *Store) make_room_for_tx(ops []tx_op) error {
+	if s.max_memory <= 0 {
+		return nil
+	}
+	sizes := make(map[key]int64) // what each key ends up taking, 0 deleted
+	for _, op := range ops {
+		sizes[op.k] = 0
+		if op.op == SET {
+			sizes[op.k] = entry_size(op.k, value{data: op.v})
+		}
+	}
+	var total, growth int64
+	keep := make([]key, 0, len(sizes))
+	for k, size := range sizes {
+		total += size
+		growth += size
+		if old, exists := s.data.get(k); exists {
+			growth -= entry_size(k, old)
+		}
+		keep = append(keep, k)
+	}
+	kind := "transaction of " + strconv.Itoa(len(sizes)) + " keys"
+	if total > s.max_memory {
+		return &ResourceLimitError{Resource: "bytes of memory", Kind: kind, Limit: int(s.max_memory)}
+	}
+	return s.evict_for(growth, kind, keep)
+}
+
+// log_batch is log_write for records that have to land together
+// caller must hold s.lock
+func (s *Store) log_batch(records []wal_record) (<-chan error, error) {
+	store_writes_total.Add(uint64(len(records)))
+	ack := acked(nil)
+	if s.persistence.logs() {
+		now := time.Now()
+		for i := range records {
+			records[i].at = now
+			s.keep_undo(records[i])
+		}
+		var err error
+		if ack, err = s.wal.append_batch(records); err != nil {
+			s.drop_undo(records)
+			return nil, err
+		}
+	}
+	return ack, nil
+}
+
+// tx_buffer holds back the records of a transaction being replayed until its COMMIT
+// every record goes through feed with a func that applies it; outside a transaction
+// that runs straight away, inside one it runs once the COMMIT shows up
+type tx_buffer struct {
+	open      bool
+	want      int
+	pending   []func() error
+	discarded int // transactions that never committed
+}
+
+func (t *tx_buffer) feed(op operation_type, value string, apply func() error) error {
+	switch op {
+	case BEGIN:
+		//a BEGIN while one is open means the open one was cut off
+		t.end()
+		want, err := strconv.Atoi(value)
+		if err != nil || want < 0 {
+			return errors.New("invalid record count in BEGIN: " + value)
+		}
+		t.open, t.want = true, want
+		return nil
+	case COMMIT:
+		if !t.open {
+			return nil
+		}
+		if len(t.pending) != t.want {
+			t.end()
+			return nil
+		}
+		pending := t.pending
+		t.open, t.pending = false, nil
+		for _, apply := range pending {
+			if err := apply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ROLLBACK:
+		t.end()
+		return nil
+	}
+
+	if !t.open {
+		return apply()
+	}
+	if len(t.pending) == t.want {
+		//more records than the BEGIN announced: the COMMIT never came and
+		//this one was written after the transaction, not as part of it
+		t.end()
+		return apply()
+	}
+	t.pending = append(t.pending, apply)
+	return nil
+}
+
+// end drops the open transaction, if there is one, and says whether there was
+func (t *tx_buffer) end() bool {
+	if !t.open {
+		return false
+	}
+	t.open, t.pending = false, nil
+	t.discarded++
+	return true
+}
+
+// roll_back_open_tx logs a ROLLBACK when replay ended inside a transaction, so the
+// records written from now on aren't read as the rest of it next time
+// Caller must hold s.lock
+func (s *Store) roll_back_open_tx(txs *tx_buffer) error {
+	if !txs.end() {
+		return nil
+	}
+	log.Println("WARNING: the WAL ends in a transaction that never committed, it was not applied")
+	ack, err := s.log_write(wal_record{lsn: s.next_lsn(), op: ROLLBACK})
+	if err != nil {
+		return err
+	}
+	return <-ack
+}
+
+// shell transactions: MULTI starts one, SET and DELETE are queued until EXEC or DISCARD
+func (s *Store) process_multi(cmd string, input_parts []string) (bool, error) {
+	switch cmd {
+	case "MULTI":
+		if s.multi != nil {
+			return true, errors.New("MULTI calls can not be nested")
+		}
+		s.multi, s.watch = s.watch, nil
+		if s.multi == nil {
+			s.multi = s.Begin()
+		}
+		log.Println("Transaction started, SET and DELETE are queued until EXEC")
+		return true, nil
+	case "WATCH":
+		// WATCH key [key ...] before MULTI, EXEC fails if any of them changes meanwhile
+		if s.multi != nil {
+			return true, errors.New("WATCH inside MULTI is not allowed")
+		}
+		if len(input_parts) < 2 {
+			return true, errors.New("WATCH command requires at least one key")
+		}
+		if s.watch == nil {
+			s.watch = s.Begin()
+		}
+		keys := make([]key, 0, len(input_parts)-1)
+		for _, name := range input_parts[1:] {
+			keys = append(keys, s.shell_key(name))
+		}
+		log.Printf("Watching %d keys\n", len(keys))
+		return true, s.watch.Watch(keys...)
+	case "UNWATCH":
+		if s.watch != nil {
+			s.watch.Rollback()
+			s.watch = nil
+		}
+		return true, nil
+	case "EXEC", "DISCARD":
+		if s.multi == nil {
+			return true, errors.New(cmd + " without MULTI")
+		}
+		tx := s.multi
+		s.multi = nil
+		if cmd == "DISCARD" {
+			tx.Rollback()
+			log.Println("Transaction discarded")
+			return true, nil
+		}
+		n := len(tx.ops)
+		if err := tx.Commit(); err == errTxConflict {
+			return true, errors.New("transaction aborted, a watched key changed")
+		} else if err != nil {
+			return true, err
+		}
+		log.Printf("Transaction committed, %d writes\n", n)
+		return true, nil
+	}
+	if s.multi == nil || (cmd != "SET" && cmd != "DELETE") {
+		return false, nil
+	}
+
+	if cmd == "DELETE" {
+		if len(input_parts) != 2 {
+			return true, errors.New("DELETE command requires a key")
+		}
+		log.Printf("Queued DELETE %s\n", input_parts[1])
+		return true, s.multi.Delete(s.shell_key(input_parts[1]))
+	}
+	if len(input_parts) != 3 && len(input_parts) != 4 {
+		return true, errors.New("SET command requires at least a key and a value")
+	}
+	var ttl time.Duration
+	if len(input_parts) == 4 {
+		var err error
+		if ttl, err = parse_ttl(input_parts[3]); err != nil {
+			return true, err
+		}
+	}
+	log.Printf("Queued SET %s\n", input_parts[1])
+	return true, s.multi.Set(s.shell_key(input_parts[1]), ttl, input_parts[2])
+}
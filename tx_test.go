@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// a transaction makes room under MaxMemory for all of its SETs together, and one that
+// can't fit at all fails before it evicts anything
+func TestTxMaxMemory(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{MaxMemory: 2000, Persistence: PersistNone})
+	defer s.Close()
+	for i := 0; i < 10; i++ {
+		set(t, s, "old:"+strconv.Itoa(i), strings.Repeat("x", 50))
+	}
+
+	tx := s.Begin()
+	for i := 0; i < 6; i++ {
+		tx.Set(key{name: "new:" + strconv.Itoa(i)}, 0, strings.Repeat("y", 100))
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if used, max := s.Memory(); used > max {
+		t.Errorf("%d bytes used after the commit, the cap is %d", used, max)
+	}
+
+	keys := len(s.Keys(0, "*"))
+	tx = s.Begin()
+	for i := 0; i < 30; i++ {
+		tx.Set(key{name: "big:" + strconv.Itoa(i)}, 0, strings.Repeat("y", 100))
+	}
+	var limit *ResourceLimitError
+	if err := tx.Commit(); !errors.As(err, &limit) {
+		t.Fatalf("commit of more than the cap: %v, want a *ResourceLimitError", err)
+	}
+	if n := len(s.Keys(0, "*")); n != keys {
+		t.Errorf("%d keys after the failed commit, want %d: it evicted", n, keys)
+	}
+}
+
+// a transaction's writes are counted and written through like Set's and Delete's
+func TestTxCountsAndWritesThrough(t *testing.T) {
+	var written []string
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{OnWrite: func(e WriteEvent) error {
+		written = append(written, e.Op+" "+e.Key+" "+e.Value)
+		return nil
+	}})
+	defer s.Close()
+	set(t, s, "b", "1")
+	written = nil
+	before := s.Stats()
+
+	tx := s.Begin()
+	tx.Set(key{name: "a"}, 0, "1")
+	tx.Delete(key{name: "b"})
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	stats := s.Stats()
+	if stats.Sets != before.Sets+1 || stats.Deletes != before.Deletes+1 {
+		t.Errorf("sets %d, deletes %d after the transaction, want %d and %d", stats.Sets, stats.Deletes, before.Sets+1, before.Deletes+1)
+	}
+	if strings.Join(written, ", ") != "SET a 1, DELETE b " {
+		t.Errorf("written through: %q", written)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typed values: a key holds either a string (value.data) or an object, a hash
+// (hash.go), a list (list.go), a set (set.go) or a sorted set (zset.go), so a client
+// can change one field or push one element without rewriting the whole value
+//
+// every change to an object is logged as its own op with only what changed, HSET
+// with the fields it set, LPOP with how many elements it took, packed into the record's
+// value with encode_args. like APPEND they carry the expiry the key kept. snapshots
+// and COMPACT can't replay a history they no longer have, so they write each object
+// whole, as one RESTORE record
+//
+// string commands on an object fail with ErrWrongType (errors.go) and so do object commands on a
+// string or on another kind of object. SET replaces whatever is there, DELETE, EXPIRE,
+// TTL and the rest work on any key. an object whose last element goes is deleted, like Redis
+
+// object is a value that isn't a plain string
+type object interface {
+	kind() string                                 // what TYPE reports, "hash" ...
+	len() int                                     // fields, elements or members
+	size() int64                                  // estimated bytes, for the memory cap
+	members() []string                            // the whole object as args, what RESTORE rebuilds it from
+	apply(op operation_type, args []string) error // a logged change, live writes and replay both go through it
+}
+
+// bookkeeping per field or element, on top of its bytes
+const element_overhead = 48
+
+// object_tags is the byte a dumped object starts with, by kind
+var object_tags = map[string]byte{"hash": 'h', "list": 'l', "set": 's', "zset": 'z'}
+
+// object_ops is the kind of object each op changes
+var object_ops = map[operation_type]string{
+	HSET: "hash", HDEL: "hash",
+	LPUSH: "list", RPUSH: "list", LPOP: "list", RPOP: "list",
+	SADD: "set", SREM: "set",
+	ZADD: "zset", ZREM: "zset",
+}
+
+// shrinking_ops only ever remove from an object, they don't need room under the memory cap
+var shrinking_ops = map[operation_type]bool{HDEL: true, LPOP: true, RPOP: true, SREM: true, ZREM: true}
+
+func new_object(kind string) object {
+	switch kind {
+	case "hash":
+		return &hash_object{fields: make(map[string]string)}
+	case "list":
+		return new_list_object()
+	case "set":
+		return &set_object{items: make(map[string]struct{})}
+	case "zset":
+		return new_zset_object()
+	}
+	return nil
+}
+
+// encode_args packs strings into one record value: each is a uvarint length and its bytes
+func encode_args(args []string) string {
+	size := 0
+	for _, a := range args {
+		size += binary.MaxVarintLen64 + len(a)
+	}
+	buf := make([]byte, 0, size)
+	for _, a := range args {
+		buf = binary.AppendUvarint(buf, uint64(len(a)))
+		buf = append(buf, a...)
+	}
+	return string(buf)
+}
+
+func decode_args(v string) ([]string, error) {
+	buf := []byte(v)
+	var args []string
+	for len(buf) > 0 {
+		n, w := binary.Uvarint(buf)
+		if w <= 0 || n > uint64(len(buf)-w) {
+			return nil, errors.New("malformed arguments in record")
+		}
+		args = append(args, string(buf[w:w+int(n)]))
+		buf = buf[w+int(n):]
+	}
+	return args, nil
+}
+
+// describe_args is a record's packed arguments for people, see wal_record.String
+func describe_args(rec wal_record) string {
+	if rec.op == RESTORE {
+		obj, err := load_object(rec.value)
+		if err != nil {
+			return "(bad object)"
+		}
+		return "(" + obj.kind() + ", " + strconv.Itoa(obj.len()) + " elements)"
+	}
+	args, err := decode_args(rec.value)
+	if err != nil {
+		return "(bad arguments)"
+	}
+	return strings.Join(args, " ")
+}
+
+// dump_object is a RESTORE record's value: the kind's tag, then its members packed
+func dump_object(obj object) string {
+	return string(object_tags[obj.kind()]) + encode_args(obj.members())
+}
+
+func load_object(v string) (object, error) {
+	if v == "" {
+		return nil, errors.New("empty object in RESTORE record")
+	}
+	for kind, tag := range object_tags {
+		if tag != v[0] {
+			continue
+		}
+		args, err := decode_args(v[1:])
+		if err != nil {
+			return nil, err
+		}
+		obj := new_object(kind)
+		return obj, obj.apply(RESTORE, args)
+	}
+	return nil, errors.New("RESTORE record holds an unknown kind of object")
+}
+
+// value_record is the record that recreates v under k: a SET for a string, a RESTORE for an object
+func value_record(k key, v value) wal_record {
+	if v.obj != nil {
+		return wal_record{lsn: v.lsn, op: RESTORE, key: k.name, db: k.db, value: dump_object(v.obj), expires_at: v.expires_at}
+	}
+	return wal_record{lsn: v.lsn, op: SET, key: k.name, db: k.db, value: v.data, expires_at: v.expires_at}
+}
+
+// replay_object applies an object op or a RESTORE
+// Caller must hold s.lock
+func (s *Store) replay_object(rec wal_record) error {
+	k := key{name: rec.key, db: rec.db}
+	defer delete(s.tombstones, k)
+
+	if rec.op == RESTORE {
+		obj, err := load_object(rec.value)
+		if err != nil {
+			return err
+		}
+		s.put(k, value{obj: obj, expires_at: rec.expires_at, lsn: rec.lsn, gen: s.view_gen.Load()})
+		return nil
+	}
+	args, err := decode_args(rec.value)
+	if err != nil {
+		return err
+	}
+	kind := object_ops[rec.op]
+
+	//only logged after the type check passed, so a key holding something else
+	//(or nothing) here starts a new object
+	val, exists := s.data.get(k)
+	if !exists || val.obj == nil || val.obj.kind() != kind {
+		obj := new_object(kind)
+		if err := obj.apply(rec.op, args); err != nil {
+			return err
+		}
+		if obj.len() > 0 {
+			s.put(k, value{obj: obj, expires_at: rec.expires_at, lsn: rec.lsn, gen: s.view_gen.Load()})
+		}
+		return nil
+	}
+
+	//the object changes in place, the estimate has to catch up before put and drop use it
+	if err := s.own_object(k, &val); err != nil {
+		return err
+	}
+	before := entry_size(k, val)
+	err = val.obj.apply(rec.op, args)
+	s.memory += entry_size(k, val) - before
+	if err != nil {
+		return err
+	}
+	if val.obj.len() == 0 {
+		s.drop(k)
+		return nil
+	}
+	val.expires_at = rec.expires_at
+	val.lsn = rec.lsn
+	s.put(k, val)
+	return nil
+}
+
+// write_object is the write path of every object command: under the write lock it finds
+// k's object (nil if k is missing or expired, ErrWrongType if k holds anything else), lets
+// plan work out the args to log as op, then logs them and applies them the way replay does.
+// no args from plan means there is nothing to change and nothing is logged
+func (s *Store) write_object(k key, kind string, op operation_type, plan func(obj object) ([]string, error)) error {
+	k = s.encode_key(k)
+	s.lock.Lock()
+
+	if err := s.check_frozen(k); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	val, exists := s.data.get(k)
+	expired := exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at)
+	var obj object
+	if exists && !expired {
+		if val.obj == nil || val.obj.kind() != kind {
+			s.lock.Unlock()
+			return ErrWrongType
+		}
+		obj = val.obj
+	}
+	args, err := plan(obj)
+	if err != nil || len(args) == 0 {
+		s.lock.Unlock()
+		return err
+	}
+	if !shrinking_ops[op] {
+		if err := s.check_sizes(k, args...); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+
+	if !shrinking_ops[op] {
+		size := entry_size(k, value{obj: obj})
+		for _, a := range args {
+			size += int64(len(a)) + element_overhead
+		}
+		if err := s.make_room_for(k, size); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	if expired {
+		//replay must not add to the expired object, it goes first the way the sweeper would take it
+		del := wal_record{lsn: s.next_lsn(), op: DELETE, key: k.name, db: k.db}
+		if _, err := s.log_write(del); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		s.drop(k)
+		s.announce(del)
+		val = value{}
+	}
+
+	rec := wal_record{lsn: s.next_lsn(), op: op, key: k.name, db: k.db, value: encode_args(args), expires_at: val.expires_at}
+	ack, err := s.log_write(rec)
+	if err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	if err := s.replay_object(rec); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	if val.access != nil {
+		val.access.touch()
+	}
+	s.announce(rec)
+	s.lock.Unlock()
+
+	return s.wait(ack)
+}
+
+// read_object returns k's live object, nil if k is missing or expired
+// Caller must hold s.lock (a read lock will do), k is already encoded
+func (s *Store) read_object(k key, kind string) (object, error) {
+	val, exists := s.data.get(k)
+	if !exists {
+		return nil, nil
+	}
+	if !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		s.found_expired(k)
+		return nil, nil
+	}
+	if val.obj == nil || val.obj.kind() != kind {
+		return nil, ErrWrongType
+	}
+	if val.access != nil {
+		val.access.touch()
+	}
+	return val.obj, nil
+}
+
+// Type is what k holds: "string", "hash", "list", "set", "zset", or "none" if it is missing or expired
+func (s *Store) Type(k key) string {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	val, exists := s.data.get(k)
+	if !exists || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		return "none"
+	}
+	if val.obj != nil {
+		return val.obj.kind()
+	}
+	return "string"
+}
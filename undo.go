@@ -0,0 +1,150 @@
+package main
+
+import (
+	"log"
+	"sort"
+)
+
+// with group commit a write is in the map before its batch is on disk: it is applied
+// under the lock and the writer waits for the fsync after letting go of it. if the
+// batch fails, the write must not stay visible. so for every record still waiting on
+// its batch the store keeps what it replaced, the keys' values and tombstones from
+// before it, and a failed batch puts them back
+//
+// the committer stops taking records when a batch fails and fails everything queued
+// behind it unwritten (see group_commit.go), so the writes to undo are always the newest
+// ones, everything logged since the last batch that made it. undone newest first they
+// leave every key as that batch left it. the committer takes records again once they
+// are undone. objects are changed in place, so one that is kept to put back is shared
+// copy on write like a View's (see view.go)
+//
+// writers undo a failed batch before their write returns its error, the committer also
+// starts an undo for async mode where nobody waits, and a checkpoint or COMPACT does one
+// first so the snapshot or the rewritten log doesn't take in the failed writes
+
+// undo_entry is one key as it was before a write
+type undo_entry struct {
+	k        key
+	val      value
+	exists   bool
+	tomb     tombstone
+	has_tomb bool
+}
+
+// record_keys is the keys a record writes, none for the markers of a transaction
+func record_keys(rec wal_record) []key {
+	if rec.key == "" {
+		return nil
+	}
+	keys := []key{{name: rec.key, db: rec.db}}
+	if rec.op == RENAME || rec.op == COPY {
+		if dst, err := move_target(rec); err == nil {
+			keys = append(keys, dst)
+		}
+	}
+	return keys
+}
+
+// keep_undo remembers what rec's keys hold now, before rec is applied, until its batch
+// is durable. only group commit needs it, without it a write that fails isn't applied
+// Caller must hold s.lock
+func (s *Store) keep_undo(rec wal_record) {
+	keys := record_keys(rec)
+	if len(keys) == 0 || s.wal.committer == nil || !s.persistence.logs() {
+		return
+	}
+	entries := make([]undo_entry, len(keys))
+	shared := false
+	for i, k := range keys {
+		e := &entries[i]
+		e.k = k
+		e.val, e.exists = s.data.get(k)
+		e.tomb, e.has_tomb = s.tombstones[k]
+		shared = shared || e.val.obj != nil
+	}
+	if shared {
+		s.share()
+	}
+	s.undo_lock.Lock()
+	if s.undo == nil {
+		s.undo = make(map[uint64][]undo_entry)
+	}
+	s.undo[rec.lsn] = entries
+	s.undo_lock.Unlock()
+}
+
+// drop_undo forgets what the records replaced, they are durable or were never applied
+func (s *Store) drop_undo(records []wal_record) {
+	s.undo_lock.Lock()
+	defer s.undo_lock.Unlock()
+	for _, rec := range records {
+		delete(s.undo, rec.lsn)
+	}
+}
+
+// batch_done is the committer's done: a batch that made it drops its undo entries, one
+// that failed gets undone, by whoever takes the lock first (see above)
+func (s *Store) batch_done(records []wal_record, err error) {
+	if err == nil {
+		s.drop_undo(records)
+		return
+	}
+	s.undoing.Add(1)
+	s.wal.res.start("undo", func() {
+		defer s.undoing.Done()
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		//a batch Close flushed, there is no committer left to wait on
+		select {
+		case <-s.stop:
+		default:
+			s.undo_failed()
+		}
+	})
+}
+
+// undo_failed puts back what the writes of a failed batch, and every one queued after
+// it, replaced, and lets the committer take records again. nothing if no batch failed
+// Caller must hold s.lock for writing
+func (s *Store) undo_failed() {
+	if s.wal.committer == nil || s.wal.committer.failed() == nil {
+		return
+	}
+	//with the lock held nothing new gets queued, once this is through the queue is
+	//empty and only failed writes are left to undo
+	s.wal.wait_pending()
+
+	s.undo_lock.Lock()
+	undo := s.undo
+	s.undo = nil
+	s.undo_lock.Unlock()
+
+	//watchers have to see the keys change, the undone writes' LSNs may be what they saw
+	undone := s.next_lsn()
+	lsns := make([]uint64, 0, len(undo))
+	for lsn := range undo {
+		lsns = append(lsns, lsn)
+	}
+	sort.Slice(lsns, func(i, j int) bool { return lsns[i] > lsns[j] })
+	for _, lsn := range lsns {
+		for _, e := range undo[lsn] {
+			if e.exists {
+				s.put(e.k, e.val)
+			} else {
+				s.drop(e.k)
+			}
+			if e.has_tomb {
+				if s.tombstones == nil {
+					s.tombstones = make(map[key]tombstone)
+				}
+				s.tombstones[e.k] = e.tomb
+			} else {
+				delete(s.tombstones, e.k)
+			}
+			s.announce(wal_record{lsn: undone, op: ROLLBACK, key: e.k.name, db: e.k.db})
+		}
+	}
+	writes_undone_total.Add(uint64(len(lsns)))
+	log.Printf("WARNING: a group commit batch failed, %d writes that weren't durable were undone\n", len(lsns))
+	s.wal.committer.repair()
+}
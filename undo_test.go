@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errDiskFull = errors.New("disk full")
+
+// fail_wal makes every WAL write fail with err until it is called with nil
+func fail_wal(s *Store, err error) {
+	s.wal.wal_lock.Lock()
+	s.wal.key_err = err
+	s.wal.wal_lock.Unlock()
+}
+
+func get(t *testing.T, s *Store, name string) string {
+	t.Helper()
+	v, _ := s.Get(key{name: name})
+	return v
+}
+
+// a write whose group commit batch fails is gone by the time it returns its error
+func TestUndoFailedBatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{GroupCommit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "a", "1")
+	set(t, s, "gone", "1")
+	if _, err := s.HSet(key{name: "h"}, map[string]string{"f": "1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	fail_wal(s, errDiskFull)
+	if err := s.Set(key{name: "a"}, 0, "2"); !errors.Is(err, errDiskFull) {
+		t.Fatalf("set: %v, want %v", err, errDiskFull)
+	}
+	if err := s.Set(key{name: "new"}, 0, "1"); err == nil {
+		t.Fatal("set of a new key didn't fail")
+	}
+	if err := s.Delete(key{name: "gone"}); err == nil {
+		t.Fatal("delete didn't fail")
+	}
+	if _, err := s.HSet(key{name: "h"}, map[string]string{"f": "2"}); err == nil {
+		t.Fatal("hset didn't fail")
+	}
+	if v := get(t, s, "a"); v != "1" {
+		t.Errorf("a = %q after its SET failed, want 1", v)
+	}
+	if _, ok := s.Get(key{name: "new"}); ok {
+		t.Error("new exists after its SET failed")
+	}
+	if v := get(t, s, "gone"); v != "1" {
+		t.Errorf("gone = %q after its DELETE failed, want 1", v)
+	}
+	if v, _, _ := s.HGet(key{name: "h"}, "f"); v != "1" {
+		t.Errorf("h.f = %q after its HSET failed, want 1", v)
+	}
+
+	fail_wal(s, nil)
+	set(t, s, "a", "3")
+
+	//crash
+	s, _, err = Recover("", path, Options{GroupCommit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if v := get(t, s, "a"); v != "3" {
+		t.Errorf("a = %q after recovery, want 3", v)
+	}
+}
+
+// writers that land in the failed batch, or queue behind it, are all undone, whatever
+// order they wake up in, and the keys end up as the last batch that made it left them
+func TestUndoConcurrentWriters(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{GroupCommit: true})
+	defer s.Close()
+	const keys = 16
+	for i := 0; i < keys; i++ {
+		set(t, s, strconv.Itoa(i), "before")
+	}
+
+	fail_wal(s, errDiskFull)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				k := key{name: strconv.Itoa(i % keys)}
+				if i%3 == 0 {
+					s.Delete(k)
+				} else {
+					s.Set(k, 0, "after")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < keys; i++ {
+		if v := get(t, s, strconv.Itoa(i)); v != "before" {
+			t.Errorf("%d = %q, want before", i, v)
+		}
+	}
+	//put and drop kept the estimate, it adds up to what is in the map
+	var size int64
+	s.data.each(0, func(k key, val value) bool {
+		size += entry_size(k, val)
+		return true
+	})
+	if used, _ := s.Memory(); used != size {
+		t.Errorf("memory estimate %d, the map holds %d", used, size)
+	}
+}
+
+// undoing a failed batch is one of the store's goroutines, Close waits for it
+func TestUndoGoroutineCounted(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{GroupCommit: true})
+	fail_wal(s, errDiskFull)
+	if err := s.Set(key{name: "a"}, 0, "1"); err == nil {
+		t.Fatal("set didn't fail")
+	}
+	if err := s.Close(); err != nil && !errors.Is(err, errDiskFull) {
+		t.Fatal(err)
+	}
+	//it is counted out just after it is done
+	deadline := time.Now().Add(time.Second)
+	for s.Resources().Routines["undo"] != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d undo goroutines still running after Close", s.Resources().Routines["undo"])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
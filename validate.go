@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// values in a namespace (the key prefix before ':') can be made to pass a
+// validator before Set logs them, for when the store holds configuration
+// and a typo shouldn't make it to disk
+//
+// before that, every key and value is held to Options.MaxKeySize and MaxValueSize,
+// so one client can't fill the memory or write a WAL record nothing can read back
+// in one go. for a hash, list, set or sorted set each field, element or member is
+// a value of its own
+
+// Violation is one thing wrong with a value
+// Path points into the JSON document ("$" is the root, "$.servers[0].port" ...)
+type Violation struct {
+	Path    string
+	Message string
+}
+
+// ValidationError is what Set returns for a value its namespace's validator rejects
+type ValidationError struct {
+	Namespace  string
+	Key        string
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		problems[i] = v.Path + ": " + v.Message
+	}
+	return "invalid value for " + e.Key + " (namespace " + e.Namespace + "): " + strings.Join(problems, "; ")
+}
+
+// SizeLimitError is what a write returns for a key or value over its size limit
+type SizeLimitError struct {
+	What  string // "key" or "value"
+	Key   string // cut short if it is the key that's too long
+	Size  int
+	Limit int
+}
+
+func (e *SizeLimitError) Error() string {
+	k := e.Key
+	if len(k) > 64 {
+		k = k[:64] + "..."
+	}
+	return e.What + " of " + strconv.Itoa(e.Size) + " bytes is over the limit of " + strconv.Itoa(e.Limit) + " (key " + k + ")"
+}
+
+// check_sizes holds k and the values about to be written under it to the size limits
+func (s *Store) check_sizes(k key, values ...string) error {
+	if s.max_key_size > 0 && len(k.name) > s.max_key_size {
+		return &SizeLimitError{What: "key", Key: k.name, Size: len(k.name), Limit: s.max_key_size}
+	}
+	if s.max_value_size > 0 {
+		for _, v := range values {
+			if len(v) > s.max_value_size {
+				return &SizeLimitError{What: "value", Key: k.name, Size: len(v), Limit: s.max_value_size}
+			}
+		}
+	}
+	return nil
+}
+
+// ValueValidator checks a value, no violations means it is accepted
+type ValueValidator interface {
+	Validate(value string) []Violation
+}
+
+// JSONValues accepts any well formed JSON document
+type JSONValues struct{}
+
+func (JSONValues) Validate(value string) []Violation {
+	if !json.Valid([]byte(value)) {
+		return []Violation{{Path: "$", Message: "not valid JSON"}}
+	}
+	return nil
+}
+
+// SetValidator makes every Set in the namespace go through v, nil removes it
+func (s *Store) SetValidator(namespace string, v ValueValidator) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if v == nil {
+		delete(s.validators, namespace)
+		return
+	}
+	if s.validators == nil {
+		s.validators = make(map[string]ValueValidator)
+	}
+	s.validators[namespace] = v
+}
+
+// validate checks the size limits and runs the namespace's validator on a value about to be set
+// caller must hold s.lock
+func (s *Store) validate(k key, v string) error {
+	if err := s.check_sizes(k, v); err != nil {
+		return err
+	}
+	namespace := key_namespace(k.name)
+	validator, ok := s.validators[namespace]
+	if !ok || namespace == "" {
+		return nil
+	}
+	if violations := validator.Validate(v); len(violations) > 0 {
+		return &ValidationError{Namespace: namespace, Key: k.name, Violations: violations}
+	}
+	return nil
+}
+
+// JSONSchema validates values against a JSON Schema, the subset that covers
+// what config documents usually need:
+//
+//	type (string, number, integer, boolean, object, array, null, or a list of them)
+//	enum, required, properties, additionalProperties (false only), items,
+//	minLength, maxLength, minimum, maximum
+//
+// anything else in the schema is ignored
+type JSONSchema struct {
+	root *schema_node
+}
+
+type schema_node struct {
+	Types                []string
+	Enum                 []any
+	Required             []string
+	Properties           map[string]*schema_node
+	AdditionalProperties *bool
+	Items                *schema_node
+	MinLength            *int
+	MaxLength            *int
+	Minimum              *float64
+	Maximum              *float64
+}
+
+// the json form of a node, "type" can be a string or a list
+type raw_schema_node struct {
+	Type                 json.RawMessage             `json:"type"`
+	Enum                 []any                       `json:"enum"`
+	Required             []string                    `json:"required"`
+	Properties           map[string]*raw_schema_node `json:"properties"`
+	AdditionalProperties *bool                       `json:"additionalProperties"`
+	Items                *raw_schema_node            `json:"items"`
+	MinLength            *int                        `json:"minLength"`
+	MaxLength            *int                        `json:"maxLength"`
+	Minimum              *float64                    `json:"minimum"`
+	Maximum              *float64                    `json:"maximum"`
+}
+
+// NewJSONSchema parses a schema document
+func NewJSONSchema(schema string) (*JSONSchema, error) {
+	var raw raw_schema_node
+	if err := json.Unmarshal([]byte(schema), &raw); err != nil {
+		return nil, errors.New("invalid JSON schema: " + err.Error())
+	}
+	root, err := raw.compile()
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSchema{root: root}, nil
+}
+
+// LoadJSONSchema reads a schema from a file
+func LoadJSONSchema(path string) (*JSONSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSchema(string(data))
+}
+
+func (raw *raw_schema_node) compile() (*schema_node, error) {
+	node := &schema_node{
+		Enum:                 raw.Enum,
+		Required:             raw.Required,
+		AdditionalProperties: raw.AdditionalProperties,
+		MinLength:            raw.MinLength,
+		MaxLength:            raw.MaxLength,
+		Minimum:              raw.Minimum,
+		Maximum:              raw.Maximum,
+	}
+
+	if len(raw.Type) > 0 {
+		var one string
+		if err := json.Unmarshal(raw.Type, &one); err == nil {
+			node.Types = []string{one}
+		} else if err := json.Unmarshal(raw.Type, &node.Types); err != nil {
+			return nil, errors.New("invalid JSON schema: type must be a string or a list of strings")
+		}
+	}
+
+	for name, prop := range raw.Properties {
+		compiled, err := prop.compile()
+		if err != nil {
+			return nil, err
+		}
+		if node.Properties == nil {
+			node.Properties = make(map[string]*schema_node)
+		}
+		node.Properties[name] = compiled
+	}
+	if raw.Items != nil {
+		items, err := raw.Items.compile()
+		if err != nil {
+			return nil, err
+		}
+		node.Items = items
+	}
+	return node, nil
+}
+
+func (js *JSONSchema) Validate(value string) []Violation {
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil || decoder.More() {
+		return []Violation{{Path: "$", Message: "not valid JSON"}}
+	}
+	return js.root.check("$", doc, nil)
+}
+
+func (n *schema_node) check(path string, v any, violations []Violation) []Violation {
+	fail := func(format string, args ...any) {
+		violations = append(violations, Violation{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if len(n.Types) > 0 && !n.type_matches(v) {
+		fail("expected %s, got %s", strings.Join(n.Types, " or "), json_type(v))
+		return violations
+	}
+
+	if len(n.Enum) > 0 && !in_enum(v, n.Enum) {
+		fail("not one of the allowed values")
+	}
+
+	switch val := v.(type) {
+	case string:
+		length := utf8.RuneCountInString(val)
+		if n.MinLength != nil && length < *n.MinLength {
+			fail("shorter than %d characters", *n.MinLength)
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			fail("longer than %d characters", *n.MaxLength)
+		}
+
+	case json.Number:
+		f, _ := val.Float64()
+		if n.Minimum != nil && f < *n.Minimum {
+			fail("less than %v", *n.Minimum)
+		}
+		if n.Maximum != nil && f > *n.Maximum {
+			fail("greater than %v", *n.Maximum)
+		}
+
+	case map[string]any:
+		for _, name := range n.Required {
+			if _, ok := val[name]; !ok {
+				fail("missing required property %q", name)
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, ok := n.Properties[name]
+			if !ok {
+				if n.AdditionalProperties != nil && !*n.AdditionalProperties {
+					fail("unexpected property %q", name)
+				}
+				continue
+			}
+			violations = prop.check(path+"."+name, val[name], violations)
+		}
+
+	case []any:
+		if n.Items != nil {
+			for i, item := range val {
+				violations = n.Items.check(fmt.Sprintf("%s[%d]", path, i), item, violations)
+			}
+		}
+	}
+	return violations
+}
+
+func (n *schema_node) type_matches(v any) bool {
+	actual := json_type(v)
+	for _, t := range n.Types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+// json_type names a decoded value the way JSON Schema does
+func json_type(v any) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := val.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	}
+	return "unknown"
+}
+
+// in_enum compares by canonical JSON, so 1 and 1.0 differ but key order doesn't matter
+func in_enum(v any, enum []any) bool {
+	encoded, _ := json.Marshal(v)
+	for _, allowed := range enum {
+		candidate, _ := json.Marshal(allowed)
+		if bytes.Equal(encoded, candidate) {
+			return true
+		}
+	}
+	return false
+}
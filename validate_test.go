@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// value validation and size limits, see validate.go
+
+// violations is "path: message" for each violation
+func violations(vs []Violation) []string {
+	var got []string
+	for _, v := range vs {
+		got = append(got, v.Path+": "+v.Message)
+	}
+	return got
+}
+
+// each keyword of the subset, with the paths of what fails it
+func TestJSONSchema(t *testing.T) {
+	schema, err := NewJSONSchema(`{
+		"type": "object",
+		"required": ["name", "port"],
+		"additionalProperties": false,
+		"properties": {
+			"name": {"type": "string", "minLength": 2, "maxLength": 8},
+			"port": {"type": "integer", "minimum": 1, "maximum": 65535},
+			"mode": {"enum": ["fast", "safe"]},
+			"tags": {"type": "array", "items": {"type": ["string", "null"]}}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, want := range map[string][]string{
+		`{"name": "api", "port": 8080, "mode": "safe", "tags": ["a", null]}`: nil,
+		`{"name": "a", "port": 0}`:                             {"$.name: shorter than 2 characters", "$.port: less than 1"},
+		`{"name": "a-long-name", "port": 1.5, "mode": "slow"}`: {"$.mode: not one of the allowed values", "$.name: longer than 8 characters", "$.port: expected integer, got number"},
+		`{"port": 80, "extra": 1, "tags": [1]}`:                {`$: missing required property "name"`, `$: unexpected property "extra"`, "$.tags[0]: expected string or null, got integer"},
+		`[1, 2]`:                                               {"$: expected object, got array"},
+		`{"name": "api"} {}`:                                   {"$: not valid JSON"},
+	} {
+		if got := violations(schema.Validate(doc)); !slices.Equal(got, want) {
+			t.Errorf("%s: %q, want %q", doc, got, want)
+		}
+	}
+	if _, err := NewJSONSchema(`{"type": 3}`); err == nil {
+		t.Error("a schema with a type that isn't a name")
+	}
+}
+
+// a namespace's validator turns away what it rejects before it is logged, other
+// namespaces take anything
+func TestValidators(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{Validators: map[string]ValueValidator{"config": JSONValues{}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	set(t, s, "config:a", `{"debug": true}`)
+	last := s.LastLSN()
+	var invalid *ValidationError
+	if err := s.Set(key{name: "config:a"}, 0, "{debug"); !errors.As(err, &invalid) || invalid.Namespace != "config" || invalid.Key != "config:a" {
+		t.Errorf("an invalid value: %v", err)
+	}
+	if get(t, s, "config:a") != `{"debug": true}` || s.LastLSN() != last {
+		t.Error("the invalid value was set or logged")
+	}
+	set(t, s, "other:a", "{debug")
+	set(t, s, "plain", "{debug")
+
+	schema, _ := NewJSONSchema(`{"type": "integer"}`)
+	s.SetValidator("port", schema)
+	if err := s.Set(key{name: "port:api"}, 0, `"80"`); !errors.As(err, &invalid) {
+		t.Errorf("a string where the schema wants an integer: %v", err)
+	}
+	set(t, s, "port:api", "80")
+	s.SetValidator("port", nil)
+	set(t, s, "port:api", `"80"`)
+}
+
+// a key or value over its limit is turned away with a *SizeLimitError and nothing
+// logged, whichever command writes it, and one at the limit goes in
+func TestSizeLimits(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{MaxKeySize: 8, MaxValueSize: 16})
+	defer s.Close()
+	set(t, s, "12345678", strings.Repeat("v", 16))
+	set(t, s, "a", "0123456789")
+	last := s.LastLSN()
+
+	too_big := func(what string, err error) {
+		t.Helper()
+		var limit *SizeLimitError
+		if !errors.As(err, &limit) || limit.What != what {
+			t.Errorf("%v, want a %s over its limit", err, what)
+		}
+	}
+	too_big("key", s.Set(key{name: "123456789"}, 0, "v"))
+	too_big("value", s.Set(key{name: "b"}, 0, strings.Repeat("v", 17)))
+	_, err := s.Append(key{name: "a"}, "0123456")
+	too_big("value", err)
+	_, err = s.HSet(key{name: "h"}, map[string]string{"f": strings.Repeat("v", 17)})
+	too_big("value", err)
+	_, err = s.RPush(key{name: "a-long-list"}, "x")
+	too_big("key", err)
+	too_big("key", s.Rename(key{name: "a"}, key{name: "a-long-name"}))
+	tx := s.Begin()
+	tx.Set(key{name: "c"}, 0, strings.Repeat("v", 17))
+	too_big("value", tx.Commit())
+	if s.LastLSN() != last || get(t, s, "a") != "0123456789" {
+		t.Errorf("%d records logged, a=%s", s.LastLSN()-last, get(t, s, "a"))
+	}
+
+	err = s.Set(key{name: strings.Repeat("k", 100)}, 0, "v")
+	if msg := err.Error(); !strings.Contains(msg, "key of 100 bytes is over the limit of 8") || !strings.HasSuffix(msg, "(key "+strings.Repeat("k", 64)+"...)") {
+		t.Errorf("error %q", msg)
+	}
+}
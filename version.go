@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+)
+
+// every key has a version, the LSN of the last write to it (value.lsn): it goes up
+// with every write to the key, SETs, EXPIREs, HSETs and the rest, and as LSNs are only
+// handed out once a key deleted and written again comes back with a higher one. it
+// is kept through restarts, snapshots and checkpoints log it with the value
+//
+// GetWithVersion reads it alongside the value and CompareVersionAndSet writes only if
+// it hasn't moved, a CAS that doesn't care what the value is, only that nobody has
+// written it since. WATCH compares the same versions, and the WAL reader and CDC
+// export carry them as each change's LSN
+
+// GetWithVersion is Get that also returns k's version, see above
+func (s *Store) GetWithVersion(k key) (string, uint64, bool) {
+	store_reads_total.Inc()
+	k = s.encode_key(k)
+	//only k's shard is locked, like Get
+	val, exists := s.data.load(k)
+	if exists && !val.expires_at.IsZero() && time.Now().After(val.expires_at) {
+		s.found_expired(k)
+		exists = false
+	}
+	if !exists || val.obj != nil {
+		s.counters.hit("", false)
+		return "", 0, false
+	}
+	if val.access != nil {
+		val.access.touch()
+	}
+	s.counters.hit(val.data, true)
+	return val.data, val.lsn, true
+}
+
+// CompareVersionAndSet replaces k's value with v only if k's version is still version,
+// and reports whether it did. like CompareAndSet the key keeps its expiry, a missing or
+// expired key never matches and only a swap that happened is logged
+func (s *Store) CompareVersionAndSet(k key, version uint64, v string) (bool, error) {
+	return s.compare_and_set(k, func(val value) bool { return val.lsn == version }, v)
+}
+
+// GETV key prints the value and its version, CASV key version value sets it if the version still holds
+func (s *Store) process_version(cmd string, input_parts []string) error {
+	if cmd == "GETV" {
+		if len(input_parts) != 2 {
+			return errors.New("GETV command requires a key")
+		}
+		v, version, found := s.GetWithVersion(s.shell_key(input_parts[1]))
+		if !found {
+			if s.Type(s.shell_key(input_parts[1])) != "none" {
+				return ErrWrongType
+			}
+			return ErrKeyNotFound
+		}
+		log.Printf("Value for key %s: %s (version %d)\n", input_parts[1], v, version)
+		return nil
+	}
+
+	if len(input_parts) != 4 {
+		return errors.New("CASV command requires a key, the expected version and the new value")
+	}
+	version, err := strconv.ParseUint(input_parts[2], 10, 64)
+	if err != nil {
+		return errors.New("CASV version must be a number, as GETV prints it")
+	}
+	swapped, err := s.CompareVersionAndSet(s.shell_key(input_parts[1]), version, input_parts[3])
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return errors.New("key " + input_parts[1] + " is not at version " + input_parts[2])
+	}
+	log.Printf("Key %s set to %s\n", input_parts[1], input_parts[3])
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// key versions, see version.go
+
+// a key's version is the LSN of its last write, every kind of write moves it, and it
+// is the same after a restart and a checkpoint
+func TestVersions(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	version := func(name string) uint64 {
+		t.Helper()
+		_, v, _ := s.GetWithVersion(key{name: name})
+		return v
+	}
+	set(t, s, "a", "1")
+	set(t, s, "b", "1")
+	if v, version_a, ok := s.GetWithVersion(key{name: "a"}); v != "1" || version_a != 1 || !ok || version("b") != 2 {
+		t.Errorf("a=%s at version %d, b at %d", v, version_a, version("b"))
+	}
+	s.Expire(key{name: "a"}, time.Hour)
+	if version("a") != 3 {
+		t.Errorf("a at version %d after EXPIRE", version("a"))
+	}
+	s.Append(key{name: "a"}, "2")
+	s.Delete(key{name: "b"})
+	set(t, s, "b", "again")
+	if version("a") != 4 || version("b") != 6 {
+		t.Errorf("a at %d after APPEND, b at %d written again after a DELETE", version("a"), version("b"))
+	}
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	if _, v, ok := s.GetWithVersion(key{name: "h"}); v != 0 || ok {
+		t.Errorf("GetWithVersion of a hash: %d %v", v, ok)
+	}
+
+	for restart := range 2 {
+		s = reopen(t, s, path)
+		if version("a") != 4 || version("b") != 6 {
+			t.Errorf("restart %d: a at %d, b at %d", restart, version("a"), version("b"))
+		}
+		if _, err := s.Checkpoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Close()
+}
+
+// CompareVersionAndSet swaps only at the version it was given, keeps the expiry, and
+// only the swap is logged
+func TestCompareVersionAndSet(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{ExpireInterval: -1})
+	defer s.Close()
+	s.Set(key{name: "a"}, time.Hour, "1")
+	_, version, _ := s.GetWithVersion(key{name: "a"})
+	set(t, s, "other", "x")
+	last := s.LastLSN()
+	if ok, err := s.CompareVersionAndSet(key{name: "a"}, version+1, "stale"); ok || err != nil || s.LastLSN() != last {
+		t.Errorf("CASV at the wrong version: %v %v, %d records logged", ok, err, s.LastLSN()-last)
+	}
+	if ok, err := s.CompareVersionAndSet(key{name: "a"}, version, "2"); !ok || err != nil || get(t, s, "a") != "2" {
+		t.Errorf("CASV at the version: %v %v, a=%s", ok, err, get(t, s, "a"))
+	}
+	if _, ttl, _, _ := s.Ttl(key{name: "a"}); ttl <= 59*time.Minute {
+		t.Errorf("a has %v left after CASV", ttl)
+	}
+	if ok, _ := s.CompareVersionAndSet(key{name: "a"}, version, "3"); ok {
+		t.Error("CASV at a version a write has moved past")
+	}
+	if ok, _ := s.CompareVersionAndSet(key{name: "missing"}, 0, "x"); ok {
+		t.Error("CASV of a missing key")
+	}
+	s.Set(key{name: "gone"}, time.Millisecond, "x")
+	_, version, _ = s.GetWithVersion(key{name: "gone"})
+	time.Sleep(5 * time.Millisecond)
+	if ok, _ := s.CompareVersionAndSet(key{name: "gone"}, version, "x"); ok {
+		t.Error("CASV of an expired key")
+	}
+
+	_, version, _ = s.GetWithVersion(key{name: "a"})
+	if err := s.Process(strings.Fields("CASV a " + strconv.FormatUint(version, 10) + " 4")); err != nil || get(t, s, "a") != "4" {
+		t.Errorf("shell CASV: %v, a=%s", err, get(t, s, "a"))
+	}
+	for _, cmd := range []string{"CASV a 1 5", "CASV a one 5", "CASV a 1", "GETV missing", "GETV"} {
+		if err := s.Process(strings.Fields(cmd)); err == nil {
+			t.Errorf("%s", cmd)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// a View is the store frozen at one point in time, to read at leisure while writers
+// carry on: SaveSnapshot writes one to disk and queries scan one, where both used to
+// hold the read lock, and every writer up, for as long as they took
+//
+// taking a view copies the map under the read lock, the keys and value headers only:
+// strings are immutable and shared as they are. objects aren't, HSET and friends change
+// them in place, so they are copied on write instead. every View bumps s.view_gen and
+// every value remembers the generation its object was made in (value.gen). a write
+// to an object from before the last View may be changing one a View still reads, it
+// changes a copy (see own_object). a View needs no closing, the GC takes it when it
+// is no longer used and the copies stop as soon as each object has been copied once
+//
+// copying the map is O(keys) under the lock. a checkpoint, which holds writers up for
+// that, takes a frozen View instead: nothing is copied, the map's writes keep the value
+// they replace (shard_map.set and remove) while the View hasn't read the key's shard
+// yet, and the View reads each shard's live values with those kept ones in place of the
+// ones changed since. it is read once, with each, and thawed when the checkpoint is done
+
+// View is a consistent, read-only copy of the store, see View
+type View struct {
+	s          *Store
+	data       map[key]value // nil for the live map, see live_view, or a frozen one
+	frozen     *map_freeze   // see frozen_view
+	tombstones []wal_record
+	last_lsn   uint64
+}
+
+// View returns the store as it is now. it holds the read lock while it copies the
+// map, not for as long as the View is used
+func (s *Store) View() *View {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.view()
+}
+
+// Caller must hold s.lock (a read lock will do)
+func (s *Store) view() *View {
+	v := &View{s: s, data: make(map[key]value, s.data.len()), tombstones: s.tombstone_records(), last_lsn: s.last_lsn}
+	s.data.each(0, func(k key, val value) bool {
+		v.data[k] = val
+		return true
+	})
+	s.view_gen.Add(1)
+	return v
+}
+
+// view_db is View with only the keys of one database in it, for a reader that won't
+// look at the others, like a query's KVScan. it has no tombstones, it isn't for snapshots
+func (s *Store) view_db(db int) *View {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v := &View{s: s, data: make(map[key]value), last_lsn: s.last_lsn}
+	s.data.each(0, func(k key, val value) bool {
+		if k.db == db {
+			v.data[k] = val
+		}
+		return true
+	})
+	s.view_gen.Add(1)
+	return v
+}
+
+// live_view is a View of the map itself without the copy, for a caller that holds
+// s.lock for as long as it uses it
+func (s *Store) live_view() *View {
+	return &View{s: s, tombstones: s.tombstone_records(), last_lsn: s.last_lsn}
+}
+
+// frozen_view is a View of the map as it is now without the copy, see above. it is
+// read once, with each, and the map thawed after
+// Caller must hold s.lock for writing
+func (s *Store) frozen_view() *View {
+	f := &map_freeze{kept: make([]map[key]kept_value, len(s.data.shards)), passed: make([]bool, len(s.data.shards))}
+	s.data.freeze = f
+	s.share()
+	return &View{s: s, frozen: f, tombstones: s.tombstone_records(), last_lsn: s.last_lsn}
+}
+
+// thaw stops keeping values for a frozen View
+// Caller must hold s.lock for writing
+func (s *Store) thaw() {
+	s.data.freeze = nil
+}
+
+// map_freeze is what a frozen View needs of the map: the values the keys had when it
+// was taken, for the keys changed since in the shards it hasn't read yet
+type map_freeze struct {
+	lock   sync.Mutex
+	kept   []map[key]kept_value // by shard
+	passed []bool               // the shards each has read, nothing is kept for them any more
+}
+
+type kept_value struct {
+	val    value
+	exists bool
+}
+
+// keep notes what k in shard i held before a write changes it, the first time only
+func (f *map_freeze) keep(i int, k key, old value, exists bool) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.passed[i] {
+		return
+	}
+	if f.kept[i] == nil {
+		f.kept[i] = make(map[key]kept_value)
+	}
+	if _, ok := f.kept[i][k]; !ok {
+		f.kept[i][k] = kept_value{old, exists}
+	}
+}
+
+// each is View.each for a frozen View. every shard is copied under its read lock, a
+// writer to it waits that long, then handed out
+func (f *map_freeze) each(m *shard_map, fn func(k key, val value) bool) {
+	var live []kept_value
+	var keys []key
+	for i := range m.shards {
+		sh := &m.shards[i]
+		sh.lock.RLock()
+		f.lock.Lock()
+		kept := f.kept[i]
+		f.passed[i] = true
+		f.lock.Unlock()
+		//nothing else is kept for the shard from here, and nothing in it changes until RUnlock
+		keys, live = keys[:0], live[:0]
+		for k, val := range sh.data {
+			if _, changed := kept[k]; !changed {
+				keys = append(keys, k)
+				live = append(live, kept_value{val: val})
+			}
+		}
+		sh.lock.RUnlock()
+
+		for j, k := range keys {
+			if !fn(k, live[j].val) {
+				return
+			}
+		}
+		for k, old := range kept {
+			if old.exists && !fn(k, old.val) {
+				return
+			}
+		}
+	}
+}
+
+// share makes the objects in the map copy on write, for a caller that keeps reading
+// one after letting go of s.lock
+// Caller must hold s.lock (a read lock will do)
+func (s *Store) share() {
+	s.view_gen.Add(1)
+}
+
+// own_object gives k's val an object of its own to change in place: a copy, put in
+// the map straight away so put and drop count the right one, if a View may be reading
+// the one it has
+// Caller must hold s.lock for writing
+func (s *Store) own_object(k key, val *value) error {
+	gen := s.view_gen.Load()
+	if val.gen == gen {
+		return nil
+	}
+	obj, err := load_object(dump_object(val.obj))
+	if err != nil {
+		return err
+	}
+	val.obj, val.gen = obj, gen
+	s.data.set(k, *val)
+	return nil
+}
+
+// each calls fn with every key and value in the View until it returns false
+func (v *View) each(fn func(k key, val value) bool) {
+	if v.frozen != nil {
+		v.frozen.each(v.s.data, fn)
+		return
+	}
+	if v.data == nil {
+		v.s.data.each(0, fn)
+		return
+	}
+	for k, val := range v.data {
+		if !fn(k, val) {
+			return
+		}
+	}
+}
+
+func (v *View) get(k key) (value, bool) {
+	if v.data == nil {
+		return v.s.data.get(k)
+	}
+	val, exists := v.data[k]
+	return val, exists
+}
+
+// LastLSN is the LSN of the last write the View has
+func (v *View) LastLSN() uint64 {
+	return v.last_lsn
+}
+
+// Get is Store.Get as of when the View was taken, expiries as of now
+func (v *View) Get(k key) (string, bool) {
+	val, exists := v.get(v.s.encode_key(k))
+	if !exists || val.obj != nil || (!val.expires_at.IsZero() && time.Now().After(val.expires_at)) {
+		return "", false
+	}
+	return val.data, true
+}
+
+// Keys is Store.Keys as of when the View was taken
+func (v *View) Keys(db int, pattern string) []string {
+	now := time.Now()
+	var keys []string
+	v.each(func(k key, val value) bool {
+		if k.db == db && (val.expires_at.IsZero() || !now.After(val.expires_at)) && glob_match(pattern, k.name) {
+			keys = append(keys, k.name)
+		}
+		return true
+	})
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"maps"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+// Views, see view.go
+
+// view_state is every key in v and its value, an object's dumped
+func view_state(v *View) map[string]string {
+	state := map[string]string{}
+	v.each(func(k key, val value) bool {
+		if val.obj != nil {
+			state[k.name] = dump_object(val.obj)
+		} else {
+			state[k.name] = val.data
+		}
+		return true
+	})
+	return state
+}
+
+// a View keeps the store as it was while writes carry on, objects changed in place
+// included, and the store has the writes
+func TestView(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	set(t, s, "a", "1")
+	set(t, s, "b", "2")
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	s.RPush(key{name: "l"}, "x")
+	v := s.View()
+	before := view_state(v)
+
+	set(t, s, "a", "new")
+	s.Delete(key{name: "b"})
+	set(t, s, "c", "3")
+	s.HSet(key{name: "h"}, map[string]string{"f": "changed", "g": "w"})
+	s.RPush(key{name: "l"}, "y")
+	if got := view_state(v); !maps.Equal(got, before) {
+		t.Errorf("the View changed: %v, was %v", got, before)
+	}
+	if a, _ := v.Get(key{name: "a"}); a != "1" || v.LastLSN() != 4 {
+		t.Errorf("a=%s in the View, LastLSN %d", a, v.LastLSN())
+	}
+	if _, ok := v.Get(key{name: "h"}); ok {
+		t.Error("Get of a hash in the View")
+	}
+	if got := v.Keys(0, "*"); !slices.Equal(got, []string{"a", "b", "h", "l"}) {
+		t.Errorf("keys in the View: %v", got)
+	}
+	if all, _ := s.HGetAll(key{name: "h"}); !maps.Equal(all, map[string]string{"f": "changed", "g": "w"}) || get(t, s, "a") != "new" {
+		t.Errorf("the store has h %v, a=%s", all, get(t, s, "a"))
+	}
+	if got := s.View().Keys(0, "*"); !slices.Equal(got, []string{"a", "c", "h", "l"}) {
+		t.Errorf("keys in a new View: %v", got)
+	}
+}
+
+// a frozen View reads the map as it was when it was taken, without a copy, while
+// writers change the shards it hasn't got to yet
+func TestFrozenView(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for i := range 100 {
+		set(t, s, "k"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	s.HSet(key{name: "h"}, map[string]string{"f": "v"})
+	want := view_state(s.View())
+
+	s.lock.Lock()
+	v := s.frozen_view()
+	s.lock.Unlock()
+	for i := range 100 {
+		if i%2 == 0 {
+			s.Delete(key{name: "k" + strconv.Itoa(i)})
+		} else {
+			set(t, s, "k"+strconv.Itoa(i), "new")
+		}
+	}
+	set(t, s, "added", "v")
+	s.HSet(key{name: "h"}, map[string]string{"f": "changed"})
+	got := view_state(v)
+	s.lock.Lock()
+	s.thaw()
+	s.lock.Unlock()
+	if !maps.Equal(got, want) {
+		t.Errorf("the frozen View has %d keys, k1=%s, want %d", len(got), got["k1"], len(want))
+	}
+}
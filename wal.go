@@ -0,0 +1,1111 @@
+package main
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// segments are rolled over once they reach this size
+const default_wal_segment_size int64 = 64 << 20
+
+// the WAL is a sequence of segment files
+// segment 0 is the base filename itself (so logs written before segmenting
+// still replay), later segments get a zero padded sequence suffix:
+//
+//	kvs_wal.log, kvs_wal.log.000001, kvs_wal.log.000002, ...
+//
+// only the highest segment is ever appended to, the rest are sealed
+// so they can be archived or deleted without touching the active file
+
+// Durability decides when WAL writes are fsynced, like Redis appendfsync
+type Durability int
+
+const (
+	DurabilityAlways   Durability = iota // fsync before every write returns (default)
+	DurabilityEverySec                   // a background ticker fsyncs once per second
+	DurabilityNone                       // never fsync, the OS flushes when it likes
+)
+
+var durability_names = map[Durability]string{
+	DurabilityAlways:   "always",
+	DurabilityEverySec: "everysec",
+	DurabilityNone:     "none",
+}
+
+func (d Durability) String() string {
+	return durability_names[d]
+}
+
+// ParseDurability maps "always", "everysec" or "none" to a Durability
+func ParseDurability(name string) (Durability, error) {
+	for d, n := range durability_names {
+		if strings.EqualFold(n, name) {
+			return d, nil
+		}
+	}
+	return DurabilityAlways, errors.New("durability must be always, everysec or none")
+}
+
+type wal struct {
+	filename     string
+	segment_size int64
+	format       WALFormat
+	codec        wal_codec
+	aead         cipher.AEAD      // set when the WAL is encrypted
+	key_err      error            // a bad encryption key, reported by every read and write
+	committer    *group_committer // nil unless group commit is on
+	durability   Durability
+	dirty        bool   // written since the last fsync (everysec)
+	active       uint64 // sequence number of the segment being written
+
+	//the active segment stays open between writes,
+	//fd is nil until it is (re)opened by open_active
+	fd          *os.File
+	writer      *bufio.Writer
+	size        int64          // bytes of records (and header) in the active segment
+	allocated   int64          // size of the file, bigger than size when it ends in preallocated zero fill
+	rotate_next bool           // the active segment is in another format, the next write starts a new one
+	preallocate bool           // new segments are allocated up to segment_size up front
+	compress    bool           // sealed segments are gzipped in the background
+	direct      *direct_writer // set while the active segment is open with O_DIRECT
+	direct_io   bool           // the active segment is written with O_DIRECT, see wal_direct.go
+	buffers     *buffer_pool   // aligned buffers for the O_DIRECT writer, see aligned_pool.go
+	resync      bool           // recovery mode: skip damaged records in the middle of a segment, see wal_frame.go
+	damaged     int            // damaged stretches skipped so far
+
+	fsync_latency *latency_histogram // see wal_stats.go, shared with the stripes
+	res           *resources         // files and goroutines of the WAL and the store, see resources.go
+
+	//see wal_stripe.go, stripes is empty unless the WAL is striped
+	stripes      []*wal      // the logs in the other directories, in stripe order after this one
+	striped_from uint64      // first segment written across the stripes, the ones before are only in this one
+	shares       chan []byte // a stripe's share of a batch, for its writer goroutine
+	shared       chan error  // what writing the share returned
+
+	compressing sync.WaitGroup // background compressions still running
+
+	//see wal_index.go, the stripes aren't indexed
+	index      bool           // sealed segments get an index
+	index_keys bool           // with a key filter in it
+	indexing   sync.WaitGroup // indexes still being written
+
+	//see wal_archive.go, archive is nil unless Options.Archive is set
+	archive      ArchiveFunc
+	archive_next uint64        // first segment not archived yet
+	archive_wake chan struct{} // pokes the archiver when a segment is sealed
+	archiving    sync.WaitGroup
+	obsolete     uint64 // segments below this are covered by a snapshot or COMPACT, deleted once archived
+	start        uint64 // first segment replay reads, older ones are only kept for the archiver
+
+	stop chan struct{} // closed by close() to stop the everysec ticker
+	//why not using RWMutex here?
+	//because we want to allow only one writer at a time
+	//but multiple readers can read concurrently
+	//so a simple Mutex is sufficient
+	wal_lock sync.Mutex
+}
+
+func new_wal(filename string, opts Options) *wal {
+	res := &resources{max_files: opts.MaxOpenFiles, max_goroutines: opts.MaxGoroutines}
+	w := open_wal(filename, opts, res, &latency_histogram{})
+	w.index, w.index_keys = opts.IndexSegments || opts.IndexKeys, opts.IndexKeys
+	w.open_stripes(opts)
+
+	//if this fails the first write retries it and reports the error. a store that
+	//doesn't log leaves it to the first write after logging is turned on
+	if opts.Persistence.logs() {
+		w.open_active()
+	}
+
+	//async mode needs the flusher goroutine too, it is what drains the queue
+	if opts.GroupCommit || opts.AsyncWAL {
+		w.committer = new_group_committer(w, opts.GroupCommitTarget)
+	}
+	return w
+}
+
+// open_wal is new_wal for one log, the WAL's own or a stripe's, without opening the
+// active segment or starting group commit
+func open_wal(filename string, opts Options, res *resources, fsyncs *latency_histogram) *wal {
+	segment_size := opts.WALSegmentSize
+	if segment_size <= 0 {
+		segment_size = default_wal_segment_size
+	}
+	w := &wal{
+		filename:     filename,
+		segment_size: segment_size,
+		format:       opts.WALFormat,
+		codec:        codec_for(opts.WALFormat),
+		durability:   opts.Durability,
+		preallocate:  opts.PreallocateWAL,
+		compress:     opts.CompressSegments,
+		direct_io:    opts.DirectIO,
+		buffers:      new_buffer_pool(opts.DirectIOAlign, opts.HugePages),
+		resync:       opts.TruncateTornTail,
+		wal_lock:     sync.Mutex{},
+		stop:         make(chan struct{}),
+
+		res:           res,
+		fsync_latency: fsyncs,
+	}
+
+	//with a key every new segment is encrypted, whatever WALFormat says
+	if opts.EncryptionKey != nil {
+		w.aead, w.key_err = new_aead(opts.EncryptionKey)
+		w.format, w.codec = WALEncrypted, encrypted_codec{aead: w.aead}
+	}
+
+	//continue writing into the newest segment on disk
+	if segments, err := w.segments(); err == nil && len(segments) > 0 {
+		w.active = segments[len(segments)-1]
+	}
+	if manifest, err := read_manifest(w.manifest_path()); err == nil && manifest[manifest_start_segment] != "" {
+		w.start, _ = strconv.ParseUint(manifest[manifest_start_segment], 10, 64)
+		w.obsolete = w.start
+	}
+	if opts.Archive != nil {
+		w.start_archiver(opts.Archive)
+	}
+	if w.durability == DurabilityEverySec {
+		w.res.start("everysec fsync", func() { w.sync_every(time.Second) })
+	}
+	return w
+}
+
+type operation_type int
+
+const (
+	SET operation_type = iota
+	DELETE
+	EXPIRE
+	GETDEL // a DELETE that also returned the value
+	GETEX  // sets expires_at, zero means PERSIST
+	UNDELETE
+	BEGIN    // starts a transaction, value is how many records it holds, see tx.go
+	COMMIT   // the transaction's records are all there
+	ROLLBACK // the open transaction never committed, written by recovery
+	CAS      // a CompareAndSet that swapped, expires_at is the expiry the key kept
+	APPEND   // value is the suffix, only logged for a live key, expires_at is the expiry it kept
+	HSET     // value is the fields and their values packed with encode_args, see hash.go
+	HDEL     // value is the fields packed with encode_args
+	RESTORE  // value is a whole object (dump_object), written by snapshots and COMPACT, see types.go
+	LPUSH    // value is the elements packed with encode_args, see list.go
+	RPUSH    // the same, at the tail
+	LPOP     // value is how many elements were popped, packed with encode_args
+	RPOP     // the same, from the tail
+	SADD     // value is the members that were added, packed with encode_args, see set.go
+	SREM     // value is the members that were removed
+	ZADD     // value is score, member pairs packed with encode_args, see zset.go
+	ZREM     // value is the members that were removed
+	RENAME   // key moved to the key packed in value (name, db) with encode_args, see rename.go
+	COPY     // key copied to the key packed in value, the same way
+	STRIPE   // ends a stripe's share of a batch, lsn is the batch's last and value how many stripes it went to, see wal_stripe.go
+)
+
+var operation_names = map[operation_type]string{
+	SET:    "SET",
+	DELETE: "DELETE",
+	EXPIRE: "EXPIRE",
+	GETDEL: "GETDEL",
+	GETEX:  "GETEX",
+
+	UNDELETE: "UNDELETE",
+	BEGIN:    "BEGIN",
+	COMMIT:   "COMMIT",
+	ROLLBACK: "ROLLBACK",
+	CAS:      "CAS",
+	APPEND:   "APPEND",
+	HSET:     "HSET",
+	HDEL:     "HDEL",
+	RESTORE:  "RESTORE",
+	LPUSH:    "LPUSH",
+	RPUSH:    "RPUSH",
+	LPOP:     "LPOP",
+	RPOP:     "RPOP",
+	SADD:     "SADD",
+	SREM:     "SREM",
+	ZADD:     "ZADD",
+	ZREM:     "ZREM",
+	RENAME:   "RENAME",
+	COPY:     "COPY",
+	STRIPE:   "STRIPE",
+}
+
+func (op operation_type) String() string {
+	if name, ok := operation_names[op]; ok {
+		return name
+	}
+	return "UNKNOWN(" + strconv.Itoa(int(op)) + ")"
+}
+
+// wal_record is one logged operation, independent of the on-disk format
+// every record carries the store's LSN, which only goes up
+// SET and EXPIRE carry an absolute expiry so replaying them later can't extend a key's life,
+// ttl is only set in logs written before expiries were absolute
+// on DELETE and GETDEL expires_at is when a soft delete's tombstone is purged
+// at is when the write was logged, zero in records snapshots and COMPACT write
+type wal_record struct {
+	lsn        uint64 // 0 in records from before LSNs, see number_records
+	op         operation_type
+	key        string
+	db         int // the key's database, 0 in records from before there were several
+	value      string
+	ttl        time.Duration
+	expires_at time.Time
+	at         time.Time
+}
+
+func (r wal_record) String() string {
+	switch r.op {
+	case SET:
+		if !r.expires_at.IsZero() {
+			return "SET " + r.key + " " + r.value + " (expires " + format_time_into_readable_string(r.expires_at) + ")"
+		}
+		if r.ttl > 0 {
+			return "SET " + r.key + " " + r.value + " " + r.ttl.String()
+		}
+		return "SET " + r.key + " " + r.value
+	case EXPIRE:
+		if !r.expires_at.IsZero() {
+			return "EXPIRE " + r.key + " (expires " + format_time_into_readable_string(r.expires_at) + ")"
+		}
+		return "EXPIRE " + r.key + " " + r.ttl.String()
+	case GETEX:
+		if r.expires_at.IsZero() {
+			return "GETEX " + r.key + " PERSIST"
+		}
+		return "GETEX " + r.key + " (expires " + format_time_into_readable_string(r.expires_at) + ")"
+	case DELETE, GETDEL:
+		if !r.expires_at.IsZero() {
+			return r.op.String() + " " + r.key + " (restorable until " + format_time_into_readable_string(r.expires_at) + ")"
+		}
+		return r.op.String() + " " + r.key
+	case BEGIN:
+		return "BEGIN (" + r.value + " records)"
+	case COMMIT, ROLLBACK:
+		return r.op.String()
+	case STRIPE:
+		return "STRIPE (batch up to LSN " + strconv.FormatUint(r.lsn, 10) + " on " + r.value + " stripes)"
+	case HSET, HDEL, RESTORE, LPUSH, RPUSH, LPOP, RPOP, SADD, SREM, ZADD, ZREM:
+		if !r.expires_at.IsZero() {
+			return r.op.String() + " " + r.key + " " + describe_args(r) + " (expires " + format_time_into_readable_string(r.expires_at) + ")"
+		}
+		return r.op.String() + " " + r.key + " " + describe_args(r)
+	case RENAME, COPY:
+		dst, err := move_target(r)
+		if err != nil {
+			return r.op.String() + " " + r.key + " (bad target)"
+		}
+		return r.op.String() + " " + r.key + " to " + describe_key(dst)
+	case CAS, APPEND:
+		if !r.expires_at.IsZero() {
+			return r.op.String() + " " + r.key + " " + r.value + " (expires " + format_time_into_readable_string(r.expires_at) + ")"
+		}
+		return r.op.String() + " " + r.key + " " + r.value
+	default:
+		return r.op.String() + " " + r.key
+	}
+}
+
+func (w *wal) segment_path(seq uint64) string {
+	if seq == 0 {
+		return w.filename
+	}
+	return fmt.Sprintf("%s.%06d", w.filename, seq)
+}
+
+// segments lists the sequence numbers of the segments on disk, oldest first
+func (w *wal) segments() ([]uint64, error) {
+	var segments []uint64
+
+	if _, err := os.Stat(w.filename); err == nil {
+		segments = append(segments, 0)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	matches, err := filepath.Glob(w.filename + ".*")
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range matches {
+		suffix := strings.TrimPrefix(m, w.filename+".")
+		seq, err := strconv.ParseUint(suffix, 10, 64)
+		if err != nil || len(suffix) < 6 {
+			continue // not a segment (temp files etc.)
+		}
+		segments = append(segments, seq)
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+// for_each_record calls fn with every record, segment by segment
+// caller must hold whatever lock keeps the segments from changing
+func (w *wal) for_each_record(fn func(rec wal_record) error) error {
+	return w.for_each_record_from(0, fn)
+}
+
+// for_each_record_from is for_each_record skipping the segments before `from`
+func (w *wal) for_each_record_from(from uint64, fn func(rec wal_record) error) error {
+	return w.for_each_record_after(from, 0, fn)
+}
+
+// for_each_record_after is for_each_record_from for a caller that only wants the records
+// after LSN after: the segments whose index says they end at or before it are skipped and
+// the next one starts near it, see wal_index.go. fn can still get some at or before it
+func (w *wal) for_each_record_after(from uint64, after uint64, fn func(rec wal_record) error) error {
+	segments, err := w.segments_from(from)
+	if err != nil {
+		return err
+	}
+
+	for i, seq := range segments {
+		if w.striped(seq) {
+			if err := w.read_striped(seq, i == len(segments)-1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		var offset int64
+		if after > 0 {
+			if idx := w.segment_index(seq); idx != nil && idx.last <= after {
+				continue
+			} else if idx != nil {
+				offset = idx.offset_after(after)
+			}
+		}
+		if err := w.read_segment_at(seq, offset, fn); err != nil {
+			//a bad record with nothing after it, in the segment we were
+			//appending to, is a write that was cut short by a crash
+			var corrupt *corrupt_record_error
+			if errors.As(err, &corrupt) && corrupt.final && i == len(segments)-1 {
+				return &torn_tail_error{path: w.segment_path(seq), offset: corrupt.offset, err: corrupt.err}
+			}
+			return fmt.Errorf("%s: %w", w.segment_path(seq), err)
+		}
+	}
+	return nil
+}
+
+// segments_from lists the segments for_each_record_from reads, the stripes' included
+func (w *wal) segments_from(from uint64) ([]uint64, error) {
+	all, err := w.log_segments()
+	if err != nil {
+		return nil, err
+	}
+	from = max(from, w.start)
+	var segments []uint64
+	for _, seq := range all {
+		if seq >= from {
+			segments = append(segments, seq)
+		}
+	}
+	return segments, nil
+}
+
+// read_segment detects the segment's format from its header and decodes every record
+func (w *wal) read_segment(seq uint64, fn func(rec wal_record) error) error {
+	return w.read_segment_at(seq, 0, fn)
+}
+
+// read_segment_at is read_segment starting at the record at offset, see skip_to
+func (w *wal) read_segment_at(seq uint64, offset int64, fn func(rec wal_record) error) error {
+	if w.key_err != nil {
+		return w.key_err
+	}
+	file, err := w.res.open_file("segment", w.segment_path(seq), os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer w.res.close(file)
+
+	reader, err := segment_reader(file)
+	if err != nil {
+		return err
+	}
+	records := w.segment_records(seq, reader)
+	if err := skip_to(records, file, offset); err != nil {
+		return err
+	}
+	return read_records(records, fn)
+}
+
+// torn_tail_error is an invalid last record in the newest segment
+type torn_tail_error struct {
+	path   string
+	offset int64 // end of the last valid record
+	err    error
+}
+
+func (e *torn_tail_error) Error() string {
+	return fmt.Sprintf("%s: invalid record at offset %d at the end of the log: %v", e.path, e.offset, e.err)
+}
+
+func (e *torn_tail_error) Unwrap() error { return e.err }
+
+// truncate_torn_tail cuts the segment back to its last valid record
+func (w *wal) truncate_torn_tail(torn *torn_tail_error) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	//the torn segment is the active one (or a stripe's), reopen it after so the size is right
+	if err := w.close_active(); err != nil {
+		return err
+	}
+	if err := w.close_stripes(); err != nil {
+		return err
+	}
+
+	fd, err := w.res.open_file("segment", torn.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer w.res.close(fd)
+
+	if err := fd.Truncate(torn.offset); err != nil {
+		return err
+	}
+	if err := sync_file(fd); err != nil {
+		return err
+	}
+	//the next write opens it again
+	return nil
+}
+
+func (w *wal) log_op(rec wal_record) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	return w.write_records([]wal_record{rec})
+}
+
+// append logs rec and returns an ack channel that gets nil (or the write error) once it is durable
+// without group commit the record is already fsynced by the time append returns
+// with group commit it is only queued, callers should apply it and release
+// their locks before waiting so other writers can join the same batch
+func (w *wal) append(rec wal_record) (<-chan error, error) {
+	if w.committer == nil {
+		if err := w.log_op(rec); err != nil {
+			return nil, err
+		}
+		return acked(nil), nil
+	}
+	if err := w.committer.failed(); err != nil {
+		return nil, err
+	}
+	return w.committer.enqueue(rec), nil
+}
+
+// append_batch is append for records that have to land together: they go into
+// the active segment in one write behind one fsync, with group commit in one batch
+func (w *wal) append_batch(records []wal_record) (<-chan error, error) {
+	if w.committer == nil {
+		w.wal_lock.Lock()
+		err := w.write_records(records)
+		w.wal_lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return acked(nil), nil
+	}
+	if err := w.committer.failed(); err != nil {
+		return nil, err
+	}
+	return w.committer.enqueue_batch(records), nil
+}
+
+// acked is an ack channel that already has its result
+func acked(err error) <-chan error {
+	ack := make(chan error, 1)
+	ack <- err
+	return ack
+}
+
+// write_records appends a batch of records to the active segment with a single fsync
+// caller must hold w.wal_lock
+func (w *wal) write_records(records []wal_record) error {
+	for _, rec := range records {
+		if _, ok := operation_names[rec.op]; !ok {
+			return errors.New("unknown operation type")
+		}
+	}
+
+	if w.key_err != nil {
+		return w.key_err
+	}
+	if len(w.stripes) > 0 {
+		return w.write_striped(records)
+	}
+	if err := w.open_active(); err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		log_entry := w.codec.encode(rec)
+
+		//roll over to a fresh segment if this record would push us past the threshold
+		//an empty segment always takes the record, however big it is
+		if w.size > 0 && (w.rotate_next || w.size+int64(len(log_entry)) > w.segment_size) {
+			if err := w.rotate(); err != nil {
+				return err
+			}
+		}
+		if err := w.put(log_entry); err != nil {
+			return err
+		}
+	}
+	wal_records_total.Add(uint64(len(records)))
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		log.Printf("\nlogged operation to WAL: %s\n", rec)
+	}
+	return nil
+}
+
+// put appends encoded records to the active segment
+// caller must hold w.wal_lock
+func (w *wal) put(log_entry []byte) error {
+	//segments start with the codec's header so replay knows how to decode them
+	if w.size == 0 {
+		log_entry = append(append([]byte{}, w.codec.header()...), log_entry...)
+	}
+
+	n := 0
+	for n < len(log_entry) {
+		nn, err := w.writer.Write(log_entry[n:])
+		if err != nil {
+			return err
+		}
+		n += nn
+	}
+	w.size += int64(len(log_entry))
+	wal_bytes_total.Add(uint64(len(log_entry)))
+	return nil
+}
+
+// flush writes out what put buffered and fsyncs it, if the durability setting says so
+// caller must hold w.wal_lock
+func (w *wal) flush() error {
+	w.allocated = max(w.allocated, w.size)
+
+	err := w.writer.Flush()
+
+	if err != nil {
+		return err
+	}
+	//O_DIRECT pads the last block with zeros, close_active cuts them off
+	if w.direct != nil {
+		w.allocated = max(w.allocated, w.direct.end())
+	}
+
+	//everysec and none leave the fsync to the ticker / the OS
+	if w.durability != DurabilityAlways {
+		w.dirty = true
+	} else if err = w.sync_active(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// open_active opens the active segment for writing at the end of its records, if it isn't open already
+// caller must hold w.wal_lock (or be new_wal)
+func (w *wal) open_active() error {
+	if w.fd != nil {
+		return nil
+	}
+
+	//no O_APPEND: a preallocated segment is written over its zero fill, not after it
+	fd, err := w.res.open_file("wal", w.segment_path(w.active), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		w.res.close(fd)
+		return err
+	}
+
+	size := w.segment_end(fd, info.Size())
+	allocated := info.Size()
+	if w.preallocate && allocated < w.segment_size {
+		if err := preallocate(fd, allocated, w.segment_size); err != nil {
+			w.res.close(fd)
+			return err
+		}
+		allocated = w.segment_size
+	}
+	if _, err := fd.Seek(size, io.SeekStart); err != nil {
+		w.res.close(fd)
+		return err
+	}
+
+	//an existing segment keeps the format (and version) it was written in,
+	//so if the configured one differs the next write starts a fresh segment
+	w.rotate_next = size > 0 && !segment_matches(fd, w.format, w.codec)
+
+	w.fd = fd
+	w.writer = bufio.NewWriter(fd)
+	w.size = size
+	w.allocated = allocated
+
+	//the ordinary file was only needed to look at the segment
+	if w.direct_io {
+		path := w.segment_path(w.active)
+		direct_fd, err := w.res.open("wal", func() (*os.File, error) { return open_direct(path) })
+		var direct *direct_writer
+		if err == nil {
+			if direct, err = new_direct_writer(direct_fd, fd, size, w.buffers); err != nil {
+				w.res.close(direct_fd)
+			}
+		}
+		w.res.close(fd)
+		if err != nil {
+			w.fd, w.writer = nil, nil
+			return err
+		}
+		w.direct = direct
+		w.fd = direct.fd
+		w.writer = bufio.NewWriter(direct)
+	}
+	return nil
+}
+
+// segment_end finds where the records of a segment stop
+// that's the end of the file, unless the segment was preallocated and not
+// closed cleanly: then the records are followed by zero fill up to the end
+func (w *wal) segment_end(fd *os.File, size int64) int64 {
+	last := make([]byte, 1)
+	if size == 0 {
+		return 0
+	}
+	if _, err := fd.ReadAt(last, size-1); err != nil || last[0] != 0 {
+		return size
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(fd, 0, size))
+	records := w.segment_records(w.active, reader)
+	for {
+		_, offset, err := records.next()
+		if err == io.EOF {
+			return offset
+		}
+		//a torn record before the zero fill gets written over, like a torn tail gets truncated
+		var corrupt *corrupt_record_error
+		if errors.As(err, &corrupt) && corrupt.final {
+			return corrupt.offset
+		}
+		if err != nil {
+			return size
+		}
+	}
+}
+
+// preallocate grows a segment to size with zeros, so appends don't change the
+// file size and fsyncs don't have to write the inode every time
+// the file is fsynced once here so the allocation itself is durable
+func preallocate(fd *os.File, from int64, size int64) error {
+	if err := allocate(fd, from, size); err != nil {
+		if err := zero_fill(fd, from, size); err != nil {
+			return err
+		}
+	}
+	return sync_file(fd)
+}
+
+// zero_fill is the portable preallocate, it writes the zeros out
+func zero_fill(fd *os.File, from int64, size int64) error {
+	zeros := make([]byte, 1<<20)
+	for off := from; off < size; {
+		n := min(int64(len(zeros)), size-off)
+		if _, err := fd.WriteAt(zeros[:n], off); err != nil {
+			return err
+		}
+		off += n
+	}
+	return nil
+}
+
+// rotate seals the active segment and opens the next one
+// caller must hold w.wal_lock
+func (w *wal) rotate() error {
+	if err := w.close_active(); err != nil {
+		return err
+	}
+	if w.index {
+		w.index_sealed(w.active)
+	}
+	//the archiver compresses before it ships
+	if w.archive != nil {
+		defer w.wake_archiver()
+	} else if w.compress {
+		w.compress_sealed(w.active)
+	}
+	w.active++
+	wal_rotations_total.Inc()
+	if err := w.open_active(); err != nil {
+		return err
+	}
+	log.Printf("WAL rotated to segment %s\n", w.segment_path(w.active))
+	//the stripes always write the segment this one does
+	return w.follow()
+}
+
+// sync_active fdatasyncs the active segment
+// caller must hold w.wal_lock
+func (w *wal) sync_active() error {
+	start := time.Now()
+	err := sync_data(w.fd)
+	took := time.Since(start)
+	wal_fsyncs_total.Inc()
+	wal_fsync_seconds.Observe(took.Seconds())
+	w.fsync_latency.observe(took)
+	return err
+}
+
+// close_active flushes, fsyncs and closes the active segment
+// caller must hold w.wal_lock
+func (w *wal) close_active() error {
+	if w.fd == nil {
+		return nil
+	}
+	fd, writer, direct := w.fd, w.writer, w.direct
+	w.fd, w.writer, w.direct = nil, nil, nil
+
+	err := writer.Flush()
+	if direct != nil {
+		direct.release()
+	}
+	//a segment that is done with doesn't need its zero fill
+	if err == nil && w.allocated > w.size {
+		err = fd.Truncate(w.size)
+	}
+	if err == nil {
+		err = sync_file(fd)
+	}
+	if err != nil {
+		w.res.close(fd)
+		return err
+	}
+	w.dirty = false
+	return w.res.close(fd)
+}
+
+// close stops the background goroutines and closes the active segment
+// whatever is still queued for group commit is written first, and running
+// segment compressions are waited for
+func (w *wal) close() error {
+	if w.committer != nil {
+		w.committer.close()
+	}
+	close(w.stop)
+
+	w.wal_lock.Lock()
+	err := w.close_active()
+	w.wal_lock.Unlock()
+	w.buffers.release()
+	for _, stripe := range w.stripes {
+		close(stripe.shares)
+		if closed := stripe.close(); err == nil {
+			err = closed
+		}
+	}
+
+	//compressions and indexes take the lock to swap the file in, so wait outside it
+	w.compressing.Wait()
+	w.indexing.Wait()
+	w.archiving.Wait()
+	return err
+}
+
+// sync_every fsyncs the active segment on every tick if anything was written since the last one
+func (w *wal) sync_every(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		w.wal_lock.Lock()
+		if w.dirty && w.fd != nil {
+			if err := w.sync_active(); err != nil {
+				log.Printf("WAL background fsync failed: %v\n", err)
+			} else {
+				w.dirty = false
+			}
+		}
+		w.wal_lock.Unlock()
+	}
+}
+
+// wait_pending blocks until every record queued so far is on disk
+// a no-op without group commit
+func (w *wal) wait_pending() error {
+	if w.committer == nil {
+		return nil
+	}
+	return w.committer.barrier()
+}
+
+// rewrite replaces the whole log with `records` in one new segment
+// the segment is written to a temp file, fsynced and renamed into place,
+// and only then are the older segments removed, so a crash at any point
+// leaves either the old log or the new one on disk
+// before_cleanup (if not nil) runs once the new segment is in place and before
+// anything is removed, with the new segment's sequence number
+// caller must make sure no records are appended concurrently
+func (w *wal) rewrite(records []wal_record, before_cleanup func(seq uint64) error) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	if w.key_err != nil {
+		return w.key_err
+	}
+
+	old_segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+
+	seq := w.active + 1
+	//striped, the new segment is one batch: the records here and a marker in every
+	//stripe, so it only counts once each stripe has its file of it
+	if w.striped(seq) {
+		if records, err = w.rewrite_stripes(seq, records); err != nil {
+			return err
+		}
+	}
+	if err := w.write_segment(seq, records); err != nil {
+		return err
+	}
+
+	if err := w.close_active(); err != nil {
+		return err
+	}
+	w.active = seq
+	if err := w.open_active(); err != nil {
+		return err
+	}
+	if before_cleanup != nil {
+		if err := before_cleanup(seq); err != nil {
+			return err
+		}
+	}
+	if err := w.drop_segments(old_segments, seq); err != nil {
+		return err
+	}
+	for _, stripe := range w.stripes {
+		if err := stripe.replaced(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write_segment writes segment seq with nothing but records in it, through a temp file
+// caller must hold w.wal_lock
+func (w *wal) write_segment(seq uint64, records []wal_record) error {
+	path := w.segment_path(seq)
+	tmp := path + ".tmp"
+
+	fd, err := w.res.open_file("temp", tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(fd)
+	writer.Write(w.codec.header())
+	for _, rec := range records {
+		writer.Write(w.codec.encode(rec))
+	}
+	if err := writer.Flush(); err != nil {
+		w.res.close(fd)
+		return err
+	}
+	if err := sync_file(fd); err != nil {
+		w.res.close(fd)
+		return err
+	}
+	if err := w.res.close(fd); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return sync_dir(filepath.Dir(path))
+}
+
+// drop_segments removes the old segments a rewrite into seq replaced
+// segments the archiver hasn't shipped yet stay, but replay skips them from now on
+// caller must hold w.wal_lock
+func (w *wal) drop_segments(old_segments []uint64, seq uint64) error {
+	w.retire(seq)
+	kept := false
+	for _, old := range old_segments {
+		if old >= seq {
+			continue
+		}
+		if !w.can_remove(old) {
+			kept = true
+			continue
+		}
+		if err := w.remove_segment(old); err != nil {
+			return err
+		}
+	}
+	if kept {
+		w.start = seq
+		return update_manifest(w.manifest_path(), manifest_start_segment, strconv.FormatUint(seq, 10))
+	}
+	return nil
+}
+
+// seal closes the active segment and starts a new one, returning the new one's sequence
+// everything logged before seal is in segments below the returned number
+func (w *wal) seal() (uint64, error) {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	if w.key_err != nil {
+		return 0, w.key_err
+	}
+
+	if err := w.rotate(); err != nil {
+		return 0, err
+	}
+	return w.active, nil
+}
+
+// idle is seal for a store that isn't logging: there are no writes to start a new
+// segment for, so the active one is only closed, and stays where replay starts and
+// where the next write goes if logging is turned back on
+func (w *wal) idle() (uint64, error) {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	if err := w.close_active(); err != nil {
+		return 0, err
+	}
+	if err := w.close_stripes(); err != nil {
+		return 0, err
+	}
+	return w.active, nil
+}
+
+// remove_before deletes the segments older than seq,
+// the ones waiting for the archiver are left to it
+func (w *wal) remove_before(seq uint64) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	w.retire(seq)
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, old := range segments {
+		if old >= seq || !w.can_remove(old) {
+			break
+		}
+		if err := w.remove_segment(old); err != nil {
+			return err
+		}
+	}
+	for _, stripe := range w.stripes {
+		if err := stripe.remove_before(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove_segment deletes a segment, and its index before it so an index never outlives it
+func (w *wal) remove_segment(seq uint64) error {
+	path := w.segment_path(seq)
+	if err := os.Remove(index_path(path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// replace_file swaps path's contents with temp file + fsync + rename
+// so a crash leaves either the old or the new file, never half of one
+func replace_file(path string, data []byte) error {
+	tmp := path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := fd.Write(data); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := sync_file(fd); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// sync_dir fsyncs a directory so a rename inside it is durable
+func sync_dir(dir string) error {
+	if !can_sync_dir {
+		return nil
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return sync_file(fd)
+}
+
+func compute_crc(data string) string {
+	checksum := crc32.ChecksumIEEE([]byte(data))
+	return fmt.Sprintf("%08x", checksum)
+}
+
+func verify_crc(line string) (string, error) {
+	idx := strings.LastIndex(line, "|")
+	if idx == -1 {
+		return "", errors.New("no CRC found in line")
+	}
+
+	data := line[:idx]
+	crc_str := line[idx+1:]
+
+	computed_crc := compute_crc(data)
+
+	if computed_crc != crc_str {
+		return "", errors.New("CRC mismatch")
+	}
+
+	return data, nil
+}
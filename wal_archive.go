@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+)
+
+// with Options.Archive every sealed segment is handed to an ArchiveFunc by a
+// background goroutine, oldest first, one at a time. a segment that hasn't been
+// archived yet is never deleted: CHECKPOINT and COMPACT leave it on disk and
+// the archiver removes it once the ArchiveFunc says it's safe
+//
+// how far archiving got is kept in the manifest, a crash between a successful
+// archive and the manifest update ships that segment again on the next run
+
+// ArchiveFunc ships a sealed WAL segment somewhere safe (S3, another host...)
+// the file isn't written again, but with CompressSegments it is gzipped first
+// returning an error makes the archiver retry the same segment later
+type ArchiveFunc func(segmentPath string) error
+
+const (
+	manifest_archived      = "archived_segments" // every segment below this one has been archived
+	manifest_start_segment = "start_segment"     // replay skips the segments below this one (COMPACT kept them for the archiver)
+)
+
+// how long the archiver waits before retrying a segment that failed
+const archive_retry = 10 * time.Second
+
+// start_archiver picks up where the last run left off and starts the archiver goroutine
+func (w *wal) start_archiver(archive ArchiveFunc) {
+	w.archive = archive
+	w.archive_wake = make(chan struct{}, 1)
+	if manifest, err := read_manifest(w.manifest_path()); err == nil && manifest[manifest_archived] != "" {
+		w.archive_next, _ = strconv.ParseUint(manifest[manifest_archived], 10, 64)
+	}
+
+	w.archiving.Add(1)
+	w.res.start("archiver", w.archive_loop)
+	//segments sealed by the last run may still be waiting
+	w.wake_archiver()
+}
+
+func (w *wal) wake_archiver() {
+	select {
+	case w.archive_wake <- struct{}{}:
+	default:
+	}
+}
+
+func (w *wal) archive_loop() {
+	defer w.archiving.Done()
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.archive_wake:
+		case <-retry:
+		case <-w.stop:
+			return
+		}
+
+		retry = nil
+		if err := w.archive_sealed(); err != nil {
+			log.Printf("ERROR: WAL archiving: %v, retrying in %s\n", err, archive_retry)
+			retry = time.After(archive_retry)
+		}
+	}
+}
+
+// archive_sealed archives every sealed segment that hasn't been yet, in order
+// it stops at the first failure, later segments have to wait for it
+func (w *wal) archive_sealed() error {
+	w.wal_lock.Lock()
+	segments, err := w.segments()
+	active := w.active
+	w.wal_lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, seq := range segments {
+		if seq >= active {
+			break
+		}
+		if seq < w.archive_next {
+			continue
+		}
+
+		path := w.segment_path(seq)
+		if w.compress {
+			if err := w.compress_segment(seq); err != nil {
+				return fmt.Errorf("compressing %s: %w", path, err)
+			}
+		}
+		if err := w.archive(path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		if err := w.archived(seq); err != nil {
+			return err
+		}
+		wal_archived_total.Inc()
+		log.Printf("Archived WAL segment %s\n", path)
+	}
+	return nil
+}
+
+// archived records that seq made it out, and deletes it if nothing needs it anymore
+func (w *wal) archived(seq uint64) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	w.archive_next = seq + 1
+	if err := update_manifest(w.manifest_path(), manifest_archived, strconv.FormatUint(w.archive_next, 10)); err != nil {
+		return err
+	}
+	if seq < w.obsolete {
+		if err := w.remove_segment(seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// can_remove says if a segment nothing needs anymore can be deleted now
+// caller must hold w.wal_lock
+func (w *wal) can_remove(seq uint64) bool {
+	return w.archive == nil || seq < w.archive_next
+}
+
+// retire marks the segments below seq as no longer needed for replay
+// the ones still waiting for the archiver are deleted once they're archived
+// caller must hold w.wal_lock
+func (w *wal) retire(seq uint64) {
+	w.obsolete = max(w.obsolete, seq)
+	w.each_stripe(func(stripe *wal) error {
+		stripe.retire(seq)
+		return nil
+	})
+}
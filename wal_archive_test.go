@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the archiving hook, see wal_archive.go
+
+// archive is an ArchiveFunc that keeps a copy of what it's given, or fails while failing is set
+type archive struct {
+	lock    sync.Mutex
+	dir     string
+	shipped []string // base names, in the order they came
+	failing bool
+}
+
+func (a *archive) ship(path string) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.failing {
+		return errors.New("archive unreachable")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	a.shipped = append(a.shipped, filepath.Base(path))
+	return os.WriteFile(filepath.Join(a.dir, filepath.Base(path)), data, 0o644)
+}
+
+// wait_shipped waits until n segments have been archived
+func (a *archive) wait_shipped(t *testing.T, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a.lock.Lock()
+		shipped := slices.Clone(a.shipped)
+		a.lock.Unlock()
+		if len(shipped) >= n {
+			return shipped
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d segments archived, waited for %d", len(shipped), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// every sealed segment is shipped once, in order, and one a checkpoint doesn't need
+// anymore stays on disk until it has been
+func TestArchive(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	a := &archive{dir: t.TempDir(), failing: true}
+	opts := Options{WALSegmentSize: 1 << 10, Archive: a.ship}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 100)
+	for i := range 40 {
+		set(t, s, "k"+strconv.Itoa(i), value)
+	}
+	sealed := len(wal_segments(t, s)) - 1
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if segments := wal_segments(t, s); len(segments) < sealed {
+		t.Errorf("the checkpoint deleted segments the archiver hasn't shipped: %v", segments)
+	}
+
+	a.lock.Lock()
+	a.failing = false
+	a.lock.Unlock()
+	//a new segment sealed wakes the archiver before its retry does
+	for i := range 20 {
+		set(t, s, "more"+strconv.Itoa(i), value)
+	}
+	shipped := a.wait_shipped(t, len(wal_segments(t, s))-1)
+	if shipped[0] != "wal.log" || shipped[1] != "wal.log.000001" {
+		t.Errorf("shipped %v", shipped)
+	}
+	s.Close()
+
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("segment 0, archived and checkpointed, is still there: %v", err)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	seen := map[string]bool{}
+	for _, name := range a.shipped {
+		if seen[name] {
+			t.Errorf("%s shipped twice", name)
+		}
+		seen[name] = true
+	}
+}
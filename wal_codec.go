@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// WALFormat selects the codec new WAL records are written with
+// the codec of an existing segment is detected from its header when it is read,
+// so this only decides how new segments are written
+type WALFormat int
+
+const (
+	WALBinary    WALFormat = iota // length prefixed binary records (default)
+	WALText                       // the original `SET k v|crc` lines, kept for compatibility
+	WALEncrypted                  // binary records sealed with AES-GCM, picked by Options.EncryptionKey
+)
+
+// wal_codec is one on-disk encoding of WAL records
+// a codec's header is written at the start of each of its segments and is
+// how replay tells the codecs apart, the text codec predates headers and
+// is what a segment with no known header is read as
+type wal_codec interface {
+	// header is written at the start of every new segment
+	header() []byte
+	// detect says whether a segment starting with these bytes was written by this codec
+	detect(peek []byte) bool
+	encode(rec wal_record) []byte
+	// records decodes the segment from the start (header included), one record per next()
+	records(reader *bufio.Reader) record_reader
+}
+
+// record_reader pulls records out of a segment one at a time
+// next returns the record and the offset it starts at, io.EOF after the last one
+// a record that fails to decode is a *corrupt_record_error and ends the segment
+type record_reader interface {
+	next() (wal_record, int64, error)
+}
+
+// read_records calls fn with every record the reader returns
+func read_records(records record_reader, fn func(rec wal_record) error) error {
+	for {
+		rec, _, err := records.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+}
+
+// adding an encoding means adding a WALFormat and registering its codec here
+var wal_codecs = map[WALFormat]wal_codec{
+	WALBinary:    binary_codec{},
+	WALText:      text_codec{},
+	WALEncrypted: encrypted_codec{}, // detection only, the store's codec has the key
+}
+
+// enough bytes to recognise any codec's header
+const max_codec_header_len = 8
+
+func codec_for(format WALFormat) wal_codec {
+	if codec, ok := wal_codecs[format]; ok {
+		return codec
+	}
+	return wal_codecs[WALBinary]
+}
+
+// detect_codec picks the codec whose header starts the segment
+func detect_codec(header []byte) (WALFormat, wal_codec) {
+	for format, codec := range wal_codecs {
+		if codec.detect(header) {
+			return format, codec
+		}
+	}
+	return WALText, wal_codecs[WALText]
+}
+
+// corrupt_record_error is a record that failed to decode
+// offset is where the bad record starts in the segment
+// and final says nothing decodable follows it, which is what a torn
+// write at the end of the log looks like
+type corrupt_record_error struct {
+	offset int64
+	final  bool
+	err    error
+}
+
+func (e *corrupt_record_error) Error() string { return e.err.Error() }
+func (e *corrupt_record_error) Unwrap() error { return e.err }
+
+// segment_format sniffs the header of an open segment
+func segment_format(fd *os.File) WALFormat {
+	header := make([]byte, max_codec_header_len)
+	n, _ := fd.ReadAt(header, 0)
+	format, _ := detect_codec(header[:n])
+	return format
+}
+
+// segment_matches says whether new records from codec can be appended to the segment:
+// it has to be in the same format and, for versioned formats, the same version
+func segment_matches(fd *os.File, format WALFormat, codec wal_codec) bool {
+	if segment_format(fd) != format {
+		return false
+	}
+	header := make([]byte, len(codec.header()))
+	n, _ := fd.ReadAt(header, 0)
+	return bytes.Equal(header[:n], codec.header())
+}
+
+type binary_codec struct{}
+
+func (binary_codec) header() []byte               { return binary_wal_header }
+func (binary_codec) detect(peek []byte) bool      { return bytes.HasPrefix(peek, binary_wal_magic) }
+func (binary_codec) encode(rec wal_record) []byte { return encode_binary_record(rec) }
+func (binary_codec) records(reader *bufio.Reader) record_reader {
+	return &binary_record_reader{
+		reader:      reader,
+		header_len:  len(binary_wal_header),
+		max_version: binary_wal_version,
+		markers_in:  4,
+		decode:      decode_binary_body,
+	}
+}
+
+type text_codec struct{}
+
+func (text_codec) header() []byte               { return nil }
+func (text_codec) detect(peek []byte) bool      { return false }
+func (text_codec) encode(rec wal_record) []byte { return []byte(encode_text_record(rec)) }
+func (text_codec) records(reader *bufio.Reader) record_reader {
+	tr := &text_record_reader{scanner: bufio.NewScanner(reader)}
+	tr.scanner.Buffer(make([]byte, 0, 64*1024), max_binary_record_size)
+	tr.scanner.Split(tr.split_lines)
+	return tr
+}
+
+// ---- binary format ----
+//
+// segment header: "QWAL" + version byte
+// record:         framed body, see wal_frame.go
+// body:           op (1 byte) | ttl in ns (int64) | expires at, unix ns (int64, 0 = never)
+//                 | lsn (uint64) | db (uint32) | logged at, unix ns (int64, 0 = unknown)
+//                 | key length (uint32) | key | value length (uint32) | value
+//
+// all integers are little endian
+// values can hold spaces, newlines, anything, unlike the text format
+// version 1 had no expires at field, SET carried a relative ttl instead
+// version 2 had no lsn, records from it get one by position on replay
+// version 3 had no record markers in the framing
+// version 4 had no db, everything in it is in database 0
+// version 5 had no logged at time, see history.go
+
+const binary_wal_version byte = 6
+
+var binary_wal_magic = []byte{'Q', 'W', 'A', 'L'}
+var binary_wal_header = append(append([]byte{}, binary_wal_magic...), binary_wal_version)
+
+// records larger than this are treated as corruption rather than allocated, text
+// records (lines) too
+const max_binary_record_size = 1 << 30
+
+func encode_binary_record(rec wal_record) []byte {
+	return frame_binary_body(encode_binary_body(rec))
+}
+
+func encode_binary_body(rec wal_record) []byte {
+	body := make([]byte, 0, 1+8+8+8+4+8+4+len(rec.key)+4+len(rec.value))
+	body = append(body, byte(rec.op))
+	body = binary.LittleEndian.AppendUint64(body, uint64(rec.ttl))
+	body = binary.LittleEndian.AppendUint64(body, uint64(unix_nano(rec.expires_at)))
+	body = binary.LittleEndian.AppendUint64(body, rec.lsn)
+	body = binary.LittleEndian.AppendUint32(body, uint32(rec.db))
+	body = binary.LittleEndian.AppendUint64(body, uint64(unix_nano(rec.at)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(rec.key)))
+	body = append(body, rec.key...)
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(rec.value)))
+	body = append(body, rec.value...)
+	return body
+}
+
+func decode_binary_body(body []byte, version byte) (wal_record, error) {
+	var rec wal_record
+	fixed := 1 + 8
+	if version >= 2 {
+		fixed += 8
+	}
+	if version >= 3 {
+		fixed += 8
+	}
+	if version >= 5 {
+		fixed += 4
+	}
+	if version >= 6 {
+		fixed += 8
+	}
+	if len(body) < fixed+4 {
+		return rec, errors.New("binary record too short")
+	}
+	rec.op = operation_type(body[0])
+	rec.ttl = time.Duration(binary.LittleEndian.Uint64(body[1:9]))
+	if version >= 2 {
+		rec.expires_at = from_unix_nano(int64(binary.LittleEndian.Uint64(body[9:17])))
+	}
+	if version >= 3 {
+		rec.lsn = binary.LittleEndian.Uint64(body[17:25])
+	}
+	if version >= 5 {
+		rec.db = int(binary.LittleEndian.Uint32(body[25:29]))
+	}
+	if version >= 6 {
+		rec.at = from_unix_nano(int64(binary.LittleEndian.Uint64(body[29:37])))
+	}
+	body = body[fixed:]
+
+	key_len := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	if uint64(key_len)+4 > uint64(len(body)) {
+		return rec, errors.New("binary record key length out of range")
+	}
+	rec.key = string(body[:key_len])
+	body = body[key_len:]
+
+	val_len := binary.LittleEndian.Uint32(body)
+	body = body[4:]
+	if uint64(val_len) != uint64(len(body)) {
+		return rec, errors.New("binary record value length out of range")
+	}
+	rec.value = string(body)
+
+	if _, ok := operation_names[rec.op]; !ok {
+		return rec, errors.New("unknown operation type in binary record")
+	}
+	return rec, nil
+}
+
+// only_zeros_left says whether the rest of the segment is empty or zero fill
+// from preallocation, i.e. nothing that could be a record follows
+// it consumes the reader, so it is only used once decoding has failed
+func only_zeros_left(reader *bufio.Reader) bool {
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err == io.EOF
+		}
+		if b != 0 {
+			return false
+		}
+	}
+}
+
+func unix_nano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func from_unix_nano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// ---- text format ----
+//
+// one record per line: `@<lsn> <command>|<crc32>` (older lines have no lsn)
+// a key outside database 0 has its db after the lsn: `@<lsn> #<db> <command>|<crc32>`
+// and a record that knows when it was logged has that in between: `@<lsn> ~<time> ...`
+// keys and values that would not survive being split on spaces
+// (spaces, newlines, quotes, empty strings...) are written as Go quoted strings:
+//
+//	SET greeting "hello world"|1a2b3c4d
+
+func encode_text_record(rec wal_record) string {
+	var log_entry string
+	switch rec.op {
+	case SET, CAS, APPEND, HSET, HDEL, RESTORE, LPUSH, RPUSH, LPOP, RPOP, SADD, SREM, ZADD, ZREM, RENAME, COPY:
+		log_entry = rec.op.String() + " " + text_field(rec.key) + " " + text_field(rec.value)
+		if !rec.expires_at.IsZero() {
+			log_entry += " " + rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+	case DELETE, GETDEL:
+		log_entry = rec.op.String() + " " + text_field(rec.key)
+		if !rec.expires_at.IsZero() {
+			log_entry += " " + rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+	case EXPIRE:
+		if !rec.expires_at.IsZero() {
+			log_entry = "EXPIRE " + text_field(rec.key) + " " + rec.expires_at.UTC().Format(time.RFC3339Nano)
+		} else {
+			log_entry = "EXPIRE " + text_field(rec.key) + " " + rec.ttl.String()
+		}
+	case UNDELETE:
+		log_entry = "UNDELETE " + text_field(rec.key)
+	case BEGIN, STRIPE:
+		log_entry = rec.op.String() + " " + rec.value
+	case COMMIT, ROLLBACK:
+		log_entry = rec.op.String()
+	case GETEX:
+		if rec.expires_at.IsZero() {
+			log_entry = "GETEX " + text_field(rec.key) + " PERSIST"
+		} else {
+			log_entry = "GETEX " + text_field(rec.key) + " " + rec.expires_at.UTC().Format(time.RFC3339Nano)
+		}
+	}
+	if rec.db != 0 {
+		log_entry = "#" + strconv.Itoa(rec.db) + " " + log_entry
+	}
+	if !rec.at.IsZero() {
+		log_entry = "~" + rec.at.UTC().Format(time.RFC3339Nano) + " " + log_entry
+	}
+	if rec.lsn != 0 {
+		log_entry = "@" + strconv.FormatUint(rec.lsn, 10) + " " + log_entry
+	}
+	return log_entry + "|" + compute_crc(log_entry) + "\n"
+}
+
+func decode_text_record(line string) (wal_record, error) {
+	var rec wal_record
+
+	data, err := verify_crc(line)
+	if err != nil {
+		return rec, err
+	}
+	input_parts, err := split_text_fields(data)
+	if err != nil {
+		return rec, err
+	}
+	//records written since LSNs exist start with @<lsn>
+	if len(input_parts) > 0 && strings.HasPrefix(input_parts[0], "@") {
+		rec.lsn, err = strconv.ParseUint(input_parts[0][1:], 10, 64)
+		if err != nil {
+			return rec, errors.New("invalid LSN in WAL entry")
+		}
+		input_parts = input_parts[1:]
+	}
+	if len(input_parts) > 0 && strings.HasPrefix(input_parts[0], "~") {
+		rec.at, err = time.Parse(time.RFC3339Nano, input_parts[0][1:])
+		if err != nil {
+			return rec, errors.New("invalid time in WAL entry")
+		}
+		input_parts = input_parts[1:]
+	}
+	if len(input_parts) > 0 && strings.HasPrefix(input_parts[0], "#") {
+		rec.db, err = strconv.Atoi(input_parts[0][1:])
+		if err != nil || rec.db < 0 {
+			return rec, errors.New("invalid database in WAL entry")
+		}
+		input_parts = input_parts[1:]
+	}
+	if len(input_parts) == 0 {
+		return rec, errors.New("empty WAL entry")
+	}
+
+	cmd := strings.ToUpper(input_parts[0])
+	switch cmd {
+	case "SET", "CAS", "APPEND", "HSET", "HDEL", "RESTORE", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM", "RENAME", "COPY":
+		if len(input_parts) < 3 {
+			return rec, errors.New(cmd + " command requires at least a key and a value")
+		}
+		rec.op = operation_named(cmd)
+		rec.key = input_parts[1]
+		rec.value = input_parts[2]
+		//an absolute expiry, or a relative ttl in logs from before expiries were absolute
+		if len(input_parts) == 4 {
+			if rec.expires_at, err = time.Parse(time.RFC3339Nano, input_parts[3]); err == nil {
+				break
+			}
+			rec.ttl, err = time.ParseDuration(input_parts[3])
+			if err != nil {
+				return rec, errors.New("invalid TTL format")
+			}
+		}
+
+	case "DELETE", "GETDEL":
+		//soft deletes carry when their tombstone is purged
+		if len(input_parts) != 2 && len(input_parts) != 3 {
+			return rec, errors.New(cmd + " command requires a key")
+		}
+		rec.op = DELETE
+		if cmd == "GETDEL" {
+			rec.op = GETDEL
+		}
+		rec.key = input_parts[1]
+		if len(input_parts) == 3 {
+			rec.expires_at, err = time.Parse(time.RFC3339Nano, input_parts[2])
+			if err != nil {
+				return rec, errors.New("invalid purge time format")
+			}
+		}
+
+	case "EXPIRE":
+		if len(input_parts) != 3 {
+			return rec, errors.New("EXPIRE command requires a key and a TTL")
+		}
+		rec.op = EXPIRE
+		rec.key = input_parts[1]
+		//an absolute expiry, or a relative ttl in logs from before expiries were absolute
+		if rec.expires_at, err = time.Parse(time.RFC3339Nano, input_parts[2]); err == nil {
+			break
+		}
+		rec.ttl, err = time.ParseDuration(input_parts[2])
+		if err != nil {
+			return rec, errors.New("invalid ttl format")
+		}
+
+	case "UNDELETE":
+		if len(input_parts) != 2 {
+			return rec, errors.New("UNDELETE command requires a key")
+		}
+		rec.op = UNDELETE
+		rec.key = input_parts[1]
+
+	case "BEGIN":
+		if len(input_parts) != 2 {
+			return rec, errors.New("BEGIN requires a record count")
+		}
+		if _, err := strconv.Atoi(input_parts[1]); err != nil {
+			return rec, errors.New("invalid record count in BEGIN")
+		}
+		rec.op = BEGIN
+		rec.value = input_parts[1]
+
+	case "STRIPE":
+		if len(input_parts) != 2 {
+			return rec, errors.New("STRIPE requires a stripe count")
+		}
+		if _, err := strconv.Atoi(input_parts[1]); err != nil {
+			return rec, errors.New("invalid stripe count in STRIPE")
+		}
+		rec.op = STRIPE
+		rec.value = input_parts[1]
+
+	case "COMMIT", "ROLLBACK":
+		if len(input_parts) != 1 {
+			return rec, errors.New(cmd + " takes no arguments")
+		}
+		rec.op = COMMIT
+		if cmd == "ROLLBACK" {
+			rec.op = ROLLBACK
+		}
+
+	case "GETEX":
+		if len(input_parts) != 3 {
+			return rec, errors.New("GETEX command requires a key and an expiry")
+		}
+		rec.op = GETEX
+		rec.key = input_parts[1]
+		if strings.ToUpper(input_parts[2]) != "PERSIST" {
+			rec.expires_at, err = time.Parse(time.RFC3339Nano, input_parts[2])
+			if err != nil {
+				return rec, errors.New("invalid expiry format")
+			}
+		}
+
+	default:
+		return rec, errors.New("Unknown command: " + cmd)
+	}
+
+	return rec, nil
+}
+
+// text_field quotes s if writing it bare would not round trip
+func text_field(s string) string {
+	if s == "" || strings.HasPrefix(s, `"`) {
+		return strconv.Quote(s)
+	}
+	for _, r := range s {
+		if r == utf8.RuneError || unicode.IsSpace(r) || !unicode.IsPrint(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
+
+// split_text_fields splits a record on whitespace like strings.Fields,
+// except that a field starting with a quote runs to its closing quote and is unquoted
+// records written before quoting existed have no quoted fields, so they split the same as before
+func split_text_fields(data string) ([]string, error) {
+	var fields []string
+	for {
+		data = strings.TrimLeftFunc(data, unicode.IsSpace)
+		if data == "" {
+			return fields, nil
+		}
+
+		if data[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(data)
+			if err != nil {
+				return nil, errors.New("invalid quoted field in WAL entry")
+			}
+			field, _ := strconv.Unquote(quoted)
+			fields = append(fields, field)
+			data = data[len(quoted):]
+			continue
+		}
+
+		end := strings.IndexFunc(data, unicode.IsSpace)
+		if end == -1 {
+			end = len(data)
+		}
+		fields = append(fields, data[:end])
+		data = data[end:]
+	}
+}
+
+type text_record_reader struct {
+	scanner   *bufio.Scanner
+	offset    int64 // where the next line starts
+	zero_fill bool  // reached the preallocated zero fill at the end of the segment
+}
+
+var errDataAfterZeroFill = errors.New("data after the zero fill at the end of the segment")
+
+// split_lines is bufio.ScanLines that also stops at preallocated zero fill:
+// a NUL ends the current (torn) line, and a run of NULs up to EOF is skipped without a token
+func (tr *text_record_reader) split_lines(data []byte, at_eof bool) (int, []byte, error) {
+	if tr.zero_fill || (len(data) > 0 && data[0] == 0) {
+		tr.zero_fill = true
+		if bytes.IndexFunc(data, func(r rune) bool { return r != 0 }) >= 0 {
+			return 0, nil, errDataAfterZeroFill
+		}
+		return len(data), nil, nil
+	}
+	if nul := bytes.IndexByte(data, 0); nul >= 0 {
+		newline := bytes.IndexByte(data[:nul], '\n')
+		if newline < 0 {
+			return nul, data[:nul], nil
+		}
+	}
+	return bufio.ScanLines(data, at_eof)
+}
+
+func (tr *text_record_reader) next() (wal_record, int64, error) {
+	for tr.scanner.Scan() {
+		line := tr.scanner.Text()
+		offset := tr.offset
+		tr.offset += int64(len(line)) + 1
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		rec, err := decode_text_record(line)
+		if err != nil {
+			//it's only the torn tail if no other record follows
+			final := true
+			for tr.scanner.Scan() {
+				if strings.TrimSpace(tr.scanner.Text()) != "" {
+					final = false
+					break
+				}
+			}
+			if tr.scanner.Err() == errDataAfterZeroFill {
+				final = false
+			}
+			return rec, offset, &corrupt_record_error{offset, final, err}
+		}
+		return rec, offset, nil
+	}
+	if err := tr.scanner.Err(); err != nil {
+		if err == errDataAfterZeroFill {
+			return wal_record{}, tr.offset, &corrupt_record_error{tr.offset, false, err}
+		}
+		return wal_record{}, tr.offset, err
+	}
+	return wal_record{}, tr.offset, io.EOF
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// sealed segments are never written again, so with Options.CompressSegments
+// they are gzipped in the background once the WAL rolls over to the next one.
+// the compressed file keeps the segment's name, readers tell the two apart by
+// the gzip magic at the start of the file. the active segment is never compressed
+//
+// gzip because it's in the standard library, snappy/zstd would be faster but
+// would be the module's first dependency
+
+var gzip_magic = []byte{0x1f, 0x8b}
+
+// segment_reader reads a segment file, decompressing it if it is gzipped
+func segment_reader(file *os.File) (*bufio.Reader, error) {
+	reader := bufio.NewReader(file)
+	magic, _ := reader.Peek(len(gzip_magic))
+	if !bytes.Equal(magic, gzip_magic) {
+		return reader, nil
+	}
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(gz), nil
+}
+
+// gzipped says whether a segment file is compressed
+func gzipped(file *os.File) bool {
+	magic := make([]byte, len(gzip_magic))
+	n, _ := file.ReadAt(magic, 0)
+	return n == len(magic) && bytes.Equal(magic, gzip_magic)
+}
+
+// compress_sealed gzips a sealed segment in the background
+// caller must hold w.wal_lock
+func (w *wal) compress_sealed(seq uint64) {
+	w.compressing.Add(1)
+	err := w.res.try_start("compression", func() {
+		defer w.compressing.Done()
+		if err := w.compress_segment(seq); err != nil {
+			log.Printf("ERROR: compressing WAL segment %s: %v\n", w.segment_path(seq), err)
+		}
+	})
+	//it stays uncompressed, which replay is fine with
+	if err != nil {
+		w.compressing.Done()
+		log.Printf("WARNING: not compressing WAL segment %s: %v\n", w.segment_path(seq), err)
+	}
+}
+
+// compress_segment writes a gzipped copy next to the segment and renames it over the original
+// the copy is made without holding the lock, only the rename takes it, so that
+// a segment deleted in the meantime (checkpoint, COMPACT) isn't brought back
+func (w *wal) compress_segment(seq uint64) error {
+	path := w.segment_path(seq)
+	tmp := path + ".gz.tmp"
+
+	src, err := w.res.open_file("segment", path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer w.res.close(src)
+
+	if gzipped(src) {
+		return nil
+	}
+
+	dst, err := w.res.open_file("temp", tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	raw, err := io.Copy(gz, src)
+	if err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = sync_file(dst)
+	}
+	if err != nil {
+		w.res.close(dst)
+		os.Remove(tmp)
+		return err
+	}
+	info, _ := dst.Stat()
+	if err := w.res.close(dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		os.Remove(tmp)
+		return nil
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	log.Printf("Compressed WAL segment %s: %d -> %d bytes\n", path, raw, info.Size())
+	return sync_dir(filepath.Dir(path))
+}
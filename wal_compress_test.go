@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gzipped sealed segments, see wal_compress.go
+
+// sealed segments end up gzipped in place and smaller, the active one isn't touched,
+// and replay and WALReader read both kinds
+func TestCompressSegments(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{CompressSegments: true, WALSegmentSize: 8 << 10}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("compressible ", 20)
+	for i := range 200 {
+		set(t, s, "k"+strconv.Itoa(i), value+strconv.Itoa(i))
+	}
+	segments := wal_segments(t, s)
+	active := s.wal.segment_path(segments[len(segments)-1])
+	//Close waits for the compressions still running
+	s.Close()
+
+	for _, seq := range segments {
+		file := s.wal.segment_path(seq)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz := bytes.HasPrefix(data, []byte{0x1f, 0x8b})
+		if file == active && gz {
+			t.Errorf("the active segment %s was compressed", filepath.Base(file))
+		}
+		if file != active && (!gz || len(data) > 4<<10) {
+			t.Errorf("sealed segment %s: gzipped %v, %d bytes", filepath.Base(file), gz, len(data))
+		}
+	}
+
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for _, i := range []int{0, 100, 199} {
+		if got := get(t, s, "k"+strconv.Itoa(i)); got != value+strconv.Itoa(i) {
+			t.Errorf("k%d after a restart: %q", i, got)
+		}
+	}
+	r, err := OpenWALReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if all := read_all(t, r); len(all) != 200 {
+		t.Errorf("WALReader read %d records, want 200", len(all))
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"log"
+)
+
+// ---- encrypted format ----
+//
+// the binary format with every record body sealed with AES-GCM:
+//
+// segment header: "QWAE" + version byte
+// record:         framed (see wal_frame.go) nonce (12 bytes) + sealed body
+//
+// the sealed body is a binary record body, v6 (with the time) from version 4 on, v5 (with
+// the db) in version 3, v4 before that.
+// version 1 had no record markers. the CRC still covers what is
+// on disk so torn writes are told apart from tampering: a torn record fails the
+// CRC and is handled like any torn tail, a record that passes the CRC but not
+// GCM's authentication was changed on purpose (or the key is wrong) and
+// replay stops with an error
+//
+// snapshots of an encrypted store are encrypted the same way
+
+const encrypted_wal_version byte = 4
+
+var encrypted_wal_magic = []byte{'Q', 'W', 'A', 'E'}
+var encrypted_wal_header = append(append([]byte{}, encrypted_wal_magic...), encrypted_wal_version)
+
+var errRecordAuth = errors.New("WAL record failed authentication: tampered with or wrong encryption key")
+
+type encrypted_codec struct {
+	aead cipher.AEAD // nil when the store has no key, then the segments can't be read
+}
+
+// new_aead makes the AES-GCM cipher for a 16, 24 or 32 byte key
+func new_aead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.New("encryption key must be 16, 24 or 32 bytes")
+	}
+	return cipher.NewGCM(block)
+}
+
+func (encrypted_codec) header() []byte          { return encrypted_wal_header }
+func (encrypted_codec) detect(peek []byte) bool { return bytes.HasPrefix(peek, encrypted_wal_magic) }
+
+func (c encrypted_codec) encode(rec wal_record) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic("crypto/rand failed: " + err.Error())
+	}
+	return frame_binary_body(c.aead.Seal(nonce, nonce, encode_binary_body(rec), nil))
+}
+
+func (c encrypted_codec) records(reader *bufio.Reader) record_reader {
+	if c.aead == nil {
+		return failed_records{errors.New("WAL segment is encrypted and no encryption key was given")}
+	}
+	return &binary_record_reader{
+		reader:      reader,
+		header_len:  len(encrypted_wal_header),
+		max_version: encrypted_wal_version,
+		markers_in:  2,
+		decode:      c.decode_body,
+	}
+}
+
+func (c encrypted_codec) decode_body(sealed []byte, version byte) (wal_record, error) {
+	nonce_size := c.aead.NonceSize()
+	if len(sealed) < nonce_size {
+		return wal_record{}, errRecordAuth
+	}
+	body, err := c.aead.Open(nil, sealed[:nonce_size], sealed[nonce_size:], nil)
+	if err != nil {
+		return wal_record{}, errRecordAuth
+	}
+	if version < 3 {
+		return decode_binary_body(body, 4)
+	}
+	if version < 4 {
+		return decode_binary_body(body, 5)
+	}
+	return decode_binary_body(body, binary_wal_version)
+}
+
+// failed_records is a segment that can't be read at all
+type failed_records struct {
+	err error
+}
+
+func (f failed_records) next() (wal_record, int64, error) { return wal_record{}, 0, f.err }
+
+// segment_records decodes a segment with the codec its header names
+// in recovery mode damaged records in segments with record markers are skipped with a warning
+func (w *wal) segment_records(seq uint64, reader *bufio.Reader) record_reader {
+	return w.records_of(w.segment_path(seq), reader)
+}
+
+// records_of is segment_records for the file at path, a stripe's too
+func (w *wal) records_of(path string, reader *bufio.Reader) record_reader {
+	header, _ := reader.Peek(max_codec_header_len)
+	records := w.segment_codec(header).records(reader)
+	if br, ok := records.(*binary_record_reader); ok && w.resync {
+		br.on_resync = func(offset int64, skipped int64) {
+			w.damaged++
+			log.Printf("WARNING: %s: skipped %d damaged bytes at offset %d, resumed at the next intact record\n", path, skipped, offset)
+		}
+	}
+	return records
+}
+
+// segment_codec is detect_codec with the store's key filled in for encrypted segments
+func (w *wal) segment_codec(header []byte) wal_codec {
+	format, codec := detect_codec(header)
+	if format == WALEncrypted {
+		return encrypted_codec{aead: w.aead}
+	}
+	return codec
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// encrypted WAL segments and snapshots, see wal_crypt.go
+
+// nothing written is readable without the key, and with it a restart, a checkpoint's
+// snapshot and a WALReader get everything back
+func TestEncryptedWAL(t *testing.T) {
+	quiet_log(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "wal.log")
+	secret := bytes.Repeat([]byte{7}, 32)
+	opts := Options{EncryptionKey: secret}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "card", "4111-1111-1111-1111")
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "pin", "hunter2-hunter2")
+	s.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "wal.log*"))
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if bytes.Contains(data, []byte("4111-1111")) || bytes.Contains(data, []byte("hunter2")) {
+			t.Errorf("%s holds a value in the clear", filepath.Base(file))
+		}
+	}
+
+	if _, _, err := Recover("", path, Options{}); err == nil {
+		t.Error("recovered without the key")
+	}
+	if _, _, err := Recover("", path, Options{EncryptionKey: bytes.Repeat([]byte{8}, 32)}); err == nil {
+		t.Error("recovered with the wrong key")
+	}
+	if _, _, err := Recover("", path, Options{EncryptionKey: []byte("short")}); err == nil {
+		t.Error("recovered with a key of the wrong size")
+	}
+
+	s, report, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if report.SnapshotKeys != 1 || get(t, s, "card") != "4111-1111-1111-1111" || get(t, s, "pin") != "hunter2-hunter2" {
+		t.Errorf("after a restart: card=%q pin=%q, %d keys from the snapshot", get(t, s, "card"), get(t, s, "pin"), report.SnapshotKeys)
+	}
+
+	r, err := OpenEncryptedWALReader(path, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if all := read_all(t, r); len(all) != 1 || all[0].Value != "hunter2-hunter2" {
+		t.Errorf("WALReader after the checkpoint: %+v", all)
+	}
+}
@@ -0,0 +1,60 @@
+//go:build darwin
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// on macOS fsync only hands the data to the drive, which may keep it in its
+// volatile cache for a while, so a power cut can still lose it. F_FULLFSYNC asks
+// the drive to flush that cache too, it is the only one that is durable, and slow
+// F_BARRIERFSYNC (APFS) only orders the writes before it ahead of the ones after
+
+// not in the syscall package, from <sys/fcntl.h>
+const f_barrierfsync = 85
+
+func fcntl_sync(fd *os.File, cmd int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, fd.Fd(), uintptr(cmd), 0)
+	if errno != 0 {
+		return &os.PathError{Op: "fcntl", Path: fd.Name(), Err: errno}
+	}
+	return nil
+}
+
+// no fallocate here, preallocate falls back to writing zeros
+func allocate(fd *os.File, from int64, size int64) error {
+	return errors.New("fallocate is not supported on this platform")
+}
+
+func open_direct(path string) (*os.File, error) {
+	return nil, errors.New("O_DIRECT is not supported on this platform")
+}
+
+// sync_data is F_FULLFSYNC, there is no fdatasync that is worth anything here
+func sync_data(fd *os.File) error {
+	return fcntl_sync(fd, syscall.F_FULLFSYNC)
+}
+
+func sync_file(fd *os.File) error {
+	return fcntl_sync(fd, syscall.F_FULLFSYNC)
+}
+
+// no huge page mappings here, the buffer pool uses ordinary aligned memory
+func alloc_huge(n int) ([]byte, bool) {
+	return nil, false
+}
+
+func free_huge(buf []byte) {}
+
+const can_sync_dir = true
+
+var sync_primitives = []sync_primitive{
+	{name: "fsync", sync: func(fd *os.File) error { return syscall.Fsync(int(fd.Fd())) },
+		note: "only reaches the drive's cache"},
+	{name: "F_BARRIERFSYNC", sync: func(fd *os.File) error { return fcntl_sync(fd, f_barrierfsync) },
+		note: "orders writes, doesn't flush the drive's cache"},
+	{name: "F_FULLFSYNC", durable: true, sync: sync_file},
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"os"
+)
+
+// with Options.DirectIO the active segment is written through an O_DIRECT file,
+// bypassing the page cache. O_DIRECT only takes whole, aligned blocks from
+// aligned memory, so direct_writer keeps the last, partly filled block of the
+// segment in an aligned buffer and writes it again, zero padded, on every flush
+//
+// the padding is what a preallocated segment's zero fill looks like, so the
+// readers already stop at it, and close_active cuts it off. the fsync stays:
+// O_DIRECT skips the page cache, not the drive's write cache or the inode update
+//
+// only appends to the active segment go through it, rewrites, snapshots and
+// everything that reads a segment use ordinary buffered files
+
+// the block size O_DIRECT writes are aligned to, 4K covers the common devices
+// the buffers' memory comes from the WAL's buffer pool, aligned to at least this
+const direct_io_align = 4096
+
+func align_up(n int) int {
+	return (n + direct_io_align - 1) &^ (direct_io_align - 1)
+}
+
+// direct_writer appends to an O_DIRECT file, every Write is one aligned pwrite
+type direct_writer struct {
+	fd    *os.File
+	pool  *buffer_pool
+	buf   []byte // aligned, from pool, starts with the data of the block at `start`
+	start int64  // file offset of buf[0], always block aligned
+	n     int    // bytes of real data in buf, the rest is padding
+}
+
+// new_direct_writer carries on writing at size through fd, opened with open_direct
+// the partly written block at the end is read through `buffered`, the segment's
+// ordinary file, since O_DIRECT reads have the same alignment rules as writes
+func new_direct_writer(fd *os.File, buffered *os.File, size int64, pool *buffer_pool) (*direct_writer, error) {
+	dw := &direct_writer{fd: fd, pool: pool, start: size &^ (direct_io_align - 1)}
+	dw.n = int(size - dw.start)
+	dw.buf = pool.get(direct_io_align)
+	dw.buf = dw.buf[:cap(dw.buf)]
+	if dw.n > 0 {
+		if _, err := buffered.ReadAt(dw.buf[:dw.n], dw.start); err != nil {
+			dw.release()
+			return nil, err
+		}
+	}
+	return dw, nil
+}
+
+func (dw *direct_writer) Write(p []byte) (int, error) {
+	padded := align_up(dw.n + len(p))
+	if padded > len(dw.buf) {
+		buf := dw.pool.get(padded)
+		copy(buf, dw.buf[:dw.n])
+		dw.pool.put(dw.buf)
+		dw.buf = buf[:cap(buf)]
+	}
+	copy(dw.buf[dw.n:], p)
+	clear(dw.buf[dw.n+len(p) : padded])
+
+	if _, err := dw.fd.WriteAt(dw.buf[:padded], dw.start); err != nil {
+		return 0, err
+	}
+	dw.n += len(p)
+
+	//only the last, partial block has to be written again
+	full := dw.n &^ (direct_io_align - 1)
+	if full > 0 {
+		copy(dw.buf, dw.buf[full:dw.n])
+		dw.start += int64(full)
+		dw.n -= full
+	}
+	return len(p), nil
+}
+
+// end is the size of the file including the padding of the last block
+func (dw *direct_writer) end() int64 {
+	return dw.start + int64(align_up(dw.n))
+}
+
+// release gives the buffer back to the pool, the writer is done with
+func (dw *direct_writer) release() {
+	dw.pool.put(dw.buf)
+	dw.buf = nil
+}
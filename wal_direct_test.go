@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the O_DIRECT writer, see wal_direct.go
+
+// records written through O_DIRECT, across a reopen that carries on in the middle of a
+// block, all replay, and a closed segment has no padding left at the end
+func TestDirectIO(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{DirectIO: true}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(key{name: "probe"}, 0, "v"); err != nil {
+		s.Close()
+		//O_DIRECT isn't there on every filesystem, tmpfs for one
+		t.Skipf("first write failed: %v", err)
+	}
+	value := strings.Repeat("v", 300)
+	for i := range 50 {
+		set(t, s, "k"+strconv.Itoa(i), value)
+	}
+	if info, _ := os.Stat(path); info.Size()%direct_io_align != 0 {
+		t.Errorf("a segment written with O_DIRECT is %d bytes, not whole blocks", info.Size())
+	}
+	s.Close()
+	closed, _ := os.Stat(path)
+
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 50; i < 100; i++ {
+		set(t, s, "k"+strconv.Itoa(i), value)
+	}
+	s.Close()
+	if info, _ := os.Stat(path); info.Size() <= closed.Size() || info.Size()%direct_io_align == 0 {
+		t.Errorf("segment went from %d to %d bytes, the padding should be cut off", closed.Size(), info.Size())
+	}
+
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.Keys(0, "*")); n != 101 {
+		t.Errorf("%d keys after a restart, want 101", n)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// ---- record framing ----
+//
+// the binary and encrypted codecs frame their record bodies the same way:
+//
+//	begin marker (4 bytes) | body length (uint32) | body | crc32 of body (uint32) | body length (uint32) | end marker (4 bytes)
+//
+// the CRC alone tells a damaged record from a good one, but once a length is
+// damaged there is no telling where the next record starts. the markers and the
+// repeated length make a record recognisable from anywhere, so in recovery mode
+// the reader can skip a damaged stretch in the middle of a segment and pick up
+// at the next intact record instead of losing the rest of the segment
+//
+// segments from before the markers (binary v1-3, encrypted v1) are just
+// body length | body | crc32
+
+var record_begin_marker = []byte{0xd1, 'R', 'E', 'C'}
+var record_end_marker = []byte{'E', 'N', 'D', 0xd1}
+
+// begin marker + length before the body, crc + length + end marker after it
+const frame_overhead = 4 + 4 + 4 + 4 + 4
+
+// frame_binary_body wraps a record body in its markers, lengths and CRC
+func frame_binary_body(body []byte) []byte {
+	buf := make([]byte, 0, frame_overhead+len(body))
+	buf = append(buf, record_begin_marker...)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, body...)
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(body))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(body)))
+	buf = append(buf, record_end_marker...)
+	return buf
+}
+
+// intact_frame_at says whether buf starts with a whole, undamaged framed record
+func intact_frame_at(buf []byte) bool {
+	if len(buf) < frame_overhead || !bytes.HasPrefix(buf, record_begin_marker) {
+		return false
+	}
+	length := binary.LittleEndian.Uint32(buf[4:])
+	if length == 0 || length > max_binary_record_size || uint64(len(buf)) < uint64(length)+frame_overhead {
+		return false
+	}
+	body := buf[8 : 8+length]
+	tail := buf[8+length:]
+	return binary.LittleEndian.Uint32(tail) == crc32.ChecksumIEEE(body) &&
+		binary.LittleEndian.Uint32(tail[4:]) == length &&
+		bytes.Equal(tail[8:12], record_end_marker)
+}
+
+// binary_record_reader reads framed, CRC checked record bodies
+// the codecs built on the binary framing (plain and encrypted) only differ
+// in their header and in how a body turns into a record
+type binary_record_reader struct {
+	reader      *bufio.Reader
+	header_len  int
+	max_version byte
+	markers_in  byte // first version whose records have begin/end markers
+	decode      func(body []byte, version byte) (wal_record, error)
+
+	// on_resync is told about every damaged stretch skipped to get to the next intact
+	// record, nil means a damaged record ends the segment. only segments with markers resync
+	on_resync func(offset int64, skipped int64)
+
+	version byte   // 0 until the header has been read
+	offset  int64  // where the next record starts
+	raw     []byte // what has been read of the current record, resync starts from it
+}
+
+func (br *binary_record_reader) markers() bool {
+	return br.version >= br.markers_in
+}
+
+func (br *binary_record_reader) resyncing() bool {
+	return br.on_resync != nil && br.markers()
+}
+
+func (br *binary_record_reader) next() (wal_record, int64, error) {
+	var rec wal_record
+	if br.version == 0 {
+		if err := br.read_header(); err != nil {
+			return rec, 0, err
+		}
+	}
+
+	offset := br.offset
+	body, err := br.read_frame()
+	if err == io.EOF {
+		return rec, offset, io.EOF
+	}
+	if err == nil {
+		rec, err = br.decode(body, br.version)
+		//the CRC matched, so a record that fails authentication wasn't cut short
+		//by a crash, it was tampered with (or the key is wrong), never a torn tail
+		if errors.Is(err, errRecordAuth) {
+			return rec, offset, err
+		}
+		if err != nil {
+			err = &corrupt_record_error{offset, br.rest_is_empty(), err}
+		}
+	}
+	if err != nil {
+		if br.resyncing() {
+			return br.resync(offset, err)
+		}
+		return rec, offset, err
+	}
+	br.offset += int64(len(br.raw))
+	return rec, offset, nil
+}
+
+// read_header reads the segment header and the version the records are in
+func (br *binary_record_reader) read_header() error {
+	header := make([]byte, br.header_len)
+	if _, err := io.ReadFull(br.reader, header); err != nil {
+		return &corrupt_record_error{0, true, errors.New("truncated binary WAL header")}
+	}
+	version := header[br.header_len-1]
+	if version < 1 || version > br.max_version {
+		return errors.New("unsupported binary WAL version " + strconv.Itoa(int(version)))
+	}
+	br.version = version
+	br.offset = int64(len(header))
+	return nil
+}
+
+// read reads n more bytes of the current record
+func (br *binary_record_reader) read(n int) ([]byte, error) {
+	start := len(br.raw)
+	br.raw = append(br.raw, make([]byte, n)...)
+	read, err := io.ReadFull(br.reader, br.raw[start:])
+	br.raw = br.raw[:start+read]
+	return br.raw[start:], err
+}
+
+// read_frame reads the next record's body, io.EOF at a clean end of the segment
+func (br *binary_record_reader) read_frame() ([]byte, error) {
+	offset := br.offset
+	br.raw = br.raw[:0]
+	truncated := &corrupt_record_error{offset, true, errors.New("truncated binary record")}
+
+	prefix_len := 4
+	if br.markers() {
+		prefix_len += len(record_begin_marker)
+	}
+	prefix, err := br.read(prefix_len)
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, truncated
+	}
+	if br.markers() {
+		if !bytes.Equal(prefix[:4], record_begin_marker) {
+			//no record starts with zeros, that's where the preallocated zero fill starts
+			if bytes.Equal(prefix, make([]byte, len(prefix))) && br.rest_is_empty() {
+				return nil, io.EOF
+			}
+			return nil, &corrupt_record_error{offset, br.rest_is_empty(), errors.New("record begin marker missing")}
+		}
+		prefix = prefix[4:]
+	}
+
+	length := binary.LittleEndian.Uint32(prefix)
+	//no record is empty, a zero length is where the preallocated zero fill starts
+	if length == 0 {
+		if !br.markers() && br.rest_is_empty() {
+			return nil, io.EOF
+		}
+		return nil, &corrupt_record_error{offset, false, errors.New("binary record length out of range")}
+	}
+	if length > max_binary_record_size {
+		return nil, &corrupt_record_error{offset, br.rest_is_empty(), errors.New("binary record length out of range")}
+	}
+
+	suffix_len := 4
+	if br.markers() {
+		suffix_len += 4 + len(record_end_marker)
+	}
+	buf, err := br.read(int(length) + suffix_len)
+	if err != nil {
+		return nil, truncated
+	}
+	body, trailer := buf[:length], buf[length:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(trailer) {
+		return nil, &corrupt_record_error{offset, br.rest_is_empty(), errors.New("CRC mismatch")}
+	}
+	if br.markers() && (binary.LittleEndian.Uint32(trailer[4:]) != length || !bytes.Equal(trailer[8:], record_end_marker)) {
+		return nil, &corrupt_record_error{offset, br.rest_is_empty(), errors.New("record end marker missing")}
+	}
+	return body, nil
+}
+
+// rest_is_empty is only_zeros_left, except when resyncing: then the rest of
+// the segment is still needed and resync decides
+func (br *binary_record_reader) rest_is_empty() bool {
+	if br.resyncing() {
+		return false
+	}
+	return only_zeros_left(br.reader)
+}
+
+// resync skips the damaged record at offset and carries on from the next intact one
+// if there is none the damage runs to the end of the segment, which is a torn tail,
+// unless it is all zeros, which is preallocated space nothing was written to
+// the rest of the segment is read into memory, this only runs in recovery mode
+func (br *binary_record_reader) resync(offset int64, cause error) (wal_record, int64, error) {
+	rest, err := io.ReadAll(br.reader)
+	if err != nil {
+		return wal_record{}, offset, err
+	}
+	rest = append(br.raw, rest...)
+
+	if bytes.Count(rest, []byte{0}) == len(rest) {
+		return wal_record{}, offset, io.EOF
+	}
+	for i := 1; i < len(rest); i++ {
+		next := bytes.Index(rest[i:], record_begin_marker)
+		if next < 0 {
+			break
+		}
+		i += next
+		if intact_frame_at(rest[i:]) {
+			br.on_resync(offset, int64(i))
+			br.reader = bufio.NewReader(bytes.NewReader(rest[i:]))
+			br.offset = offset + int64(i)
+			return br.next()
+		}
+	}
+
+	var corrupt *corrupt_record_error
+	if errors.As(cause, &corrupt) {
+		return wal_record{}, offset, &corrupt_record_error{offset, true, corrupt.err}
+	}
+	return wal_record{}, offset, cause
+}
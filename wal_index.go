@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// ---- segment indexes ----
+//
+// with Options.IndexSegments every sealed segment gets a sidecar index, <segment>.idx,
+// written in the background once the WAL rolls over, like compression: the LSNs of the
+// segment's first and last records and the offset of every index_every'th record. reading
+// the log from an LSN (ReplayFrom, WALReader.Seek, GetAsOf replaying past its snapshot)
+// skips the segments that end before it and starts the first one that doesn't at the
+// last indexed record before it, instead of decoding everything from the start.
+// Options.IndexKeys adds a bloom filter of the keys the segment writes, so reading the
+// history of one key (History) only has to go through the segments that may have it
+//
+// the offsets are into the records as written, a gzipped segment is still decompressed
+// up to the offset but nothing before it is decoded. text and striped segments aren't
+// indexed, and neither are the ones sealed before indexing was on or with records out of
+// LSN order (COMPACT's): they are read from the start as before. an index is only trusted
+// while its segment is as long as it was, a segment a crash made the active one again
+// and that has been written to since is read in full
+//
+// index file: "QIDX" | version | flags | first lsn | last lsn | length | count |
+// count × (lsn | offset) | [hashes | filter length | filter] | crc32 of all before it,
+// the numbers little endian uint64s but the hash count (a byte) and the count, filter
+// length and crc (uint32s)
+
+const segment_index_version byte = 1
+
+var segment_index_magic = []byte{'Q', 'I', 'D', 'X'}
+
+// the flags: the index has a key filter, the segment ends inside a transaction
+const (
+	index_has_keys byte = 1 << iota
+	index_open_tx
+)
+
+// every index_every'th record of a segment is in its index, the first one included
+const index_every = 64
+
+type segment_index struct {
+	first   uint64      // LSN of the segment's first record
+	last    uint64      // and of its last
+	length  int64       // bytes of header and records when it was indexed
+	lsns    []uint64    // LSNs of the indexed records
+	offsets []int64     // where they start
+	keys    *key_filter // nil unless the index was written with IndexKeys
+	open_tx bool        // the segment ends between a BEGIN and its COMMIT
+}
+
+func index_path(segment string) string {
+	return segment + ".idx"
+}
+
+// offset_after is where to start reading the segment for the records after lsn:
+// the last indexed record at or before the one after it
+func (idx *segment_index) offset_after(lsn uint64) int64 {
+	i := sort.Search(len(idx.lsns), func(i int) bool { return idx.lsns[i] > lsn+1 })
+	if i == 0 {
+		return 0
+	}
+	return idx.offsets[i-1]
+}
+
+// may_have says whether the segment may write k, always true without a key filter
+func (idx *segment_index) may_have(k key) bool {
+	return idx.keys == nil || idx.keys.may_have(key_hash(k))
+}
+
+func (idx *segment_index) encode() []byte {
+	var flags byte
+	if idx.keys != nil {
+		flags |= index_has_keys
+	}
+	if idx.open_tx {
+		flags |= index_open_tx
+	}
+	buf := append([]byte{}, segment_index_magic...)
+	buf = append(buf, segment_index_version, flags)
+	buf = binary.LittleEndian.AppendUint64(buf, idx.first)
+	buf = binary.LittleEndian.AppendUint64(buf, idx.last)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(idx.length))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(idx.lsns)))
+	for i, lsn := range idx.lsns {
+		buf = binary.LittleEndian.AppendUint64(buf, lsn)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(idx.offsets[i]))
+	}
+	if idx.keys != nil {
+		buf = append(buf, idx.keys.hashes)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(idx.keys.bits)))
+		buf = append(buf, idx.keys.bits...)
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+var errBadIndex = errors.New("damaged segment index")
+
+func decode_segment_index(data []byte) (*segment_index, error) {
+	if len(data) < len(segment_index_magic)+2+8+8+8+4+4 || string(data[:len(segment_index_magic)]) != string(segment_index_magic) {
+		return nil, errBadIndex
+	}
+	body, crc := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, errBadIndex
+	}
+	if version := body[len(segment_index_magic)]; version != segment_index_version {
+		return nil, errors.New("unsupported segment index version " + strconv.Itoa(int(version)))
+	}
+	flags := body[len(segment_index_magic)+1]
+	body = body[len(segment_index_magic)+2:]
+
+	idx := &segment_index{
+		first:   binary.LittleEndian.Uint64(body),
+		last:    binary.LittleEndian.Uint64(body[8:]),
+		length:  int64(binary.LittleEndian.Uint64(body[16:])),
+		open_tx: flags&index_open_tx != 0,
+	}
+	count := int(binary.LittleEndian.Uint32(body[24:]))
+	body = body[28:]
+	if len(body) < count*16 {
+		return nil, errBadIndex
+	}
+	for i := 0; i < count; i++ {
+		idx.lsns = append(idx.lsns, binary.LittleEndian.Uint64(body))
+		idx.offsets = append(idx.offsets, int64(binary.LittleEndian.Uint64(body[8:])))
+		body = body[16:]
+	}
+	if flags&index_has_keys != 0 {
+		if len(body) < 5 {
+			return nil, errBadIndex
+		}
+		hashes, n := body[0], int(binary.LittleEndian.Uint32(body[1:]))
+		if len(body[5:]) != n || n == 0 {
+			return nil, errBadIndex
+		}
+		idx.keys = &key_filter{bits: body[5:], hashes: hashes}
+	}
+	return idx, nil
+}
+
+// key_filter is a bloom filter of keys, sized for about 1% false positives
+type key_filter struct {
+	bits   []byte
+	hashes byte
+}
+
+// 10 bits and 7 hashes a key is about 1%
+const (
+	filter_bits_per_key = 10
+	filter_hashes       = 7
+)
+
+func new_key_filter(keys []uint64) *key_filter {
+	f := &key_filter{bits: make([]byte, max(8, (len(keys)*filter_bits_per_key+7)/8)), hashes: filter_hashes}
+	for _, h := range keys {
+		f.each_bit(h, func(bit uint64) bool {
+			f.bits[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return f
+}
+
+func (f *key_filter) may_have(h uint64) bool {
+	return f.each_bit(h, func(bit uint64) bool { return f.bits[bit/8]&(1<<(bit%8)) != 0 })
+}
+
+// each_bit calls fn with the bits of a key's hash until it returns false
+// the bits come from two halves of the hash (Kirsch-Mitzenmacher), not a hash each
+func (f *key_filter) each_bit(h uint64, fn func(bit uint64) bool) bool {
+	n := uint64(len(f.bits)) * 8
+	h1, h2 := h&0xffffffff, h>>32|1
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		if !fn((h1 + i*h2) % n) {
+			return false
+		}
+	}
+	return true
+}
+
+// key_hash is what a key filter is keyed on, the same in every process
+func key_hash(k key) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(k.name))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(k.db)))
+	return h.Sum64()
+}
+
+// index_sealed indexes a segment that was just sealed, in the background
+// caller must hold w.wal_lock
+func (w *wal) index_sealed(seq uint64) {
+	if w.striped(seq) {
+		return
+	}
+	w.indexing.Add(1)
+	err := w.res.try_start("indexing", func() {
+		defer w.indexing.Done()
+		if err := w.index_segment(seq); err != nil {
+			log.Printf("ERROR: indexing WAL segment %s: %v\n", w.segment_path(seq), err)
+		}
+	})
+	//it gets read from the start, as if it was never indexed
+	if err != nil {
+		w.indexing.Done()
+		log.Printf("WARNING: not indexing WAL segment %s: %v\n", w.segment_path(seq), err)
+	}
+}
+
+// index_segment reads a sealed segment through and writes its index next to it
+// like compress_segment only the rename takes the lock, so a segment deleted in the
+// meantime doesn't get an index
+func (w *wal) index_segment(seq uint64) error {
+	path := w.segment_path(seq)
+	file, err := w.res.open_file("segment", path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer w.res.close(file)
+	reader, err := segment_reader(file)
+	if err != nil {
+		return err
+	}
+	records, ok := w.segment_records(seq, reader).(*binary_record_reader)
+	if !ok {
+		return nil
+	}
+
+	idx := &segment_index{}
+	var keys []uint64
+	for n := 0; ; n++ {
+		rec, offset, err := records.next()
+		if err == io.EOF {
+			idx.length = offset
+			break
+		}
+		if err != nil {
+			return err
+		}
+		//from before LSNs, or out of order: the offsets couldn't be searched
+		if rec.lsn == 0 || rec.lsn <= idx.last {
+			return nil
+		}
+		if n%index_every == 0 {
+			idx.lsns = append(idx.lsns, rec.lsn)
+			idx.offsets = append(idx.offsets, offset)
+		}
+		if n == 0 {
+			idx.first = rec.lsn
+		}
+		idx.last = rec.lsn
+		switch rec.op {
+		case BEGIN:
+			idx.open_tx = true
+		case COMMIT, ROLLBACK:
+			idx.open_tx = false
+		}
+		if w.index_keys {
+			for _, k := range record_keys(rec) {
+				keys = append(keys, key_hash(k))
+			}
+		}
+	}
+	if len(idx.lsns) == 0 {
+		return nil
+	}
+	if w.index_keys {
+		idx.keys = new_key_filter(keys)
+	}
+
+	tmp := index_path(path) + ".tmp"
+	fd, err := w.res.open_file("temp", tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(idx.encode())
+	if err == nil {
+		err = sync_file(fd)
+	}
+	if closed := w.res.close(fd); err == nil {
+		err = closed
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+	if _, err := os.Stat(path); err != nil {
+		os.Remove(tmp)
+		return nil
+	}
+	return os.Rename(tmp, index_path(path))
+}
+
+// segment_index is the index of segment seq, nil if it has none that can be trusted
+func (w *wal) segment_index(seq uint64) *segment_index {
+	path := w.segment_path(seq)
+	data, err := os.ReadFile(index_path(path))
+	if err != nil {
+		return nil
+	}
+	idx, err := decode_segment_index(data)
+	if err != nil {
+		log.Printf("WARNING: %s: %v, reading the segment from the start\n", index_path(path), err)
+		return nil
+	}
+	file, err := w.res.open_file("segment", path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil
+	}
+	defer w.res.close(file)
+	info, err := file.Stat()
+	if err != nil || (info.Size() != idx.length && !gzipped(file)) {
+		return nil
+	}
+	return idx
+}
+
+// skip_to has records, just opened on file, start at offset, where an index says a
+// record starts, without decoding anything before it
+func skip_to(records record_reader, file *os.File, offset int64) error {
+	br, ok := records.(*binary_record_reader)
+	if !ok || offset == 0 {
+		return nil
+	}
+	if err := br.read_header(); err != nil {
+		return err
+	}
+	if gzipped(file) {
+		if _, err := br.reader.Discard(int(offset - br.offset)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		br.reader.Reset(file)
+	}
+	br.offset = offset
+	return nil
+}
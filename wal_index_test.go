@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// segment indexes, see wal_index.go
+
+// indexed_store is a store with n keys set in small segments, closed and opened again so
+// every sealed segment has its index
+func indexed_store(tb testing.TB, opts Options, n int) *Store {
+	path := filepath.Join(tb.TempDir(), "wal.log")
+	opts.WALSegmentSize = 4096
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		tb.Fatalf("recover: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		if err := s.Set(key{name: "k:" + strconv.Itoa(i)}, 0, strconv.Itoa(i)); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	s.Close()
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		tb.Fatalf("recover: %v", err)
+	}
+	tb.Cleanup(func() { s.Close() })
+	return s
+}
+
+// replayed is the LSNs ReplayFrom(lsn) hands over
+func replayed(t *testing.T, s *Store, lsn uint64) []uint64 {
+	t.Helper()
+	var lsns []uint64
+	if err := s.ReplayFrom(lsn, func(e Entry) error {
+		lsns = append(lsns, e.LSN)
+		return nil
+	}); err != nil {
+		t.Fatalf("ReplayFrom(%d): %v", lsn, err)
+	}
+	return lsns
+}
+
+func check_replayed(t *testing.T, s *Store, lsn uint64) {
+	t.Helper()
+	lsns := replayed(t, s, lsn)
+	if uint64(len(lsns)) != s.LastLSN()-lsn {
+		t.Fatalf("ReplayFrom(%d) gave %d records, want %d", lsn, len(lsns), s.LastLSN()-lsn)
+	}
+	for i, got := range lsns {
+		if got != lsn+1+uint64(i) {
+			t.Fatalf("ReplayFrom(%d): record %d has LSN %d", lsn, i, got)
+		}
+	}
+}
+
+// every sealed segment is indexed, and ReplayFrom seeks past the ones before its LSN:
+// damage in a segment it skips doesn't stop it
+func TestSegmentIndexSeek(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run("compress="+strconv.FormatBool(compress), func(t *testing.T) {
+			s := indexed_store(t, Options{IndexSegments: true, CompressSegments: compress}, 500)
+			segments := wal_segments(t, s)
+			if len(segments) < 4 {
+				t.Fatalf("only %d segments", len(segments))
+			}
+			for _, seq := range segments[:len(segments)-1] {
+				if s.wal.segment_index(seq) == nil {
+					t.Errorf("segment %d has no index", seq)
+				}
+			}
+			for _, lsn := range []uint64{0, 1, 63, 64, 65, 250, s.LastLSN() - 1, s.LastLSN()} {
+				check_replayed(t, s, lsn)
+			}
+
+			//past the first segment, its records are never read
+			first := s.wal.segment_index(segments[0])
+			if !compress {
+				fd, err := os.OpenFile(s.wal.segment_path(segments[0]), os.O_WRONLY, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				fd.WriteAt([]byte("damage"), 64)
+				fd.Close()
+				if err := s.ReplayFrom(0, func(Entry) error { return nil }); err == nil {
+					t.Fatal("the damage went unnoticed from the start")
+				}
+			}
+			check_replayed(t, s, first.last)
+			check_replayed(t, s, first.last+100)
+		})
+	}
+}
+
+// WALReader.Seek starts the reader after the LSN, in the middle of an indexed segment too
+func TestWALReaderSeek(t *testing.T) {
+	s := indexed_store(t, Options{IndexSegments: true}, 500)
+	for _, lsn := range []uint64{0, 100, 129, 400} {
+		reader, err := OpenWALReader(s.wal.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reader.Seek(lsn); err != nil {
+			t.Fatal(err)
+		}
+		e, err := reader.Next()
+		if err != nil || e.LSN != lsn+1 || e.Key != "k:"+strconv.FormatUint(lsn, 10) {
+			t.Errorf("Seek(%d): first record %d %s, %v", lsn, e.LSN, e.Key, err)
+		}
+		if err := reader.Seek(lsn); err == nil {
+			t.Error("Seek after Next")
+		}
+		reader.Close()
+	}
+}
+
+// an index that doesn't match its segment is ignored, and a checkpoint takes the
+// indexes with the segments it deletes
+func TestSegmentIndexStale(t *testing.T) {
+	s := indexed_store(t, Options{IndexSegments: true}, 500)
+	segments := wal_segments(t, s)
+	//the segments are all about as big, the first has the header too
+	data, err := os.ReadFile(index_path(s.wal.segment_path(segments[1])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(index_path(s.wal.segment_path(segments[0])), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if s.wal.segment_index(segments[0]) != nil {
+		t.Error("segment 0 took the index of segment 1")
+	}
+	check_replayed(t, s, 10)
+	//a damaged index is read past too
+	if err := os.WriteFile(index_path(s.wal.segment_path(segments[1])), data[:len(data)-1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	check_replayed(t, s, 100)
+
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range segments {
+		if _, err := os.Stat(index_path(s.wal.segment_path(seq))); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("segment %d is gone, its index isn't: %v", seq, err)
+		}
+	}
+}
+
+// the key filter has every key the segment writes, and not many it doesn't
+func TestSegmentIndexKeys(t *testing.T) {
+	s := indexed_store(t, Options{IndexKeys: true}, 500)
+	segments := wal_segments(t, s)
+	idx := s.wal.segment_index(segments[0])
+	if idx == nil || idx.keys == nil {
+		t.Fatal("the first segment has no key filter")
+	}
+	written := 0
+	for i := 0; i < 500; i++ {
+		k := key{name: "k:" + strconv.Itoa(i)}
+		if uint64(i) < idx.last {
+			written++
+			if !idx.may_have(k) {
+				t.Errorf("the filter doesn't have %s", k.name)
+			}
+		}
+	}
+	misses := 0
+	for i := 0; i < 1000; i++ {
+		if idx.may_have(key{name: "other:" + strconv.Itoa(i)}) {
+			misses++
+		}
+	}
+	if misses > 50 {
+		t.Errorf("%d of 1000 keys not in a segment of %d keys may be in it", misses, written)
+	}
+
+	//GetAsOf seeks past the snapshot the same way
+	if v, ok, err := s.GetAsOf(key{name: "k:10"}, 200); err != nil || !ok || v != "10" {
+		t.Errorf("GetAsOf(k:10, 200) = %q %v %v", v, ok, err)
+	}
+}
+
+// catching up on the last few writes of a long log, with and without indexes
+//
+//	go test -run XXX -bench ReplayFromTail
+func BenchmarkReplayFromTail(b *testing.B) {
+	for _, indexed := range []bool{false, true} {
+		b.Run("indexed="+strconv.FormatBool(indexed), func(b *testing.B) {
+			s := indexed_store(b, Options{IndexSegments: indexed}, 20_000)
+			lsn := s.LastLSN() - 10
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.ReplayFrom(lsn, func(Entry) error { return nil }); err != nil && err != io.EOF {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
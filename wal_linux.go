@@ -0,0 +1,53 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate reserves [from, size) with fallocate, the blocks read back as zeros
+func allocate(fd *os.File, from int64, size int64) error {
+	return syscall.Fallocate(int(fd.Fd()), 0, from, size-from)
+}
+
+// open_direct opens a segment for writes that bypass the page cache
+func open_direct(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|syscall.O_DIRECT, 0644)
+}
+
+// sync_data is fdatasync: it flushes the data and only the metadata needed
+// to read it back, which for a preallocated segment is no metadata at all
+func sync_data(fd *os.File) error {
+	return syscall.Fdatasync(int(fd.Fd()))
+}
+
+// sync_file is fsync, data and metadata, down through the drive's cache
+func sync_file(fd *os.File) error {
+	return syscall.Fsync(int(fd.Fd()))
+}
+
+// alloc_huge maps n bytes (a multiple of 2MB) backed by huge pages, which only
+// works with huge pages reserved (vm.nr_hugepages)
+func alloc_huge(n int) ([]byte, bool) {
+	buf, err := syscall.Mmap(-1, 0, n, syscall.PROT_READ|syscall.PROT_WRITE,
+		syscall.MAP_PRIVATE|syscall.MAP_ANONYMOUS|syscall.MAP_HUGETLB)
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+func free_huge(buf []byte) {
+	syscall.Munmap(buf)
+}
+
+// a directory fsync is what makes a rename or a new file in it durable
+const can_sync_dir = true
+
+var sync_primitives = []sync_primitive{
+	{name: "fsync", durable: true, sync: sync_file},
+	{name: "fdatasync", durable: true, sync: sync_data,
+		note: "skips metadata that isn't needed to read the data back"},
+}
@@ -0,0 +1,38 @@
+//go:build !linux && !darwin && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// no fallocate here, preallocate falls back to writing zeros
+func allocate(fd *os.File, from int64, size int64) error {
+	return errors.New("fallocate is not supported on this platform")
+}
+
+func open_direct(path string) (*os.File, error) {
+	return nil, errors.New("O_DIRECT is not supported on this platform")
+}
+
+func sync_data(fd *os.File) error {
+	return fd.Sync()
+}
+
+func sync_file(fd *os.File) error {
+	return fd.Sync()
+}
+
+// no huge page mappings here, the buffer pool uses ordinary aligned memory
+func alloc_huge(n int) ([]byte, bool) {
+	return nil, false
+}
+
+func free_huge(buf []byte) {}
+
+const can_sync_dir = true
+
+var sync_primitives = []sync_primitive{
+	{name: "fsync", durable: true, sync: sync_file},
+}
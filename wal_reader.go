@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Entry is one decoded WAL record, as handed out by WALReader
+type Entry struct {
+	LSN       uint64
+	Op        string // SET, DELETE, EXPIRE, GETDEL, GETEX, UNDELETE, CAS, APPEND, a hash, list, set or sorted set op, RESTORE, RENAME, COPY, or BEGIN/COMMIT/ROLLBACK around a transaction
+	Key       string
+	DB        int           // the database Key is in
+	Value     string        // SET, CAS, APPEND's suffix, BEGIN's record count, and the packed arguments of the typed value ops and RESTORE
+	TTL       time.Duration // SET and EXPIRE records from before absolute expiries
+	ExpiresAt time.Time     // SET, EXPIRE and GETEX, zero if the key never expires; DELETE and GETDEL, when a soft delete is purged
+	At        time.Time     // when the write was logged, zero if the record doesn't say (see history.go)
+	Segment   string        // segment file the record is in
+	Offset    int64         // byte offset of the record in that segment
+}
+
+// WALReader walks every record of a WAL, segment by segment in order,
+// for tooling that wants to look at the log without a Store
+// a log that is being written to is read up to whatever has been flushed
+// a striped one is read across the stripes its manifest names, see wal_stripe.go
+type WALReader struct {
+	wal      *wal
+	segments []uint64
+	next_seg int
+
+	file    *os.File
+	path    string
+	records record_reader
+	merged  *stripe_merge // records, when the segment is striped
+	lsns    lsn_counter
+	err     error // sticky, once a segment is bad the reader stops
+
+	after  uint64 // see Seek, the records up to it are skipped
+	offset int64  // where Seek starts the next segment opened
+
+	on_damaged func(segment string, offset int64, skipped int64) // see SkipDamaged
+}
+
+// OpenWALReader opens the WAL whose first segment is filename (e.g. kvs_wal.log)
+func OpenWALReader(filename string) (*WALReader, error) {
+	return OpenEncryptedWALReader(filename, nil)
+}
+
+// OpenEncryptedWALReader is OpenWALReader for a WAL written with Options.EncryptionKey
+func OpenEncryptedWALReader(filename string, encryption_key []byte) (*WALReader, error) {
+	//files are counted, but not as the store's
+	w := &wal{filename: filename, res: &resources{}}
+	if encryption_key != nil {
+		aead, err := new_aead(encryption_key)
+		if err != nil {
+			return nil, err
+		}
+		w.aead = aead
+	}
+	manifest, err := read_manifest(w.manifest_path())
+	if err != nil {
+		return nil, err
+	}
+	if manifest[manifest_stripes] != "" {
+		w.striped_from, _ = strconv.ParseUint(manifest[manifest_striped_from], 10, 64)
+		for _, dir := range filepath.SplitList(manifest[manifest_stripes]) {
+			w.stripes = append(w.stripes, &wal{filename: filepath.Join(dir, filepath.Base(filename))})
+		}
+	}
+	segments, err := w.log_segments()
+	if err != nil {
+		return nil, err
+	}
+	return &WALReader{wal: w, segments: segments}, nil
+}
+
+// Next returns the next record, io.EOF after the last one
+// a corrupt record is returned as an error naming the segment and offset
+func (r *WALReader) Next() (Entry, error) {
+	for r.err == nil {
+		if r.records == nil {
+			if r.next_seg == len(r.segments) {
+				r.err = io.EOF
+				break
+			}
+			r.err = r.open(r.segments[r.next_seg])
+			r.next_seg++
+			continue
+		}
+
+		rec, offset, err := r.records.next()
+		if err == io.EOF {
+			r.err = r.close_segment()
+			continue
+		}
+		//the stripes' errors name their file already
+		if err != nil && r.merged != nil {
+			r.err = err
+			break
+		}
+		if err != nil {
+			r.err = fmt.Errorf("%s: offset %d: %w", r.path, offset, err)
+			break
+		}
+		if r.merged != nil {
+			r.path = r.merged.path
+		}
+		r.lsns.stamp(&rec)
+		if rec.lsn <= r.after {
+			continue
+		}
+		e := record_entry(rec)
+		e.Segment, e.Offset = r.path, offset
+		return e, nil
+	}
+	return Entry{}, r.err
+}
+
+// record_entry is the Entry of a decoded record, without where it is in the log
+func record_entry(rec wal_record) Entry {
+	return Entry{
+		LSN:       rec.lsn,
+		Op:        rec.op.String(),
+		Key:       rec.key,
+		DB:        rec.db,
+		Value:     rec.value,
+		TTL:       rec.ttl,
+		ExpiresAt: rec.expires_at,
+		At:        rec.at,
+	}
+}
+
+func (r *WALReader) open(seq uint64) error {
+	if r.wal.striped(seq) {
+		return r.open_striped(seq)
+	}
+	r.path = r.wal.segment_path(seq)
+	file, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	reader, err := segment_reader(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	header, _ := reader.Peek(max_codec_header_len)
+	r.file, r.records = file, r.wal.segment_codec(header).records(reader)
+	if err := skip_to(r.records, file, r.offset); err != nil {
+		r.close_segment()
+		return err
+	}
+	r.offset = 0
+	if br, ok := r.records.(*binary_record_reader); ok && r.on_damaged != nil {
+		path := r.path
+		br.on_resync = func(offset int64, skipped int64) { r.on_damaged(path, offset, skipped) }
+	}
+	return nil
+}
+
+func (r *WALReader) open_striped(seq uint64) error {
+	merged, err := r.wal.merge_stripes(seq, seq == r.segments[len(r.segments)-1])
+	if err != nil {
+		return err
+	}
+	for _, h := range merged.heads {
+		if br, ok := h.records.(*binary_record_reader); ok && r.on_damaged != nil {
+			path := h.path
+			br.on_resync = func(offset int64, skipped int64) { r.on_damaged(path, offset, skipped) }
+		}
+	}
+	r.merged, r.records = merged, merged
+	return nil
+}
+
+// Seek makes Next start after LSN lsn, and has to come before it. with segment
+// indexes (see wal_index.go) the segments that end at or before lsn aren't read at
+// all, and the first one that doesn't is read from the last indexed record before it
+func (r *WALReader) Seek(lsn uint64) error {
+	if r.next_seg > 0 {
+		return errors.New("WALReader.Seek after Next")
+	}
+	r.after = lsn
+	for ; r.next_seg < len(r.segments); r.next_seg++ {
+		seq := r.segments[r.next_seg]
+		if r.wal.striped(seq) {
+			break
+		}
+		idx := r.wal.segment_index(seq)
+		if idx == nil {
+			break
+		}
+		if idx.last > lsn {
+			r.offset = idx.offset_after(lsn)
+			break
+		}
+		r.lsns.last = idx.last
+	}
+	return nil
+}
+
+// SkipDamaged makes the reader carry on past damaged records in segments with
+// record markers (see wal_frame.go): fn is told where each damaged stretch
+// starts and how many bytes were skipped, and Next returns the next intact record
+// damage nothing intact follows, and damage in older segments, still ends the read
+func (r *WALReader) SkipDamaged(fn func(segment string, offset int64, skipped int64)) {
+	r.on_damaged = fn
+}
+
+func (r *WALReader) close_segment() error {
+	if r.merged != nil {
+		r.merged.close()
+		r.merged, r.records = nil, nil
+		return nil
+	}
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file, r.records = nil, nil
+	return err
+}
+
+// Close releases the segment currently being read
+func (r *WALReader) Close() error {
+	return r.close_segment()
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// WALReader over a log a store is still writing, see wal_reader.go
+
+// read_all is every entry r hands out up to io.EOF
+func read_all(t *testing.T, r *WALReader) []Entry {
+	t.Helper()
+	var all []Entry
+	for {
+		e, err := r.Next()
+		if err == io.EOF {
+			return all
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, e)
+	}
+}
+
+// every record in order across the segments, with where it is in the log
+func TestWALReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{WALSegmentSize: 1 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := range 30 {
+		set(t, s, "k"+strconv.Itoa(i), "value "+strconv.Itoa(i))
+	}
+	s.Set(key{name: "other", db: 4}, time.Hour, "x")
+	s.Delete(key{name: "k0"})
+
+	r, err := OpenWALReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	all := read_all(t, r)
+	if len(all) != 32 {
+		t.Fatalf("%d entries, want 32", len(all))
+	}
+	segments := map[string]bool{}
+	for i, e := range all[:30] {
+		if e.LSN != uint64(i+1) || e.Op != "SET" || e.Key != "k"+strconv.Itoa(i) || e.Value != "value "+strconv.Itoa(i) || e.At.IsZero() {
+			t.Errorf("entry %d: %+v", i, e)
+		}
+		segments[e.Segment] = true
+	}
+	if len(segments) < 2 {
+		t.Errorf("entries from %d segments", len(segments))
+	}
+	if e := all[30]; e.DB != 4 || e.ExpiresAt.IsZero() {
+		t.Errorf("a write to db 4 with a ttl: %+v", e)
+	}
+	if e := all[31]; e.Op != "DELETE" || e.Key != "k0" {
+		t.Errorf("the delete: %+v", e)
+	}
+	if first := all[0]; first.Segment != path || first.Offset != int64(len(binary_wal_header)) {
+		t.Errorf("the first entry is at %s:%d", first.Segment, first.Offset)
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Next after the end: %v", err)
+	}
+}
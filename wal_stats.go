@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// every fsync of the active segment (per write, per group commit batch, or from the
+// everysec ticker) goes into a per-WAL latency histogram, so WALStats can tell how
+// much of a write's latency was the disk
+//
+// the histogram is HDR style: log-linear buckets in nanoseconds, exact below 128ns and
+// within 1/64 (~1.6%) of the value above, whatever its size, in a fixed array updated with atomics
+
+// sub-buckets per power of two, the upper half of them is used above the exact range
+const fsync_sub_bucket_bits = 7
+
+// 2^40ns is about 18 minutes, anything longer lands in the last bucket
+const fsync_max_shift = 40 - fsync_sub_bucket_bits
+
+const fsync_buckets = (fsync_max_shift+1)<<(fsync_sub_bucket_bits-1) + 1<<(fsync_sub_bucket_bits-1)
+
+// WALStats is how long the WAL's fsyncs took since the store was opened
+type WALStats struct {
+	Fsyncs uint64
+	Total  time.Duration // time spent in fsyncs
+	P50    time.Duration
+	P95    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+type latency_histogram struct {
+	counts [fsync_buckets]atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64 // nanoseconds
+	max    atomic.Uint64
+}
+
+// latency_bucket maps a value to its bucket: values below 2^bits are their own bucket,
+// above that the value keeps its top `bits` significant bits and the rest is the shift
+func latency_bucket(v uint64) int {
+	const half = 1 << (fsync_sub_bucket_bits - 1)
+	shift := bits.Len64(v) - fsync_sub_bucket_bits
+	if shift <= 0 {
+		return int(v)
+	}
+	if shift > fsync_max_shift {
+		return fsync_buckets - 1
+	}
+	return shift*half + int(v>>shift)
+}
+
+// latency_bucket_max is the biggest value that lands in bucket i
+func latency_bucket_max(i int) uint64 {
+	const half = 1 << (fsync_sub_bucket_bits - 1)
+	if i < 2*half {
+		return uint64(i)
+	}
+	shift := i/half - 1
+	top := uint64(i - shift*half)
+	return (top+1)<<shift - 1
+}
+
+func (h *latency_histogram) observe(d time.Duration) {
+	v := uint64(max(d, 0))
+	h.counts[latency_bucket(v)].Add(1)
+	h.count.Add(1)
+	h.sum.Add(v)
+	for {
+		old := h.max.Load()
+		if v <= old || h.max.CompareAndSwap(old, v) {
+			break
+		}
+	}
+}
+
+// quantile is the q-th quantile (0..1), the top of the bucket it falls in, never above the max
+func (h *latency_histogram) quantile(q float64, count uint64) time.Duration {
+	if count == 0 {
+		return 0
+	}
+	rank := uint64(q * float64(count))
+	rank = max(rank, 1)
+	seen := uint64(0)
+	for i := range h.counts {
+		seen += h.counts[i].Load()
+		if seen >= rank {
+			return time.Duration(min(latency_bucket_max(i), h.max.Load()))
+		}
+	}
+	return time.Duration(h.max.Load())
+}
+
+// stats reads the histogram while fsyncs may still be going on, so the numbers
+// can be off by the few fsyncs that finished while it was being read
+func (h *latency_histogram) stats() WALStats {
+	count := h.count.Load()
+	return WALStats{
+		Fsyncs: count,
+		Total:  time.Duration(h.sum.Load()),
+		P50:    h.quantile(0.50, count),
+		P95:    h.quantile(0.95, count),
+		P99:    h.quantile(0.99, count),
+		Max:    time.Duration(h.max.Load()),
+	}
+}
+
+// WALStats shows how long the WAL's fsyncs have taken, all zero while nothing has been fsynced
+func (s *Store) WALStats() WALStats {
+	return s.wal.fsync_latency.stats()
+}
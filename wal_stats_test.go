@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// the fsync latency histogram, see wal_stats.go
+
+// a value lands in a bucket whose top is at or above it and within 1/64 of it, and
+// the buckets go up with the values
+func TestLatencyBucket(t *testing.T) {
+	last := 0
+	for _, v := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 4095, 4096, 1e6, 1e9, 1 << 39, 1<<40 - 1} {
+		i := latency_bucket(v)
+		if i < last {
+			t.Errorf("%d in bucket %d, below %d's", v, i, last)
+		}
+		last = i
+		if top := latency_bucket_max(i); top < v || float64(top-v) > float64(v)/64 {
+			t.Errorf("%d in bucket %d, which goes up to %d", v, i, top)
+		}
+	}
+	if got := latency_bucket(1 << 50); got != fsync_buckets-1 {
+		t.Errorf("2^50ns in bucket %d, want the last, %d", got, fsync_buckets-1)
+	}
+}
+
+// the quantiles of 1..1000µs are where they should be, to the bucket
+func TestLatencyHistogram(t *testing.T) {
+	var h latency_histogram
+	if (h.stats() != WALStats{}) {
+		t.Errorf("stats of nothing: %+v", h.stats())
+	}
+	for i := 1; i <= 1000; i++ {
+		h.observe(time.Duration(i) * time.Microsecond)
+	}
+	stats := h.stats()
+	if stats.Fsyncs != 1000 || stats.Max != time.Millisecond || stats.Total != 500500*time.Microsecond {
+		t.Errorf("stats %+v", stats)
+	}
+	for got, want := range map[time.Duration]time.Duration{stats.P50: 500 * time.Microsecond, stats.P95: 950 * time.Microsecond, stats.P99: 990 * time.Microsecond} {
+		if got < want || got > want+want/64 {
+			t.Errorf("quantile %s, want %s", got, want)
+		}
+	}
+}
+
+// WALStats is zero until the WAL has fsynced, then counts every fsync
+func TestWALStats(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Durability: DurabilityNone})
+	set(t, s, "a", "1")
+	if (s.WALStats() != WALStats{}) {
+		t.Errorf("stats without an fsync: %+v", s.WALStats())
+	}
+	s.Close()
+
+	s = New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	for range 10 {
+		set(t, s, "a", "1")
+	}
+	if stats := s.WALStats(); stats.Fsyncs < 10 || stats.Max <= 0 || stats.P50 > stats.P99 || stats.P99 > stats.Max {
+		t.Errorf("stats after 10 writes: %+v", stats)
+	}
+}
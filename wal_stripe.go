@@ -0,0 +1,528 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// with Options.WALStripes the WAL is striped across several directories, ideally on
+// different disks: the WAL's own file and one log per directory with the same name,
+//
+//	/disk0/kvs_wal.log.000003, /disk1/kvs_wal.log.000003, /disk2/kvs_wal.log.000003
+//
+// a batch (a write, or a group commit batch) is dealt out by LSN, record n to stripe
+// n % stripes, and every stripe writes and fsyncs its share at the same time, so a big
+// batch takes as long as its biggest share on one disk instead of all of it. the stripes
+// roll over together, segment n of the WAL is segment n of every stripe, so checkpoints,
+// COMPACT and the archiver still deal in segment numbers
+//
+// the records don't say which batch they were in, so each share ends with a STRIPE
+// marker: the batch's last LSN and how many stripes it went to. replay reads a segment's
+// files side by side, merges them back into LSN order and holds a batch's records back
+// until every stripe it went to has its marker. a crash in the middle of a batch leaves
+// some shares on disk and not others: that batch was never acknowledged, it is dropped
+// and recovery cuts every stripe back to the last whole batch, like a torn tail. a batch
+// that fails to write is cut back off the stripes that took their share straight away
+//
+// the directories are recorded in the manifest the first time, and the log is read
+// across those from then on, whatever WALStripes says. a log that was written before it
+// was striped carries on from its next segment
+
+const (
+	manifest_stripes      = "wal_stripes"          // the other directories, in stripe order
+	manifest_striped_from = "striped_from_segment" // the segments before this one are only in the WAL's own directory
+)
+
+// errUnfinishedBatch is the end of a striped WAL some stripes have the last batch in and others don't
+var errUnfinishedBatch = errors.New("a batch not every stripe got")
+
+// open_stripes opens the stripes the manifest or opts name, the first time recording them
+func (w *wal) open_stripes(opts Options) {
+	dirs := opts.WALStripes
+	manifest, err := read_manifest(w.manifest_path())
+	if err != nil {
+		log.Printf("WARNING: reading %s: %v, the WAL isn't striped\n", w.manifest_path(), err)
+		return
+	}
+	if recorded := manifest[manifest_stripes]; recorded != "" {
+		if len(dirs) > 0 && !slices.Equal(dirs, filepath.SplitList(recorded)) {
+			log.Printf("WARNING: the WAL is striped across %s, not %v, reading and writing those\n", recorded, dirs)
+		}
+		dirs = filepath.SplitList(recorded)
+		w.striped_from, _ = strconv.ParseUint(manifest[manifest_striped_from], 10, 64)
+	} else if len(dirs) > 0 {
+		if err := w.check_stripes(dirs); err != nil {
+			log.Printf("WARNING: %v, the WAL isn't striped\n", err)
+			return
+		}
+		//an existing log finishes its active segment on its own
+		w.striped_from = w.active
+		if info, err := os.Stat(w.segment_path(w.active)); err == nil && info.Size() > 0 {
+			w.striped_from++
+		}
+		err := update_manifest(w.manifest_path(), manifest_striped_from, strconv.FormatUint(w.striped_from, 10))
+		if err == nil {
+			err = update_manifest(w.manifest_path(), manifest_stripes, strings.Join(dirs, string(filepath.ListSeparator)))
+		}
+		if err != nil {
+			log.Printf("WARNING: recording the stripes in %s: %v, the WAL isn't striped\n", w.manifest_path(), err)
+			return
+		}
+	}
+
+	for _, dir := range dirs {
+		stripe := open_wal(filepath.Join(dir, filepath.Base(w.filename)), opts, w.res, w.fsync_latency)
+		stripe.active = max(w.active, w.striped_from)
+		stripe.shares, stripe.shared = make(chan []byte), make(chan error)
+		w.res.start("wal stripe", stripe.write_shares)
+		w.stripes = append(w.stripes, stripe)
+	}
+}
+
+// check_stripes makes sure every directory is a different one, the WAL's own included
+func (w *wal) check_stripes(dirs []string) error {
+	seen := map[string]bool{}
+	for _, dir := range append([]string{filepath.Dir(w.filename)}, dirs...) {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		if seen[abs] {
+			return fmt.Errorf("%s is in WALStripes twice, or is the WAL's own directory", dir)
+		}
+		seen[abs] = true
+	}
+	return nil
+}
+
+// striped says whether segment seq is written across the stripes
+func (w *wal) striped(seq uint64) bool {
+	return len(w.stripes) > 0 && seq >= w.striped_from
+}
+
+// each_stripe calls fn with every stripe, under its lock
+// caller must hold w.wal_lock
+func (w *wal) each_stripe(fn func(stripe *wal) error) error {
+	for _, stripe := range w.stripes {
+		stripe.wal_lock.Lock()
+		err := fn(stripe)
+		stripe.wal_lock.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// log_segments is segments for the whole WAL, the stripes' included
+func (w *wal) log_segments() ([]uint64, error) {
+	all, err := w.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, stripe := range w.stripes {
+		theirs, err := stripe.segments()
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, theirs...)
+	}
+	slices.Sort(all)
+	return slices.Compact(all), nil
+}
+
+// follow rolls the stripes over to the segment this log is writing
+// caller must hold w.wal_lock
+func (w *wal) follow() error {
+	return w.each_stripe(func(stripe *wal) error {
+		for stripe.active < w.active {
+			if err := stripe.rotate(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// close_stripes closes the stripes' active segments
+// caller must hold w.wal_lock
+func (w *wal) close_stripes() error {
+	return w.each_stripe(func(stripe *wal) error { return stripe.close_active() })
+}
+
+// write_striped is write_records for a striped WAL, see above
+// caller must hold w.wal_lock
+func (w *wal) write_striped(records []wal_record) error {
+	logs := append([]*wal{w}, w.stripes...)
+	shares := make([][]byte, len(logs))
+	marker := wal_record{op: STRIPE}
+	for _, rec := range records {
+		i := rec.lsn % uint64(len(logs))
+		shares[i] = append(shares[i], logs[i].codec.encode(rec)...)
+		marker.lsn = max(marker.lsn, rec.lsn)
+	}
+	took := 0
+	for _, share := range shares {
+		if len(share) > 0 {
+			took++
+		}
+	}
+	marker.value = strconv.Itoa(took)
+	for i := range shares {
+		if len(shares[i]) > 0 {
+			shares[i] = append(shares[i], logs[i].codec.encode(marker)...)
+		}
+	}
+
+	//they roll over together, as soon as one of them would go past the segment size.
+	//the segment the log was in when it was first striped is left to it
+	if err := w.open_active(); err != nil {
+		return err
+	}
+	rotate := w.active < w.striped_from || w.full(shares[0])
+	i := 0
+	err := w.each_stripe(func(stripe *wal) error {
+		i++
+		if err := stripe.open_active(); err != nil {
+			return err
+		}
+		rotate = rotate || stripe.full(shares[i])
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if rotate {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+
+	for _, stripe := range w.stripes {
+		stripe.wal_lock.Lock()
+		defer stripe.wal_lock.Unlock()
+	}
+	before := make([]int64, len(logs))
+	for i, l := range logs[1:] {
+		before[i+1] = l.size
+		if len(shares[i+1]) > 0 {
+			l.shares <- shares[i+1]
+		}
+	}
+	before[0] = w.size
+	errs := make([]error, len(logs))
+	if len(shares[0]) > 0 {
+		errs[0] = w.write_share(shares[0])
+	}
+	for i, l := range logs[1:] {
+		if len(shares[i+1]) > 0 {
+			errs[i+1] = <-l.shared
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		//the stripes that took their share would have it replayed if a later batch came after
+		for i, l := range logs {
+			if len(shares[i]) > 0 {
+				l.cut_back(before[i])
+			}
+		}
+		return err
+	}
+
+	wal_records_total.Add(uint64(len(records)))
+	for _, rec := range records {
+		log.Printf("\nlogged operation to WAL: %s\n", rec)
+	}
+	return nil
+}
+
+// full says whether share would take the active segment past the segment size, an
+// empty segment takes it however big it is
+// caller must hold w.wal_lock
+func (w *wal) full(share []byte) bool {
+	return len(share) > 0 && w.size > 0 && (w.rotate_next || w.size+int64(len(share)) > w.segment_size)
+}
+
+// write_shares writes the stripe's shares of batches as write_striped hands them over,
+// until the WAL is closed
+func (w *wal) write_shares() {
+	for share := range w.shares {
+		w.shared <- w.write_share(share)
+	}
+}
+
+// write_share appends a stripe's share of a batch to its active segment and fsyncs it
+// like write_records does. the WAL holds the stripe's lock while it waits for it
+func (w *wal) write_share(share []byte) error {
+	if err := w.put(share); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// cut_back drops what was written to the active segment past size, the share of a batch
+// that failed. the next write opens the segment again
+// caller must hold w.wal_lock
+func (w *wal) cut_back(size int64) {
+	//whatever made it into the file past size, close_active truncates it off
+	w.size, w.allocated = size, math.MaxInt64
+	if err := w.close_active(); err != nil {
+		log.Printf("WARNING: %s: cutting a failed batch off: %v\n", w.segment_path(w.active), err)
+	}
+}
+
+// rewrite_stripes writes the stripes' files of segment seq for rewrite, each with nothing
+// but the marker of the one batch the segment is, and returns records with the marker
+// for this log's file
+// caller must hold w.wal_lock
+func (w *wal) rewrite_stripes(seq uint64, records []wal_record) ([]wal_record, error) {
+	marker := wal_record{op: STRIPE, value: strconv.Itoa(len(w.stripes) + 1)}
+	for _, rec := range records {
+		marker.lsn = max(marker.lsn, rec.lsn)
+	}
+	err := w.each_stripe(func(stripe *wal) error {
+		return stripe.write_segment(seq, []wal_record{marker})
+	})
+	return append(records[:len(records):len(records)], marker), err
+}
+
+// replaced moves a stripe on to the segment a rewrite wrote, and drops its older ones
+// caller must hold the WAL's wal_lock
+func (w *wal) replaced(seq uint64) error {
+	w.wal_lock.Lock()
+	defer w.wal_lock.Unlock()
+
+	old_segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	if err := w.close_active(); err != nil {
+		return err
+	}
+	w.active = seq
+	return w.drop_segments(old_segments, seq)
+}
+
+// read_striped is read_segment for a segment written across the stripes
+// last is whether it is the newest one, where a crash leaves its mark
+func (w *wal) read_striped(seq uint64, last bool, fn func(rec wal_record) error) error {
+	if w.key_err != nil {
+		return w.key_err
+	}
+	m, err := w.merge_stripes(seq, last)
+	if err != nil {
+		return err
+	}
+	defer m.close()
+	err = read_records(m, fn)
+	if m.dropped > 0 {
+		log.Printf("WARNING: %s: dropped %d records of batches not every stripe has, they were never acknowledged\n", w.segment_path(seq), m.dropped)
+	}
+	return err
+}
+
+// stripe_merge reads one segment of a striped WAL, the records in the stripes' files of
+// it in LSN order and a batch's only once it is whole, see above
+type stripe_merge struct {
+	w       *wal
+	heads   []*stripe_head
+	batch   []stripe_record // the records of the batch being read
+	lsn     uint64          // the last LSN of the batch whose markers are being counted
+	markers int             // how many of them have been read
+	ready   []stripe_record // a whole batch, being handed out
+	dropped int             // records of batches a stripe is missing
+	last    bool            // the newest segment, see read_striped
+	path    string          // the file of the record next returned last
+}
+
+type stripe_record struct {
+	rec    wal_record
+	path   string
+	offset int64
+}
+
+// stripe_head is one stripe's file of the segment, read a record ahead
+type stripe_head struct {
+	path    string
+	file    *os.File
+	records record_reader
+	rec     wal_record
+	offset  int64 // where rec starts, once done where the records end
+	done    bool
+	kept    int64 // where the last whole batch ends in the file
+	torn    error // the bad record the newest segment ends with
+}
+
+// merge_stripes opens the stripes' files of segment seq
+func (w *wal) merge_stripes(seq uint64, last bool) (*stripe_merge, error) {
+	m := &stripe_merge{w: w, last: last}
+	for _, l := range append([]*wal{w}, w.stripes...) {
+		h := &stripe_head{path: l.segment_path(seq)}
+		m.heads = append(m.heads, h)
+		file, err := w.res.open_file("segment", h.path, os.O_RDONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			//a crash can leave a segment in some stripes and not others
+			h.done = true
+			continue
+		}
+		if err != nil {
+			m.close()
+			return nil, err
+		}
+		h.file = file
+		reader, err := segment_reader(file)
+		if err != nil {
+			m.close()
+			return nil, fmt.Errorf("%s: %w", h.path, err)
+		}
+		h.records = w.records_of(h.path, reader)
+		if err := m.advance(h); err != nil {
+			m.close()
+			return nil, err
+		}
+		h.kept = h.offset
+	}
+	return m, nil
+}
+
+// advance reads h's next record
+func (m *stripe_merge) advance(h *stripe_head) error {
+	rec, offset, err := h.records.next()
+	h.rec, h.offset = rec, offset
+	if err == io.EOF {
+		h.done = true
+		return nil
+	}
+	//a write the crash cut short, nothing after it in this stripe counts
+	var corrupt *corrupt_record_error
+	if errors.As(err, &corrupt) && corrupt.final && m.last {
+		h.done, h.torn, h.offset = true, err, corrupt.offset
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", h.path, err)
+	}
+	return nil
+}
+
+// lowest is the head with the lowest LSN, a batch's records before its markers
+func (m *stripe_merge) lowest() *stripe_head {
+	var lowest *stripe_head
+	for _, h := range m.heads {
+		if h.done {
+			continue
+		}
+		if lowest == nil || h.rec.lsn < lowest.rec.lsn || (h.rec.lsn == lowest.rec.lsn && lowest.rec.op == STRIPE && h.rec.op != STRIPE) {
+			lowest = h
+		}
+	}
+	return lowest
+}
+
+func (m *stripe_merge) next() (wal_record, int64, error) {
+	for len(m.ready) == 0 {
+		h := m.lowest()
+		if h == nil {
+			return wal_record{}, 0, m.end()
+		}
+		rec, offset := h.rec, h.offset
+		if err := m.advance(h); err != nil {
+			return wal_record{}, 0, err
+		}
+		//a stripe got past the batch without its marker
+		if m.markers > 0 && rec.lsn > m.lsn {
+			m.drop()
+		}
+		if rec.op != STRIPE {
+			m.batch = append(m.batch, stripe_record{rec: rec, path: h.path, offset: offset})
+			continue
+		}
+		if m.markers == 0 {
+			m.lsn = rec.lsn
+		}
+		m.markers++
+		if want, _ := strconv.Atoi(rec.value); m.markers >= want {
+			m.ready, m.batch, m.markers = m.batch, nil, 0
+			for _, h := range m.heads {
+				h.kept = h.offset
+			}
+		}
+	}
+	r := m.ready[0]
+	m.ready = m.ready[1:]
+	m.path = r.path
+	return r.rec, r.offset, nil
+}
+
+// end is what next returns once every file has been read: a batch that isn't whole is
+// dropped, and in the newest segment every stripe with more than whole batches in it is
+// a torn tail to cut back to the last one
+func (m *stripe_merge) end() error {
+	m.drop()
+	if !m.last {
+		return io.EOF
+	}
+	var tails []error
+	for _, h := range m.heads {
+		if h.torn == nil && h.offset <= h.kept {
+			continue
+		}
+		err := h.torn
+		if err == nil {
+			err = errUnfinishedBatch
+		}
+		tails = append(tails, &torn_tail_error{path: h.path, offset: h.kept, err: err})
+	}
+	if len(tails) == 0 {
+		return io.EOF
+	}
+	return errors.Join(tails...)
+}
+
+func (m *stripe_merge) drop() {
+	m.dropped += len(m.batch)
+	m.batch, m.markers = nil, 0
+}
+
+func (m *stripe_merge) close() {
+	for _, h := range m.heads {
+		if h.file != nil {
+			m.w.res.close(h.file)
+			h.file = nil
+		}
+	}
+}
+
+// torn_tails is the torn tails in err, a striped WAL can have one in every stripe
+func torn_tails(err error) []*torn_tail_error {
+	var tails []*torn_tail_error
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+	for _, err := range errs {
+		var torn *torn_tail_error
+		if errors.As(err, &torn) {
+			tails = append(tails, torn)
+		}
+	}
+	return tails
+}
+
+// unfinished says whether the tails are only a batch the crash interrupted, no damage
+func unfinished(tails []*torn_tail_error) bool {
+	for _, torn := range tails {
+		if !errors.Is(torn, errUnfinishedBatch) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// striped logs, see wal_stripe.go. like persistence_test.go the crashed stores are just
+// abandoned
+
+func open_striped(t *testing.T, path string, opts Options) *Store {
+	t.Helper()
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if len(s.wal.stripes) != 2 {
+		t.Fatalf("the WAL has %d stripes, want 2", len(s.wal.stripes))
+	}
+	return s
+}
+
+func stripe_dirs(t *testing.T) (string, []string) {
+	return filepath.Join(t.TempDir(), "wal.log"), []string{t.TempDir(), t.TempDir()}
+}
+
+func check_keys(t *testing.T, s *Store, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if v, _ := s.Get(key{name: name}); v != name {
+			t.Errorf("%s = %q after recovery", name, v)
+		}
+	}
+}
+
+// every stripe gets a share, and what was acknowledged comes back in LSN order
+func TestStripedWAL(t *testing.T) {
+	for _, group := range []bool{false, true} {
+		t.Run("group="+strconv.FormatBool(group), func(t *testing.T) {
+			path, dirs := stripe_dirs(t)
+			s := open_striped(t, path, Options{WALStripes: dirs, GroupCommit: group})
+			var names []string
+			var writers sync.WaitGroup
+			for w := 0; w < 4; w++ {
+				for i := 0; i < 25; i++ {
+					names = append(names, "k:"+strconv.Itoa(w*25+i))
+				}
+				writers.Add(1)
+				go func(names []string) {
+					defer writers.Done()
+					for _, name := range names {
+						if err := s.Set(key{name: name}, 0, name); err != nil {
+							t.Error(err)
+						}
+					}
+				}(names[w*25:])
+			}
+			writers.Wait()
+			for _, stripe := range s.wal.stripes {
+				info, err := os.Stat(stripe.segment_path(stripe.active))
+				if err != nil || info.Size() == 0 {
+					t.Errorf("%s: nothing written: %v", stripe.segment_path(stripe.active), err)
+				}
+			}
+
+			//crash, and reopened without WALStripes: the manifest has them
+			s = open_striped(t, path, Options{GroupCommit: group})
+			defer s.Close()
+			check_keys(t, s, names...)
+			var last uint64
+			err := s.ReplayFrom(0, func(e Entry) error {
+				if e.LSN <= last {
+					t.Errorf("LSN %d after %d", e.LSN, last)
+				}
+				last = e.LSN
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last != s.LastLSN() {
+				t.Errorf("ReplayFrom ended at LSN %d, the store is at %d", last, s.LastLSN())
+			}
+		})
+	}
+}
+
+// a crash that leaves a batch in some stripes and not others: the batch is dropped and
+// every stripe cut back to the batch before it, without TruncateTornTail
+func TestStripedUnfinishedBatch(t *testing.T) {
+	path, dirs := stripe_dirs(t)
+	opts := Options{WALStripes: dirs}
+	s := open_striped(t, path, opts)
+	set(t, s, "a", "a")
+	set(t, s, "b", "b")
+	set(t, s, "c", "c")
+	segment := s.wal.segment_path(s.wal.active)
+	before, err := os.Stat(segment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//one batch with a record in every stripe
+	tx := s.Begin()
+	for _, name := range []string{"x", "y", "z"} {
+		tx.Set(key{name: name}, 0, name)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	//the crash came before this log's share hit the disk, the other stripes have theirs.
+	//a share the crash cut short is a torn tail like any other, see TruncateTornTail
+	if err := os.Truncate(segment, before.Size()); err != nil {
+		t.Fatal(err)
+	}
+	var sizes []int64
+	for _, stripe := range s.wal.stripes {
+		info, err := os.Stat(stripe.segment_path(stripe.active))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, info.Size())
+	}
+
+	s, report, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatalf("recover: %v", err)
+	}
+	if !report.TornTail {
+		t.Error("the unfinished batch wasn't reported as a torn tail")
+	}
+	check_keys(t, s, "a", "b", "c")
+	for _, name := range []string{"x", "y", "z"} {
+		if _, ok := s.Get(key{name: name}); ok {
+			t.Errorf("%s of the unfinished batch was recovered", name)
+		}
+	}
+	for i, stripe := range s.wal.stripes {
+		info, err := os.Stat(stripe.segment_path(stripe.active))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() >= sizes[i] {
+			t.Errorf("%s wasn't cut back", stripe.segment_path(stripe.active))
+		}
+	}
+
+	//what is written after lines up again
+	set(t, s, "d", "d")
+	s = open_striped(t, path, opts)
+	defer s.Close()
+	check_keys(t, s, "a", "b", "c", "d")
+}
+
+// checkpoints and COMPACT drop and rewrite the segments of every stripe
+func TestStripedCompaction(t *testing.T) {
+	path, dirs := stripe_dirs(t)
+	opts := Options{WALStripes: dirs, Persistence: PersistBoth}
+	s := open_striped(t, path, opts)
+	for i := 0; i < 10; i++ {
+		set(t, s, "k", strconv.Itoa(i))
+		set(t, s, "k:"+strconv.Itoa(i), "k:"+strconv.Itoa(i))
+	}
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "k", "k")
+	set(t, s, "after", "after")
+	if _, err := s.CompactWAL(); err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "compacted", "compacted")
+	segments := wal_segments(t, s)
+	for _, stripe := range s.wal.stripes {
+		theirs, err := stripe.segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(theirs) != len(segments) || theirs[0] != segments[0] {
+			t.Errorf("%s has segments %v, the WAL %v", stripe.filename, theirs, segments)
+		}
+	}
+
+	s = open_striped(t, path, opts)
+	defer s.Close()
+	check_keys(t, s, "k", "after", "compacted", "k:0", "k:9")
+}
+
+// a log written before it was striped is read from its own directory up to the segment
+// the stripes start at
+func TestStripingExistingWAL(t *testing.T) {
+	path, dirs := stripe_dirs(t)
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "before", "before")
+	s.Close()
+
+	s = open_striped(t, path, Options{WALStripes: dirs})
+	if s.wal.striped_from == 0 || s.wal.striped(s.wal.striped_from-1) {
+		t.Errorf("the old segments are striped, from %d", s.wal.striped_from)
+	}
+	set(t, s, "after", "after")
+	s = open_striped(t, path, Options{})
+	defer s.Close()
+	check_keys(t, s, "before", "after")
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the walbench modes as go benchmarks, concurrent SETs of 100 byte values into a fresh
+// WAL each, with the fsyncs per SET next to the time:
+//
+//	go test -run XXX -bench WAL -cpu 1,8
+//
+// -cpu is how many writers there are (RunParallel runs one per GOMAXPROCS): group
+// commit only pays off with more than one, everysec and async fsync off the write path
+
+func bench_wal(b *testing.B, opts Options) {
+	s := New_Store(filepath.Join(b.TempDir(), "wal.log"), opts)
+	defer s.Close()
+	value := strings.Repeat("v", 100)
+	if err := s.Set(key{name: "probe"}, 0, value); err != nil {
+		//O_DIRECT isn't there on every filesystem, tmpfs for one
+		b.Skipf("first write failed: %v", err)
+	}
+	before := s.WALStats().Fsyncs
+
+	var next atomic.Uint64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := s.Set(key{name: "key:" + strconv.FormatUint(next.Add(1), 10)}, 0, value); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+	b.StopTimer()
+	b.ReportMetric(float64(s.WALStats().Fsyncs-before)/float64(b.N), "fsyncs/op")
+}
+
+func BenchmarkWAL(b *testing.B) {
+	for _, mode := range walbench_modes {
+		b.Run(mode.name, func(b *testing.B) { bench_wal(b, mode.opts) })
+	}
+}
+
+// the adaptive window against none: a target so low the controller shrinks the window
+// to nothing straight away, so each batch is only what queued during the last fsync
+func BenchmarkGroupCommitWindow(b *testing.B) {
+	for _, target := range []time.Duration{time.Nanosecond, default_group_commit_target} {
+		b.Run(fmt.Sprintf("target=%s", target), func(b *testing.B) {
+			bench_wal(b, Options{GroupCommit: true, GroupCommitTarget: target})
+		})
+	}
+}
+
+// past WALSegmentSize the log goes on in a new segment, the old ones sealed and
+// replayed in order on a restart
+func TestSegmentRotation(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{WALSegmentSize: 4 << 10}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 100)
+	for i := 0; i < 200; i++ {
+		set(t, s, "k"+strconv.Itoa(i%50), value+strconv.Itoa(i))
+	}
+	segments := wal_segments(t, s)
+	if len(segments) < 4 {
+		t.Fatalf("%d segments for 20KB of records in 4KB ones", len(segments))
+	}
+	for i, seq := range segments {
+		if seq != uint64(i) {
+			t.Fatalf("segments %v aren't numbered from 0", segments)
+		}
+	}
+	for _, seq := range segments[:len(segments)-1] {
+		info, err := os.Stat(s.wal.segment_path(seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > 4<<10+200 {
+			t.Errorf("segment %d is %d bytes, more than a record past the size", seq, info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".000001"); err != nil {
+		t.Errorf("the second segment isn't at %s.000001: %v", path, err)
+	}
+	s.Close()
+
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 150; i < 200; i++ {
+		if got := get(t, s, "k"+strconv.Itoa(i%50)); got != value+strconv.Itoa(i) {
+			t.Fatalf("k%d after a restart: %q", i%50, got)
+		}
+	}
+}
+
+// concurrent writers share fsyncs, each gets its answer once its batch is durable, and
+// every write is there after a restart
+func TestGroupCommit(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{GroupCommit: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const writers, writes = 16, 50
+	before := s.WALStats().Fsyncs
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range writes {
+				if err := s.Set(key{name: fmt.Sprintf("w%d:%d", w, i)}, 0, "v"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	stats, ok := s.GroupCommitStats()
+	if !ok || stats.Records != writers*writes {
+		t.Fatalf("group commit stats %+v, on %v", stats, ok)
+	}
+	if stats.Batches >= stats.Records {
+		t.Errorf("%d batches for %d records", stats.Batches, stats.Records)
+	}
+	if fsyncs := s.WALStats().Fsyncs - before; fsyncs > stats.Batches {
+		t.Errorf("%d fsyncs for %d batches", fsyncs, stats.Batches)
+	}
+	s.Close()
+
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.Keys(0, "*")); n != writers*writes {
+		t.Errorf("%d keys after a restart, want %d", n, writers*writes)
+	}
+}
+
+// always fsyncs every write, everysec once a second whatever was written since, and
+// none never
+func TestDurability(t *testing.T) {
+	quiet_log(t)
+	for name, want := range map[string]Durability{"always": DurabilityAlways, "EverySec": DurabilityEverySec, "none": DurabilityNone} {
+		if d, err := ParseDurability(name); d != want || err != nil {
+			t.Errorf("ParseDurability(%s) = %v %v", name, d, err)
+		}
+	}
+	if _, err := ParseDurability("sometimes"); err == nil {
+		t.Error("ParseDurability(sometimes)")
+	}
+
+	fsyncs := func(d Durability, wait time.Duration) uint64 {
+		s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Durability: d})
+		defer s.Close()
+		before := s.WALStats().Fsyncs
+		for i := range 10 {
+			set(t, s, "k"+strconv.Itoa(i), "v")
+		}
+		time.Sleep(wait)
+		return s.WALStats().Fsyncs - before
+	}
+	if n := fsyncs(DurabilityAlways, 0); n != 10 {
+		t.Errorf("always: %d fsyncs for 10 writes", n)
+	}
+	if n := fsyncs(DurabilityNone, 0); n != 0 {
+		t.Errorf("none: %d fsyncs", n)
+	}
+	if n := fsyncs(DurabilityEverySec, 0); n != 0 {
+		t.Errorf("everysec: %d fsyncs straight after the writes", n)
+	}
+	if n := fsyncs(DurabilityEverySec, 1500*time.Millisecond); n != 1 {
+		t.Errorf("everysec: %d fsyncs a second and a half after 10 writes", n)
+	}
+}
+
+// with AsyncWAL the acks of SetAsync and DeleteAsync come once the writes are durable,
+// and Close writes out what is still queued
+func TestAsyncWAL(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{AsyncWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var acks []<-chan error
+	for i := range 100 {
+		ack, err := s.SetAsync(key{name: "k" + strconv.Itoa(i)}, 0, "v")
+		if err != nil {
+			t.Fatal(err)
+		}
+		acks = append(acks, ack)
+	}
+	//visible before it's durable
+	if get(t, s, "k99") != "v" {
+		t.Error("k99 isn't there straight after SetAsync")
+	}
+	ack, err := s.DeleteAsync(key{name: "k0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ack := range append(acks, ack) {
+		if err := <-ack; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 100; i < 200; i++ {
+		set(t, s, "k"+strconv.Itoa(i), "v")
+	}
+	s.Close()
+
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.Keys(0, "*")); n != 199 || s.Exists(key{name: "k0"}) {
+		t.Errorf("%d keys after a restart, k0 there %v", n, s.Exists(key{name: "k0"}))
+	}
+}
+
+// PreallocateWAL allocates a segment's full size up front, writes go over the zero fill,
+// a crashed store's segment replays up to its records and a closed one is cut back
+func TestPreallocateWAL(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	opts := Options{PreallocateWAL: true, WALSegmentSize: 64 << 10}
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 10 {
+		set(t, s, "k"+strconv.Itoa(i), "v")
+	}
+	if info, _ := os.Stat(path); info.Size() != 64<<10 {
+		t.Errorf("a preallocated segment is %d bytes", info.Size())
+	}
+	//crashed: never closed, the zero fill still there
+	s, _, err = Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "k10", "v")
+	if info, _ := os.Stat(path); info.Size() != 64<<10 {
+		t.Errorf("the segment grew to %d bytes writing over its zero fill", info.Size())
+	}
+	s.Close()
+	info, _ := os.Stat(path)
+	if info.Size() >= 64<<10 {
+		t.Errorf("closing left the zero fill, %d bytes", info.Size())
+	}
+
+	s, _, err = Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if n := len(s.Keys(0, "*")); n != 11 {
+		t.Errorf("%d keys after the restarts, want 11", n)
+	}
+}
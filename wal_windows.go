@@ -0,0 +1,47 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// no fallocate here, preallocate falls back to writing zeros
+func allocate(fd *os.File, from int64, size int64) error {
+	return errors.New("fallocate is not supported on this platform")
+}
+
+// FILE_FLAG_NO_BUFFERING would be the equivalent, os.OpenFile can't pass it
+func open_direct(path string) (*os.File, error) {
+	return nil, errors.New("O_DIRECT is not supported on this platform")
+}
+
+// sync_data is FlushFileBuffers, which writes out the file's data and
+// metadata and tells the drive to flush its cache; Windows has nothing lighter
+func sync_data(fd *os.File) error {
+	return sync_file(fd)
+}
+
+func sync_file(fd *os.File) error {
+	if err := syscall.FlushFileBuffers(syscall.Handle(fd.Fd())); err != nil {
+		return &os.PathError{Op: "FlushFileBuffers", Path: fd.Name(), Err: err}
+	}
+	return nil
+}
+
+// no huge page mappings here, the buffer pool uses ordinary aligned memory
+func alloc_huge(n int) ([]byte, bool) {
+	return nil, false
+}
+
+func free_huge(buf []byte) {}
+
+// FlushFileBuffers on a directory handle is access denied, and NTFS journals
+// renames itself, so there is nothing to do for a directory
+const can_sync_dir = false
+
+var sync_primitives = []sync_primitive{
+	{name: "FlushFileBuffers", durable: true, sync: sync_file},
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+// `go-io-drill walbench` runs the same SET workload against each WAL write
+// strategy, every one in a fresh WAL, and prints them side by side
+//
+// latency is per Set call, so for async it is the time to queue the record;
+// the elapsed time includes Close, which waits for whatever is still queued
+//
+// with -readers, that many goroutines Get random keys of the workload for as long
+// as the writers run, to see how much the writes hold the reads up. reads are too
+// many to keep every latency, one in read_sample is timed
+
+type walbench_mode struct {
+	name string
+	opts Options
+}
+
+var walbench_modes = []walbench_mode{
+	{"sync", Options{}},
+	{"group", Options{GroupCommit: true}},
+	{"everysec", Options{Durability: DurabilityEverySec}},
+	{"async", Options{AsyncWAL: true}},
+	{"direct", Options{DirectIO: true}},
+}
+
+const read_sample = 64
+
+type walbench_result struct {
+	ops     int
+	elapsed time.Duration
+	p50     time.Duration
+	p99     time.Duration
+	fsyncs  uint64
+
+	reads    int
+	read_p99 time.Duration
+}
+
+func run_walbench(args []string) error {
+	flags := flag.NewFlagSet("walbench", flag.ContinueOnError)
+	ops := flags.Int("ops", 10000, "SETs per mode")
+	workers := flags.Int("workers", 8, "concurrent writers")
+	readers := flags.Int("readers", 0, "concurrent readers, Getting keys while the writers run")
+	value_size := flags.Int("value", 100, "value size in bytes")
+	dir := flags.String("dir", "", "where the WALs go (default: a temp dir, removed afterwards)")
+	only := flags.String("modes", "", "comma separated modes to run (default: sync,group,everysec,async,direct)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *ops <= 0 || *workers <= 0 || *readers < 0 {
+		return errors.New("walbench: -ops and -workers must be positive, -readers can't be negative")
+	}
+
+	modes := walbench_modes
+	if *only != "" {
+		modes = nil
+		for _, name := range strings.Split(*only, ",") {
+			mode, ok := find_walbench_mode(strings.TrimSpace(name))
+			if !ok {
+				return errors.New("walbench: unknown mode " + name)
+			}
+			modes = append(modes, mode)
+		}
+	}
+
+	if *dir == "" {
+		tmp, err := os.MkdirTemp("", "walbench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmp)
+		*dir = tmp
+	}
+
+	//the store logs every write, which would be most of what we measure
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	fmt.Printf("%d SETs of %d byte values, %d writers, %d readers\n\n", *ops, *value_size, *workers, *readers)
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "mode\tops/s\tp50\tp99\tfsyncs\treads/s\tread p99\t")
+	for _, mode := range modes {
+		path := filepath.Join(*dir, mode.name+".wal")
+		res, err := walbench_run(path, mode.opts, *ops, *workers, *readers, *value_size)
+		if err != nil {
+			fmt.Fprintf(table, "%s\tfailed: %v\t\t\t\t\t\t\n", mode.name, err)
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%.0f\t%s\t%s\t%d\t%.0f\t%s\t\n", mode.name,
+			float64(res.ops)/res.elapsed.Seconds(), res.p50, res.p99, res.fsyncs,
+			float64(res.reads)/res.elapsed.Seconds(), res.read_p99)
+	}
+	return table.Flush()
+}
+
+func find_walbench_mode(name string) (walbench_mode, bool) {
+	for _, mode := range walbench_modes {
+		if mode.name == name {
+			return mode, true
+		}
+	}
+	return walbench_mode{}, false
+}
+
+func walbench_run(path string, opts Options, ops int, workers int, readers int, value_size int) (walbench_result, error) {
+	s := New_Store(path, opts)
+	if err := s.Replay_wal(); err != nil {
+		s.Close()
+		return walbench_result{}, err
+	}
+	//O_DIRECT and friends fail on the first write, not on open
+	if err := s.Set(key{name: "walbench:probe"}, 0, "x"); err != nil {
+		s.Close()
+		return walbench_result{}, err
+	}
+
+	value := strings.Repeat("v", value_size)
+	fsyncs := wal_fsyncs_total.Value()
+	latencies := make([][]time.Duration, workers)
+	errs := make([]error, workers)
+
+	done := make(chan struct{})
+	read_latencies := make([][]time.Duration, readers)
+	var reads atomic.Int64
+	var read_wg sync.WaitGroup
+	for r := 0; r < readers; r++ {
+		read_wg.Add(1)
+		go func(r int) {
+			defer read_wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(r), 0))
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					reads.Add(int64(i))
+					return
+				default:
+				}
+				k := key{name: "walbench:" + strconv.Itoa(rng.IntN(ops))}
+				if i%read_sample != 0 {
+					s.Get(k)
+					continue
+				}
+				op_start := time.Now()
+				s.Get(k)
+				read_latencies[r] = append(read_latencies[r], time.Since(op_start))
+			}
+		}(r)
+	}
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; i < ops; i += workers {
+				op_start := time.Now()
+				if err := s.Set(key{name: "walbench:" + strconv.Itoa(i)}, 0, value); err != nil {
+					errs[w] = err
+					return
+				}
+				latencies[w] = append(latencies[w], time.Since(op_start))
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+	read_wg.Wait()
+	close_err := s.Close()
+	elapsed := time.Since(start)
+
+	if err := errors.Join(append(errs, close_err)...); err != nil {
+		return walbench_result{}, err
+	}
+
+	all := walbench_sorted(latencies)
+	res := walbench_result{
+		ops:     len(all),
+		elapsed: elapsed,
+		p50:     all[len(all)*50/100],
+		p99:     all[len(all)*99/100],
+		fsyncs:  wal_fsyncs_total.Value() - fsyncs,
+	}
+	if timed := walbench_sorted(read_latencies); len(timed) > 0 {
+		res.reads = int(reads.Load())
+		res.read_p99 = timed[len(timed)*99/100]
+	}
+	return res, nil
+}
+
+// walbench_sorted is every worker's latencies in one sorted slice
+func walbench_sorted(latencies [][]time.Duration) []time.Duration {
+	var all []time.Duration
+	for _, l := range latencies {
+		all = append(all, l...)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+	return all
+}
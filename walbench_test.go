@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// the walbench subcommand, see walbench.go
+
+// a row per mode asked for, sync with an fsync per write and group commit with fewer
+func TestWALBench(t *testing.T) {
+	var err error
+	out := stdout(t, func() {
+		err = run_walbench([]string{"-ops", "200", "-workers", "4", "-readers", "2", "-modes", "sync,group,async", "-dir", t.TempDir()})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsyncs := map[string]int{}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 7 && f[0] != "mode" {
+			fsyncs[f[0]], _ = strconv.Atoi(f[4])
+		}
+	}
+	if len(fsyncs) != 3 {
+		t.Fatalf("rows for %v:\n%s", fsyncs, out)
+	}
+	if fsyncs["sync"] < 200 || fsyncs["group"] >= fsyncs["sync"] {
+		t.Errorf("fsyncs %v for 200 writes", fsyncs)
+	}
+
+	for _, args := range [][]string{{"-modes", "fast"}, {"-ops", "0"}, {"-readers", "-1"}} {
+		stdout(t, func() { err = run_walbench(args) })
+		if err == nil {
+			t.Errorf("walbench %v", args)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// `go-io-drill waldump kvs_wal.log` prints every record of a WAL, one per line:
+// LSN, segment, offset, op, database, key, value size, expiry and whether it checked out
+//
+// damaged records in segments with record markers are reported and skipped,
+// anything else that fails to decode is reported and ends the dump, with a non-zero exit
+
+func run_waldump(args []string) error {
+	flags := flag.NewFlagSet("waldump", flag.ContinueOnError)
+	only_key := flags.String("key", "", "only records for this key")
+	only_op := flags.String("op", "", "only records with this op (SET, DELETE, EXPIRE, ...)")
+	only_db := flags.Int("db", -1, "only records for keys in this database")
+	key_hex := flags.String("encryption-key", "", "hex encoded key, for a WAL written with EncryptionKey")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: waldump [-key k] [-op OP] [-db n] [-encryption-key hex] wal.log")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("waldump: expected the WAL's first segment, e.g. kvs_wal.log")
+	}
+
+	var encryption_key []byte
+	if *key_hex != "" {
+		var err error
+		if encryption_key, err = hex.DecodeString(*key_hex); err != nil {
+			return errors.New("waldump: -encryption-key is not hex")
+		}
+	}
+	reader, err := OpenEncryptedWALReader(flags.Arg(0), encryption_key)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "LSN\tSEGMENT\tOFFSET\tOP\tDB\tKEY\tVALUE\tEXPIRY\tSTATUS")
+	reader.SkipDamaged(func(segment string, offset int64, skipped int64) {
+		fmt.Fprintf(table, "-\t%s\t%d\t-\t-\t-\t-\t-\tDAMAGED, skipped %d bytes\n", filepath.Base(segment), offset, skipped)
+	})
+
+	records, shown := 0, 0
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(table, "-\t-\t-\t-\t-\t-\t-\t-\tBAD: %v\n", err)
+			table.Flush()
+			return errors.New("waldump: stopped at a bad record")
+		}
+		records++
+		if *only_key != "" && e.Key != *only_key {
+			continue
+		}
+		if *only_op != "" && !strings.EqualFold(e.Op, *only_op) {
+			continue
+		}
+		if *only_db >= 0 && e.DB != *only_db {
+			continue
+		}
+		shown++
+		fmt.Fprintf(table, "%d\t%s\t%d\t%s\t%d\t%s\t%s\t%s\tok\n", e.LSN, filepath.Base(e.Segment), e.Offset,
+			e.Op, e.DB, strconv.Quote(e.Key), waldump_value(e), waldump_expiry(e))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d records, %d shown\n", records, shown)
+	return nil
+}
+
+func waldump_value(e Entry) string {
+	if e.Op == "BEGIN" {
+		return e.Value + " records"
+	}
+	switch e.Op {
+	case "SET", "CAS", "APPEND", "HSET", "HDEL", "RESTORE", "LPUSH", "RPUSH", "LPOP", "RPOP", "SADD", "SREM", "ZADD", "ZREM", "RENAME", "COPY":
+	default:
+		return "-"
+	}
+	return strconv.Itoa(len(e.Value)) + "B"
+}
+
+func waldump_expiry(e Entry) string {
+	switch {
+	case !e.ExpiresAt.IsZero():
+		return format_time_into_readable_string(e.ExpiresAt)
+	case e.TTL != 0:
+		return "ttl " + e.TTL.String()
+	}
+	return "-"
+}
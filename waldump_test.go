@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the waldump subcommand, see waldump.go
+
+// stdout is what fn prints
+func stdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stdout
+	os.Stdout = w
+	done := make(chan string)
+	go func() {
+		out, _ := io.ReadAll(r)
+		done <- string(out)
+	}()
+	defer func() { os.Stdout = saved }()
+	fn()
+	w.Close()
+	return <-done
+}
+
+// a line per record the filters let through, and a count of both at the end
+func TestWALDump(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	set(t, s, "a", "hello")
+	s.Set(key{name: "b", db: 2}, time.Hour, "x")
+	s.Delete(key{name: "a"})
+	s.Close()
+
+	var err error
+	out := stdout(t, func() { err = run_waldump([]string{path}) })
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if err != nil || len(lines) != 6 || !strings.HasPrefix(lines[0], "LSN") || lines[5] != "3 records, 3 shown" {
+		t.Fatalf("waldump: %v\n%s", err, out)
+	}
+	if f := strings.Fields(lines[1]); strings.Join(f, " ") != `1 wal.log 5 SET 0 "a" 5B - ok` {
+		t.Errorf("the first record: %s", lines[1])
+	}
+	if f := strings.Fields(lines[2]); f[4] != "2" || f[7] == "-" {
+		t.Errorf("a record in db 2 with an expiry: %s", lines[2])
+	}
+
+	for args, want := range map[string]string{"-key a": "3 records, 2 shown", "-op delete": "3 records, 1 shown", "-db 2": "3 records, 1 shown"} {
+		out := stdout(t, func() { err = run_waldump(append(strings.Fields(args), path)) })
+		if err != nil || !strings.HasSuffix(strings.TrimSpace(out), want) {
+			t.Errorf("waldump %s: %v\n%s", args, err, out)
+		}
+	}
+}
+
+// an encrypted log needs its key, and a record that can't be read ends the dump
+func TestWALDumpFailures(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	secret := []byte("0123456789abcdef")
+	s, _, err := Recover("", path, Options{EncryptionKey: secret})
+	if err != nil {
+		t.Fatal(err)
+	}
+	set(t, s, "a", "1")
+	s.Close()
+
+	out := stdout(t, func() { err = run_waldump([]string{"-encryption-key", hex.EncodeToString(secret), path}) })
+	if err != nil || !strings.HasSuffix(strings.TrimSpace(out), "1 records, 1 shown") {
+		t.Errorf("waldump with the key: %v\n%s", err, out)
+	}
+	out = stdout(t, func() { err = run_waldump([]string{path}) })
+	if err == nil || !strings.Contains(out, "BAD:") {
+		t.Errorf("waldump without the key: %v\n%s", err, out)
+	}
+	stdout(t, func() { err = run_waldump([]string{"-encryption-key", "zz", path}) })
+	if err == nil {
+		t.Error("waldump with a key that isn't hex")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// warm-up: with Options.WarmUp set to n a checkpoint also writes the n keys used the
+// most, by the LFU score (see eviction.go), to <wal>.snapshot.hot along with how often
+// and when they were used. a restart loads the whole snapshot and log into memory anyway,
+// what it loses is those counts: every key comes back used once, just now, so the first
+// evictions after it are as likely to pick a hot key as a cold one, and every hot key
+// evicted is a miss that goes to Load
+//
+// after Recover a goroutine goes through the list, hottest first: the keys in memory get
+// their counts back, and with Options.Load the ones that aren't (evicted or expired since
+// the checkpoint) are loaded through it, before the first Get for them has to. Stats and
+// INFO show how far it got. the access stats are kept with WarmUp even without a memory
+// cap, there would be nothing to list otherwise
+//
+// file: "QHOT" | version | count (u32) | count × (db (u32) | name length (u32) | name |
+// hits | last access, unix nanoseconds) | crc32 of all before it, little endian, the
+// hits and last access uint64s
+
+const hot_keys_version byte = 1
+
+var hot_keys_magic = []byte{'Q', 'H', 'O', 'T'}
+
+// keys the warm-up restores under one hold of the read lock
+const warm_up_batch = 256
+
+type hot_key struct {
+	k    key
+	hits uint64
+	last int64 // unix nanoseconds
+}
+
+func (h hot_key) score() uint64 {
+	return lfu_score(EvictionCandidate{LastAccess: time.Unix(0, h.last), Accesses: h.hits})
+}
+
+// restore gives a the counts h had at the checkpoint, on top of what it has been used since
+func (h hot_key) restore(a *access_stats) {
+	a.hits.Add(h.hits)
+	if h.last > a.last.Load() {
+		a.last.Store(h.last)
+	}
+}
+
+// warm_up_state is the progress Stats reports, the counts are atomics the warm-up bumps
+// without s.lock
+type warm_up_state struct {
+	total   atomic.Int64
+	done    atomic.Int64
+	loaded  atomic.Int64
+	took    atomic.Int64 // nanoseconds, 0 while it runs
+	running sync.WaitGroup
+}
+
+func (s *Store) hot_keys_path() string {
+	return s.snapshot_path() + ".hot"
+}
+
+// hot_heap keeps the hottest keys seen so far, the coldest of them on top
+type hot_heap []hot_key
+
+func (h hot_heap) Len() int           { return len(h) }
+func (h hot_heap) Less(i, j int) bool { return h[i].score() < h[j].score() }
+func (h hot_heap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *hot_heap) Push(x any)        { *h = append(*h, x.(hot_key)) }
+func (h *hot_heap) Pop() any {
+	last := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return last
+}
+
+// hottest is the n live keys of v with the highest LFU score, hottest first
+func hottest(v *View, n int) []hot_key {
+	var h hot_heap
+	now := time.Now()
+	v.each(func(k key, val value) bool {
+		if val.access == nil || (!val.expires_at.IsZero() && !val.expires_at.After(now)) {
+			return true
+		}
+		hk := hot_key{k: k, hits: val.access.hits.Load(), last: val.access.last.Load()}
+		switch {
+		case h.Len() < n:
+			heap.Push(&h, hk)
+		case hk.score() > h[0].score():
+			h[0] = hk
+			heap.Fix(&h, 0)
+		}
+		return true
+	})
+	hot := make([]hot_key, h.Len())
+	for i := len(hot) - 1; i >= 0; i-- {
+		hot[i] = heap.Pop(&h).(hot_key)
+	}
+	return hot
+}
+
+func encode_hot_keys(hot []hot_key) []byte {
+	buf := append([]byte{}, hot_keys_magic...)
+	buf = append(buf, hot_keys_version)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(hot)))
+	for _, h := range hot {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(h.k.db))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(h.k.name)))
+		buf = append(buf, h.k.name...)
+		buf = binary.LittleEndian.AppendUint64(buf, h.hits)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(h.last))
+	}
+	return binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+}
+
+var errBadHotKeys = errors.New("damaged hot key list")
+
+func decode_hot_keys(data []byte) ([]hot_key, error) {
+	if len(data) < len(hot_keys_magic)+1+4+4 || string(data[:len(hot_keys_magic)]) != string(hot_keys_magic) {
+		return nil, errBadHotKeys
+	}
+	body, crc := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != crc {
+		return nil, errBadHotKeys
+	}
+	if version := body[len(hot_keys_magic)]; version != hot_keys_version {
+		return nil, errors.New("unsupported hot key list version " + strconv.Itoa(int(version)))
+	}
+	body = body[len(hot_keys_magic)+1:]
+	count := int(binary.LittleEndian.Uint32(body))
+	body = body[4:]
+	hot := make([]hot_key, 0, min(count, len(body)/24))
+	for i := 0; i < count; i++ {
+		if len(body) < 8 {
+			return nil, errBadHotKeys
+		}
+		db, length := int(binary.LittleEndian.Uint32(body)), int(binary.LittleEndian.Uint32(body[4:]))
+		body = body[8:]
+		if len(body) < length+16 {
+			return nil, errBadHotKeys
+		}
+		hot = append(hot, hot_key{
+			k:    key{name: string(body[:length]), db: db},
+			hits: binary.LittleEndian.Uint64(body[length:]),
+			last: int64(binary.LittleEndian.Uint64(body[length+8:])),
+		})
+		body = body[length+16:]
+	}
+	if len(body) != 0 {
+		return nil, errBadHotKeys
+	}
+	return hot, nil
+}
+
+// save_hot_keys lists the hottest keys of v for the next start's warm-up
+// caller must hold s.lock if v is the live_view
+func (s *Store) save_hot_keys(v *View) error {
+	return replace_file(s.hot_keys_path(), encode_hot_keys(hottest(v, s.warm_up)))
+}
+
+// start_warm_up starts going through the hot keys the last checkpoint listed, if
+// there is a list and WarmUp is on
+func (s *Store) start_warm_up() {
+	if s.warm_up <= 0 {
+		return
+	}
+	data, err := os.ReadFile(s.hot_keys_path())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var hot []hot_key
+	if err == nil {
+		hot, err = decode_hot_keys(data)
+	}
+	if err != nil {
+		log.Printf("WARNING: %s: %v, starting cold\n", s.hot_keys_path(), err)
+		return
+	}
+	hot = hot[:min(len(hot), s.warm_up)]
+	s.warming.total.Store(int64(len(hot)))
+	s.warming.running.Add(1)
+	err = s.wal.res.try_start("warm-up", func() {
+		defer s.warming.running.Done()
+		s.warm(hot)
+	})
+	if err != nil {
+		s.warming.running.Done()
+		log.Printf("WARNING: no warm-up: %v\n", err)
+	}
+}
+
+// warm restores the counts of the hot keys in memory a batch at a time and loads the
+// missing ones, until it is through them or the store closes
+func (s *Store) warm(hot []hot_key) {
+	start := time.Now()
+	for len(hot) > 0 {
+		batch := hot[:min(len(hot), warm_up_batch)]
+		hot = hot[len(batch):]
+		var missing []hot_key
+		s.lock.RLock()
+		for _, h := range batch {
+			if val, exists := s.data.get(h.k); !exists {
+				missing = append(missing, h)
+			} else if val.access != nil {
+				h.restore(val.access)
+			}
+		}
+		s.lock.RUnlock()
+		s.warming.done.Add(int64(len(batch) - len(missing)))
+
+		for _, h := range missing {
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			if s.load != nil {
+				if _, found := s.load_through(h.k); found {
+					s.warming.loaded.Add(1)
+					s.lock.RLock()
+					if val, exists := s.data.get(h.k); exists && val.access != nil {
+						h.restore(val.access)
+					}
+					s.lock.RUnlock()
+				}
+			}
+			s.warming.done.Add(1)
+		}
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+	}
+	s.warming.took.Store(int64(max(time.Since(start), 1)))
+	log.Printf("Warm-up: %d hot keys in %s, %d loaded\n", s.warming.total.Load(), time.Since(start).Round(time.Millisecond), s.warming.loaded.Load())
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// the warm-up after a restart, see warmup.go
+
+// warm_store has keys k:0 to k:n-1, the first hot of them read 50 times, checkpointed
+// with the hot keys listed and closed
+func warm_store(t *testing.T, n, hot int) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s, _, err := Recover("", path, Options{WarmUp: hot})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	for i := 0; i < n; i++ {
+		set(t, s, "k:"+strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+	for r := 0; r < 50; r++ {
+		for i := 0; i < hot; i++ {
+			s.Get(key{name: "k:" + strconv.Itoa(i)})
+		}
+	}
+	if _, err := s.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func warmed_up(t *testing.T, path string, opts Options) *Store {
+	t.Helper()
+	s, _, err := Recover("", path, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	s.warming.running.Wait()
+	return s
+}
+
+func hits(s *Store, name string) uint64 {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	val, _ := s.data.get(key{name: name})
+	return val.access.hits.Load()
+}
+
+// the checkpoint lists the hot keys, and the restart gives them their counts back
+func TestWarmUp(t *testing.T) {
+	quiet_log(t)
+	path := warm_store(t, 200, 10)
+	data, err := os.ReadFile(path + ".snapshot.hot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hot, err := decode_hot_keys(data)
+	if err != nil || len(hot) != 10 {
+		t.Fatalf("%d hot keys listed, %v", len(hot), err)
+	}
+	for _, h := range hot {
+		if n, _ := strconv.Atoi(strings.TrimPrefix(h.k.name, "k:")); n >= 10 || h.hits < 50 {
+			t.Errorf("%s listed hot with %d hits", h.k.name, h.hits)
+		}
+	}
+
+	s := warmed_up(t, path, Options{WarmUp: 10})
+	stats := s.Stats()
+	if stats.WarmUpKeys != 10 || stats.WarmedUp != 10 || stats.WarmUpTook == 0 {
+		t.Errorf("warm-up went through %d of %d keys, took %s", stats.WarmedUp, stats.WarmUpKeys, stats.WarmUpTook)
+	}
+	if n := hits(s, "k:0"); n < 50 {
+		t.Errorf("k:0 has %d hits after the warm-up", n)
+	}
+	if n := hits(s, "k:100"); n > 1 {
+		t.Errorf("k:100 has %d hits, it was never read", n)
+	}
+	lines := info_lines(stats)
+	if last := lines[len(lines)-1]; !strings.HasPrefix(last, "warm-up: 10/10 hot keys (0 loaded), done in") {
+		t.Errorf("INFO says %q", last)
+	}
+
+	//a damaged list is a cold start, not a failed one
+	os.WriteFile(path+".snapshot.hot", data[:len(data)-1], 0644)
+	s.Close()
+	if s := warmed_up(t, path, Options{WarmUp: 10}); s.Stats().WarmUpKeys != 0 {
+		t.Error("warmed up from a damaged list")
+	}
+}
+
+// a hot key gone since the checkpoint is loaded before a Get has to
+func TestWarmUpLoads(t *testing.T) {
+	quiet_log(t)
+	path := warm_store(t, 200, 10)
+	s, _, err := Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Delete(key{name: "k:3"})
+	s.Close()
+
+	var loads atomic.Int32
+	load := func(name string, db int) (string, time.Duration, bool, error) {
+		loads.Add(1)
+		return "from the database", 0, true, nil
+	}
+	s = warmed_up(t, path, Options{WarmUp: 10, Load: load})
+	if stats := s.Stats(); stats.WarmUpLoaded != 1 || loads.Load() != 1 {
+		t.Errorf("warm-up loaded %d keys, Load called %d times", stats.WarmUpLoaded, loads.Load())
+	}
+	if v, ok := s.Get(key{name: "k:3"}); !ok || v != "from the database" || loads.Load() != 1 {
+		t.Errorf("k:3 = %q %v after the warm-up, %d loads", v, ok, loads.Load())
+	}
+}
+
+// under a memory cap, the first evictions after a restart leave the hot keys alone
+// with the warm-up and pick among all of them without
+func TestWarmUpEvictions(t *testing.T) {
+	quiet_log(t)
+	path := warm_store(t, 1000, 10)
+	s, _, err := Recover("", path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	capped := s.Stats().Memory
+	s.Close()
+
+	evicted := func(warm_up int) int {
+		dir := t.TempDir()
+		files, _ := filepath.Glob(path + "*")
+		for _, file := range files {
+			data, _ := os.ReadFile(file)
+			os.WriteFile(filepath.Join(dir, filepath.Base(file)), data, 0644)
+		}
+		s := warmed_up(t, filepath.Join(dir, "wal.log"), Options{WarmUp: warm_up, MaxMemory: capped, Eviction: EvictLFU})
+		for i := 0; i < 500; i++ {
+			set(t, s, "new:"+strconv.Itoa(i), strings.Repeat("v", 100))
+		}
+		gone := 0
+		for i := 0; i < 10; i++ {
+			if _, ok := s.Get(key{name: "k:" + strconv.Itoa(i)}); !ok {
+				gone++
+			}
+		}
+		return gone
+	}
+	cold := evicted(0)
+	if warm := evicted(10); warm != 0 {
+		t.Errorf("%d hot keys evicted after the warm-up", warm)
+	}
+	t.Logf("%d of 10 hot keys evicted without the warm-up", cold)
+}
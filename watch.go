@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// WATCH: optimistic concurrency for transactions that depend on what they read.
+// tx.Watch(k) notes k's version, the LSN of the last write to it, then the caller
+// reads, decides and queues its writes, and Commit checks under the write lock that
+// no watched key has been written (or has expired) since. if one has, nothing is
+// written and Commit returns errTxConflict, the caller reads again and retries.
+// CAS does the same for one key and one value, Watch for any number of keys
+//
+// value.lsn is the version of a live key, but a deleted key has no value left to
+// hold one, so while a key is watched the store also keeps the LSN of the last
+// write to it in s.watched, deletes included, and that is what the check compares
+
+var errTxConflict = errors.New("transaction aborted: a watched key changed since it was watched")
+
+// watched_key is the version of a key at least one open transaction is watching
+type watched_key struct {
+	version  uint64 // LSN of the last write to the key
+	watchers int
+}
+
+// tx_watch is what a transaction saw of a watched key
+type tx_watch struct {
+	version    uint64
+	expires_at time.Time // when the key expires, zero if it doesn't or wasn't there
+}
+
+// Watch makes Commit fail with errTxConflict if any of keys is written, deleted or
+// expires before it. watch before reading the keys the transaction's writes depend on
+func (tx *Tx) Watch(keys ...key) error {
+	if tx.done {
+		return errTxDone
+	}
+	s := tx.s
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if tx.watches == nil {
+		tx.watches = make(map[key]tx_watch)
+	}
+	if s.watched == nil {
+		s.watched = make(map[key]*watched_key)
+	}
+	now := time.Now()
+	for _, k := range keys {
+		k = s.encode_key(k)
+		if _, ok := tx.watches[k]; ok {
+			continue
+		}
+		val, exists := s.data.get(k)
+		if exists && !val.expires_at.IsZero() && now.After(val.expires_at) {
+			val = value{}
+		}
+		w := s.watched[k]
+		if w == nil {
+			w = &watched_key{version: val.lsn}
+			s.watched[k] = w
+		}
+		w.watchers++
+		tx.watches[k] = tx_watch{version: w.version, expires_at: val.expires_at}
+	}
+	return nil
+}
+
+// watched_changed says whether a watched key was written or has expired since Watch
+// Caller must hold s.lock
+func (tx *Tx) watched_changed() bool {
+	now := time.Now()
+	for k, w := range tx.watches {
+		if tx.s.watched[k].version != w.version {
+			return true
+		}
+		if !w.expires_at.IsZero() && now.After(w.expires_at) {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatch lets go of the transaction's watches
+// Caller must hold s.lock
+func (tx *Tx) unwatch() {
+	for k := range tx.watches {
+		if w := tx.s.watched[k]; w != nil {
+			w.watchers--
+			if w.watchers == 0 {
+				delete(tx.s.watched, k)
+			}
+		}
+	}
+	tx.watches = nil
+}
+
+// touch_watched bumps the version of the watched keys rec writes
+// Caller must hold s.lock
+func (s *Store) touch_watched(rec wal_record) {
+	if len(s.watched) == 0 || rec.key == "" {
+		return
+	}
+	if w := s.watched[key{name: rec.key, db: rec.db}]; w != nil {
+		w.version = rec.lsn
+	}
+	if rec.op == RENAME || rec.op == COPY {
+		if dst, err := move_target(rec); err == nil {
+			if w := s.watched[dst]; w != nil {
+				w.version = rec.lsn
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// WATCH, see watch.go
+
+// a transaction commits unless a key it watched was written, deleted, renamed onto or
+// expired in the meantime, and then writes nothing
+func TestWatch(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	set(t, s, "a", "1")
+	s.Set(key{name: "short"}, 20*time.Millisecond, "x")
+	for _, tc := range []struct {
+		name    string
+		watch   string
+		meddle  func()
+		aborted bool
+	}{
+		{"nothing changed", "a", func() {}, false},
+		{"a write to another key", "a", func() { set(t, s, "b", "2") }, false},
+		{"a write", "a", func() { set(t, s, "a", "3") }, true},
+		{"the same value written", "a", func() { set(t, s, "a", "3") }, true},
+		{"a delete", "a", func() { s.Delete(key{name: "a"}) }, true},
+		{"a missing key created", "a", func() { set(t, s, "a", "4") }, true},
+		{"a rename onto it", "a", func() { s.Rename(key{name: "b"}, key{name: "a"}) }, true},
+		{"expiry", "short", func() { time.Sleep(30 * time.Millisecond) }, true},
+	} {
+		tx := s.Begin()
+		tx.Watch(key{name: tc.watch})
+		tc.meddle()
+		tx.Set(key{name: "out"}, 0, tc.name)
+		err := tx.Commit()
+		if tc.aborted && (err != errTxConflict || get(t, s, "out") == tc.name) {
+			t.Errorf("%s: Commit = %v, out=%s", tc.name, err, get(t, s, "out"))
+		}
+		if !tc.aborted && (err != nil || get(t, s, "out") != tc.name) {
+			t.Errorf("%s: Commit = %v, out=%s", tc.name, err, get(t, s, "out"))
+		}
+	}
+	if len(s.watched) != 0 {
+		t.Errorf("%d keys still watched", len(s.watched))
+	}
+}
+
+// the shell's WATCH before MULTI, EXEC fails if the key changed, UNWATCH lets it go
+func TestProcessWatch(t *testing.T) {
+	quiet_log(t)
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{Persistence: PersistNone})
+	defer s.Close()
+	run := func(cmds ...string) error {
+		var err error
+		for _, cmd := range cmds {
+			if err = s.Process(strings.Fields(cmd)); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	if err := run("WATCH a", "SET a 1", "MULTI", "SET b 1", "EXEC"); err == nil || get(t, s, "b") != "" {
+		t.Errorf("EXEC after a watched key changed: %v, b=%s", err, get(t, s, "b"))
+	}
+	if err := run("WATCH a", "SET a 2", "UNWATCH", "MULTI", "SET b 2", "EXEC"); err != nil || get(t, s, "b") != "2" {
+		t.Errorf("EXEC after UNWATCH: %v, b=%s", err, get(t, s, "b"))
+	}
+	if err := run("MULTI", "WATCH a"); err == nil {
+		t.Error("WATCH inside MULTI")
+	}
+	run("DISCARD")
+	if err := run("WATCH"); err == nil {
+		t.Error("WATCH without a key")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// sorted sets: distinct members, each with a score, kept in score order (members
+// with the same score in byte order). the order is a sorted slice next to a map of
+// member → score: adding or removing a member shifts the slice, which is a memmove
+// and fine for the sizes this store sees, and in exchange a rank is an index and a
+// score range is two binary searches. ZScan in operator.go walks it for queries
+//
+// ZADD logs the members whose score it set, new or changed, ZREM the ones it removed
+
+// ScoredMember is a sorted set member and its score
+type ScoredMember struct {
+	Member string
+	Score  float64
+}
+
+type zset_object struct {
+	scores map[string]float64
+	order  []ScoredMember
+	bytes  int64
+}
+
+func new_zset_object() *zset_object {
+	return &zset_object{scores: make(map[string]float64)}
+}
+
+func (z *zset_object) kind() string { return "zset" }
+func (z *zset_object) len() int     { return len(z.order) }
+func (z *zset_object) size() int64  { return z.bytes }
+
+// members is score, member, score, member ... in order
+func (z *zset_object) members() []string {
+	args := make([]string, 0, 2*len(z.order))
+	for _, m := range z.order {
+		args = append(args, format_score(m.Score), m.Member)
+	}
+	return args
+}
+
+func format_score(score float64) string {
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parse_score takes anything strconv does, inf and -inf included, but not NaN
+func parse_score(s string) (float64, error) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, errors.New("invalid score: " + s)
+	}
+	return score, nil
+}
+
+func zset_less(a, b ScoredMember) bool {
+	if a.Score != b.Score {
+		return a.Score < b.Score
+	}
+	return a.Member < b.Member
+}
+
+// rank is where m sits (or would go) in order
+func (z *zset_object) rank(m ScoredMember) int {
+	return sort.Search(len(z.order), func(i int) bool { return !zset_less(z.order[i], m) })
+}
+
+// first_at is the rank of the first member scored at least lo (more than lo if exclusive)
+func (z *zset_object) first_at(lo float64, exclusive bool) int {
+	return sort.Search(len(z.order), func(i int) bool {
+		if exclusive {
+			return z.order[i].Score > lo
+		}
+		return z.order[i].Score >= lo
+	})
+}
+
+func (z *zset_object) add(member string, score float64) {
+	z.remove(member)
+	m := ScoredMember{Member: member, Score: score}
+	i := z.rank(m)
+	z.order = append(z.order, ScoredMember{})
+	copy(z.order[i+1:], z.order[i:])
+	z.order[i] = m
+	z.scores[member] = score
+	z.bytes += int64(len(member)) + 8 + element_overhead
+}
+
+func (z *zset_object) remove(member string) {
+	score, ok := z.scores[member]
+	if !ok {
+		return
+	}
+	i := z.rank(ScoredMember{Member: member, Score: score})
+	z.order = append(z.order[:i], z.order[i+1:]...)
+	delete(z.scores, member)
+	z.bytes -= int64(len(member)) + 8 + element_overhead
+}
+
+func (z *zset_object) apply(op operation_type, args []string) error {
+	switch op {
+	case ZADD, RESTORE:
+		if len(args)%2 != 0 {
+			return errors.New(op.String() + " record has a score without a member")
+		}
+		for i := 0; i < len(args); i += 2 {
+			score, err := parse_score(args[i])
+			if err != nil {
+				return err
+			}
+			z.add(args[i+1], score)
+		}
+	case ZREM:
+		for _, m := range args {
+			z.remove(m)
+		}
+	default:
+		return errors.New(op.String() + " is not a sorted set operation")
+	}
+	return nil
+}
+
+// ZAdd sets the scores of members of the sorted set at k, creating it if needed,
+// and returns how many of them are new. members whose score doesn't change aren't logged
+func (s *Store) ZAdd(k key, members map[string]float64) (int, error) {
+	if len(members) == 0 {
+		return 0, errors.New("ZADD needs at least one member")
+	}
+	for m, score := range members {
+		if math.IsNaN(score) {
+			return 0, errors.New("score of " + m + " is not a number")
+		}
+	}
+	added := 0
+	err := s.write_object(k, "zset", ZADD, func(obj object) ([]string, error) {
+		names := make([]string, 0, len(members))
+		for m := range members {
+			names = append(names, m)
+		}
+		sort.Strings(names)
+		var args []string
+		for _, m := range names {
+			if obj != nil {
+				if old, ok := obj.(*zset_object).scores[m]; ok {
+					if old != members[m] {
+						args = append(args, format_score(members[m]), m)
+					}
+					continue
+				}
+			}
+			added++
+			args = append(args, format_score(members[m]), m)
+		}
+		return args, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return added, nil
+}
+
+// ZRem removes members from the sorted set at k and returns how many were there
+// the sorted set goes when its last member does
+func (s *Store) ZRem(k key, members ...string) (int, error) {
+	var removed []string
+	err := s.write_object(k, "zset", ZREM, func(obj object) ([]string, error) {
+		if obj == nil {
+			return nil, nil
+		}
+		seen := make(map[string]bool)
+		for _, m := range members {
+			if _, ok := obj.(*zset_object).scores[m]; ok && !seen[m] {
+				seen[m] = true
+				removed = append(removed, m)
+			}
+		}
+		return removed, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(removed), nil
+}
+
+// read_zset is read_object for a sorted set
+// Caller must hold s.lock (a read lock will do)
+func (s *Store) read_zset(k key) (*zset_object, error) {
+	obj, err := s.read_object(k, "zset")
+	if obj == nil {
+		return nil, err
+	}
+	return obj.(*zset_object), nil
+}
+
+// ZScore returns the score of m in the sorted set at k
+func (s *Store) ZScore(k key, m string) (float64, bool, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	z, err := s.read_zset(k)
+	if z == nil {
+		return 0, false, err
+	}
+	score, ok := z.scores[m]
+	return score, ok, nil
+}
+
+// ZCard is how many members the sorted set at k has, 0 if k is missing
+func (s *Store) ZCard(k key) (int, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	z, err := s.read_zset(k)
+	if z == nil {
+		return 0, err
+	}
+	return z.len(), nil
+}
+
+// ZRange returns the members ranked start to stop, both included, lowest score first
+// negative ranks count from the highest (-1 is the last), out of range ones are clamped
+func (s *Store) ZRange(k key, start, stop int) ([]ScoredMember, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	z, err := s.read_zset(k)
+	if z == nil {
+		return nil, err
+	}
+	n := z.len()
+	if start < 0 {
+		start = max(n+start, 0)
+	}
+	if stop < 0 {
+		stop = n + stop
+	}
+	stop = min(stop, n-1)
+	if start > stop {
+		return nil, nil
+	}
+	return append([]ScoredMember(nil), z.order[start:stop+1]...), nil
+}
+
+// ZRangeByScore returns the members scored lo to hi, both included, lowest first
+func (s *Store) ZRangeByScore(k key, lo, hi float64) ([]ScoredMember, error) {
+	k = s.encode_key(k)
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	z, err := s.read_zset(k)
+	if z == nil {
+		return nil, err
+	}
+	from, to := z.first_at(lo, false), z.first_at(hi, true)
+	if from >= to {
+		return nil, nil
+	}
+	return append([]ScoredMember(nil), z.order[from:to]...), nil
+}
+
+// ZADD key score member [score member ...], ZREM key member [member ...], ZSCORE key member,
+// ZCARD key, ZRANGE key start stop, ZRANGEBYSCORE key min max
+func (s *Store) process_zset(cmd string, input_parts []string) error {
+	switch cmd {
+	case "ZADD":
+		if len(input_parts) < 4 || len(input_parts)%2 != 0 {
+			return errors.New("ZADD command requires a key and score member pairs")
+		}
+		members := make(map[string]float64)
+		for i := 2; i < len(input_parts); i += 2 {
+			score, err := parse_score(input_parts[i])
+			if err != nil {
+				return err
+			}
+			members[input_parts[i+1]] = score
+		}
+		added, err := s.ZAdd(s.shell_key(input_parts[1]), members)
+		if err != nil {
+			return err
+		}
+		log.Printf("Sorted set %s: %d members added\n", input_parts[1], added)
+
+	case "ZREM":
+		if len(input_parts) < 3 {
+			return errors.New("ZREM command requires a key and at least one member")
+		}
+		removed, err := s.ZRem(s.shell_key(input_parts[1]), input_parts[2:]...)
+		if err != nil {
+			return err
+		}
+		log.Printf("Sorted set %s: %d members removed\n", input_parts[1], removed)
+
+	case "ZSCORE":
+		if len(input_parts) != 3 {
+			return errors.New("ZSCORE command requires a key and a member")
+		}
+		score, ok, err := s.ZScore(s.shell_key(input_parts[1]), input_parts[2])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errors.New("member does not exist")
+		}
+		log.Printf("Score of %s in %s: %s\n", input_parts[2], input_parts[1], format_score(score))
+
+	case "ZCARD":
+		if len(input_parts) != 2 {
+			return errors.New("ZCARD command requires a key")
+		}
+		n, err := s.ZCard(s.shell_key(input_parts[1]))
+		if err != nil {
+			return err
+		}
+		log.Printf("Sorted set %s has %d members\n", input_parts[1], n)
+
+	case "ZRANGE", "ZRANGEBYSCORE":
+		if len(input_parts) != 4 {
+			return errors.New(cmd + " command requires a key, a start and a stop")
+		}
+		var members []ScoredMember
+		var err error
+		if cmd == "ZRANGE" {
+			start, err1 := strconv.Atoi(input_parts[2])
+			stop, err2 := strconv.Atoi(input_parts[3])
+			if err1 != nil || err2 != nil {
+				return errors.New("ZRANGE start and stop must be integers")
+			}
+			members, err = s.ZRange(s.shell_key(input_parts[1]), start, stop)
+		} else {
+			lo, err1 := parse_score(input_parts[2])
+			hi, err2 := parse_score(input_parts[3])
+			if err1 != nil || err2 != nil {
+				return errors.New("ZRANGEBYSCORE min and max must be numbers (or -inf, +inf)")
+			}
+			members, err = s.ZRangeByScore(s.shell_key(input_parts[1]), lo, hi)
+		}
+		if err != nil {
+			return err
+		}
+		for i, m := range members {
+			log.Printf("  %d) %s (%s)\n", i+1, m.Member, format_score(m.Score))
+		}
+		log.Printf("%d members\n", len(members))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sorted sets, see zset.go
+
+// members_of is "member:score" for each, in order
+func members_of(members []ScoredMember) string {
+	pairs := make([]string, len(members))
+	for i, m := range members {
+		pairs[i] = m.Member + ":" + format_score(m.Score)
+	}
+	return strings.Join(pairs, " ")
+}
+
+// members stay in score order, ties by member, through adds, score changes and
+// removals, and ZADD logs only the scores that changed
+func TestZSet(t *testing.T) {
+	quiet_log(t)
+	path := filepath.Join(t.TempDir(), "wal.log")
+	s := open_store(t, path, PersistWAL)
+	board := key{name: "board"}
+	if n, err := s.ZAdd(board, map[string]float64{"ann": 10, "bob": 5, "cat": 10, "dan": -1.5}); n != 4 || err != nil {
+		t.Errorf("ZADD of 4 new members: %d %v", n, err)
+	}
+	if n, _ := s.ZAdd(board, map[string]float64{"bob": 20, "cat": 10, "eve": math.Inf(1)}); n != 1 {
+		t.Errorf("ZADD of a new member and two old ones: %d", n)
+	}
+	if _, err := s.ZAdd(board, map[string]float64{"x": math.NaN()}); err == nil {
+		t.Error("ZADD with a NaN score")
+	}
+	if got, _ := s.ZRange(board, 0, -1); members_of(got) != "dan:-1.5 ann:10 cat:10 bob:20 eve:+Inf" {
+		t.Errorf("ZRANGE 0 -1: %s", members_of(got))
+	}
+	if got, _ := s.ZRange(board, -2, 100); members_of(got) != "bob:20 eve:+Inf" {
+		t.Errorf("ZRANGE -2 100: %s", members_of(got))
+	}
+	for _, tc := range []struct {
+		lo, hi float64
+		want   string
+	}{{10, 20, "ann:10 cat:10 bob:20"}, {math.Inf(-1), 0, "dan:-1.5"}, {11, 19, ""}, {20, math.Inf(1), "bob:20 eve:+Inf"}} {
+		if got, _ := s.ZRangeByScore(board, tc.lo, tc.hi); members_of(got) != tc.want {
+			t.Errorf("ZRANGEBYSCORE %v %v: %s, want %s", tc.lo, tc.hi, members_of(got), tc.want)
+		}
+	}
+	if n, _ := s.ZRem(board, "dan", "dan", "zed"); n != 1 {
+		t.Errorf("ZREM dan dan zed: %d", n)
+	}
+	if score, ok, _ := s.ZScore(board, "bob"); score != 20 || !ok {
+		t.Errorf("ZSCORE bob: %v %v", score, ok)
+	}
+	set(t, s, "str", "x")
+	if _, err := s.ZRange(key{name: "str"}, 0, -1); err != ErrWrongType {
+		t.Errorf("ZRANGE on a string: %v", err)
+	}
+
+	var logged []string
+	s.ReplayFrom(0, func(e Entry) error {
+		if e.Key == board.name {
+			args, _ := decode_args(e.Value)
+			logged = append(logged, e.Op+" "+strings.Join(args, " "))
+		}
+		return nil
+	})
+	if got := strings.Join(logged, ", "); got != "ZADD 10 ann 5 bob 10 cat -1.5 dan, ZADD 20 bob +Inf eve, ZREM dan" {
+		t.Errorf("logged %s", got)
+	}
+
+	s = reopen(t, s, path)
+	defer s.Close()
+	if got, _ := s.ZRange(board, 0, -1); members_of(got) != "ann:10 cat:10 bob:20 eve:+Inf" {
+		t.Errorf("after a restart: %s", members_of(got))
+	}
+	if n, _ := s.ZCard(board); n != 4 {
+		t.Errorf("ZCARD after a restart: %d", n)
+	}
+}
+
+// SCAN ZSET reads a score range in order, so LIMIT gives the lowest
+func TestZSetQuery(t *testing.T) {
+	s := New_Store(filepath.Join(t.TempDir(), "wal.log"), Options{})
+	defer s.Close()
+	s.ZAdd(key{name: "board"}, map[string]float64{"ann": 10, "bob": 5, "cat": 30, "dan": 20})
+	if got := row_pairs(query(t, s, "SCAN ZSET board SCORE 10 +inf LIMIT 2")); got != "ann=10 dan=20" {
+		t.Errorf("SCAN ZSET board SCORE 10 +inf LIMIT 2: %s", got)
+	}
+}